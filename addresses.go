@@ -0,0 +1,513 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var address_types = map[string]bool{
+	"home":     true,
+	"work":     true,
+	"billing":  true,
+	"shipping": true,
+	"other":    true,
+}
+
+// customer_expansions are what ?expand= can add to a customer
+var customer_expansions = map[string]bool{
+	"addresses": true,
+	"company":   true,
+}
+
+type Address struct {
+	ID         int64  `json:"id"`
+	CustomerID int64  `json:"customer_id"`
+	Type       string `json:"type"` // home, work, billing, shipping or other
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"` // iso 3166-1 alpha-2
+	Primary    bool   `json:"primary"` // exactly one address is primary while the customer has any
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+}
+
+type AddressDetails struct {
+	Type       string `json:"type"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+	Primary    bool   `json:"primary"` // make this the primary address, the first address always is
+}
+
+func validate_address(input *AddressDetails) error {
+	input.Type = strings.ToLower(strings.TrimSpace(input.Type))
+	if !address_types[input.Type] {
+		return &ValidationError{Field: "type", Message: "must be home, work, billing, shipping or other"}
+	}
+
+	input.Line1 = strings.TrimSpace(input.Line1)
+	if input.Line1 == "" {
+		return &ValidationError{Field: "line1", Message: "is required"}
+	}
+	input.Line2 = strings.TrimSpace(input.Line2)
+
+	input.City = strings.TrimSpace(input.City)
+	if input.City == "" {
+		return &ValidationError{Field: "city", Message: "is required"}
+	}
+	input.PostalCode = strings.ToUpper(strings.TrimSpace(input.PostalCode))
+
+	input.Country = strings.ToUpper(strings.TrimSpace(input.Country))
+	if !country_pattern.MatchString(input.Country) {
+		return &ValidationError{Field: "country", Message: "must be a two letter iso 3166-1 code"}
+	}
+
+	return nil
+}
+
+// expand_customers adds what ?expand= asks for to customers about to be returned,
+// addresses sets each customer's primary_address and company their company
+func expand_customers(db *sql.DB, r *http.Request, customers []Customer) error {
+	expand := map[string]bool{}
+	for _, expansion := range split_list(r.URL.Query().Get("expand")) {
+		if !customer_expansions[expansion] {
+			return &ValidationError{Field: "expand", Message: "unknown expansion " + expansion}
+		}
+		expand[expansion] = true
+	}
+
+	if len(expand) == 0 || len(customers) == 0 {
+		return nil
+	}
+
+	if expand["addresses"] {
+		ids := make([]int64, len(customers))
+		for i, customer := range customers {
+			ids[i] = customer.ID
+		}
+
+		addresses, err := get_primary_addresses(db, ids)
+		if err != nil {
+			return err
+		}
+
+		for i := range customers {
+			address, ok := addresses[customers[i].ID]
+			if ok {
+				customers[i].PrimaryAddress = &address
+			}
+		}
+	}
+
+	if expand["company"] {
+		var ids []int64
+		for _, customer := range customers {
+			if customer.CompanyID != nil {
+				ids = append(ids, *customer.CompanyID)
+			}
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		companies, err := get_companies_by_id(db, ids)
+		if err != nil {
+			return err
+		}
+
+		for i := range customers {
+			if customers[i].CompanyID == nil {
+				continue
+			}
+
+			company, ok := companies[*customers[i].CompanyID]
+			if ok {
+				customers[i].Company = &company
+			}
+		}
+	}
+
+	return nil
+}
+
+// path_address_ids reads the customer and address ids of /customers/{id}/addresses/{address_id}
+func path_address_ids(r *http.Request) (int64, int64, error) {
+	id, err := path_customer_id(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	address_id, err := strconv.ParseInt(r.PathValue("address_id"), 10, 64)
+	return id, address_id, err
+}
+
+func register_address_routes(mux *http.ServeMux, db *sql.DB) {
+	// the customer's addresses, primary first
+	mux.HandleFunc("GET /api/customers/{id}/addresses", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		addresses, err := get_addresses(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Address]{Data: addresses})
+	})
+
+	// add an address
+	mux.HandleFunc("POST /api/customers/{id}/addresses", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req AddressDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_address(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		address, err := create_address(db, id, req)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[Address]{Data: *address})
+	}))
+
+	// a single address
+	mux.HandleFunc("GET /api/customers/{id}/addresses/{address_id}", func(w http.ResponseWriter, r *http.Request) {
+		id, address_id, err := path_address_ids(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		address, err := get_address(db, id, address_id)
+		if err != nil && err.Error() == "Address not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Address]{Data: *address})
+	})
+
+	// replace an address, primary: true makes it the primary one
+	mux.HandleFunc("PUT /api/customers/{id}/addresses/{address_id}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, address_id, err := path_address_ids(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req AddressDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_address(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		address, err := update_address(db, id, address_id, req)
+		if err != nil && err.Error() == "Address not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Address]{Data: *address})
+	}))
+
+	// remove an address, the oldest remaining one takes over as primary
+	mux.HandleFunc("DELETE /api/customers/{id}/addresses/{address_id}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, address_id, err := path_address_ids(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_address(db, id, address_id)
+		if err != nil && err.Error() == "Address not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// #region Database
+const address_columns = `id, customer_id, type, line1, line2, city, postal_code, country, is_primary,
+	strftime('%Y-%m-%dT%H:%M:%SZ', created_at), strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)`
+
+func scan_address(row row_scanner) (Address, error) {
+	var address Address
+	err := row.Scan(&address.ID, &address.CustomerID, &address.Type, &address.Line1, &address.Line2, &address.City, &address.PostalCode, &address.Country, &address.Primary,
+		&address.CreatedAt, &address.UpdatedAt)
+	return address, err
+}
+
+func get_address(db db_handle, customer_id int64, id int64) (*Address, error) {
+	address, err := scan_address(db.QueryRow(`SELECT `+address_columns+` FROM customer_addresses WHERE id = ? AND customer_id = ?;`, id, customer_id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Address not found")
+		}
+		return nil, err
+	}
+
+	return &address, nil
+}
+
+func get_addresses(db *sql.DB, customer_id int64) ([]Address, error) {
+	get_records := `
+	SELECT ` + address_columns + `
+	FROM customer_addresses
+	WHERE customer_id = ?
+	ORDER BY is_primary DESC, id;
+	`
+
+	rows, err := db.Query(get_records, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	addresses := []Address{}
+	for rows.Next() {
+		address, err := scan_address(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses, rows.Err()
+}
+
+// get_primary_addresses reads the primary address of each customer that has one
+func get_primary_addresses(db *sql.DB, customer_ids []int64) (map[int64]Address, error) {
+	args := make([]any, len(customer_ids))
+	for i, id := range customer_ids {
+		args[i] = id
+	}
+
+	get_records := `
+	SELECT ` + address_columns + `
+	FROM customer_addresses
+	WHERE is_primary = 1 AND customer_id IN (?` + strings.Repeat(", ?", len(customer_ids)-1) + `);
+	`
+
+	rows, err := db.Query(get_records, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	addresses := map[int64]Address{}
+	for rows.Next() {
+		address, err := scan_address(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses[address.CustomerID] = address
+	}
+
+	return addresses, rows.Err()
+}
+
+// make_primary_address moves the primary flag to the address
+func make_primary_address(tx *sql.Tx, customer_id int64, id int64) error {
+	_, err := tx.Exec(`UPDATE customer_addresses SET is_primary = 0 WHERE customer_id = ? AND is_primary = 1 AND id != ?;`, customer_id, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE customer_addresses SET is_primary = 1 WHERE id = ?;`, id)
+	return err
+}
+
+// create_address adds the address, it becomes primary when asked to or when it is the customer's first
+func create_address(db *sql.DB, customer_id int64, input AddressDetails) (*Address, error) {
+	create_record := `
+	INSERT INTO customer_addresses (customer_id, type, line1, line2, city, postal_code, country)
+	SELECT id, ?, ?, ?, ?, ?, ? FROM customers WHERE id = ?;
+	`
+
+	var address *Address
+	err := with_tx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(create_record, input.Type, input.Line1, input.Line2, input.City, input.PostalCode, input.Country, customer_id)
+		if err != nil {
+			return err
+		}
+
+		created, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if created == 0 {
+			return errors.New("Customer not found")
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		var has_primary bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM customer_addresses WHERE customer_id = ? AND is_primary = 1);`, customer_id).Scan(&has_primary)
+		if err != nil {
+			return err
+		}
+
+		if input.Primary || !has_primary {
+			err = make_primary_address(tx, customer_id, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		address, err = get_address(tx, customer_id, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// update_address replaces the address, primary: false leaves the flag where it is
+func update_address(db *sql.DB, customer_id int64, id int64, input AddressDetails) (*Address, error) {
+	update_record := `
+	UPDATE customer_addresses
+	SET type = ?, line1 = ?, line2 = ?, city = ?, postal_code = ?, country = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND customer_id = ?;
+	`
+
+	var address *Address
+	err := with_tx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(update_record, input.Type, input.Line1, input.Line2, input.City, input.PostalCode, input.Country, id, customer_id)
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if updated == 0 {
+			return errors.New("Address not found")
+		}
+
+		if input.Primary {
+			err = make_primary_address(tx, customer_id, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		address, err = get_address(tx, customer_id, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// delete_address removes the address, when it was primary the oldest remaining address takes over
+func delete_address(db *sql.DB, customer_id int64, id int64) error {
+	promote_record := `
+	UPDATE customer_addresses
+	SET is_primary = 1
+	WHERE id = (SELECT MIN(id) FROM customer_addresses WHERE customer_id = ?)
+		AND NOT EXISTS (SELECT 1 FROM customer_addresses WHERE customer_id = ? AND is_primary = 1);
+	`
+
+	return with_tx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`DELETE FROM customer_addresses WHERE id = ? AND customer_id = ?;`, id, customer_id)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if deleted == 0 {
+			return errors.New("Address not found")
+		}
+
+		_, err = tx.Exec(promote_record, customer_id, customer_id)
+		return err
+	})
+}
+
+// #endregion
@@ -0,0 +1,229 @@
+// the customers page, it reads and writes through the api with the login session
+(function () {
+  "use strict";
+
+  const root = document.getElementById("customers");
+  const can_edit = root.dataset.canEdit === "true";
+  const rows = document.getElementById("rows");
+  const message = document.getElementById("message");
+  const search = document.getElementById("search");
+  const prev = document.getElementById("prev");
+  const next = document.getElementById("next");
+  const page_label = document.getElementById("page");
+  const limit = 20;
+
+  let state = { page: 1, q: "" };
+
+  // api calls the session cookie authenticates, a lapsed session goes back through the login
+  async function api(method, path, body) {
+    const options = { method: method, headers: { Accept: "application/json" } };
+    if (body !== undefined) {
+      options.headers["Content-Type"] = "application/json";
+      options.body = JSON.stringify(body);
+    }
+
+    const res = await fetch(path, options);
+    if (res.status === 401) {
+      location.href = "/auth/login?return_to=" + encodeURIComponent(location.pathname + location.search);
+      throw new Error("Your session has ended, logging in again");
+    }
+
+    const text = await res.text();
+    if (!res.ok) {
+      throw new Error(text.trim() || res.statusText);
+    }
+
+    return text ? JSON.parse(text).data : null;
+  }
+
+  function show(element, text, info) {
+    element.textContent = text;
+    element.classList.toggle("info", !!info);
+    element.hidden = !text;
+  }
+
+  function cell(text) {
+    const td = document.createElement("td");
+    td.textContent = text == null ? "" : text;
+    return td;
+  }
+
+  function button(label, handler, class_name) {
+    const b = document.createElement("button");
+    b.type = "button";
+    b.textContent = label;
+    if (class_name) {
+      b.className = class_name;
+    }
+    b.addEventListener("click", handler);
+    return b;
+  }
+
+  function render(customers, pagination) {
+    rows.replaceChildren();
+    if (customers.length === 0) {
+      const td = cell(state.q ? "No customers match your search." : "No customers yet.");
+      td.colSpan = can_edit ? 8 : 7;
+      td.className = "empty";
+      const tr = document.createElement("tr");
+      tr.append(td);
+      rows.append(tr);
+    }
+
+    for (const customer of customers) {
+      const tr = document.createElement("tr");
+      tr.append(cell(customer.id), cell(customer.name), cell(customer.email), cell(customer.contact), cell(customer.dob), cell(customer.country), cell(customer.status));
+      if (can_edit) {
+        const actions = cell("");
+        actions.className = "actions";
+        actions.append(button("Edit", () => open_editor(customer.id)), " ", button("Delete", () => confirm_delete(customer), "danger"));
+        tr.append(actions);
+      }
+      rows.append(tr);
+    }
+
+    page_label.textContent = "Page " + pagination.page + " of " + Math.max(pagination.total_pages, 1) + " · " + pagination.total_records + " customers";
+    prev.disabled = !pagination.has_prev;
+    next.disabled = !pagination.has_next;
+  }
+
+  async function load() {
+    const query = new URLSearchParams({ page: state.page, limit: limit });
+    let path = "/api/customers?" + query;
+    if (state.q) {
+      query.set("q", state.q);
+      path = "/api/customers/search?" + query;
+    }
+
+    try {
+      // search results are customers with a score added, they render the same
+      const data = await api("GET", path);
+      render(data.records, data);
+    } catch (err) {
+      show(message, err.message);
+    }
+  }
+
+  search.addEventListener("submit", (event) => {
+    event.preventDefault();
+    state = { page: 1, q: search.elements.q.value.trim() };
+    show(message, "");
+    load();
+  });
+
+  prev.addEventListener("click", () => {
+    state.page--;
+    load();
+  });
+
+  next.addEventListener("click", () => {
+    state.page++;
+    load();
+  });
+
+  load();
+
+  if (!can_edit) {
+    return;
+  }
+
+  const editor = document.getElementById("editor");
+  const form = document.getElementById("customer-form");
+  const form_message = form.querySelector(".message");
+  const editor_title = document.getElementById("editor-title");
+  const confirm = document.getElementById("confirm-delete");
+  const confirm_message = confirm.querySelector(".message");
+  const fields = ["name", "email", "contact", "dob", "country"];
+
+  // the customer being edited, null while creating. An update sends back what the form doesn't show as it was
+  let editing = null;
+  let deleting = null;
+
+  for (const close of document.querySelectorAll("[data-close]")) {
+    close.addEventListener("click", () => close.closest("dialog").close());
+  }
+
+  document.getElementById("create").addEventListener("click", () => {
+    editing = null;
+    editor_title.textContent = "New customer";
+    form.reset();
+    show(form_message, "");
+    editor.showModal();
+  });
+
+  async function open_editor(id) {
+    try {
+      editing = await api("GET", "/api/customers/" + id);
+    } catch (err) {
+      show(message, err.message);
+      return;
+    }
+
+    editor_title.textContent = "Edit customer " + editing.id;
+    for (const field of fields) {
+      form.elements[field].value = editing[field] || "";
+    }
+    show(form_message, "");
+    editor.showModal();
+  }
+
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+
+    const details = {};
+    for (const field of fields) {
+      details[field] = form.elements[field].value.trim();
+    }
+    details.country = details.country.toUpperCase();
+
+    const save = form.querySelector("button[type=submit]");
+    save.disabled = true;
+    try {
+      let saved;
+      if (editing) {
+        saved = await api("PUT", "/api/customers/" + editing.id, Object.assign({
+          version: editing.version,
+          external_id: editing.external_id || "",
+          referral_code: editing.referral_code,
+          referred_by_customer_id: editing.referred_by_customer_id,
+          company_id: editing.company_id,
+          status: editing.status,
+        }, details));
+      } else {
+        saved = await api("POST", "/api/customers", details);
+      }
+
+      editor.close();
+      show(message, "Saved " + saved.name + ".", true);
+      load();
+    } catch (err) {
+      show(form_message, err.message);
+    } finally {
+      save.disabled = false;
+    }
+  });
+
+  function confirm_delete(customer) {
+    deleting = customer;
+    document.getElementById("delete-name").textContent = customer.name + " (" + customer.id + ")";
+    show(confirm_message, "");
+    confirm.showModal();
+  }
+
+  confirm.querySelector("form").addEventListener("submit", async (event) => {
+    event.preventDefault();
+
+    const remove = confirm.querySelector("button[type=submit]");
+    remove.disabled = true;
+    try {
+      await api("DELETE", "/api/customers/" + deleting.id);
+      confirm.close();
+      show(message, "Deleted " + deleting.name + ".", true);
+      load();
+    } catch (err) {
+      show(confirm_message, err.message);
+    } finally {
+      remove.disabled = false;
+    }
+  });
+})();
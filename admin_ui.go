@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strconv"
+)
+
+// admin_files are the pages and assets of the admin ui, built into the binary so it needs no deployment of its own
+//
+//go:embed admin
+var admin_files embed.FS
+
+var admin_html = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"bytes": func(n int64) string {
+		size, unit := float64(n), 0
+		for size >= 1024 && unit < len(byte_units)-1 {
+			size, unit = size/1024, unit+1
+		}
+		return strconv.FormatFloat(size, 'f', min(unit, 1), 64) + " " + byte_units[unit]
+	},
+}).ParseFS(admin_files, "admin/*.html"))
+
+var byte_units = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// admin_csp lets the admin pages load their own scripts and styles and call the api, nothing from elsewhere
+const admin_csp = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self'; connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'"
+
+// AdminPage is what every admin page is rendered with
+type AdminPage struct {
+	Title   string
+	User    string
+	Roles   []string
+	CanEdit bool // editors and admins see the create, edit and delete controls, the api checks again either way
+	IsAdmin bool
+	Refresh int // seconds until the page reloads itself, 0 for never
+	Version string
+}
+
+func new_admin_page(config Config, r *http.Request, title string) AdminPage {
+	page := AdminPage{Title: title, CanEdit: config.AuthDisabled, IsAdmin: config.AuthDisabled, Version: version_info().Version}
+
+	principal := principal_from(r)
+	if principal != nil {
+		page.User = principal.Subject
+		page.Roles = principal.Roles
+		page.CanEdit = principal.Rank() >= role_ranks[RoleEditor]
+		page.IsAdmin = principal.Rank() >= role_ranks[RoleAdmin] && principal.TenantID == ""
+	}
+
+	return page
+}
+
+// register_admin_ui_routes serves the admin ui for staff, pages whose scripts read and write customers through
+// the api with the login session, so the api's validation, roles and audit log apply to them as they are
+func register_admin_ui_routes(mux *http.ServeMux, config Config) {
+	assets, err := fs.Sub(admin_files, "admin/static")
+	if err != nil {
+		panic(err)
+	}
+	static := http.StripPrefix("/admin/static/", http.FileServerFS(assets))
+
+	mux.HandleFunc("GET /admin/static/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		static.ServeHTTP(w, r)
+	})
+
+	mux.HandleFunc("GET /admin", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/admin/customers", http.StatusFound)
+	})
+
+	// listing, search, the create and edit forms and delete confirmation, all on the one page
+	mux.HandleFunc("GET /admin/customers", func(w http.ResponseWriter, r *http.Request) {
+		write_admin_page(w, "customers.html", new_admin_page(config, r, "Customers"))
+	})
+}
+
+func write_admin_page(w http.ResponseWriter, name string, page any) {
+	var body bytes.Buffer
+	err := admin_html.ExecuteTemplate(&body, name, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", admin_csp)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const EventCustomerAnonymized = "customer.anonymized"
+
+// AnonymizationRequest is a right to be forgotten request, carried out once execute_at has passed
+type AnonymizationRequest struct {
+	CustomerID  int64   `json:"customer_id"`
+	RequestedBy string  `json:"requested_by"`
+	RequestedAt string  `json:"requested_at"`
+	ExecuteAt   string  `json:"execute_at"`
+	ExecutedAt  *string `json:"executed_at"` // set once the customer is anonymized, which cannot be undone
+}
+
+type AnonymizationDetails struct {
+	GracePeriod *string `json:"grace_period"` // a duration such as 72h, ANONYMIZE_GRACE_PERIOD when left out
+}
+
+// anonymization_grace_period reads the optional body of POST /customers/{id}/anonymize
+func anonymization_grace_period(config Config, r *http.Request) (time.Duration, error) {
+	var req AnonymizationDetails
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		return 0, &ValidationError{Field: "body", Message: err.Error()}
+	}
+
+	if req.GracePeriod == nil {
+		return config.AnonymizeGracePeriod, nil
+	}
+
+	grace_period, err := time.ParseDuration(*req.GracePeriod)
+	if err != nil || grace_period < 0 {
+		return 0, &ValidationError{Field: "grace_period", Message: "must be a duration such as 72h"}
+	}
+
+	return grace_period, nil
+}
+
+// run_anonymizations queues a job for each request whose grace period is over, the job workers carry them out
+// and retry those that fail
+func run_anonymizations(ctx context.Context, db *sql.DB, config Config) {
+	ticker := time.NewTicker(config.AnonymizeInterval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := get_due_anonymizations(db)
+		if err != nil {
+			println("listing due anonymizations failed:", err.Error())
+		}
+
+		for _, id := range ids {
+			err = enqueue_anonymization(db, config, id)
+			if err != nil {
+				println("queueing anonymization failed:", err.Error())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func register_anonymization_routes(mux *http.ServeMux, db *sql.DB, config Config, store BlobStore) {
+	// request the customer be anonymized, at once or after the body's grace_period. Nothing is deleted, the personal
+	// data in the row, its history, events and audit trail is replaced by placeholders
+	mux.HandleFunc("POST /api/customers/{id}/anonymize", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		grace_period, err := anonymization_grace_period(config, r)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		request, err := create_anonymization_request(db, id, actor_from(r), grace_period)
+		if err != nil && (err.Error() == "Anonymization is already scheduled" || err.Error() == "Customer is already anonymized") {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if grace_period > 0 {
+			write_json_response(w, http.StatusAccepted, ApiResponse[AnonymizationRequest]{Data: *request})
+			return
+		}
+
+		err = anonymize_customer(r.Context(), db, store, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		request, err = get_anonymization_request(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[AnonymizationRequest]{Data: *request})
+	}))
+
+	mux.HandleFunc("GET /api/customers/{id}/anonymize", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		request, err := get_anonymization_request(db, id)
+		if err != nil && err.Error() == "Anonymization request not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[AnonymizationRequest]{Data: *request})
+	})
+
+	// withdraw a request during its grace period
+	mux.HandleFunc("DELETE /api/customers/{id}/anonymize", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = cancel_anonymization_request(db, id)
+		if err != nil && err.Error() == "Anonymization request not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil && err.Error() == "Customer is already anonymized" {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// #region Database
+const anonymization_request_columns = `customer_id, requested_by, strftime('%Y-%m-%dT%H:%M:%SZ', requested_at), strftime('%Y-%m-%dT%H:%M:%SZ', execute_at), strftime('%Y-%m-%dT%H:%M:%SZ', executed_at)`
+
+func scan_anonymization_request(row row_scanner) (AnonymizationRequest, error) {
+	var request AnonymizationRequest
+	err := row.Scan(&request.CustomerID, &request.RequestedBy, &request.RequestedAt, &request.ExecuteAt, &request.ExecutedAt)
+	return request, err
+}
+
+func get_anonymization_request(db *sql.DB, customer_id int64) (*AnonymizationRequest, error) {
+	request, err := scan_anonymization_request(db.QueryRow(`SELECT `+anonymization_request_columns+` FROM anonymization_requests WHERE customer_id = ?;`, customer_id))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Anonymization request not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// create_anonymization_request schedules the anonymization, a customer has at most one request
+func create_anonymization_request(db *sql.DB, customer_id int64, actor string, grace_period time.Duration) (*AnonymizationRequest, error) {
+	create_record := `
+	INSERT INTO anonymization_requests (customer_id, requested_by, execute_at)
+	VALUES (?, ?, datetime('now', ?))
+	ON CONFLICT (customer_id) DO NOTHING
+	RETURNING ` + anonymization_request_columns + `;
+	`
+
+	modifier := "+" + strconv.FormatInt(int64(grace_period/time.Second), 10) + " seconds"
+	request, err := scan_anonymization_request(db.QueryRow(create_record, customer_id, actor, modifier))
+	if err != sql.ErrNoRows {
+		if err != nil {
+			return nil, err
+		}
+		return &request, nil
+	}
+
+	existing, err := get_anonymization_request(db, customer_id)
+	if err != nil {
+		return nil, err
+	}
+	if existing.ExecutedAt != nil {
+		return nil, errors.New("Customer is already anonymized")
+	}
+
+	return nil, errors.New("Anonymization is already scheduled")
+}
+
+// cancel_anonymization_request withdraws a request that has not been carried out
+func cancel_anonymization_request(db *sql.DB, customer_id int64) error {
+	result, err := exec_with_retry(db, `DELETE FROM anonymization_requests WHERE customer_id = ? AND executed_at IS NULL;`, customer_id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		_, err = get_anonymization_request(db, customer_id)
+		if err != nil {
+			return err
+		}
+		return errors.New("Customer is already anonymized")
+	}
+
+	return nil
+}
+
+func get_due_anonymizations(db *sql.DB) ([]int64, error) {
+	rows, err := db.Query(`SELECT customer_id FROM anonymization_requests WHERE executed_at IS NULL AND execute_at <= CURRENT_TIMESTAMP ORDER BY execute_at;`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// enqueue_anonymization queues the anonymization job of a due request, once however often it is found due
+func enqueue_anonymization(db *sql.DB, config Config, customer_id int64) error {
+	// a customer deleted during the grace period has no tenant left, its job goes to the default one
+	tenant_id, err := get_owning_tenant(db, "customers", customer_id)
+	if err == sql.ErrNoRows {
+		tenant_id, err = "default", nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = enqueue_job(db, config, NewJob{
+		TenantID:  tenant_id,
+		Type:      "anonymize",
+		Payload:   map[string]int64{"customer_id": customer_id},
+		DedupeKey: "anonymize:" + strconv.FormatInt(customer_id, 10),
+		CreatedBy: "system",
+	})
+	return err
+}
+
+// anonymize_customer replaces the customer's personal data with placeholders everywhere it is kept: the row and
+// its emails and phones, addresses, notes, status reasons, attachments and avatar, recorded versions, events
+// and the audit trail. The suppression list keeps the real address so the person is never emailed again
+func anonymize_customer(ctx context.Context, db *sql.DB, store BlobStore, id int64) error {
+	scrubber, err := new_anonymizer()
+	if err != nil {
+		return err
+	}
+
+	var event *CustomerEvent
+	err = with_tx(db, func(tx *sql.Tx) error {
+		before, err := get_customer(tx, id)
+		if err != nil && err.Error() != "Customer not found" {
+			return err
+		}
+
+		// a customer deleted during the grace period still has a history to scrub
+		if before != nil {
+			err = anonymize_customer_row(tx, scrubber, before)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = scrub_customer_records(tx, scrubber, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE anonymization_requests SET executed_at = CURRENT_TIMESTAMP WHERE customer_id = ?;`, id)
+		if err != nil || before == nil {
+			return err
+		}
+
+		customer, err := get_customer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// no changes, their old values are what is being forgotten
+		event, err = record_event(tx, EventCustomerAnonymized, id, customer)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if event != nil {
+		event_broker.Publish(*event)
+	}
+
+	return purge_customer_blobs(ctx, db, store, id)
+}
+
+func anonymize_customer_row(tx *sql.Tx, scrubber *Scrubber, customer *Customer) error {
+	update_record := `
+	UPDATE customers
+	SET name = ?, email = ?, email_index = ?, contact = '', contact_index = '', dob = '', external_id = NULL, metadata = '{}', email_verified_at = NULL, avatar_updated_at = NULL,
+		blocked_reason = CASE WHEN blocked_at IS NOT NULL THEN 'Blocked (reason scrubbed)' END, blocked_by = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?;
+	`
+
+	var blocked_by *string
+	if customer.Block != nil {
+		blocked_by = new(string)
+		*blocked_by = scrubber.Email(customer.Block.BlockedBy)
+	}
+
+	email := scrubber.Email(customer.Email)
+	sealed_email, err := encrypt_pii("email", email)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(update_record, scrubber.Name(customer.Name), sealed_email, pii_index("email", email), blocked_by, customer.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM customer_contact_points WHERE customer_id = ?;`, customer.ID)
+	if err != nil {
+		return err
+	}
+
+	err = save_contact_points(tx, customer.ID, "email", email, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM customer_addresses WHERE customer_id = ?;`, customer.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE customer_notes SET body = 'Note scrubbed' WHERE customer_id = ?;`, customer.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE customer_status_transitions SET reason = 'Reason scrubbed' WHERE customer_id = ? AND reason != '';`, customer.ID)
+	return err
+}
+
+// scrub_customer_records scrubs the copies of the customer kept for history, after the row so the version
+// its update recorded is included
+func scrub_customer_records(tx *sql.Tx, scrubber *Scrubber, id int64) error {
+	type record struct {
+		id       int64
+		snapshot string
+		changes  *string
+	}
+
+	read := func(query string) ([]record, error) {
+		rows, err := tx.Query(query, id)
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		var records []record
+		for rows.Next() {
+			var r record
+			err = rows.Scan(&r.id, &r.snapshot, &r.changes)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+
+		return records, rows.Err()
+	}
+
+	versions, err := read(`SELECT id, snapshot, NULL FROM customer_versions WHERE customer_id = ?;`)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		snapshot, err := scrubber.payload(v.snapshot)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE customer_versions SET snapshot = ? WHERE id = ?;`, snapshot, v.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	events, err := read(`SELECT id, payload, changes FROM customer_events WHERE customer_id = ?;`)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		payload, err := scrubber.payload(e.snapshot)
+		if err != nil {
+			return err
+		}
+
+		var changes *string
+		if e.changes != nil {
+			scrubbed, err := scrubber.changes(*e.changes)
+			if err != nil {
+				return err
+			}
+			changes = &scrubbed
+		}
+
+		_, err = tx.Exec(`UPDATE customer_events SET payload = ?, changes = ? WHERE id = ?;`, payload, changes, e.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := get_customer_audit_logs(tx, id)
+	if err != nil {
+		return err
+	}
+
+	// writes to the customer itself carry customer snapshots, the sub-resources' notes, addresses and
+	// files are dropped whole
+	path := "/api/customers/" + strconv.FormatInt(id, 10)
+	for _, entry := range entries {
+		var before, after *string
+		if entry.Path == path || entry.Route == "POST /api/customers" {
+			for _, payload := range []struct {
+				raw json.RawMessage
+				to  **string
+			}{{entry.Before, &before}, {entry.After, &after}} {
+				if payload.raw == nil {
+					continue
+				}
+
+				scrubbed, err := scrubber.payload(string(payload.raw))
+				if err != nil {
+					return err
+				}
+				*payload.to = &scrubbed
+			}
+		}
+
+		_, err = tx.Exec(`UPDATE audit_logs SET before = ?, after = ? WHERE id = ?;`, before, after, entry.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// #endregion
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// Attachment is a document kept for a customer, such as a contract or a scan of an id. The file itself is in the blob store
+type Attachment struct {
+	ID          int64  `json:"id"`
+	CustomerID  int64  `json:"customer_id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`      // hex digest of the file, also its ETag
+	UploadedBy  string `json:"uploaded_by"` // the caller who uploaded it
+	CreatedAt   string `json:"created_at"`
+}
+
+// normalize_filename keeps the last path element of the name a client sent and checks it is printable
+func normalize_filename(filename string) (string, error) {
+	filename = strings.TrimSpace(path.Base(strings.ReplaceAll(filename, `\`, "/")))
+	if filename == "" || filename == "." || filename == "/" || utf8.RuneCountInString(filename) > 255 {
+		return "", &ValidationError{Field: "filename", Message: "must be 1 to 255 characters"}
+	}
+
+	for _, r := range filename {
+		if !unicode.IsPrint(r) {
+			return "", &ValidationError{Field: "filename", Message: "must not contain control characters"}
+		}
+	}
+
+	return filename, nil
+}
+
+// is_attachment_upload tells harden to take a file of up to ATTACHMENT_MAX_BYTES rather than a json body
+func is_attachment_upload(r *http.Request) bool {
+	path, ok := strings.CutSuffix(r.URL.Path, "/attachments")
+	return ok && r.Method == http.MethodPost && strings.HasPrefix(path, "/api/customers/") && !strings.Contains(strings.TrimPrefix(path, "/api/customers/"), "/")
+}
+
+// attachment_key names a new blob, random so a retried upload never overwrites another file
+func attachment_key(customer_id int64) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return "attachments/" + strconv.FormatInt(customer_id, 10) + "/" + hex.EncodeToString(buf), nil
+}
+
+// purge_customer_blobs removes the files of a deleted customer, their avatar and attachments
+func purge_customer_blobs(ctx context.Context, db *sql.DB, store BlobStore, customer_id int64) error {
+	err := delete_avatar_blobs(ctx, store, customer_id)
+	if err != nil {
+		return err
+	}
+
+	keys, err := get_attachment_keys(db, customer_id)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = store.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = exec_with_retry(db, `DELETE FROM customer_attachments WHERE customer_id = ?;`, customer_id)
+	return err
+}
+
+func register_attachment_routes(mux *http.ServeMux, db *sql.DB, config Config, store BlobStore) {
+	// uploads are the file itself, request validation reads it like any other file
+	for _, content_type := range split_list(config.AttachmentContentTypes) {
+		if openapi3filter.RegisteredBodyDecoder(content_type) == nil {
+			openapi3filter.RegisterBodyDecoder(content_type, openapi3filter.FileBodyDecoder)
+		}
+	}
+
+	// the customer's attachments, newest first
+	mux.HandleFunc("GET /api/customers/{id}/attachments", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		attachments, err := get_attachments(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Attachment]{Data: attachments})
+	})
+
+	// attach a file, sent as the body with its content type and named by ?filename=
+	mux.HandleFunc("POST /api/customers/{id}/attachments", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		filename, err := normalize_filename(r.URL.Query().Get("filename"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		content_type, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, "Invalid Content-Type", http.StatusBadRequest)
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		var max_bytes_error *http.MaxBytesError
+		if errors.As(err, &max_bytes_error) {
+			http.Error(w, "Attachment exceeds "+strconv.FormatInt(max_bytes_error.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(data) == 0 {
+			http.Error(w, "Attachment is empty", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		key, err := attachment_key(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = store.Put(r.Context(), key, data, content_type)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sum := sha256.Sum256(data)
+		attachment := Attachment{
+			CustomerID:  id,
+			Filename:    filename,
+			ContentType: content_type,
+			Size:        int64(len(data)),
+			SHA256:      hex.EncodeToString(sum[:]),
+			UploadedBy:  actor_from(r),
+		}
+
+		created, err := create_attachment(db, attachment, key)
+		if err != nil {
+			// the customer may have been deleted meanwhile, the blob would be left with nothing pointing at it
+			store.Delete(r.Context(), key)
+		}
+
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[Attachment]{Data: *created})
+	}))
+
+	// download the file
+	mux.HandleFunc("GET /api/customers/{id}/attachments/{attachment_id}", func(w http.ResponseWriter, r *http.Request) {
+		id, attachment_id, err := path_attachment_ids(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		attachment, key, err := get_attachment(db, id, attachment_id)
+		if err != nil && err.Error() == "Attachment not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// files never change, a new upload is a new attachment
+		etag := `"` + attachment.SHA256 + `"`
+		w.Header().Set("ETag", etag)
+		if etag_matches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		data, err := store.Get(r.Context(), key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// always downloaded rather than shown, an uploaded html file must not run in the api's origin
+		w.Header().Set("Content-Type", attachment.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	})
+
+	// remove the attachment and its file
+	mux.HandleFunc("DELETE /api/customers/{id}/attachments/{attachment_id}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, attachment_id, err := path_attachment_ids(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		key, err := delete_attachment(db, id, attachment_id)
+		if err != nil && err.Error() == "Attachment not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = store.Delete(r.Context(), key)
+		if err != nil {
+			println("deleting attachment blob failed:", err.Error())
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// path_attachment_ids reads the customer and attachment ids of /customers/{id}/attachments/{attachment_id}
+func path_attachment_ids(r *http.Request) (int64, int64, error) {
+	id, err := path_customer_id(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	attachment_id, err := strconv.ParseInt(r.PathValue("attachment_id"), 10, 64)
+	return id, attachment_id, err
+}
+
+// #region Database
+const attachment_columns = `id, customer_id, filename, content_type, size, sha256, uploaded_by, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)`
+
+func scan_attachment(row row_scanner) (Attachment, error) {
+	var attachment Attachment
+	err := row.Scan(&attachment.ID, &attachment.CustomerID, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.SHA256, &attachment.UploadedBy, &attachment.CreatedAt)
+	return attachment, err
+}
+
+// create_attachment records a file already put at key, as long as the customer still exists
+func create_attachment(db *sql.DB, attachment Attachment, key string) (*Attachment, error) {
+	create_record := `
+	INSERT INTO customer_attachments (customer_id, filename, content_type, size, sha256, uploaded_by, storage_key)
+	SELECT id, ?, ?, ?, ?, ?, ? FROM customers WHERE id = ?
+	RETURNING ` + attachment_columns + `;
+	`
+
+	created, err := scan_attachment(db.QueryRow(create_record, attachment.Filename, attachment.ContentType, attachment.Size, attachment.SHA256, attachment.UploadedBy, key, attachment.CustomerID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Customer not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// get_attachment returns the attachment and the key of its blob
+func get_attachment(db *sql.DB, customer_id int64, id int64) (*Attachment, string, error) {
+	var key string
+	row := db.QueryRow(`SELECT `+attachment_columns+`, storage_key FROM customer_attachments WHERE id = ? AND customer_id = ?;`, id, customer_id)
+
+	var attachment Attachment
+	err := row.Scan(&attachment.ID, &attachment.CustomerID, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.SHA256, &attachment.UploadedBy, &attachment.CreatedAt, &key)
+	if err == sql.ErrNoRows {
+		return nil, "", errors.New("Attachment not found")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &attachment, key, nil
+}
+
+func get_attachments(db *sql.DB, customer_id int64) ([]Attachment, error) {
+	get_records := `
+	SELECT ` + attachment_columns + `
+	FROM customer_attachments
+	WHERE customer_id = ?
+	ORDER BY id DESC;
+	`
+
+	rows, err := db.Query(get_records, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		attachment, err := scan_attachment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+func get_attachment_keys(db *sql.DB, customer_id int64) ([]string, error) {
+	rows, err := db.Query(`SELECT storage_key FROM customer_attachments WHERE customer_id = ?;`, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// delete_attachment removes the record and returns the key of the blob it pointed at
+func delete_attachment(db *sql.DB, customer_id int64, id int64) (string, error) {
+	var key string
+	err := db.QueryRow(`DELETE FROM customer_attachments WHERE id = ? AND customer_id = ? RETURNING storage_key;`, id, customer_id).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", errors.New("Attachment not found")
+	}
+
+	return key, err
+}
+
+// #endregion
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditLog is one write made through the api, who made it and what it changed
+type AuditLog struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`  // the jwt subject or api_key:<id>, anonymous when auth is disabled
+	KeyID     *int64          `json:"key_id"` // set when the caller used an api key
+	Action    string          `json:"action"` // create, update or delete, from the method
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Route     string          `json:"route"` // the matched route, e.g. PUT /api/customers/{id}
+	Status    int             `json:"status"`
+	Before    json.RawMessage `json:"before"` // the resource as its GET route returned it before an update or delete
+	After     json.RawMessage `json:"after"`  // the response to the write
+	RequestID string          `json:"request_id"`
+	TenantID  string          `json:"tenant_id"` // the tenant the write was made in, each tenant only sees its own
+	CreatedAt string          `json:"created_at"`
+}
+
+type AuditLogListingResponse struct {
+	Records []AuditLog `json:"records"`
+	Pagination
+}
+
+// AuditLogFilter narrows GET /audit-logs, zero values match everything but the tenant, which is always set
+type AuditLogFilter struct {
+	TenantID string
+	Actor    string
+	Action   string
+	Path     string // a prefix, /api/customers/42 also matches its sub-resources
+	Since    string
+	Until    string
+}
+
+// audit_actions names what each writing method does
+var audit_actions = map[string]string{
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodPatch:  "update",
+	http.MethodDelete: "delete",
+}
+
+// audit_max_payload keeps exports and other large responses out of the log, larger bodies are recorded as null
+const audit_max_payload = 64 << 10
+
+// audit_redacted_keys are json keys whose values are credentials, such as a new api key or webhook secret
+var audit_redacted_keys = []string{"key", "secret", "token", "password"}
+
+// audit_writer passes the response through, keeping the status and the start of the body
+type audit_writer struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (aw *audit_writer) WriteHeader(status int) {
+	aw.status = status
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *audit_writer) Write(b []byte) (int, error) {
+	if aw.body.Len() <= audit_max_payload {
+		aw.body.Write(b)
+	}
+
+	return aw.ResponseWriter.Write(b)
+}
+
+func (aw *audit_writer) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// audit_payload turns a json response into what the log keeps, its data with credentials redacted.
+// Anything else is null
+func audit_payload(header http.Header, body []byte) json.RawMessage {
+	media_type, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if media_type != "application/json" || len(body) == 0 || len(body) > audit_max_payload {
+		return nil
+	}
+
+	var document any
+	err := json.Unmarshal(body, &document)
+	if err != nil {
+		return nil
+	}
+
+	if envelope, ok := document.(map[string]any); ok {
+		if data, ok := envelope["data"]; ok && len(envelope) == 1 {
+			document = data
+		}
+	}
+
+	payload, err := json.Marshal(redact_credentials(document))
+	if err != nil {
+		return nil
+	}
+
+	return payload
+}
+
+func redact_credentials(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for field, nested := range value {
+			redacted := false
+			for _, key := range audit_redacted_keys {
+				if field == key || strings.HasSuffix(field, "_"+key) {
+					redacted = true
+				}
+			}
+
+			if redacted {
+				value[field] = "[redacted]"
+			} else {
+				value[field] = redact_credentials(nested)
+			}
+		}
+	case []any:
+		for i, nested := range value {
+			value[i] = redact_credentials(nested)
+		}
+	}
+
+	return value
+}
+
+// audit_before reads the resource a write is about to change through its GET route, as the caller
+func audit_before(mux *http.ServeMux, r *http.Request) json.RawMessage {
+	if r.Method == http.MethodPost {
+		return nil
+	}
+
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	get.Body = http.NoBody
+	get.ContentLength = 0
+	get.Header.Del("Content-Type")
+	get.Header.Del("If-None-Match")
+	get.Header.Del("Accept-Encoding")
+
+	_, pattern := mux.Handler(get)
+	if pattern == "" {
+		return nil
+	}
+
+	recorder := &audit_recorder{header: http.Header{}, status: http.StatusOK}
+	mux.ServeHTTP(recorder, get)
+	if recorder.status != http.StatusOK {
+		return nil
+	}
+
+	return audit_payload(recorder.header, recorder.body.Bytes())
+}
+
+// audit_recorder keeps the response of the GET audit_before makes, nothing of it reaches the caller
+type audit_recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (ar *audit_recorder) Header() http.Header {
+	return ar.header
+}
+
+func (ar *audit_recorder) WriteHeader(status int) {
+	ar.status = status
+}
+
+func (ar *audit_recorder) Write(b []byte) (int, error) {
+	if ar.body.Len() <= audit_max_payload {
+		ar.body.Write(b)
+	}
+
+	return len(b), nil
+}
+
+// audit records every successful write to a route of mux in the audit log, with the caller and the
+// resource before and after
+func audit(db *sql.DB, mux *http.ServeMux, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action, ok := audit_actions[r.Method]
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			next(w, r)
+			return
+		}
+
+		before := audit_before(mux, r)
+
+		aw := &audit_writer{ResponseWriter: w, status: http.StatusOK}
+		next(aw, r)
+
+		if aw.status < 200 || aw.status >= 300 {
+			return
+		}
+
+		entry := AuditLog{
+			Actor:     actor_from(r),
+			Action:    action,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Route:     route,
+			Status:    aw.status,
+			Before:    before,
+			After:     audit_payload(aw.Header(), aw.body.Bytes()),
+			RequestID: request_id_from(r),
+			TenantID:  tenant_from(r),
+		}
+		if principal := principal_from(r); principal != nil && principal.KeyID != 0 {
+			entry.KeyID = &principal.KeyID
+		}
+
+		err := create_audit_log(db, entry)
+		if err != nil {
+			println("recording audit log failed:", err.Error())
+		}
+	}
+}
+
+func register_audit_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// the audit log newest first, filtered by ?actor=, ?action=, ?path= and a ?since= / ?until= time range
+	mux.HandleFunc("GET /api/audit-logs", func(w http.ResponseWriter, r *http.Request) {
+		page, limit := page_params(config, r, 50)
+
+		query := r.URL.Query()
+		filter := AuditLogFilter{
+			TenantID: tenant_from(r),
+			Actor:    query.Get("actor"),
+			Action:   query.Get("action"),
+			Path:     query.Get("path"),
+		}
+
+		for param, bound := range map[string]*string{"since": &filter.Since, "until": &filter.Until} {
+			if !query.Has(param) {
+				continue
+			}
+
+			at, err := time.Parse(time.RFC3339, query.Get(param))
+			if err != nil {
+				http.Error(w, "Invalid "+param+", expected a timestamp like 2024-01-31T12:00:00Z", http.StatusBadRequest)
+				return
+			}
+			*bound = at.UTC().Format("2006-01-02 15:04:05")
+		}
+
+		records, total_records, err := get_audit_logs(db, filter, (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[AuditLogListingResponse]{
+			Data: AuditLogListingResponse{
+				Records:    records,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+}
+
+// #region Database
+const audit_log_columns = `id, actor, key_id, action, method, path, route, status, before, after, request_id, tenant_id, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)`
+
+func scan_audit_log(row row_scanner) (AuditLog, error) {
+	var entry AuditLog
+	var before, after *string
+	err := row.Scan(&entry.ID, &entry.Actor, &entry.KeyID, &entry.Action, &entry.Method, &entry.Path, &entry.Route, &entry.Status, &before, &after, &entry.RequestID, &entry.TenantID, &entry.CreatedAt)
+	if err != nil {
+		return entry, err
+	}
+
+	for _, payload := range []struct {
+		stored *string
+		to     *json.RawMessage
+	}{{before, &entry.Before}, {after, &entry.After}} {
+		if payload.stored == nil {
+			continue
+		}
+
+		opened, err := open_pii_json([]byte(*payload.stored))
+		if err != nil {
+			return entry, err
+		}
+		*payload.to = json.RawMessage(opened)
+	}
+
+	return entry, nil
+}
+
+func create_audit_log(db *sql.DB, entry AuditLog) error {
+	create_record := `
+	INSERT INTO audit_logs (actor, key_id, action, method, path, route, status, before, after, request_id, tenant_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	// the customers in an entry are sealed as their columns are
+	var before, after *string
+	for _, payload := range []struct {
+		raw json.RawMessage
+		to  **string
+	}{{entry.Before, &before}, {entry.After, &after}} {
+		if payload.raw == nil {
+			continue
+		}
+
+		sealed, err := seal_pii_json(payload.raw)
+		if err != nil {
+			return err
+		}
+		*payload.to = new(string)
+		**payload.to = string(sealed)
+	}
+
+	_, err := exec_with_retry(db, create_record, entry.Actor, entry.KeyID, entry.Action, entry.Method, entry.Path, entry.Route, entry.Status, before, after, entry.RequestID, entry.TenantID)
+	return err
+}
+
+func get_audit_logs(db *sql.DB, filter AuditLogFilter, offset int, limit int) ([]AuditLog, int, error) {
+	where := `
+	WHERE tenant_id = ?
+		AND (? = '' OR actor = ?)
+		AND (? = '' OR action = ?)
+		AND (? = '' OR path = ? OR path LIKE ? ESCAPE '\')
+		AND (? = '' OR created_at >= ?)
+		AND (? = '' OR created_at < ?)
+	`
+
+	path_prefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.TrimSuffix(filter.Path, "/")) + "/%"
+	args := []any{filter.TenantID, filter.Actor, filter.Actor, filter.Action, filter.Action, filter.Path, filter.Path, path_prefix, filter.Since, filter.Since, filter.Until, filter.Until}
+
+	rows, err := db.Query(`SELECT `+audit_log_columns+` FROM audit_logs `+where+` ORDER BY id DESC LIMIT ? OFFSET ?;`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	entries := []AuditLog{}
+	for rows.Next() {
+		entry, err := scan_audit_log(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, rows.Err()
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM audit_logs `+where+`;`, args...).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return entries, count, nil
+}
+
+// get_customer_audit_logs reads the writes to the customer and its sub-resources oldest first, with the one that created it
+func get_customer_audit_logs(db db_handle, customer_id int64) ([]AuditLog, error) {
+	get_records := `
+	SELECT ` + audit_log_columns + `
+	FROM audit_logs
+	WHERE path = ? OR path LIKE ? OR (route = 'POST /api/customers' AND json_extract(after, '$.id') = ?)
+	ORDER BY id;
+	`
+
+	path := "/api/customers/" + strconv.FormatInt(customer_id, 10)
+	rows, err := db.Query(get_records, path, path+"/%", customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []AuditLog{}
+	for rows.Next() {
+		entry, err := scan_audit_log(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// #endregion
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Principal is the authenticated caller attached to the request context
+type Principal struct {
+	Subject  string   `json:"subject"`
+	KeyID    int64    `json:"key_id,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	TenantID string   `json:"tenant_id,omitempty"` // empty for platform credentials, which may pick a tenant with X-Tenant-ID
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+type principal_key struct{}
+
+func principal_from(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principal_key{}).(*Principal)
+	return principal
+}
+
+type ApiKey struct {
+	ID         int64   `json:"id"`
+	Label      string  `json:"label"`
+	Prefix     string  `json:"prefix"` // first characters of the key, enough to recognise it
+	Role       string  `json:"role"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at"`
+	RevokedAt  *string `json:"revoked_at"`
+	TenantID   *string `json:"tenant_id"` // the tenant the key is bound to, null for platform keys
+}
+
+type CreatedApiKey struct {
+	ApiKey
+	Key string `json:"key"` // only ever returned on creation
+}
+
+type ApiKeyDetails struct {
+	Label string `json:"label"`
+	Role  string `json:"role"` // defaults to read_only
+}
+
+// public_paths skip authentication so probes, load balancers, the login flow and verification links can reach them
+var public_paths = map[string]bool{
+	"/healthz":       true,
+	"/readyz":        true,
+	"/version":       true,
+	"/openapi.yaml":  true,
+	"/auth/login":    true,
+	"/auth/callback": true,
+	"/auth/logout":   true,
+	"/verify":        true,
+	"/exports":       true,
+}
+
+func principal_from_claims(config Config, claims JwtClaims) *Principal {
+	principal := &Principal{Subject: claims.Subject(), Roles: []string{}, TenantID: claims.Tenant(config.JwtTenantClaim)}
+
+	// the provider names the roles as it likes, only the configured names grant one, whatever else it calls a
+	// role grants nothing here
+	provider_roles := map[string]string{
+		config.JwtAdminRole:    RoleAdmin,
+		config.JwtEditorRole:   RoleEditor,
+		config.JwtReadOnlyRole: RoleReadOnly,
+	}
+	for _, claimed := range claims.Roles(config.JwtRolesClaim) {
+		role, ok := provider_roles[claimed]
+		if ok && claimed != "" && !principal.HasRole(role) {
+			principal.Roles = append(principal.Roles, role)
+		}
+	}
+
+	return principal
+}
+
+// authenticate rejects requests without a valid bearer token, X-API-Key or login session, the ADMIN_API_KEY
+// from config and tokens carrying the admin role grant admin access
+func authenticate(db *sql.DB, config Config, verifier *JwtVerifier, sessions *SessionSigner, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AuthDisabled || public_paths[r.URL.Path] {
+			next(w, r)
+			return
+		}
+
+		token, is_bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if is_bearer && verifier != nil {
+			claims, err := verifier.Verify(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			principal := principal_from_claims(config, claims)
+			next(w, r.WithContext(context.WithValue(r.Context(), principal_key{}, principal)))
+			return
+		}
+
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			principal := session_principal(sessions, r)
+			if principal != nil {
+				if r.Method != http.MethodGet && r.Method != http.MethodHead && !same_origin(r) {
+					http.Error(w, "Cross origin request rejected", http.StatusForbidden)
+					return
+				}
+
+				next(w, r.WithContext(context.WithValue(r.Context(), principal_key{}, principal)))
+				return
+			}
+
+			// people opening the admin ui log in first rather than see a 401
+			if config.OIDCIssuer != "" && r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/admin") {
+				http.Redirect(w, r, "/auth/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", `ApiKey header="X-API-Key"`)
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		var principal *Principal
+		if config.AdminApiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(config.AdminApiKey)) == 1 {
+			principal = &Principal{Subject: "admin", Roles: []string{RoleAdmin}}
+		} else {
+			api_key, err := get_api_key_by_key(db, key)
+			if err != nil && err.Error() != "API key not found" {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if api_key == nil {
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+
+			principal = &Principal{Subject: "api_key:" + strconv.FormatInt(api_key.ID, 10), KeyID: api_key.ID, Roles: []string{api_key.Role}}
+			if api_key.TenantID != nil {
+				principal.TenantID = *api_key.TenantID
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principal_key{}, principal)))
+	}
+}
+
+func hash_api_key(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generate_api_key() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return "ck_" + hex.EncodeToString(buf), nil
+}
+
+func register_api_key_routes(mux *http.ServeMux, db *sql.DB) {
+	// create an api key, the plain key is only shown in this response
+	mux.HandleFunc("POST /api/admin/api-keys", func(w http.ResponseWriter, r *http.Request) {
+		var req ApiKeyDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Label == "" {
+			http.Error(w, "Label is required", http.StatusBadRequest)
+			return
+		}
+
+		if req.Role == "" {
+			req.Role = RoleReadOnly
+		}
+
+		_, ok := role_ranks[req.Role]
+		if !ok {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+
+		api_key, err := create_api_key(db, req, api_key_tenant(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := ApiResponse[CreatedApiKey]{
+			Data: *api_key,
+		}
+
+		response_str, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(response_str)
+	})
+
+	// list api keys, including revoked ones. Tenant admins only see their tenant's keys
+	mux.HandleFunc("GET /api/admin/api-keys", func(w http.ResponseWriter, r *http.Request) {
+		api_keys, err := get_api_keys(db, bound_tenant(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := ApiResponse[[]ApiKey]{
+			Data: api_keys,
+		}
+
+		response_str, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	})
+
+	// revoke an api key
+	mux.HandleFunc("DELETE /api/admin/api-keys/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = revoke_api_key(db, id, bound_tenant(r))
+		if err != nil && err.Error() == "API key not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// bound_tenant is the tenant the caller's credential is bound to, empty for platform credentials
+func bound_tenant(r *http.Request) string {
+	principal := principal_from(r)
+	if principal == nil {
+		return ""
+	}
+
+	return principal.TenantID
+}
+
+// api_key_tenant is the tenant a new key is bound to: the caller's own, or the one a platform admin named
+// with X-Tenant-ID. Without either the key is a platform key
+func api_key_tenant(r *http.Request) string {
+	if bound_tenant(r) != "" || r.Header.Get("X-Tenant-ID") != "" {
+		return tenant_from(r)
+	}
+
+	return ""
+}
+
+// #region Database
+// api_key_touch_interval is how often last_used_at is stamped for a key in use
+const api_key_touch_interval = time.Minute
+
+const api_key_columns = `id, label, prefix, role, created_at, last_used_at, revoked_at, tenant_id`
+
+func scan_api_key(row row_scanner) (ApiKey, error) {
+	var api_key ApiKey
+	err := row.Scan(&api_key.ID, &api_key.Label, &api_key.Prefix, &api_key.Role, &api_key.CreatedAt, &api_key.LastUsedAt, &api_key.RevokedAt, &api_key.TenantID)
+	return api_key, err
+}
+
+// create_api_key makes a key bound to tenant_id, or a platform key when it is empty
+func create_api_key(db *sql.DB, input ApiKeyDetails, tenant_id string) (*CreatedApiKey, error) {
+	key, err := generate_api_key()
+	if err != nil {
+		return nil, err
+	}
+
+	api_key, err := insert_api_key(db, input, tenant_id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreatedApiKey{ApiKey: *api_key, Key: key}, nil
+}
+
+func insert_api_key(db db_handle, input ApiKeyDetails, tenant_id string, key string) (*ApiKey, error) {
+	create_record := `
+	INSERT INTO api_keys (label, prefix, role, key_hash, tenant_id)
+	VALUES (?, ?, ?, ?, NULLIF(?, ''))
+	RETURNING ` + api_key_columns + `;
+	`
+
+	api_key, err := scan_api_key(db.QueryRow(create_record, input.Label, key[:11], input.Role, hash_api_key(key), tenant_id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api_key, nil
+}
+
+// get_api_key_by_key finds an active key and stamps its last use, at most once per api_key_touch_interval so
+// authenticating a read doesn't take the write lock
+func get_api_key_by_key(db *sql.DB, key string) (*ApiKey, error) {
+	get_record := `
+	SELECT ` + api_key_columns + `, last_used_at IS NULL OR last_used_at < datetime('now', ?)
+	FROM api_keys
+	WHERE key_hash = ? AND revoked_at IS NULL;
+	`
+
+	var api_key ApiKey
+	var stale bool
+	since := "-" + strconv.Itoa(int(api_key_touch_interval.Seconds())) + " seconds"
+	err := db.QueryRow(get_record, since, hash_api_key(key)).Scan(&api_key.ID, &api_key.Label, &api_key.Prefix, &api_key.Role, &api_key.CreatedAt, &api_key.LastUsedAt, &api_key.RevokedAt, &api_key.TenantID, &stale)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("API key not found")
+		}
+		return nil, err
+	}
+
+	// the stamp is only informational, the request goes ahead without it, as it does in read only mode
+	if stale && maintenance_mode.begin_write() {
+		_, err = exec_with_retry(db, `UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?;`, api_key.ID)
+		maintenance_mode.end_write()
+		if err != nil {
+			println("stamping api key use failed:", err.Error())
+		}
+	}
+
+	return &api_key, nil
+}
+
+// get_api_keys lists the keys bound to tenant_id, or every key when it is empty
+func get_api_keys(db *sql.DB, tenant_id string) ([]ApiKey, error) {
+	get_records := `
+	SELECT ` + api_key_columns + `
+	FROM api_keys
+	WHERE ? = '' OR tenant_id = ?
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, tenant_id, tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var api_keys []ApiKey = []ApiKey{}
+	for rows.Next() {
+		api_key, err := scan_api_key(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		api_keys = append(api_keys, api_key)
+	}
+
+	return api_keys, rows.Err()
+}
+
+// revoke_api_key revokes the key, only among those bound to tenant_id unless it is empty
+func revoke_api_key(db *sql.DB, id int64, tenant_id string) error {
+	update_record := `
+	UPDATE api_keys
+	SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP)
+	WHERE id = ? AND (? = '' OR tenant_id = ?);
+	`
+
+	result, err := exec_with_retry(db, update_record, id, tenant_id, tenant_id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("API key not found")
+	}
+
+	return nil
+}
+
+// #endregion
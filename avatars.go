@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// avatar_sizes are the square thumbnails kept of each avatar in pixels, largest first. The first is served by default
+var avatar_sizes = []int{256, 64}
+
+// avatar_content_types are the image formats PUT /customers/{id}/avatar accepts, told apart by their content
+var avatar_content_types = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// avatar_max_pixels turns away images that are small on the wire but would take too much memory to decode
+const avatar_max_pixels = 40_000_000
+
+func avatar_key(id int64, size int) string {
+	return "avatars/" + strconv.FormatInt(id, 10) + "/" + strconv.Itoa(size) + ".png"
+}
+
+// is_avatar_upload tells harden to take an image of up to AVATAR_MAX_BYTES rather than a json body
+func is_avatar_upload(r *http.Request) bool {
+	path, ok := strings.CutSuffix(r.URL.Path, "/avatar")
+	return ok && r.Method == http.MethodPut && strings.HasPrefix(path, "/api/customers/") && !strings.Contains(strings.TrimPrefix(path, "/api/customers/"), "/")
+}
+
+// avatar_thumbnail crops the middle square out of src and scales it to size, averaging the pixels
+// each thumbnail pixel covers
+func avatar_thumbnail(src image.Image, size int) *image.NRGBA {
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	left := bounds.Min.X + (bounds.Dx()-side)/2
+	top := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0 := top + y*side/size
+		y1 := max(top+(y+1)*side/size, y0+1)
+		for x := 0; x < size; x++ {
+			x0 := left + x*side/size
+			x1 := max(left+(x+1)*side/size, x0+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			thumbnail.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+
+	return thumbnail
+}
+
+// avatar_thumbnails decodes an uploaded image into a png of each of avatar_sizes
+func avatar_thumbnails(data []byte) (map[int][]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, &ValidationError{Field: "avatar", Message: "cannot be read: " + err.Error()}
+	}
+	if config.Width*config.Height > avatar_max_pixels {
+		return nil, &ValidationError{Field: "avatar", Message: "must be at most " + strconv.Itoa(avatar_max_pixels) + " pixels"}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &ValidationError{Field: "avatar", Message: "cannot be read: " + err.Error()}
+	}
+
+	// each size is scaled from the one before, which is quicker than going back to the full image
+	thumbnails := map[int][]byte{}
+	for _, size := range avatar_sizes {
+		thumbnail := avatar_thumbnail(img, size)
+		img = thumbnail
+
+		var buf bytes.Buffer
+		err = png.Encode(&buf, thumbnail)
+		if err != nil {
+			return nil, err
+		}
+		thumbnails[size] = buf.Bytes()
+	}
+
+	return thumbnails, nil
+}
+
+// delete_avatar_blobs removes every thumbnail of the customer's avatar
+func delete_avatar_blobs(ctx context.Context, store BlobStore, id int64) error {
+	for _, size := range avatar_sizes {
+		err := store.Delete(ctx, avatar_key(id, size))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func register_avatar_routes(mux *http.ServeMux, db *sql.DB, store BlobStore) {
+	// upload the customer's avatar, a jpeg, png or gif sent as the body. It is cropped square and kept as thumbnails
+	mux.HandleFunc("PUT /api/customers/{id}/avatar", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		var max_bytes_error *http.MaxBytesError
+		if errors.As(err, &max_bytes_error) {
+			http.Error(w, "Avatar exceeds "+strconv.FormatInt(max_bytes_error.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the declared content type is not trusted, the image has to look like one of the formats
+		if !avatar_content_types[http.DetectContentType(data)] {
+			http.Error(w, "Avatar must be a jpeg, png or gif image", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		thumbnails, err := avatar_thumbnails(data)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for size, thumbnail := range thumbnails {
+			err = store.Put(r.Context(), avatar_key(id, size), thumbnail, "image/png")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		write_scope_change(w, r, func(id int64) (*Customer, error) {
+			return set_customer_avatar(db, id, true)
+		})
+	}))
+
+	// the avatar as a png, ?size= picks a thumbnail
+	mux.HandleFunc("GET /api/customers/{id}/avatar", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		size := avatar_sizes[0]
+		if r.URL.Query().Has("size") {
+			size, err = strconv.Atoi(r.URL.Query().Get("size"))
+			if err != nil || !slices.Contains(avatar_sizes, size) {
+				sizes := make([]string, len(avatar_sizes))
+				for i, size := range avatar_sizes {
+					sizes[i] = strconv.Itoa(size)
+				}
+				http.Error(w, "Size must be one of "+strings.Join(sizes, ", "), http.StatusBadRequest)
+				return
+			}
+		}
+
+		customer, err := get_customer(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if customer.AvatarUpdatedAt == nil {
+			http.Error(w, "Avatar not found", http.StatusNotFound)
+			return
+		}
+
+		// a new upload changes the tag, so clients only download each avatar once
+		etag := `"avatar-` + strconv.Itoa(size) + "-" + strings.NewReplacer("-", "", ":", "").Replace(*customer.AvatarUpdatedAt) + `"`
+		w.Header().Set("ETag", etag)
+		if etag_matches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		data, err := store.Get(r.Context(), avatar_key(id, size))
+		if err != nil && err.Error() == "Blob not found" {
+			http.Error(w, "Avatar not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	})
+
+	// remove the avatar
+	mux.HandleFunc("DELETE /api/customers/{id}/avatar", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_avatar_blobs(r.Context(), store, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_scope_change(w, r, func(id int64) (*Customer, error) {
+			return set_customer_avatar(db, id, false)
+		})
+	}))
+}
+
+// #region Database
+
+// set_customer_avatar records when the avatar was uploaded, or that it was removed
+func set_customer_avatar(db *sql.DB, id int64, uploaded bool) (*Customer, error) {
+	upload_record := `
+	UPDATE customers
+	SET avatar_updated_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?;
+	`
+
+	remove_record := `
+	UPDATE customers
+	SET avatar_updated_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND avatar_updated_at IS NOT NULL;
+	`
+
+	update_record := upload_record
+	if !uploaded {
+		update_record = remove_record
+	}
+
+	return change_customer(db, id, update_record, EventCustomerUpdated)
+}
+
+// #endregion
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backup is a snapshot of the main database and, with TENANT_ISOLATION=database, of every tenant's
+type Backup struct {
+	ID        int64        `json:"id"`
+	Name      string       `json:"name"`
+	Trigger   string       `json:"trigger"` // manual or scheduled
+	Size      int64        `json:"size"`    // compressed, of all the files
+	Files     []BackupFile `json:"files"`
+	CreatedBy string       `json:"created_by"`
+	CreatedAt string       `json:"created_at"`
+}
+
+// BackupFile is one database of a backup, gzipped in the backup store
+type BackupFile struct {
+	TenantID    string `json:"tenant_id"` // the default tenant's is the main database
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`        // of the gzipped file
+	LastEventID int64  `json:"last_event_id"` // the newest customer event in it, where a replay picks up
+}
+
+// BackupManifest is stored next to the files, so a restore needs nothing but the backup store
+type BackupManifest struct {
+	Name      string       `json:"name"`
+	Encrypted bool         `json:"encrypted"` // the files are encrypted with DATABASE_PASSPHRASE
+	Files     []BackupFile `json:"files"`
+	CreatedAt string       `json:"created_at"`
+}
+
+// new_backup_store keeps backups in BACKUP_DIR or, with BACKUP_STORE=s3, under backups/ in BACKUP_S3_BUCKET
+// with the blob store's credentials
+func new_backup_store(config Config) (BlobStore, error) {
+	return new_store_in(config, config.BackupStore, config.BackupDir, config.BackupS3Bucket, "backups/")
+}
+
+func backup_manifest_key(name string) string {
+	return name + "/manifest.json"
+}
+
+// create_backup snapshots every database without stopping writes, stores the files and their manifest and
+// then rotates out the backups past BACKUP_KEEP
+func create_backup(ctx context.Context, db *sql.DB, store BlobStore, config Config, trigger string, actor string) (*Backup, error) {
+	now := time.Now().UTC()
+	manifest := BackupManifest{
+		Name:      "backup-" + now.Format("20060102T150405.000Z"),
+		Encrypted: config.DatabasePassphrase != "",
+		CreatedAt: now.Format(time.RFC3339),
+	}
+
+	tenant_ids := []string{default_tenant}
+	if tenant_databases != nil {
+		tenants, err := get_tenants(db)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tenant := range tenants {
+			if tenant.ID != default_tenant {
+				tenant_ids = append(tenant_ids, tenant.ID)
+			}
+		}
+	}
+
+	for _, tenant_id := range tenant_ids {
+		tenant_db := db
+		var err error
+		if tenant_id != default_tenant {
+			tenant_db, err = tenant_databases.DB(tenant_id)
+		}
+
+		var file *BackupFile
+		if err == nil {
+			file, err = backup_database(ctx, tenant_db, store, config, manifest.Name+"/"+tenant_id+".db.gz")
+		}
+		if err != nil {
+			delete_backup_files(ctx, store, manifest.Files)
+			return nil, errors.New("backing up " + tenant_id + ": " + err.Error())
+		}
+
+		file.TenantID = tenant_id
+		manifest.Files = append(manifest.Files, *file)
+	}
+
+	encoded, err := json.Marshal(manifest)
+	if err == nil {
+		err = store.Put(ctx, backup_manifest_key(manifest.Name), encoded, "application/json")
+	}
+	if err != nil {
+		delete_backup_files(ctx, store, manifest.Files)
+		return nil, err
+	}
+
+	backup, err := create_backup_record(db, manifest, trigger, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	// the new backup is safe before any old one goes
+	err = rotate_backups(ctx, db, store, config.BackupKeep)
+	if err != nil {
+		println("rotating backups failed:", err.Error())
+	}
+
+	return backup, nil
+}
+
+// backup_database writes db to a temporary file with VACUUM INTO, which reads one consistent snapshot while
+// writes go on, checks the copy and stores it gzipped under key
+func backup_database(ctx context.Context, db *sql.DB, store BlobStore, config Config, key string) (*BackupFile, error) {
+	dir, err := os.MkdirTemp("", "backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// an encrypted database is copied through the adiantum vfs, so the backup stays encrypted
+	path := filepath.Join(dir, "snapshot.db")
+	target, dsn := path, "file:"+path
+	if config.DatabasePassphrase != "" {
+		target = encrypted_dsn(path, config.DatabasePassphrase)
+		dsn = target
+	}
+
+	// not ExecContext, the wasm driver refuses to vacuum under a context it may have to interrupt
+	_, err = db.Exec(`VACUUM INTO ?;`, target)
+	if err != nil {
+		return nil, err
+	}
+
+	err = check_database(dsn)
+	if err != nil {
+		return nil, errors.New("the snapshot failed its check: " + err.Error())
+	}
+
+	last_event_id, err := get_snapshot_last_event_id(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Put(ctx, key, compressed.Bytes(), "application/gzip")
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(compressed.Bytes())
+	return &BackupFile{Key: key, Size: int64(compressed.Len()), SHA256: hex.EncodeToString(sum[:]), LastEventID: last_event_id}, nil
+}
+
+func delete_backup_files(ctx context.Context, store BlobStore, files []BackupFile) error {
+	for _, file := range files {
+		err := store.Delete(ctx, file.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotate_backups deletes all but the newest keep backups, none when keep is 0
+func rotate_backups(ctx context.Context, db *sql.DB, store BlobStore, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	expired, err := get_expired_backups(db, keep)
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range expired {
+		err = delete_backup_files(ctx, store, backup.Files)
+		if err == nil {
+			err = store.Delete(ctx, backup_manifest_key(backup.Name))
+		}
+		if err == nil {
+			err = delete_backup_record(db, backup.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func register_backup_routes(mux *http.ServeMux, db *sql.DB, store BlobStore, config Config) {
+	// take a backup now, the api keeps serving reads and writes meanwhile
+	mux.HandleFunc("POST /api/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		// large databases take longer than the write timeout allows
+		clear_deadlines(w)
+
+		backup, err := create_backup(r.Context(), db, store, config, "manual", actor_from(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[Backup]{Data: *backup})
+	})
+
+	// the backups kept, newest first
+	mux.HandleFunc("GET /api/admin/backups", func(w http.ResponseWriter, r *http.Request) {
+		backups, err := get_backups(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Backup]{Data: backups})
+	})
+}
+
+// #region Database
+const backup_columns = `id, name, trigger, size, files, created_by, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)`
+
+func scan_backup(row row_scanner) (Backup, error) {
+	var backup Backup
+	var files string
+	err := row.Scan(&backup.ID, &backup.Name, &backup.Trigger, &backup.Size, &files, &backup.CreatedBy, &backup.CreatedAt)
+	if err != nil {
+		return backup, err
+	}
+
+	err = json.Unmarshal([]byte(files), &backup.Files)
+	return backup, err
+}
+
+// get_snapshot_last_event_id reads the newest event of a snapshot, through the wasm driver which opens
+// plain and encrypted files alike
+func get_snapshot_last_event_id(dsn string) (int64, error) {
+	snapshot, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+
+	var last_event_id int64
+	err = snapshot.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM customer_events;`).Scan(&last_event_id)
+	return last_event_id, err
+}
+
+func create_backup_record(db *sql.DB, manifest BackupManifest, trigger string, actor string) (*Backup, error) {
+	create_record := `
+	INSERT INTO backups (name, trigger, size, files, created_by)
+	VALUES (?, ?, ?, ?, ?)
+	RETURNING ` + backup_columns + `;
+	`
+
+	var size int64
+	for _, file := range manifest.Files {
+		size += file.Size
+	}
+
+	files, err := json.Marshal(manifest.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	var backup Backup
+	err = retry_busy(func() error {
+		var err error
+		backup, err = scan_backup(db.QueryRow(create_record, manifest.Name, trigger, size, string(files), actor))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &backup, nil
+}
+
+func get_backups(db *sql.DB) ([]Backup, error) {
+	return query_backups(db, `SELECT `+backup_columns+` FROM backups ORDER BY id DESC;`)
+}
+
+func get_expired_backups(db *sql.DB, keep int) ([]Backup, error) {
+	return query_backups(db, `SELECT `+backup_columns+` FROM backups ORDER BY id DESC LIMIT -1 OFFSET ?;`, keep)
+}
+
+func query_backups(db *sql.DB, query string, args ...any) ([]Backup, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	backups := []Backup{}
+	for rows.Next() {
+		backup, err := scan_backup(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, backup)
+	}
+
+	return backups, rows.Err()
+}
+
+func delete_backup_record(db *sql.DB, id int64) error {
+	_, err := exec_with_retry(db, `DELETE FROM backups WHERE id = ?;`, id)
+	return err
+}
+
+// #endregion
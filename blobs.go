@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps files the database only refers to, keys are slash separated paths
+type BlobStore interface {
+	Name() string
+	Put(ctx context.Context, key string, data []byte, content_type string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+func new_blob_store(config Config) (BlobStore, error) {
+	switch config.BlobStore {
+	case "", "disk":
+		return &DiskBlobStore{dir: config.BlobDir}, nil
+	case "s3":
+		if config.S3Bucket == "" || config.S3AccessKeyID == "" || config.S3SecretAccessKey == "" {
+			return nil, errors.New("BLOB_STORE=s3 needs S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+		}
+		return &S3BlobStore{
+			client:     &http.Client{Timeout: 60 * time.Second},
+			endpoint:   strings.TrimSuffix(config.S3Endpoint, "/"),
+			bucket:     config.S3Bucket,
+			region:     config.S3Region,
+			access_key: config.S3AccessKeyID,
+			secret_key: config.S3SecretAccessKey,
+		}, nil
+	default:
+		return nil, errors.New("Unknown blob store " + config.BlobStore)
+	}
+}
+
+// new_store_in opens a store apart from the blob store, a disk one in dir or an s3 one under prefix in
+// bucket. The bucket defaults to S3_BUCKET, the credentials are the blob store's
+func new_store_in(config Config, store string, dir string, bucket string, prefix string) (BlobStore, error) {
+	config.BlobStore, config.BlobDir = store, dir
+	if bucket != "" {
+		config.S3Bucket = bucket
+	}
+
+	blobs, err := new_blob_store(config)
+	if err != nil || store != "s3" {
+		return blobs, err
+	}
+
+	return &PrefixedBlobStore{BlobStore: blobs, prefix: prefix}, nil
+}
+
+// DiskBlobStore keeps blobs as files under dir
+type DiskBlobStore struct {
+	dir string
+}
+
+func (s *DiskBlobStore) Name() string {
+	return "disk"
+}
+
+func (s *DiskBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first, so readers never see half a blob. Files carry no content type,
+// callers keep it themselves
+func (s *DiskBlobStore) Put(ctx context.Context, key string, data []byte, content_type string) error {
+	path := s.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *DiskBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.New("Blob not found")
+	}
+
+	return data, err
+}
+
+// Delete succeeds for blobs that are already gone
+func (s *DiskBlobStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// S3BlobStore keeps blobs as objects in a bucket of S3 or a compatible store such as minio, addressed by path
+// so endpoints without wildcard dns work too
+type S3BlobStore struct {
+	client     *http.Client
+	endpoint   string // e.g. https://s3.eu-west-1.amazonaws.com
+	bucket     string
+	region     string
+	access_key string
+	secret_key string
+}
+
+func (s *S3BlobStore) Name() string {
+	return "s3"
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, content_type string) error {
+	res, err := s.do(ctx, http.MethodPut, key, data, content_type)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3_error(res)
+	}
+
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errors.New("Blob not found")
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s3_error(res)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+// Delete succeeds for blobs that are already gone, S3 answers 204 either way
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3_error(res)
+	}
+
+	return nil
+}
+
+func (s *S3BlobStore) Check(ctx context.Context) error {
+	res, err := s.do(ctx, http.MethodHead, "", nil, "")
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("S3 bucket " + s.bucket + " answered " + res.Status)
+	}
+
+	return nil
+}
+
+// do sends a request for the object at key signed with aws signature version 4, an empty key addresses the bucket
+func (s *S3BlobStore) do(ctx context.Context, method string, key string, body []byte, content_type string) (*http.Response, error) {
+	path := "/" + s.bucket
+	if key != "" {
+		path += "/" + key
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+s3_escape_path(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if content_type != "" {
+		req.Header.Set("Content-Type", content_type)
+	}
+
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the Authorization header, https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	payload_sum := sha256.Sum256(body)
+	payload_hash := hex.EncodeToString(payload_sum[:])
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amz_date)
+	req.Header.Set("X-Amz-Content-Sha256", payload_hash)
+
+	signed_headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical_headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payload_hash + "\n" +
+		"x-amz-date:" + amz_date + "\n"
+	canonical_request := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonical_headers, signed_headers, payload_hash}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	request_sum := sha256.Sum256([]byte(canonical_request))
+	string_to_sign := "AWS4-HMAC-SHA256\n" + amz_date + "\n" + scope + "\n" + hex.EncodeToString(request_sum[:])
+
+	key := []byte("AWS4" + s.secret_key)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmac_sha256(key, part)
+	}
+	signature := hex.EncodeToString(hmac_sha256(key, string_to_sign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.access_key+"/"+scope+", SignedHeaders="+signed_headers+", Signature="+signature)
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3_escape_path percent-encodes everything but unreserved characters and the slashes between segments,
+// which is the encoding the signature is computed over
+func s3_escape_path(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func s3_error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return errors.New("s3 answered " + strconv.Itoa(res.StatusCode) + ": " + strings.TrimSpace(string(body)))
+}
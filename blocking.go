@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	EventCustomerBlocked   = "customer.blocked"
+	EventCustomerUnblocked = "customer.unblocked"
+)
+
+type CustomerBlock struct {
+	Reason    string `json:"reason"`
+	BlockedBy string `json:"blocked_by"`
+	BlockedAt string `json:"blocked_at"`
+}
+
+// CustomerStatus is the cheap answer for services that only need to know whether a customer may act
+type CustomerStatus struct {
+	CustomerID int64          `json:"customer_id"`
+	Status     string         `json:"status"`
+	Blocked    bool           `json:"blocked"`
+	Block      *CustomerBlock `json:"block,omitempty"`
+}
+
+type BlockDetails struct {
+	Reason string `json:"reason"`
+}
+
+// actor_from names the caller for attribution, falling back to anonymous when auth is disabled
+func actor_from(r *http.Request) string {
+	principal := principal_from(r)
+	if principal == nil || principal.Subject == "" {
+		return "anonymous"
+	}
+
+	return principal.Subject
+}
+
+func path_customer_id(r *http.Request) (int64, error) {
+	return strconv.ParseInt(r.PathValue("id"), 10, 64)
+}
+
+// reject_blocked is the enforcement hook for customer scoped writes, blocked customers answer 423. Every write
+// to a customer goes through it but the block itself and status changes, which are how one is lifted
+func reject_blocked(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		status, err := get_customer_status(db, id)
+		if err == nil && status.Blocked {
+			http.Error(w, "Customer is blocked", http.StatusLocked)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func register_blocking_routes(mux *http.ServeMux, db *sql.DB) {
+	// block status, one indexed lookup for other services to consult
+	mux.HandleFunc("GET /api/customers/{id}/status", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		status, err := get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_customer_status(w, status)
+	})
+
+	// block the customer
+	mux.HandleFunc("POST /api/customers/{id}/block", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req BlockDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Reason == "" {
+			http.Error(w, "Reason is required", http.StatusBadRequest)
+			return
+		}
+
+		status, err := set_customer_block(db, id, &CustomerBlock{Reason: req.Reason, BlockedBy: actor_from(r)}, actor_from(r))
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_customer_status(w, status)
+	})
+
+	// unblock the customer
+	mux.HandleFunc("DELETE /api/customers/{id}/block", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		status, err := set_customer_block(db, id, nil, actor_from(r))
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_customer_status(w, status)
+	})
+}
+
+func write_customer_status(w http.ResponseWriter, status *CustomerStatus) {
+	response := ApiResponse[CustomerStatus]{
+		Data: *status,
+	}
+
+	response_str, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response_str)
+}
+
+// #region Database
+func get_customer_status(db db_handle, id int64) (*CustomerStatus, error) {
+	get_record := `
+	SELECT id, status, blocked_at IS NOT NULL, COALESCE(blocked_reason, ''), COALESCE(blocked_by, ''), COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', blocked_at), '')
+	FROM customers
+	WHERE id = ?;
+	`
+
+	status := CustomerStatus{}
+	block := CustomerBlock{}
+	err := db.QueryRow(get_record, id).Scan(&status.CustomerID, &status.Status, &status.Blocked, &block.Reason, &block.BlockedBy, &block.BlockedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Customer not found")
+		}
+		return nil, err
+	}
+
+	if status.Blocked {
+		status.Block = &block
+	}
+
+	return &status, nil
+}
+
+// set_customer_block blocks the customer with the given block, or unblocks when block is nil. It moves the
+// status to blocked and back to active, recording the transition for actor
+func set_customer_block(db *sql.DB, id int64, block *CustomerBlock, actor string) (*CustomerStatus, error) {
+	block_record := `
+	UPDATE customers
+	SET status = 'blocked', blocked_at = CURRENT_TIMESTAMP, blocked_reason = ?, blocked_by = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?;
+	`
+
+	unblock_record := `
+	UPDATE customers
+	SET status = 'active', blocked_at = NULL, blocked_reason = NULL, blocked_by = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND blocked_at IS NOT NULL;
+	`
+
+	var status *CustomerStatus
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		current, err := get_customer_status(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// unblocking an unblocked customer changes nothing and records nothing
+		if block == nil && !current.Blocked {
+			status = current
+			return nil
+		}
+
+		event_type := EventCustomerBlocked
+		if block == nil {
+			event_type = EventCustomerUnblocked
+			_, err = tx.Exec(unblock_record, id)
+		} else {
+			_, err = tx.Exec(block_record, block.Reason, block.BlockedBy, id)
+		}
+		if err != nil {
+			return err
+		}
+
+		status, err = get_customer_status(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// re-blocking only replaces the reason
+		if status.Status != current.Status {
+			reason := ""
+			if block != nil {
+				reason = block.Reason
+			}
+			err = record_status_transition(tx, id, current.Status, status.Status, reason, actor)
+			if err != nil {
+				return err
+			}
+		}
+
+		event, err = record_event(tx, event_type, id, status)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if event != nil {
+		event_broker.Publish(*event)
+	}
+
+	return status, nil
+}
+
+// #endregion
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type cache_entry[K comparable, V any] struct {
+	key        K
+	value      V
+	err        error
+	expires_at time.Time
+}
+
+// Cache is a read-through lru cache in front of store reads, concurrent misses for a key share one load
+// and errors that is_negative accepts (e.g. not found) are cached for the shorter negative ttl
+type Cache[K comparable, V any] struct {
+	ttl          time.Duration
+	negative_ttl time.Duration
+	max_entries  int
+	is_negative  func(error) bool
+
+	mu      sync.Mutex
+	entries map[K]*list.Element
+	recency *list.List // of *cache_entry, most recently read first
+	version uint64     // bumped by Invalidate so loads that started before it are not stored
+	group   singleflight.Group
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func new_cache[K comparable, V any](ttl time.Duration, negative_ttl time.Duration, max_entries int, is_negative func(error) bool) *Cache[K, V] {
+	return &Cache[K, V]{
+		ttl:          ttl,
+		negative_ttl: negative_ttl,
+		max_entries:  max_entries,
+		is_negative:  is_negative,
+		entries:      map[K]*list.Element{},
+		recency:      list.New(),
+	}
+}
+
+// Get returns the cached value for key or loads it, a zero ttl turns the cache off
+func (c *Cache[K, V]) Get(key K, load func() (V, error)) (V, error) {
+	if c == nil || c.ttl <= 0 {
+		return load()
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	element, ok := c.entries[key]
+	if ok && now.Before(element.Value.(*cache_entry[K, V]).expires_at) {
+		c.recency.MoveToFront(element)
+		entry := *element.Value.(*cache_entry[K, V])
+		c.mu.Unlock()
+
+		c.hits.Add(1)
+		return entry.value, entry.err
+	}
+	version := c.version
+	c.mu.Unlock()
+
+	c.misses.Add(1)
+	result, err, _ := c.group.Do(fmt.Sprint(key), func() (any, error) {
+		value, err := load()
+
+		ttl := c.ttl
+		if err != nil {
+			if !c.is_negative(err) {
+				return value, err
+			}
+			ttl = c.negative_ttl
+		}
+
+		c.mu.Lock()
+		if c.version == version && ttl > 0 {
+			c.remove(key)
+			c.evict()
+			c.entries[key] = c.recency.PushFront(&cache_entry[K, V]{key: key, value: value, err: err, expires_at: now.Add(ttl)})
+		}
+		c.mu.Unlock()
+
+		return value, err
+	})
+
+	return result.(V), err
+}
+
+// Invalidate drops key after a write, loads already in flight are not cached
+func (c *Cache[K, V]) Invalidate(key K) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.remove(key)
+	c.version++
+	c.mu.Unlock()
+
+	c.group.Forget(fmt.Sprint(key))
+}
+
+func (c *Cache[K, V]) remove(key K) {
+	element, ok := c.entries[key]
+	if ok {
+		c.recency.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// evict makes room for one more entry by dropping the least recently read ones, expired entries are
+// never read again so they reach the back on their own
+func (c *Cache[K, V]) evict() {
+	for len(c.entries) >= max(c.max_entries, 1) {
+		c.remove(c.recency.Back().Value.(*cache_entry[K, V]).key)
+	}
+}
+
+// write_metrics reports hits and misses under name, e.g. customer_cache_hits_total
+func (c *Cache[K, V]) write_metrics(w http.ResponseWriter, name string, help string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	size := int64(len(c.entries))
+	c.mu.Unlock()
+
+	write_metric(w, name+"_hits_total", "counter", "Reads of "+help+" answered from the cache.", c.hits.Load())
+	write_metric(w, name+"_misses_total", "counter", "Reads of "+help+" that went to the database.", c.misses.Load())
+	write_metric(w, name+"_entries", "gauge", "Entries in the cache of "+help+".", size)
+}
+
+// customer_cache fronts get_customer for the by-id endpoint, invalidated whenever a customer event is published.
+// Ids are per tenant once tenants have their own database files
+var customer_cache CustomerCache
+
+type customer_cache_key struct {
+	tenant_id string
+	id        int64
+}
+
+// new_customer_cache keeps customers in memory, or with CACHE_STORE=redis where every replica reads and invalidates them
+func new_customer_cache(config Config) (CustomerCache, error) {
+	switch config.CacheStore {
+	case "", "memory":
+		return new_cache[customer_cache_key, Customer](config.CustomerCacheTTL, config.CustomerCacheNegativeTTL, config.CustomerCacheSize, func(err error) bool {
+			return err.Error() == "Customer not found"
+		}), nil
+	case "redis":
+		client, err := shared_redis(config)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisCustomerCache{client: client, ttl: config.CustomerCacheTTL, negative_ttl: config.CustomerCacheNegativeTTL}, nil
+	default:
+		return nil, errors.New("Unknown cache store " + config.CacheStore)
+	}
+}
+
+// get_cached_customer returns a copy the caller may localize without touching the cached value
+func get_cached_customer(db db_handle, tenant_id string, id int64) (*Customer, error) {
+	customer, err := customer_cache.Get(customer_cache_key{tenant_id, id}, func() (Customer, error) {
+		customer, err := get_customer(db, id)
+		if err != nil {
+			return Customer{}, err
+		}
+		return *customer, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &customer, nil
+}
+
+// count_cache fronts get_total_customers for the listings. Any customer change can move any count, so
+// rather than finding the keys it touched a write bumps count_generation and older entries are never read again
+var count_cache *Cache[count_cache_key, int]
+
+var count_generation atomic.Uint64
+
+type count_cache_key struct {
+	generation uint64
+	query      string // the where clause and its args
+}
+
+func new_count_cache(config Config) *Cache[count_cache_key, int] {
+	return new_cache[count_cache_key, int](config.CountCacheTTL, 0, config.CountCacheSize, func(err error) bool {
+		return false
+	})
+}
+
+// invalidate_counts is called for every write that can change which customers a listing selects
+func invalidate_counts() {
+	count_generation.Add(1)
+}
+
+func get_cached_total_customers(db *sql.DB, scope ListingScope) (int, error) {
+	where, args := scope.where()
+	key := count_cache_key{count_generation.Load(), where + fmt.Sprintf("%#v", args)}
+
+	return count_cache.Get(key, func() (int, error) {
+		return get_total_customers(db, scope)
+	})
+}
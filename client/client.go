@@ -0,0 +1,192 @@
+// Package client is a small Go client for the customer api
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Customer struct {
+	ID                   int64   `json:"id"`
+	Version              int64   `json:"version"`
+	Name                 string  `json:"name"`
+	DOB                  string  `json:"dob"`
+	Email                string  `json:"email"`
+	Contact              string  `json:"contact"`
+	Country              string  `json:"country"`
+	ExternalID           string  `json:"external_id,omitempty"`
+	CreatedAt            string  `json:"created_at"`
+	UpdatedAt            string  `json:"updated_at"`
+	ReferralCode         string  `json:"referral_code"`
+	ReferredByCustomerID *int64  `json:"referred_by_customer_id"`
+	Blocked              bool    `json:"blocked"`
+	Status               string  `json:"status"`
+	ArchivedAt           *string `json:"archived_at"`
+	EmailVerifiedAt      *string `json:"email_verified_at"`
+}
+
+// Filter narrows ListAll, the include flags widen the server's default listing scope
+type Filter struct {
+	PageSize          int // records per request, the server caps it at MAX_PAGE_LIMIT
+	IncludeArchived   bool
+	IncludeUnverified bool
+	IncludeInactive   bool
+}
+
+// Error is a non-2xx answer from the api
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return strconv.Itoa(e.StatusCode) + ": " + e.Message
+}
+
+type Client struct {
+	BaseURL    string // e.g. https://customers.example.com
+	APIKey     string
+	HTTPClient *http.Client
+	MaxRetries int           // attempts after a 429 before giving up
+	MaxBackoff time.Duration // longest wait between retries when the server sends no Retry-After
+}
+
+func New(base_url string, api_key string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(base_url, "/"),
+		APIKey:     api_key,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 5,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+type listing_response struct {
+	Data struct {
+		Records []Customer `json:"records"`
+		HasNext bool       `json:"has_next"`
+	} `json:"data"`
+}
+
+// ListAll yields every customer matching filter, following the pages' next links and backing off
+// when rate limited. Iteration stops at the first error, which is yielded with a zero Customer
+//
+//	for customer, err := range c.ListAll(ctx, client.Filter{}) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+func (c *Client) ListAll(ctx context.Context, filter Filter) iter.Seq2[Customer, error] {
+	return func(yield func(Customer, error) bool) {
+		query := url.Values{}
+		if filter.PageSize > 0 {
+			query.Set("limit", strconv.Itoa(filter.PageSize))
+		}
+		if filter.IncludeArchived {
+			query.Set("include_archived", "true")
+		}
+		if filter.IncludeUnverified {
+			query.Set("include_unverified", "true")
+		}
+		if filter.IncludeInactive {
+			query.Set("include_inactive", "true")
+		}
+
+		next := "/v1/customers?" + query.Encode()
+		for next != "" {
+			var page listing_response
+			res_header, err := c.get(ctx, next, &page)
+			if err != nil {
+				yield(Customer{}, err)
+				return
+			}
+
+			for _, customer := range page.Data.Records {
+				if !yield(customer, nil) {
+					return
+				}
+			}
+
+			next = ""
+			if page.Data.HasNext {
+				next = next_link(res_header.Get("Link"))
+			}
+		}
+	}
+}
+
+// get fetches path into out, retrying 429s after Retry-After or an exponential backoff
+func (c *Client) get(ctx context.Context, path string, out any) (http.Header, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if c.APIKey != "" {
+			req.Header.Set("X-API-Key", c.APIKey)
+		}
+
+		res, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode == http.StatusTooManyRequests && attempt < c.MaxRetries {
+			wait := min(backoff, c.MaxBackoff)
+			seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+			if err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			backoff *= 2
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return nil, &Error{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
+		}
+
+		err = json.Unmarshal(body, out)
+		if err != nil {
+			return nil, errors.New("decoding " + path + ": " + err.Error())
+		}
+
+		return res.Header, nil
+	}
+}
+
+// next_link picks the rel="next" target out of an rfc 5988 Link header
+func next_link(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+
+		return strings.Trim(strings.TrimSpace(target), "<>")
+	}
+
+	return ""
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Company is the organization a b2b customer works for, customers belong to at most one
+type Company struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Domain    string `json:"domain"` // the company's email domain, unique within the tenant when set
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type CompanyDetails struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain"`
+}
+
+type CompanyListingResponse struct {
+	Records []Company `json:"records"`
+	Pagination
+}
+
+func validate_company(db *sql.DB, tenant_id string, input *CompanyDetails, id int64) error {
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		return &ValidationError{Field: "name", Message: "is required"}
+	}
+
+	input.Domain = strings.ToLower(strings.TrimSpace(input.Domain))
+	if input.Domain != "" {
+		if strings.ContainsAny(input.Domain, "@/ ") || !strings.Contains(input.Domain, ".") {
+			return &ValidationError{Field: "domain", Message: "must be a domain name like example.com"}
+		}
+
+		var owner int64
+		err := db.QueryRow(`SELECT id FROM companies WHERE tenant_id = ? AND domain = ?;`, tenant_id, input.Domain).Scan(&owner)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && owner != id {
+			return &ValidationError{Field: "domain", Message: "is already taken"}
+		}
+	}
+
+	return nil
+}
+
+// path_company_id reads the {id} of /companies/{id}
+func path_company_id(r *http.Request) (int64, error) {
+	return strconv.ParseInt(r.PathValue("id"), 10, 64)
+}
+
+func register_company_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// companies by name
+	mux.HandleFunc("GET /api/companies", func(w http.ResponseWriter, r *http.Request) {
+		page, limit := page_params(config, r, 20)
+
+		records, total_records, err := get_companies(db, tenant_from(r), (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[CompanyListingResponse]{
+			Data: CompanyListingResponse{
+				Records:    records,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+
+	mux.HandleFunc("POST /api/companies", func(w http.ResponseWriter, r *http.Request) {
+		var req CompanyDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_company(db, tenant_from(r), &req, 0)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		company, err := create_company(db, tenant_from(r), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[Company]{Data: *company})
+	})
+
+	mux.HandleFunc("GET /api/companies/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_company_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		company, err := get_company(db, id)
+		if err != nil && err.Error() == "Company not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Company]{Data: *company})
+	})
+
+	mux.HandleFunc("PUT /api/companies/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_company_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req CompanyDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_company(db, tenant_from(r), &req, id)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		company, err := update_company(db, id, req)
+		if err != nil && err.Error() == "Company not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Company]{Data: *company})
+	})
+
+	// remove a company, its customers have to be moved or unlinked first
+	mux.HandleFunc("DELETE /api/companies/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_company_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_company(db, id)
+		if err != nil && err.Error() == "Company not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil && err.Error() == "Company has customers" {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// the company's customers, in the default listing scope
+	mux.HandleFunc("GET /api/companies/{id}/customers", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_company_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_company(db, id)
+		if err != nil && err.Error() == "Company not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		page, limit := page_params(config, r, 10)
+		scope := listing_scope(config, r)
+		scope.CompanyID = &id
+
+		result, err := get_customers(db, scope, (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		total_records, err := get_total_customers(db, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = expand_customers(db, r, result)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range result {
+			present_customer(r, &result[i])
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[GetListingResponse]{
+			Data: GetListingResponse{
+				Records:    result,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+
+	// take the customer out of its company, an update leaving company_id out keeps it
+	mux.HandleFunc("DELETE /api/customers/{id}/company", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		customer, err := remove_customer_company(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		present_customer(r, customer)
+		write_json_response(w, http.StatusOK, ApiResponse[Customer]{Data: *customer})
+	}))
+}
+
+// #region Database
+const company_columns = `id, name, COALESCE(domain, ''), strftime('%Y-%m-%dT%H:%M:%SZ', created_at), strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)`
+
+func scan_company(row row_scanner) (Company, error) {
+	var company Company
+	err := row.Scan(&company.ID, &company.Name, &company.Domain, &company.CreatedAt, &company.UpdatedAt)
+	return company, err
+}
+
+func get_company(db db_handle, id int64) (*Company, error) {
+	company, err := scan_company(db.QueryRow(`SELECT `+company_columns+` FROM companies WHERE id = ?;`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Company not found")
+		}
+		return nil, err
+	}
+
+	return &company, nil
+}
+
+func get_companies(db *sql.DB, tenant_id string, offset int, limit int) ([]Company, int, error) {
+	get_records := `
+	SELECT ` + company_columns + `
+	FROM companies
+	WHERE tenant_id = ?
+	ORDER BY name, id
+	LIMIT ? OFFSET ?;
+	`
+
+	rows, err := db.Query(get_records, tenant_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	companies := []Company{}
+	for rows.Next() {
+		company, err := scan_company(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		companies = append(companies, company)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, rows.Err()
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM companies WHERE tenant_id = ?;`, tenant_id).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return companies, count, nil
+}
+
+// get_companies_by_id reads the companies with the ids, for ?expand=company
+func get_companies_by_id(db *sql.DB, ids []int64) (map[int64]Company, error) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	get_records := `
+	SELECT ` + company_columns + `
+	FROM companies
+	WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `);
+	`
+
+	rows, err := db.Query(get_records, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	companies := map[int64]Company{}
+	for rows.Next() {
+		company, err := scan_company(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		companies[company.ID] = company
+	}
+
+	return companies, rows.Err()
+}
+
+func create_company(db *sql.DB, tenant_id string, input CompanyDetails) (*Company, error) {
+	var company *Company
+	err := with_tx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`INSERT INTO companies (tenant_id, name, domain) VALUES (?, ?, NULLIF(?, ''));`, tenant_id, input.Name, input.Domain)
+		if err != nil {
+			return err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		company, err = get_company(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return company, nil
+}
+
+func update_company(db *sql.DB, id int64, input CompanyDetails) (*Company, error) {
+	update_record := `
+	UPDATE companies
+	SET name = ?, domain = NULLIF(?, ''), updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?;
+	`
+
+	var company *Company
+	err := with_tx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(update_record, input.Name, input.Domain, id)
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if updated == 0 {
+			return errors.New("Company not found")
+		}
+
+		company, err = get_company(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return company, nil
+}
+
+// delete_company refuses while customers still belong to the company
+func delete_company(db *sql.DB, id int64) error {
+	return with_tx(db, func(tx *sql.Tx) error {
+		var members bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM customers WHERE company_id = ?);`, id).Scan(&members)
+		if err != nil {
+			return err
+		}
+
+		if members {
+			return errors.New("Company has customers")
+		}
+
+		result, err := tx.Exec(`DELETE FROM companies WHERE id = ?;`, id)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if deleted == 0 {
+			return errors.New("Company not found")
+		}
+
+		return nil
+	})
+}
+
+// remove_customer_company clears the customer's company, recording the change as an update does
+func remove_customer_company(db *sql.DB, id int64) (*Customer, error) {
+	var customer *Customer
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		before, err := get_customer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE customers SET company_id = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?;`, id)
+		if err != nil {
+			return err
+		}
+
+		customer, err = get_customer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		changes, err := customer_changes(before, customer)
+		if err != nil {
+			return err
+		}
+
+		event, err = record_change_event(tx, EventCustomerUpdated, id, customer, changes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	event_broker.Publish(*event)
+
+	return customer, nil
+}
+
+// #endregion
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// incompressible_types are already compressed or streamed event by event, compressing them only costs cpu or latency
+var incompressible_types = map[string]bool{
+	"application/octet-stream": true, // age encrypted exports
+	"application/gzip":         true,
+	"application/zip":          true,
+	"application/pdf":          true,
+	"text/event-stream":        true,
+}
+
+var gzip_writers = sync.Pool{New: func() any {
+	return gzip.NewWriter(nil)
+}}
+
+var zstd_writers = sync.Pool{New: func() any {
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	return encoder
+}}
+
+// accepted_encoding is the first of the configured encodings the client's Accept-Encoding allows, empty for none
+func accepted_encoding(r *http.Request, encodings []string) string {
+	accepted := map[string]bool{}
+	wildcard := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		allowed := true
+		if q_str, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(q_str, 64)
+			allowed = err == nil && q > 0
+		}
+
+		if coding == "*" {
+			wildcard = allowed
+			continue
+		}
+		accepted[coding] = allowed
+	}
+
+	for _, encoding := range encodings {
+		allowed, named := accepted[encoding]
+		if allowed || (!named && wildcard) {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// compress encodes responses of at least COMPRESS_MIN_BYTES with gzip or zstd when the client accepts it,
+// the first of COMPRESS_ENCODINGS the client takes wins. Smaller responses are sent as they are
+func compress(config Config, next http.HandlerFunc) http.HandlerFunc {
+	encodings := split_list(strings.ToLower(config.CompressEncodings))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(encodings) == 0 {
+			next(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := accepted_encoding(r, encodings)
+		if encoding == "" || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		cw := &compress_writer{ResponseWriter: w, encoding: encoding, min_bytes: config.CompressMinBytes, status: http.StatusOK}
+		next(cw, r)
+		cw.finish()
+	}
+}
+
+// compress_writer holds back the start of the body until it knows whether the response is worth compressing
+type compress_writer struct {
+	http.ResponseWriter
+	encoding  string
+	min_bytes int
+	status    int
+	started   bool // the handler called WriteHeader or Write
+	decided   bool // headers are out, buffer is flushed
+	buffer    []byte
+	encoder   io.WriteCloser
+}
+
+func (cw *compress_writer) WriteHeader(status int) {
+	if cw.started {
+		return
+	}
+	cw.started = true
+	cw.status = status
+
+	// nothing to compress in bodyless responses
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compress_writer) Write(b []byte) (int, error) {
+	if !cw.started {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.buffer = append(cw.buffer, b...)
+		if len(cw.buffer) >= cw.min_bytes {
+			err := cw.decide(true)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, streaming handlers flush after every chunk
+func (cw *compress_writer) Flush() {
+	if !cw.started {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.decide(len(cw.buffer) >= cw.min_bytes)
+	}
+
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compress_writer) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide sends the headers, compressed when asked to and the content allows it, then the buffered body
+func (cw *compress_writer) decide(compressed bool) error {
+	cw.decided = true
+
+	header := cw.Header()
+	media_type, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if compressed && header.Get("Content-Encoding") == "" && !incompressible_types[media_type] {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+
+		// the bytes differ from the uncompressed rendering, only a weak tag still holds
+		etag := header.Get("ETag")
+		if etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		switch cw.encoding {
+		case "gzip":
+			writer := gzip_writers.Get().(*gzip.Writer)
+			writer.Reset(cw.ResponseWriter)
+			cw.encoder = writer
+		case "zstd":
+			writer := zstd_writers.Get().(*zstd.Encoder)
+			writer.Reset(cw.ResponseWriter)
+			cw.encoder = writer
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buffer := cw.buffer
+	cw.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+
+	if cw.encoder != nil {
+		_, err := cw.encoder.Write(buffer)
+		return err
+	}
+
+	_, err := cw.ResponseWriter.Write(buffer)
+	return err
+}
+
+// finish sends a body that stayed under the threshold, or ends the compressed stream
+func (cw *compress_writer) finish() {
+	if !cw.started {
+		return
+	}
+
+	if !cw.decided {
+		cw.decide(false)
+		return
+	}
+
+	if cw.encoder == nil {
+		return
+	}
+
+	cw.encoder.Close()
+	switch writer := cw.encoder.(type) {
+	case *gzip.Writer:
+		writer.Reset(nil)
+		gzip_writers.Put(writer)
+	case *zstd.Encoder:
+		writer.Reset(nil)
+		zstd_writers.Put(writer)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings, all read from environment variables
+type Config struct {
+	AuthDisabled               bool
+	AdminApiKey                string
+	JwtSecret                  string
+	JwksURL                    string
+	JwtIssuer                  string
+	JwtAudience                string
+	JwtRolesClaim              string
+	JwtAdminRole               string
+	JwtEditorRole              string
+	JwtReadOnlyRole            string
+	JwtTenantClaim             string
+	OIDCIssuer                 string
+	OIDCClientID               string
+	OIDCClientSecret           string
+	OIDCRedirectURL            string
+	OIDCScopes                 string
+	SessionSecret              string
+	SessionTTL                 time.Duration
+	SqliteBusyTimeout          time.Duration
+	SqliteCheckpointInterval   time.Duration
+	SqliteSynchronous          string
+	SqliteCacheSize            int // pages when positive, KiB when negative as PRAGMA cache_size takes it
+	DatabaseMaxOpenConns       int
+	DatabaseMaxIdleConns       int
+	DatabaseConnMaxLifetime    time.Duration
+	DatabasePingInterval       time.Duration
+	CorsAllowedOrigins         string
+	CorsAllowedMethods         string
+	CorsAllowedHeaders         string
+	CorsExposedHeaders         string
+	CorsAllowCredentials       bool
+	CorsMaxAge                 time.Duration
+	CustomerCacheTTL           time.Duration
+	CustomerCacheNegativeTTL   time.Duration
+	CustomerCacheSize          int
+	CountCacheTTL              time.Duration
+	CountCacheSize             int
+	StatementCacheSize         int
+	RateLimitRPM               int
+	RateLimitBurst             int
+	RateLimitStore             string
+	RedisURL                   string
+	CacheStore                 string
+	IdempotencyStore           string
+	IdempotencyTTL             time.Duration
+	IdempotencyExpirySchedule  string
+	ListenAddr                 string
+	TLSCertFile                string
+	TLSKeyFile                 string
+	AutocertHosts              string
+	AutocertEmail              string
+	AutocertCacheDir           string
+	AutocertDirectoryURL       string
+	HTTPRedirectAddr           string
+	DebugAddr                  string
+	IntegrationsCritical       string
+	LeaderElection             bool
+	LeaderLeaseTTL             time.Duration
+	ShutdownDrainDelay         time.Duration
+	MaxBodyBytes               int64
+	AllowedContentTypes        string
+	CompressEncodings          string
+	LegacyDeprecatedAt         string
+	LegacySunset               string
+	PhoneDefaultRegion         string
+	EmailFoldGmail             bool
+	EmailCheckMX               bool
+	DisposableEmail            string
+	DisposableDomainsURL       string
+	DisposableDomainsRefresh   time.Duration
+	PIIEncryptionKey           string
+	PIIPreviousKey             string
+	PIIRotateBatchSize         int
+	DatabasePassphrase         string
+	TenantIsolation            string
+	TenantDatabaseDir          string
+	PublicURL                  string
+	SMTPAddr                   string
+	SMTPUsername               string
+	SMTPPassword               string
+	SMTPFrom                   string
+	VerificationTokenTTL       time.Duration
+	VerificationResendInterval time.Duration
+	BlobStore                  string
+	BlobDir                    string
+	S3Endpoint                 string
+	S3Bucket                   string
+	S3Region                   string
+	S3AccessKeyID              string
+	S3SecretAccessKey          string
+	AttachmentMaxBytes         int64
+	ImportMaxBytes             int64
+	AttachmentContentTypes     string
+	AvatarMaxBytes             int64
+	CompressMinBytes           int
+	ReadHeaderTimeout          time.Duration
+	ReadTimeout                time.Duration
+	WriteTimeout               time.Duration
+	IdleTimeout                time.Duration
+	SentryDSN                  string
+	SentryEnvironment          string
+	FieldPolicyFile            string
+	FixturesFile               string
+	CustomerQuota              int64
+	ExportRequireEncryption    bool
+	ExportLinkTTL              time.Duration
+	MaxPageLimit               int
+	ListingExcludeArchived     bool
+	ListingExcludeUnverified   bool
+	ListingOnlyActive          bool
+	StorageQuotaBytes          int64
+	WarehouseSink              string
+	WarehouseInterval          time.Duration
+	WarehouseBatchSize         int
+	WarehouseBackfill          bool
+	ClickHouseURL              string
+	ClickHouseUser             string
+	ClickHousePassword         string
+	ClickHouseTable            string
+	BigQueryProject            string
+	BigQueryDataset            string
+	BigQueryTable              string
+	BigQueryCredentialsFile    string // a service account key, the gcp metadata server when empty
+	WebhookInterval            time.Duration
+	WebhookMaxBackoff          time.Duration
+	WebhookTimeout             time.Duration
+	WebhookBatchSize           int
+	WebhookConcurrency         int
+	WebhookDisableAfterDays    int
+	RulesInterval              time.Duration
+	AnonymizeGracePeriod       time.Duration
+	AnonymizeInterval          time.Duration
+	JobWorkers                 int
+	JobPollInterval            time.Duration
+	JobLease                   time.Duration
+	JobMaxAttempts             int
+	JobBackoff                 time.Duration
+	AnalyzeSchedule            string
+	VacuumSchedule             string
+	ArchivePurgeSchedule       string
+	ArchiveRetention           time.Duration
+	AuditPruneSchedule         string
+	AuditRetention             time.Duration
+	EventPruneSchedule         string
+	EventRetention             time.Duration
+	BackupStore                string
+	BackupDir                  string
+	BackupS3Bucket             string
+	BackupSchedule             string
+	BackupKeep                 int
+	ReplicaStore               string
+	ReplicaDir                 string
+	ReplicaS3Bucket            string
+	ReplicaSyncInterval        time.Duration
+	ReplicaCheckpointInterval  time.Duration
+	ReplicaSnapshotInterval    time.Duration
+	ReplicaRetention           time.Duration
+	ReadOnly                   bool
+	ReadOnlyRetryAfter         time.Duration
+	ReadOnlyDrainTimeout       time.Duration
+	HtmxURL                    string
+	HtmxIntegrity              string
+	GenerateEnabled            bool
+	GenerateMaxCount           int
+	EventBus                   string
+	EventBusInterval           time.Duration
+	EventBusBatchSize          int
+	NatsURL                    string
+	NatsSubject                string
+	KafkaBrokers               string
+	KafkaTopic                 string
+}
+
+func load_config() Config {
+	return Config{
+		AuthDisabled:               env_bool("AUTH_DISABLED", false),
+		AdminApiKey:                env("ADMIN_API_KEY", ""),
+		JwtSecret:                  env("JWT_SECRET", ""),
+		JwksURL:                    env("JWKS_URL", ""),
+		JwtIssuer:                  env("JWT_ISSUER", ""),
+		JwtAudience:                env("JWT_AUDIENCE", ""),
+		JwtRolesClaim:              env("JWT_ROLES_CLAIM", "roles"),
+		JwtAdminRole:               env("JWT_ADMIN_ROLE", "admin"),
+		JwtEditorRole:              env("JWT_EDITOR_ROLE", "editor"),
+		JwtReadOnlyRole:            env("JWT_READ_ONLY_ROLE", "read_only"),
+		JwtTenantClaim:             env("JWT_TENANT_CLAIM", "tenant_id"),
+		OIDCIssuer:                 env("OIDC_ISSUER", ""),
+		OIDCClientID:               env("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:           env("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:            env("OIDC_REDIRECT_URL", "http://localhost:3000/auth/callback"),
+		OIDCScopes:                 env("OIDC_SCOPES", "openid profile email"),
+		SessionSecret:              env("SESSION_SECRET", ""),
+		SessionTTL:                 env_duration("SESSION_TTL", 8*time.Hour),
+		SqliteBusyTimeout:          env_duration("SQLITE_BUSY_TIMEOUT", 5*time.Second),
+		SqliteCheckpointInterval:   env_duration("SQLITE_CHECKPOINT_INTERVAL", time.Minute),
+		SqliteSynchronous:          strings.ToUpper(env("SQLITE_SYNCHRONOUS", "NORMAL")),
+		SqliteCacheSize:            env_int("SQLITE_CACHE_SIZE", -20000),
+		DatabaseMaxOpenConns:       env_int("DATABASE_MAX_OPEN_CONNS", 0),
+		DatabaseMaxIdleConns:       env_int("DATABASE_MAX_IDLE_CONNS", 0),
+		DatabaseConnMaxLifetime:    env_duration("DATABASE_CONN_MAX_LIFETIME", 0),
+		DatabasePingInterval:       env_duration("DATABASE_PING_INTERVAL", 30*time.Second),
+		CorsAllowedOrigins:         env("CORS_ALLOWED_ORIGINS", "*"),
+		CorsAllowedMethods:         env("CORS_ALLOWED_METHODS", "GET, POST, PUT, DELETE"),
+		CorsAllowedHeaders:         env("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, X-API-Key, Idempotency-Key, If-Match, If-None-Match"),
+		CorsExposedHeaders:         env("CORS_EXPOSED_HEADERS", "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Deprecation, Sunset, Link, Idempotent-Replayed, ETag, X-Total-Count, X-Total-Count-Estimated"),
+		CorsAllowCredentials:       env_bool("CORS_ALLOW_CREDENTIALS", false),
+		CorsMaxAge:                 env_duration("CORS_MAX_AGE", 10*time.Minute),
+		CustomerCacheTTL:           env_duration("CUSTOMER_CACHE_TTL", 10*time.Second),
+		CustomerCacheNegativeTTL:   env_duration("CUSTOMER_CACHE_NEGATIVE_TTL", 2*time.Second),
+		CustomerCacheSize:          env_int("CUSTOMER_CACHE_SIZE", 10000),
+		CountCacheTTL:              env_duration("COUNT_CACHE_TTL", 30*time.Second),
+		CountCacheSize:             env_int("COUNT_CACHE_SIZE", 1000),
+		StatementCacheSize:         env_int("STATEMENT_CACHE_SIZE", 256),
+		RateLimitRPM:               env_int("RATE_LIMIT_RPM", 0),
+		RateLimitBurst:             env_int("RATE_LIMIT_BURST", 0),
+		RateLimitStore:             env("RATE_LIMIT_STORE", "memory"),
+		RedisURL:                   env("REDIS_URL", "redis://localhost:6379/0"),
+		CacheStore:                 env("CACHE_STORE", "memory"),
+		IdempotencyStore:           env("IDEMPOTENCY_STORE", "memory"),
+		IdempotencyTTL:             env_duration("IDEMPOTENCY_TTL", 24*time.Hour),
+		IdempotencyExpirySchedule:  env("IDEMPOTENCY_EXPIRY_SCHEDULE", "@every 1m"),
+		ListenAddr:                 env("LISTEN_ADDR", ":3000"),
+		TLSCertFile:                env("TLS_CERT_FILE", ""),
+		TLSKeyFile:                 env("TLS_KEY_FILE", ""),
+		AutocertHosts:              env("AUTOCERT_HOSTS", ""),
+		AutocertEmail:              env("AUTOCERT_EMAIL", ""),
+		AutocertCacheDir:           env("AUTOCERT_CACHE_DIR", "certs"),
+		AutocertDirectoryURL:       env("AUTOCERT_DIRECTORY_URL", ""),
+		HTTPRedirectAddr:           env("HTTP_REDIRECT_ADDR", ":80"),
+		DebugAddr:                  env("DEBUG_ADDR", ""),
+		IntegrationsCritical:       env("INTEGRATIONS_CRITICAL", ""),
+		LeaderElection:             env_bool("LEADER_ELECTION", false),
+		LeaderLeaseTTL:             env_duration("LEADER_LEASE_TTL", 15*time.Second),
+		ShutdownDrainDelay:         env_duration("SHUTDOWN_DRAIN_DELAY", 0),
+		MaxBodyBytes:               int64(env_int("MAX_BODY_BYTES", 1<<20)),
+		AllowedContentTypes:        env("ALLOWED_CONTENT_TYPES", "application/json,application/msgpack,application/x-msgpack"),
+		CompressEncodings:          env("COMPRESS_ENCODINGS", "zstd,gzip"),
+		LegacyDeprecatedAt:         env("LEGACY_DEPRECATED_AT", "2026-10-15"),
+		LegacySunset:               env("LEGACY_SUNSET", "2027-04-15"),
+		PhoneDefaultRegion:         env("PHONE_DEFAULT_REGION", ""),
+		EmailFoldGmail:             env_bool("EMAIL_FOLD_GMAIL", false),
+		EmailCheckMX:               env_bool("EMAIL_CHECK_MX", false),
+		DisposableEmail:            env("DISPOSABLE_EMAIL", "flag"),
+		DisposableDomainsURL:       env("DISPOSABLE_DOMAINS_URL", ""),
+		DisposableDomainsRefresh:   env_duration("DISPOSABLE_DOMAINS_REFRESH", 24*time.Hour),
+		PIIEncryptionKey:           env("PII_ENCRYPTION_KEY", ""),
+		PIIPreviousKey:             env("PII_ENCRYPTION_PREVIOUS_KEY", ""),
+		PIIRotateBatchSize:         env_int("PII_ROTATE_BATCH_SIZE", 500),
+		DatabasePassphrase:         env("DATABASE_PASSPHRASE", ""),
+		TenantIsolation:            env("TENANT_ISOLATION", "row"),
+		TenantDatabaseDir:          env("TENANT_DATABASE_DIR", "./tenants"),
+		PublicURL:                  env("PUBLIC_URL", "http://localhost:3000"),
+		SMTPAddr:                   env("SMTP_ADDR", ""),
+		SMTPUsername:               env("SMTP_USERNAME", ""),
+		SMTPPassword:               env("SMTP_PASSWORD", ""),
+		SMTPFrom:                   env("SMTP_FROM", "no-reply@localhost"),
+		VerificationTokenTTL:       env_duration("VERIFICATION_TOKEN_TTL", 24*time.Hour),
+		VerificationResendInterval: env_duration("VERIFICATION_RESEND_INTERVAL", time.Minute),
+		BlobStore:                  env("BLOB_STORE", "disk"),
+		BlobDir:                    env("BLOB_DIR", "./blobs"),
+		S3Endpoint:                 env("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Bucket:                   env("S3_BUCKET", ""),
+		S3Region:                   env("S3_REGION", "us-east-1"),
+		S3AccessKeyID:              env("S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey:          env("S3_SECRET_ACCESS_KEY", ""),
+		AttachmentMaxBytes:         int64(env_int("ATTACHMENT_MAX_BYTES", 20<<20)),
+		ImportMaxBytes:             int64(env_int("IMPORT_MAX_BYTES", 100<<20)),
+		AttachmentContentTypes:     env("ATTACHMENT_CONTENT_TYPES", "application/pdf,image/jpeg,image/png,text/plain,application/vnd.openxmlformats-officedocument.wordprocessingml.document"),
+		AvatarMaxBytes:             int64(env_int("AVATAR_MAX_BYTES", 5<<20)),
+		CompressMinBytes:           env_int("COMPRESS_MIN_BYTES", 1024),
+		ReadHeaderTimeout:          env_duration("READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:                env_duration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:               env_duration("WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:                env_duration("IDLE_TIMEOUT", 2*time.Minute),
+		SentryDSN:                  env("SENTRY_DSN", ""),
+		SentryEnvironment:          env("SENTRY_ENVIRONMENT", "production"),
+		FieldPolicyFile:            env("FIELD_POLICY_FILE", ""),
+		FixturesFile:               env("FIXTURES_FILE", ""),
+		CustomerQuota:              int64(env_int("CUSTOMER_QUOTA", 0)),
+		ExportRequireEncryption:    env_bool("EXPORT_REQUIRE_ENCRYPTION", false),
+		ExportLinkTTL:              env_duration("EXPORT_LINK_TTL", 24*time.Hour),
+		MaxPageLimit:               env_int("MAX_PAGE_LIMIT", 100),
+		ListingExcludeArchived:     env_bool("LISTING_EXCLUDE_ARCHIVED", true),
+		ListingExcludeUnverified:   env_bool("LISTING_EXCLUDE_UNVERIFIED", false),
+		ListingOnlyActive:          env_bool("LISTING_ONLY_ACTIVE", false),
+		StorageQuotaBytes:          int64(env_int("STORAGE_QUOTA_BYTES", 0)),
+		WarehouseSink:              env("WAREHOUSE_SINK", ""),
+		WarehouseInterval:          env_duration("WAREHOUSE_INTERVAL", time.Minute),
+		WarehouseBatchSize:         env_int("WAREHOUSE_BATCH_SIZE", 500),
+		WarehouseBackfill:          env_bool("WAREHOUSE_BACKFILL", false),
+		ClickHouseURL:              env("CLICKHOUSE_URL", "http://localhost:8123"),
+		ClickHouseUser:             env("CLICKHOUSE_USER", "default"),
+		ClickHousePassword:         env("CLICKHOUSE_PASSWORD", ""),
+		ClickHouseTable:            env("CLICKHOUSE_TABLE", "customer_events"),
+		BigQueryProject:            env("BIGQUERY_PROJECT", ""),
+		BigQueryDataset:            env("BIGQUERY_DATASET", ""),
+		BigQueryTable:              env("BIGQUERY_TABLE", "customer_events"),
+		BigQueryCredentialsFile:    env("BIGQUERY_CREDENTIALS_FILE", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")),
+		WebhookInterval:            env_duration("WEBHOOK_INTERVAL", 5*time.Second),
+		WebhookMaxBackoff:          env_duration("WEBHOOK_MAX_BACKOFF", time.Hour),
+		WebhookTimeout:             env_duration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookBatchSize:           env_int("WEBHOOK_BATCH_SIZE", 100),
+		WebhookConcurrency:         env_int("WEBHOOK_CONCURRENCY", 16),
+		WebhookDisableAfterDays:    env_int("WEBHOOK_DISABLE_AFTER_DAYS", 3),
+		RulesInterval:              env_duration("RULES_INTERVAL", 5*time.Second),
+		AnonymizeGracePeriod:       env_duration("ANONYMIZE_GRACE_PERIOD", 0),
+		AnonymizeInterval:          env_duration("ANONYMIZE_INTERVAL", time.Minute),
+		JobWorkers:                 env_int("JOB_WORKERS", 4),
+		JobPollInterval:            env_duration("JOB_POLL_INTERVAL", time.Second),
+		JobLease:                   env_duration("JOB_LEASE", 5*time.Minute),
+		JobMaxAttempts:             env_int("JOB_MAX_ATTEMPTS", 5),
+		JobBackoff:                 env_duration("JOB_BACKOFF", 10*time.Second),
+		AnalyzeSchedule:            env("ANALYZE_SCHEDULE", "0 3 * * *"),
+		VacuumSchedule:             env("VACUUM_SCHEDULE", "0 4 * * 0"),
+		ArchivePurgeSchedule:       env("ARCHIVE_PURGE_SCHEDULE", "30 3 * * *"),
+		ArchiveRetention:           env_duration("ARCHIVE_RETENTION", 0),
+		AuditPruneSchedule:         env("AUDIT_PRUNE_SCHEDULE", "0 2 * * *"),
+		AuditRetention:             env_duration("AUDIT_RETENTION", 0),
+		EventPruneSchedule:         env("EVENT_PRUNE_SCHEDULE", "15 2 * * *"),
+		EventRetention:             env_duration("EVENT_RETENTION", 0),
+		BackupStore:                env("BACKUP_STORE", "disk"),
+		BackupDir:                  env("BACKUP_DIR", "./backups"),
+		BackupS3Bucket:             env("BACKUP_S3_BUCKET", ""),
+		BackupSchedule:             env("BACKUP_SCHEDULE", "off"),
+		BackupKeep:                 env_int("BACKUP_KEEP", 7),
+		ReplicaStore:               env("REPLICA_STORE", ""),
+		ReplicaDir:                 env("REPLICA_DIR", "./replica"),
+		ReplicaS3Bucket:            env("REPLICA_S3_BUCKET", ""),
+		ReplicaSyncInterval:        env_duration("REPLICA_SYNC_INTERVAL", time.Second),
+		ReplicaCheckpointInterval:  env_duration("REPLICA_CHECKPOINT_INTERVAL", time.Minute),
+		ReplicaSnapshotInterval:    env_duration("REPLICA_SNAPSHOT_INTERVAL", 24*time.Hour),
+		ReplicaRetention:           env_duration("REPLICA_RETENTION", 72*time.Hour),
+		ReadOnly:                   env_bool("READ_ONLY", false),
+		ReadOnlyRetryAfter:         env_duration("READ_ONLY_RETRY_AFTER", time.Minute),
+		ReadOnlyDrainTimeout:       env_duration("READ_ONLY_DRAIN_TIMEOUT", 30*time.Second),
+		HtmxURL:                    env("HTMX_URL", "https://unpkg.com/htmx.org@2.0.4/dist/htmx.min.js"),
+		HtmxIntegrity:              env("HTMX_INTEGRITY", "sha384-HGfztofotfshcF7+8n44JQL2oJmowVChPTg48S+jvZoztPfvwD79OC/LTtG6dMp+"),
+		GenerateEnabled:            env_bool("GENERATE_ENABLED", false),
+		GenerateMaxCount:           env_int("GENERATE_MAX_COUNT", 10000),
+		EventBus:                   env("EVENT_BUS", ""),
+		EventBusInterval:           env_duration("EVENT_BUS_INTERVAL", 5*time.Second),
+		EventBusBatchSize:          env_int("EVENT_BUS_BATCH_SIZE", 100),
+		NatsURL:                    env("NATS_URL", "nats://127.0.0.1:4222"),
+		NatsSubject:                env("NATS_SUBJECT", "customers.events"),
+		KafkaBrokers:               env("KAFKA_BROKERS", "localhost:9092"),
+		KafkaTopic:                 env("KAFKA_TOPIC", "customer-events"),
+	}
+}
+
+func env(key string, fallback string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+func env_int(key string, fallback int) int {
+	value, err := strconv.Atoi(env(key, ""))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+func env_bool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(env(key, ""))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+func env_duration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(env(key, ""))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
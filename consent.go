@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	EventConsentGranted = "customer.consent_granted"
+	EventConsentRevoked = "customer.consent_revoked"
+)
+
+// consent_purposes are what a customer can consent to
+var consent_purposes = map[string]bool{
+	"marketing_email": true,
+	"sms":             true,
+	"data_processing": true,
+}
+
+// Consent is the customer's current answer for one purpose. A purpose never recorded has no consent
+type Consent struct {
+	CustomerID int64   `json:"customer_id"`
+	Purpose    string  `json:"purpose"`
+	Granted    bool    `json:"granted"`
+	Source     string  `json:"source"` // where the answer was given, e.g. signup_form or support_call
+	RecordedBy string  `json:"recorded_by"`
+	GrantedAt  *string `json:"granted_at"` // the latest grant, kept after a revocation
+	RevokedAt  *string `json:"revoked_at"` // set while revoked
+	UpdatedAt  string  `json:"updated_at"`
+}
+
+type ConsentDetails struct {
+	Granted *bool  `json:"granted"`
+	Source  string `json:"source"`
+}
+
+func validate_consent(input *ConsentDetails) error {
+	if input.Granted == nil {
+		return &ValidationError{Field: "granted", Message: "is required"}
+	}
+
+	input.Source = strings.TrimSpace(input.Source)
+	if input.Source == "" {
+		return &ValidationError{Field: "source", Message: "is required"}
+	}
+
+	return nil
+}
+
+// listing_consents reads ?consent=marketing_email,sms, customers must have granted every purpose
+func listing_consents(r *http.Request) ([]string, error) {
+	purposes := split_list(r.URL.Query().Get("consent"))
+	for _, purpose := range purposes {
+		if !consent_purposes[purpose] {
+			return nil, &ValidationError{Field: "consent", Message: "unknown purpose " + purpose}
+		}
+	}
+
+	return purposes, nil
+}
+
+func register_consent_routes(mux *http.ServeMux, db *sql.DB) {
+	// the customer's recorded consents by purpose
+	mux.HandleFunc("GET /api/customers/{id}/consents", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		consents, err := get_consents(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Consent]{Data: consents})
+	})
+
+	// record that the customer granted or revoked consent for the purpose, and where
+	mux.HandleFunc("PUT /api/customers/{id}/consents/{purpose}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		purpose := r.PathValue("purpose")
+		if !consent_purposes[purpose] {
+			http.Error(w, "Purpose must be marketing_email, sms or data_processing", http.StatusBadRequest)
+			return
+		}
+
+		var req ConsentDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_consent(&req)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		consent, err := set_consent(db, id, purpose, req, actor_from(r))
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Consent]{Data: *consent})
+	}))
+}
+
+// #region Database
+const consent_columns = `customer_id, purpose, granted, source, recorded_by, strftime('%Y-%m-%dT%H:%M:%SZ', granted_at), strftime('%Y-%m-%dT%H:%M:%SZ', revoked_at), strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)`
+
+func scan_consent(row row_scanner) (Consent, error) {
+	var consent Consent
+	err := row.Scan(&consent.CustomerID, &consent.Purpose, &consent.Granted, &consent.Source, &consent.RecordedBy, &consent.GrantedAt, &consent.RevokedAt, &consent.UpdatedAt)
+	return consent, err
+}
+
+func get_consents(db *sql.DB, customer_id int64) ([]Consent, error) {
+	rows, err := db.Query(`SELECT `+consent_columns+` FROM customer_consents WHERE customer_id = ? ORDER BY purpose;`, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	consents := []Consent{}
+	for rows.Next() {
+		consent, err := scan_consent(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		consents = append(consents, consent)
+	}
+
+	return consents, rows.Err()
+}
+
+// set_consent records the answer, each grant or revocation is kept as an event for proof of consent
+func set_consent(db *sql.DB, customer_id int64, purpose string, input ConsentDetails, actor string) (*Consent, error) {
+	upsert_record := `
+	INSERT INTO customer_consents (customer_id, purpose, granted, source, recorded_by, granted_at, revoked_at)
+	VALUES (?, ?, ?, ?, ?, CASE WHEN ? THEN CURRENT_TIMESTAMP END, CASE WHEN ? THEN NULL ELSE CURRENT_TIMESTAMP END)
+	ON CONFLICT (customer_id, purpose) DO UPDATE SET
+		granted = excluded.granted, source = excluded.source, recorded_by = excluded.recorded_by,
+		granted_at = COALESCE(excluded.granted_at, granted_at), revoked_at = excluded.revoked_at, updated_at = CURRENT_TIMESTAMP
+	RETURNING ` + consent_columns + `;
+	`
+
+	var consent Consent
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		_, err := get_customer_status(tx, customer_id)
+		if err != nil {
+			return err
+		}
+
+		consent, err = scan_consent(tx.QueryRow(upsert_record, customer_id, purpose, *input.Granted, input.Source, actor, *input.Granted, *input.Granted))
+		if err != nil {
+			return err
+		}
+
+		event_type := EventConsentGranted
+		if !consent.Granted {
+			event_type = EventConsentRevoked
+		}
+
+		event, err = record_event(tx, event_type, customer_id, consent)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	event_broker.Publish(*event)
+
+	return &consent, nil
+}
+
+// #endregion
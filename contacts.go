@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var contact_labels = map[string]bool{
+	"work":   true,
+	"home":   true,
+	"mobile": true,
+	"other":  true,
+}
+
+// ContactPoint is one of a customer's emails or phone numbers. customer_contact_points holds them all,
+// the email and contact columns keep a copy of the primary ones for lookups and older clients. The values
+// are encrypted as those columns are, value_index is their blind index
+type ContactPoint struct {
+	Label   string `json:"label"` // work, home, mobile or other
+	Value   string `json:"value"`
+	Primary bool   `json:"primary"`
+}
+
+// contact_point_columns read a customer's emails and phones as json arrays, primary first
+const contact_point_columns = `
+	(SELECT json_group_array(json_object('label', label, 'value', value, 'primary', json(CASE WHEN is_primary THEN 'true' ELSE 'false' END)))
+	FROM (SELECT * FROM customer_contact_points WHERE customer_id = customers.id AND kind = 'email' ORDER BY is_primary DESC, id)),
+	(SELECT json_group_array(json_object('label', label, 'value', value, 'primary', json(CASE WHEN is_primary THEN 'true' ELSE 'false' END)))
+	FROM (SELECT * FROM customer_contact_points WHERE customer_id = customers.id AND kind = 'phone' ORDER BY is_primary DESC, id))`
+
+// contact_field_points are the list fields that hold more of a single contact field, a policy hiding
+// the field hides its list as well
+var contact_field_points = map[string]string{
+	"email":   "emails",
+	"contact": "phones",
+}
+
+// contact_point_kinds are the customers columns whose key the points of a kind are sealed and indexed with,
+// so a primary point has the same blind index as its copy
+var contact_point_kinds = map[string]string{
+	"email": "email",
+	"phone": "contact",
+}
+
+// normalize_contact_points checks the labels, normalizes and dedupes the values and picks the primary,
+// which primary names when set. field is the request field for errors. It returns the primary value
+func normalize_contact_points(points []ContactPoint, primary string, field string, normalize func(string) (string, error)) ([]ContactPoint, string, error) {
+	seen := map[string]bool{}
+	normalized := []ContactPoint{}
+	primaries := 0
+	for _, point := range points {
+		point.Label = strings.ToLower(strings.TrimSpace(point.Label))
+		if point.Label == "" {
+			point.Label = "other"
+		}
+		if !contact_labels[point.Label] {
+			return nil, "", &ValidationError{Field: field, Message: "labels must be work, home, mobile or other"}
+		}
+
+		value, err := normalize(point.Value)
+		if err != nil {
+			var validation_error *ValidationError
+			if errors.As(err, &validation_error) {
+				return nil, "", &ValidationError{Field: field, Message: point.Value + ": " + validation_error.Message}
+			}
+			return nil, "", err
+		}
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+
+		point.Value = value
+		if primary != "" {
+			point.Primary = value == primary
+		}
+		if point.Primary {
+			primaries++
+		}
+		normalized = append(normalized, point)
+	}
+
+	if primary != "" && !seen[primary] {
+		return nil, "", &ValidationError{Field: field, Message: "must include " + primary}
+	}
+	if primaries > 1 {
+		return nil, "", &ValidationError{Field: field, Message: "only one can be primary"}
+	}
+	if primaries == 0 && len(normalized) > 0 {
+		normalized[0].Primary = true
+	}
+
+	for _, point := range normalized {
+		if point.Primary {
+			return normalized, point.Value, nil
+		}
+	}
+
+	return normalized, "", nil
+}
+
+// validate_contact_points normalizes emails and phones when given, setting email and contact to their
+// primaries. Without them email and contact work as they always have
+func validate_contact_points(ctx context.Context, input *CustomerDetails) error {
+	if input.Emails != nil {
+		emails, email, err := normalize_contact_points(*input.Emails, input.Email, "emails", func(value string) (string, error) {
+			return normalize_email(ctx, value)
+		})
+		if err != nil {
+			return err
+		}
+		input.Emails, input.Email = &emails, email
+	}
+
+	if input.Phones != nil {
+		phones, contact, err := normalize_contact_points(*input.Phones, input.Contact, "phones", func(value string) (string, error) {
+			return normalize_phone(value, input.Country)
+		})
+		if err != nil {
+			return err
+		}
+		input.Phones, input.Contact = &phones, contact
+	}
+
+	return nil
+}
+
+// #region Database
+
+// save_contact_points replaces the customer's points of kind with points. When points is nil, as for clients
+// that only send email and contact, primary replaces the primary point and the rest are kept. An empty
+// primary removes it
+func save_contact_points(tx *sql.Tx, customer_id int64, kind string, primary string, points *[]ContactPoint) error {
+	field := contact_point_kinds[kind]
+	if points != nil {
+		_, err := tx.Exec(`DELETE FROM customer_contact_points WHERE customer_id = ? AND kind = ?;`, customer_id, kind)
+		if err != nil {
+			return err
+		}
+
+		for _, point := range *points {
+			sealed, err := encrypt_pii(field, point.Value)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`INSERT INTO customer_contact_points (customer_id, kind, label, value, value_index, is_primary) VALUES (?, ?, ?, ?, ?, ?);`, customer_id, kind, point.Label, sealed, pii_index(field, point.Value), point.Primary)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	index := pii_index(field, primary)
+	_, err := tx.Exec(`DELETE FROM customer_contact_points WHERE customer_id = ? AND kind = ? AND is_primary = 1 AND value_index != ?;`, customer_id, kind, index)
+	if err != nil || primary == "" {
+		return err
+	}
+
+	sealed, err := encrypt_pii(field, primary)
+	if err != nil {
+		return err
+	}
+
+	// a value that was already one of the other points is promoted
+	upsert_record := `
+	INSERT INTO customer_contact_points (customer_id, kind, label, value, value_index, is_primary)
+	VALUES (?, ?, 'other', ?, ?, 1)
+	ON CONFLICT (customer_id, kind, value_index) DO UPDATE SET is_primary = 1;
+	`
+
+	_, err = tx.Exec(upsert_record, customer_id, kind, sealed, index)
+	return err
+}
+
+// scan_contact_points reads a contact_point_columns array of the points of kind
+func scan_contact_points(points_str string, kind string) ([]ContactPoint, error) {
+	points := []ContactPoint{}
+	if points_str == "" {
+		return points, nil
+	}
+
+	err := json.Unmarshal([]byte(points_str), &points)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range points {
+		points[i].Value, err = decrypt_pii(contact_point_kinds[kind], points[i].Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return points, nil
+}
+
+// #endregion
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cors lets browsers on the configured origins call the api, CORS_ALLOWED_ORIGINS is a comma separated
+// list where * allows any origin
+func cors(config Config, next http.HandlerFunc) http.HandlerFunc {
+	origins := map[string]bool{}
+	for _, origin := range strings.Split(config.CorsAllowedOrigins, ",") {
+		origins[strings.TrimSuffix(strings.TrimSpace(origin), "/")] = true
+	}
+	max_age := strconv.Itoa(int(config.CorsMaxAge.Seconds()))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// the answer depends on the origin, caches must not share it between origins
+		w.Header().Add("Vary", "Origin")
+
+		if origin != "" && (origins[origin] || origins["*"]) {
+			// credentials are never allowed with a wildcard, the browser would reject it anyway
+			if config.CorsAllowCredentials && origins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			} else if origins["*"] {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", config.CorsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", config.CorsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", max_age)
+			} else if config.CorsExposedHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", config.CorsExposedHeaders)
+			}
+		}
+
+		// preflights never reach auth, a disallowed origin just gets no cors headers
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
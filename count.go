@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// estimate_sample_size is how many of the newest customers an estimated count reads
+const estimate_sample_size = 1000
+
+type CustomerCount struct {
+	Count     int  `json:"count"`
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// listing_total counts the listing from the count cache, or with ?estimate=true from a sample of it
+func listing_total(db *sql.DB, r *http.Request, scope ListingScope) (int, bool, error) {
+	if r.URL.Query().Get("estimate") == "true" {
+		return estimate_total_customers(db, scope)
+	}
+
+	count, err := get_cached_total_customers(db, scope)
+	return count, false, err
+}
+
+func set_total_count_header(w http.ResponseWriter, count int, estimated bool) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(count))
+	if estimated {
+		w.Header().Set("X-Total-Count-Estimated", "true")
+	}
+}
+
+func register_count_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// how many customers the listing filters select, without reading them
+	mux.HandleFunc("GET /api/customers/count", func(w http.ResponseWriter, r *http.Request) {
+		scope, err := filtered_listing_scope(config, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		count, estimated, err := listing_total(db, r, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response_str, err := json.Marshal(ApiResponse[CustomerCount]{Data: CustomerCount{Count: count, Estimated: estimated}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		set_total_count_header(w, count, estimated)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	})
+
+	// the count of the listing as X-Total-Count, for badges that don't need the page
+	mux.HandleFunc("HEAD /api/customers", func(w http.ResponseWriter, r *http.Request) {
+		scope, err := filtered_listing_scope(config, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		count, estimated, err := listing_total(db, r, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		set_total_count_header(w, count, estimated)
+		w.Header().Set("Content-Type", "application/json")
+	})
+}
+
+// #region Database
+
+// estimate_total_customers scales the share of the newest customers the scope selects up to the total the
+// customer_counts triggers keep. Scopes with nothing but the tenant, and tenants smaller than the sample, are counted exactly
+func estimate_total_customers(db *sql.DB, scope ListingScope) (int, bool, error) {
+	var total int
+	err := db.QueryRow(`SELECT COALESCE(SUM(count), 0) FROM customer_counts WHERE dimension = 'total' AND (?1 = '' OR tenant_id = ?1);`, scope.TenantID).Scan(&total)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if scope.where_is_tenant_only() {
+		return total, false, nil
+	}
+
+	if total <= estimate_sample_size {
+		count, err := get_total_customers(db, scope)
+		return count, false, err
+	}
+
+	where, args := scope.where()
+	get_sample := `
+	SELECT COUNT(*)
+	FROM (
+		SELECT * FROM customers WHERE ?1 = '' OR tenant_id = ?1 ORDER BY id DESC LIMIT ?2
+	) AS customers
+	` + where + `;
+	`
+
+	var matches int
+	err = db.QueryRow(get_sample, append([]any{scope.TenantID, estimate_sample_size}, args...)...).Scan(&matches)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return matches * total / estimate_sample_size, true, nil
+}
+
+// #endregion
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// dashboard_refresh is how often the dashboard reloads itself, in seconds
+const dashboard_refresh = 15
+
+// dashboard_rate_window is how far back the request and error rates are averaged
+const dashboard_rate_window = 5 * time.Minute
+
+// dashboard_audit_entries is how many of the latest writes the dashboard lists
+const dashboard_audit_entries = 20
+
+// Dashboard is what /admin/dashboard shows, the figures of this process and the main database
+type Dashboard struct {
+	AdminPage
+	GeneratedAt string
+	Uptime      time.Duration
+
+	RequestsPerSecond float64
+	ErrorRate         float64 // percent of the responses that were 5xx
+	ClientErrorRate   float64 // percent that were 4xx
+	Minutes           []RequestMinute
+	BusiestMinute     int64 // the most requests in one of Minutes, for the bars
+
+	DatabaseBytes  int64
+	FreeBytes      int64 // pages deletes freed, a vacuum returns them
+	DatabaseUp     bool
+	PingLatency    time.Duration
+	BusyRetries    int64
+	OpenConns      int
+	InUseConns     int
+	ReadOnly       bool
+	JobQueue       []JobQueueDepth
+	OldestQueued   string // when the longest waiting due job was queued, empty when none waits
+	RecentAudit    []AuditLog
+	TenantDatabase bool // TENANT_ISOLATION=database, the figures above are of the main database only
+}
+
+// JobQueueDepth is how many jobs are in a status, across tenants
+type JobQueueDepth struct {
+	Status string
+	Count  int
+}
+
+func (d Dashboard) UptimeText() string {
+	return d.Uptime.Truncate(time.Second).String()
+}
+
+func register_dashboard_routes(mux *http.ServeMux, db *sql.DB, config Config, maintenance_mode *ReadOnlyMode) {
+	// the figures to check when something seems off, without a metrics stack
+	mux.HandleFunc("GET /admin/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		page := new_admin_page(config, r, "Dashboard")
+		page.Refresh = dashboard_refresh
+
+		dashboard := Dashboard{
+			AdminPage:      page,
+			GeneratedAt:    now.UTC().Format("2006-01-02 15:04:05 UTC"),
+			Uptime:         now.Sub(request_metrics.started),
+			Minutes:        request_metrics.recent(now),
+			DatabaseUp:     storage_metrics.ping_up.Load(),
+			PingLatency:    time.Duration(storage_metrics.ping_latency_ns.Load()).Round(time.Microsecond),
+			BusyRetries:    storage_metrics.busy_retries.Load(),
+			ReadOnly:       maintenance_mode.Get().ReadOnly,
+			TenantDatabase: tenant_databases != nil,
+		}
+
+		stats := db.Stats()
+		dashboard.OpenConns, dashboard.InUseConns = stats.OpenConnections, stats.InUse
+
+		// the rates average the minutes within the window, or the time since startup when that is shorter
+		var requests, client_errors, server_errors int64
+		since := now.Add(-dashboard_rate_window)
+		for _, minute := range dashboard.Minutes {
+			dashboard.BusiestMinute = max(dashboard.BusiestMinute, minute.Requests)
+			if minute.Start.Add(time.Minute).After(since) {
+				requests += minute.Requests
+				client_errors += minute.ClientErrors
+				server_errors += minute.ServerErrors
+			}
+		}
+		if requests > 0 {
+			dashboard.RequestsPerSecond = float64(requests) / min(dashboard_rate_window, dashboard.Uptime).Seconds()
+			dashboard.ErrorRate = 100 * float64(server_errors) / float64(requests)
+			dashboard.ClientErrorRate = 100 * float64(client_errors) / float64(requests)
+		}
+
+		var err error
+		dashboard.DatabaseBytes, err = get_database_size(db)
+		if err == nil {
+			dashboard.FreeBytes, err = get_database_free_bytes(db)
+		}
+		if err == nil {
+			dashboard.JobQueue, dashboard.OldestQueued, err = get_job_queue_depth(db, now)
+		}
+		if err == nil {
+			dashboard.RecentAudit, err = get_recent_audit_logs(db, dashboard_audit_entries)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_admin_page(w, "dashboard.html", dashboard)
+	})
+}
+
+// #region Database
+
+func get_database_free_bytes(db *sql.DB) (int64, error) {
+	var free int64
+	err := db.QueryRow(`SELECT freelist_count * page_size FROM pragma_freelist_count(), pragma_page_size();`).Scan(&free)
+	return free, err
+}
+
+// get_job_queue_depth counts the jobs of every tenant by status and finds the longest a due job has waited
+func get_job_queue_depth(db *sql.DB, now time.Time) ([]JobQueueDepth, string, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM jobs GROUP BY status ORDER BY status;`)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer rows.Close()
+
+	depths := []JobQueueDepth{}
+	for rows.Next() {
+		var depth JobQueueDepth
+		err = rows.Scan(&depth.Status, &depth.Count)
+		if err != nil {
+			return nil, "", err
+		}
+
+		depths = append(depths, depth)
+	}
+
+	if rows.Err() != nil {
+		return nil, "", rows.Err()
+	}
+
+	var oldest sql.NullString
+	err = db.QueryRow(`SELECT strftime('%Y-%m-%dT%H:%M:%SZ', MIN(created_at)) FROM jobs WHERE status = 'queued' AND run_at <= ?;`, now.UnixMilli()).Scan(&oldest)
+	return depths, oldest.String, err
+}
+
+// get_recent_audit_logs reads the latest writes of every tenant, newest first
+func get_recent_audit_logs(db *sql.DB, limit int) ([]AuditLog, error) {
+	rows, err := db.Query(`SELECT `+audit_log_columns+` FROM audit_logs ORDER BY id DESC LIMIT ?;`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []AuditLog{}
+	for rows.Next() {
+		entry, err := scan_audit_log(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// #endregion
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	_ "github.com/ncruces/go-sqlite3/vfs/adiantum"
+)
+
+// plaintext_header starts every unencrypted sqlite file
+const plaintext_header = "SQLite format 3\x00"
+
+// encrypted_dsn opens path through the adiantum vfs, which encrypts every page of the database and its
+// wal with a key derived from passphrase. Modernc has no codec, so encrypted files use the wasm build of
+// sqlite registered as sqlite3. The format is adiantum's, not sqlcipher's, the sqlcipher cli can't read it
+func encrypted_dsn(path string, passphrase string) string {
+	return "file:" + path + "?vfs=adiantum&textkey=" + url.QueryEscape(passphrase)
+}
+
+// is_plaintext_database is true when path holds an unencrypted sqlite file, false when it is encrypted,
+// missing or empty
+func is_plaintext_database(path string) (bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(plaintext_header))
+	_, err = io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+
+	return bytes.Equal(header, []byte(plaintext_header)), err
+}
+
+// prepare_database_file converts a plaintext database at path to encrypted form when DATABASE_PASSPHRASE
+// is set. Without a passphrase it refuses an encrypted file rather than failing later on the first query
+func prepare_database_file(path string, passphrase string) error {
+	plaintext, err := is_plaintext_database(path)
+	if err != nil {
+		return err
+	}
+
+	if passphrase == "" {
+		info, err := os.Stat(path)
+		if err == nil && info.Size() > 0 && !plaintext {
+			return errors.New(path + " is encrypted, DATABASE_PASSPHRASE is required")
+		}
+		return nil
+	}
+
+	if !plaintext {
+		return nil
+	}
+
+	println("encrypting " + path)
+	return encrypt_database_file(path, passphrase)
+}
+
+// encrypt_database_file copies the plaintext database into an encrypted file next to it and swaps it in
+// once the copy checks out, so an interrupted conversion leaves the plaintext database as it was
+func encrypt_database_file(path string, passphrase string) error {
+	encrypting := path + ".encrypting"
+	os.Remove(encrypting)
+
+	plain_db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		return err
+	}
+
+	_, err = plain_db.Exec(`VACUUM INTO ?;`, encrypted_dsn(encrypting, passphrase))
+	// closing checkpoints the plaintext wal into the file it is about to replace
+	close_err := plain_db.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = check_database(encrypted_dsn(encrypting, passphrase))
+	}
+	if err != nil {
+		os.Remove(encrypting)
+		return errors.New("encrypting " + path + ": " + err.Error())
+	}
+
+	// a wal left behind would be replayed onto the encrypted file
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err = os.Remove(path + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(encrypting, path)
+}
+
+func check_database(dsn string) error {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow(`PRAGMA quick_check;`).Scan(&result)
+	if err == nil && result != "ok" {
+		err = errors.New(result)
+	}
+
+	return err
+}
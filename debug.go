@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtime_pprof "runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+)
+
+var started_at = time.Now()
+
+type RuntimeStats struct {
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	Goroutines    int   `json:"goroutines"`
+	GOMAXPROCS    int   `json:"gomaxprocs"`
+	NumCPU        int   `json:"num_cpu"`
+	CgoCalls      int64 `json:"cgo_calls"`
+
+	HeapAllocBytes    uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes    uint64 `json:"heap_inuse_bytes"`
+	HeapIdleBytes     uint64 `json:"heap_idle_bytes"`
+	HeapReleasedBytes uint64 `json:"heap_released_bytes"`
+	HeapObjects       uint64 `json:"heap_objects"`
+	TotalAllocBytes   uint64 `json:"total_alloc_bytes"`
+	SysBytes          uint64 `json:"sys_bytes"`
+	StackInuseBytes   uint64 `json:"stack_inuse_bytes"`
+
+	NumGC         uint32  `json:"num_gc"`
+	NextGCBytes   uint64  `json:"next_gc_bytes"`
+	LastGC        string  `json:"last_gc,omitempty"`
+	LastPauseNs   uint64  `json:"last_pause_ns"`
+	PauseTotalNs  uint64  `json:"pause_total_ns"`
+	GCCPUFraction float64 `json:"gc_cpu_fraction"`
+}
+
+func runtime_stats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := RuntimeStats{
+		UptimeSeconds:     int64(time.Since(started_at).Seconds()),
+		Goroutines:        runtime.NumGoroutine(),
+		GOMAXPROCS:        runtime.GOMAXPROCS(0),
+		NumCPU:            runtime.NumCPU(),
+		CgoCalls:          runtime.NumCgoCall(),
+		HeapAllocBytes:    mem.HeapAlloc,
+		HeapInuseBytes:    mem.HeapInuse,
+		HeapIdleBytes:     mem.HeapIdle,
+		HeapReleasedBytes: mem.HeapReleased,
+		HeapObjects:       mem.HeapObjects,
+		TotalAllocBytes:   mem.TotalAlloc,
+		SysBytes:          mem.Sys,
+		StackInuseBytes:   mem.StackInuse,
+		NumGC:             mem.NumGC,
+		NextGCBytes:       mem.NextGC,
+		PauseTotalNs:      mem.PauseTotalNs,
+		GCCPUFraction:     mem.GCCPUFraction,
+	}
+
+	if mem.NumGC > 0 {
+		stats.LastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339Nano)
+		stats.LastPauseNs = mem.PauseNs[(mem.NumGC+255)%256]
+	}
+
+	return stats
+}
+
+// new_debug_mux serves pprof under /debug/pprof/ and runtime stats at /debug/runtime, with the given cpu
+// profile and trace handlers
+func new_debug_mux(profile http.HandlerFunc, trace http.HandlerFunc) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", trace)
+
+	mux.HandleFunc("GET /debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		response_str, err := json.Marshal(ApiResponse[RuntimeStats]{Data: runtime_stats()})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(response_str)
+	})
+
+	return mux
+}
+
+func register_debug_routes(mux *http.ServeMux) {
+	// pprof's profile and trace refuse a ?seconds= beyond the server's WRITE_TIMEOUT, these record as long as
+	// asked with the response deadline cleared
+	debug_mux := new_debug_mux(
+		record_profile("profile", 30, runtime_pprof.StartCPUProfile, runtime_pprof.StopCPUProfile),
+		record_profile("trace", 1, trace.Start, trace.Stop),
+	)
+
+	// the admin prefix puts profiling behind admin auth, pprof expects its paths to start at /debug/pprof/
+	mux.Handle("/api/admin/debug/", http.StripPrefix("/api/admin", debug_mux))
+}
+
+// record_profile answers as pprof.Profile and pprof.Trace do, recording for ?seconds= or default_seconds
+// until the client goes away
+func record_profile(name string, default_seconds float64, start func(w io.Writer) error, stop func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seconds, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
+		if err != nil || seconds <= 0 {
+			seconds = default_seconds
+		}
+
+		clear_deadlines(w)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+		err = start(w)
+		if err != nil {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "Could not enable "+name+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(seconds * float64(time.Second))):
+		case <-r.Context().Done():
+		}
+		stop()
+	}
+}
+
+// new_debug_server serves the debug routes without auth on DEBUG_ADDR, meant to be bound to
+// localhost or a private interface, nil when it isn't configured
+func new_debug_server(config Config) *http.Server {
+	if config.DebugAddr == "" {
+		return nil
+	}
+
+	return &http.Server{
+		Addr:              config.DebugAddr,
+		Handler:           new_debug_mux(pprof.Profile, pprof.Trace),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed disposable_domains.txt
+var embedded_disposable_domains string
+
+// DisposableDomains is the blocklist of throwaway mailbox providers, the embedded list until a refresh replaces it
+type DisposableDomains struct {
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+var disposable_domains = &DisposableDomains{domains: parse_domain_list(strings.NewReader(embedded_disposable_domains))}
+
+// parse_domain_list reads one domain per line, blank lines and # comments are skipped
+func parse_domain_list(r io.Reader) map[string]bool {
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line != "" {
+			domains[line] = true
+		}
+	}
+
+	return domains
+}
+
+// Contains is true for listed domains and their subdomains, mail.yopmail.com is as disposable as yopmail.com
+func (d *DisposableDomains) Contains(domain string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	domain = strings.ToLower(domain)
+	for domain != "" {
+		if d.domains[domain] {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+
+	return false
+}
+
+func (d *DisposableDomains) Replace(domains map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.domains = domains
+}
+
+// is_disposable_email is true when the address's domain is on the blocklist
+func is_disposable_email(email string) bool {
+	_, domain, ok := strings.Cut(email, "@")
+	return ok && disposable_domains.Contains(domain)
+}
+
+// fetch_disposable_domains downloads a list in the embedded format, an empty list is refused so a
+// broken upstream can't switch detection off
+func fetch_disposable_domains(ctx context.Context, url string) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("disposable domains: " + res.Status)
+	}
+
+	domains := parse_domain_list(res.Body)
+	if len(domains) == 0 {
+		return nil, errors.New("disposable domains: empty list")
+	}
+
+	return domains, nil
+}
+
+// run_disposable_refresh replaces the blocklist from DISPOSABLE_DOMAINS_URL now and every
+// DISPOSABLE_DOMAINS_REFRESH. Every replica refreshes its own copy, a failed fetch keeps the current list
+func run_disposable_refresh(ctx context.Context, config Config) {
+	ticker := time.NewTicker(config.DisposableDomainsRefresh)
+	defer ticker.Stop()
+
+	for {
+		domains, err := fetch_disposable_domains(ctx, config.DisposableDomainsURL)
+		if err != nil {
+			println("disposable domains refresh failed:", err.Error())
+		} else {
+			disposable_domains.Replace(domains)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
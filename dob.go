@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// dob_layouts are the inputs accepted for a date of birth, all stored as YYYY-MM-DD
+var dob_layouts = []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05"}
+
+// normalize_dob parses a date of birth into YYYY-MM-DD, it must be a real date no later than today
+func normalize_dob(value string) (string, error) {
+	for _, layout := range dob_layouts {
+		dob, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+
+		if dob.Year() < 1900 || dob.After(time.Now().UTC()) {
+			return "", &ValidationError{Field: "dob", Message: "must be between 1900-01-01 and today"}
+		}
+
+		return dob.Format("2006-01-02"), nil
+	}
+
+	return "", &ValidationError{Field: "dob", Message: "must be an iso date, YYYY-MM-DD"}
+}
+
+// customer_age is the age in whole years on the given day, nil when the date of birth is unknown
+func customer_age(dob string, today time.Time) *int {
+	born, err := time.Parse("2006-01-02", dob)
+	if err != nil {
+		return nil
+	}
+
+	age := today.Year() - born.Year()
+	if today.Month() < born.Month() || (today.Month() == born.Month() && today.Day() < born.Day()) {
+		age--
+	}
+
+	return &age
+}
+
+// dob_range reads ?dob_from=, ?dob_to=, ?min_age= and ?max_age= as one inclusive date of birth range,
+// the ages count on today. Either end is empty when left open
+func dob_range(r *http.Request) (string, string, error) {
+	query := r.URL.Query()
+	today := time.Now().UTC()
+
+	from, to := "", ""
+	for _, param := range []string{"dob_from", "dob_to"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+
+		dob, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return "", "", &ValidationError{Field: param, Message: "must be an iso date, YYYY-MM-DD"}
+		}
+
+		if param == "dob_from" {
+			from = dob.Format("2006-01-02")
+		} else {
+			to = dob.Format("2006-01-02")
+		}
+	}
+
+	for _, param := range []string{"min_age", "max_age"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+
+		age, err := strconv.Atoi(value)
+		if err != nil || age < 0 {
+			return "", "", &ValidationError{Field: param, Message: "must be a whole number of years"}
+		}
+
+		// at least min_age means born on or before today min_age years ago, at most max_age means
+		// born after today max_age + 1 years ago
+		if param == "min_age" {
+			to = min_date(to, today.AddDate(-age, 0, 0).Format("2006-01-02"))
+		} else {
+			from = max_date(from, today.AddDate(-age-1, 0, 1).Format("2006-01-02"))
+		}
+	}
+
+	// encrypted dates of birth only compare once decrypted, which a paginated query cannot do
+	if pii_cipher != nil && (from != "" || to != "") {
+		return "", "", &ValidationError{Field: "dob", Message: "date of birth and age filters are unavailable while PII_ENCRYPTION_KEY is set"}
+	}
+
+	return from, to, nil
+}
+
+func min_date(a string, b string) string {
+	if a == "" || b < a {
+		return b
+	}
+	return a
+}
+
+func max_date(a string, b string) string {
+	if a == "" || b > a {
+		return b
+	}
+	return a
+}
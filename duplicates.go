@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const EventCustomerMerged = "customer.merged"
+
+// duplicate_name_threshold is the least name similarity that makes a customer a likely duplicate by name alone
+const duplicate_name_threshold = 0.8
+
+// max_duplicates caps the candidates returned for a customer
+const max_duplicates = 20
+
+// Duplicate is a customer that is likely the same person, reasons say which of email, phone and name matched
+type Duplicate struct {
+	Customer Customer `json:"customer"`
+	Score    float64  `json:"score"` // 1 for a shared email, down to duplicate_name_threshold for a similar name
+	Reasons  []string `json:"reasons"`
+}
+
+// MergedCustomer is the payload of the merged event, the target as it is now and the id it absorbed
+type MergedCustomer struct {
+	Customer
+	MergedCustomerID int64 `json:"merged_customer_id"`
+}
+
+// MergeDetails folds source into target, target's values win where both have one
+type MergeDetails struct {
+	SourceID int64 `json:"source_id"`
+	TargetID int64 `json:"target_id"`
+}
+
+// name_tokens lowercases the name and splits it into words of letters only
+func name_tokens(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+}
+
+// soundex is the american soundex code of a word, e.g. R163 for robert and rupert. Letters outside a-z are skipped
+func soundex(word string) string {
+	codes := map[rune]byte{
+		'b': '1', 'f': '1', 'p': '1', 'v': '1',
+		'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+		'd': '3', 't': '3',
+		'l': '4',
+		'm': '5', 'n': '5',
+		'r': '6',
+	}
+
+	var code []byte
+	var last byte
+	for _, r := range strings.ToLower(word) {
+		if r < 'a' || r > 'z' {
+			continue
+		}
+
+		digit := codes[r]
+		if len(code) == 0 {
+			code = append(code, byte(unicode.ToUpper(r)))
+			last = digit
+			continue
+		}
+
+		// h and w don't separate letters with the same code, vowels do
+		if r == 'h' || r == 'w' {
+			continue
+		}
+		if digit != 0 && digit != last {
+			code = append(code, digit)
+		}
+		last = digit
+
+		if len(code) == 4 {
+			break
+		}
+	}
+
+	if len(code) == 0 {
+		return ""
+	}
+
+	return string(code) + strings.Repeat("0", 4-len(code))
+}
+
+// levenshtein counts the single letter edits between a and b
+func levenshtein(a string, b string) int {
+	a_runes, b_runes := []rune(a), []rune(b)
+	previous := make([]int, len(b_runes)+1)
+	current := make([]int, len(b_runes)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a_runes); i++ {
+		current[0] = i
+		for j := 1; j <= len(b_runes); j++ {
+			cost := 1
+			if a_runes[i-1] == b_runes[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b_runes)]
+}
+
+// name_similarity is between 0 and 1, the better of the edit distance over the whole name and the share of
+// words that sound alike, so "Jon Smyth" is close to "John Smith" and "Smith John" as well
+func name_similarity(a string, b string) float64 {
+	a_tokens, b_tokens := name_tokens(a), name_tokens(b)
+	if len(a_tokens) == 0 || len(b_tokens) == 0 {
+		return 0
+	}
+
+	a_name, b_name := strings.Join(a_tokens, " "), strings.Join(b_tokens, " ")
+	longest := max(len([]rune(a_name)), len([]rune(b_name)))
+	edit := 1 - float64(levenshtein(a_name, b_name))/float64(longest)
+
+	b_codes := map[string]int{}
+	for _, token := range b_tokens {
+		b_codes[soundex(token)]++
+	}
+
+	alike := 0
+	for _, token := range a_tokens {
+		code := soundex(token)
+		if b_codes[code] > 0 {
+			b_codes[code]--
+			alike++
+		}
+	}
+
+	// sounding alike is a weaker signal than being spelled alike, it never scores a full match
+	phonetic := 0.9 * float64(alike) / float64(max(len(a_tokens), len(b_tokens)))
+
+	return max(edit, phonetic)
+}
+
+func register_duplicate_routes(mux *http.ServeMux, db *sql.DB, config Config, blobs BlobStore) {
+	// likely duplicates of the customer, best first
+	mux.HandleFunc("GET /api/customers/{id}/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		customer, err := get_customer(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		duplicates, err := find_duplicates(db, tenant_from(r), customer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range duplicates {
+			present_customer(r, &duplicates[i].Customer)
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Duplicate]{Data: duplicates})
+	})
+
+	// fold one customer into another, the source is deleted and what was attached to it moves to the target
+	mux.HandleFunc("POST /api/customers/merge", func(w http.ResponseWriter, r *http.Request) {
+		var req MergeDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.SourceID == req.TargetID {
+			http.Error(w, (&ValidationError{Field: "source_id", Message: "must differ from target_id"}).Error(), http.StatusBadRequest)
+			return
+		}
+
+		// the owner check in scope_tenant only covers ids in the path
+		for _, id := range []int64{req.SourceID, req.TargetID} {
+			tenant_id, err := get_owning_tenant(db, "customers", id)
+			if err != nil && err != sql.ErrNoRows {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if err == sql.ErrNoRows || tenant_id != tenant_from(r) {
+				http.Error(w, "Customer not found", http.StatusNotFound)
+				return
+			}
+
+			// reject_blocked only reads the id in the path
+			status, err := get_customer_status(db, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if status.Blocked {
+				http.Error(w, "Customer is blocked", http.StatusLocked)
+				return
+			}
+		}
+
+		customer, err := merge_customers(db, req.SourceID, req.TargetID)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the attachments moved, so this only takes the source's avatar
+		err = purge_customer_blobs(r.Context(), db, blobs, req.SourceID)
+		if err != nil {
+			println("deleting merged customer files failed:", err.Error())
+		}
+
+		err = check_quotas(db, config, tenant_from(r))
+		if err != nil {
+			println("quota check failed:", err.Error())
+		}
+
+		present_customer(r, customer)
+		write_json_response(w, http.StatusOK, ApiResponse[Customer]{Data: *customer})
+	})
+}
+
+// #region Database
+
+// find_duplicates looks up customers sharing one of the customer's emails or phones, which are stored
+// normalized, and compares every name in the tenant
+func find_duplicates(db *sql.DB, tenant_id string, customer *Customer) ([]Duplicate, error) {
+	found := map[int64]*Duplicate{}
+	add := func(id int64, reason string, score float64) {
+		duplicate, ok := found[id]
+		if !ok {
+			duplicate = &Duplicate{Reasons: []string{}}
+			found[id] = duplicate
+		}
+		duplicate.Reasons = append(duplicate.Reasons, reason)
+		duplicate.Score = max(duplicate.Score, score)
+	}
+
+	// a point not yet rotated still carries the previous key's index
+	get_matches := `
+	SELECT DISTINCT p.customer_id
+	FROM customer_contact_points p
+	JOIN customers c ON c.id = p.customer_id
+	WHERE p.kind = ? AND p.value_index IN (?, ?) AND p.customer_id != ? AND c.tenant_id = ?;
+	`
+
+	points := []struct {
+		kind   string
+		reason string
+		score  float64
+		values []ContactPoint
+	}{
+		{"email", "email", 1, customer.Emails},
+		{"phone", "phone", 0.9, customer.Phones},
+	}
+	for _, point := range points {
+		matched := map[int64]bool{}
+		for _, value := range point.values {
+			indexes := pii_lookup_indexes(contact_point_kinds[point.kind], value.Value)
+			rows, err := db.Query(get_matches, point.kind, indexes[0], indexes[len(indexes)-1], customer.ID, tenant_id)
+			if err != nil {
+				return nil, err
+			}
+
+			for rows.Next() {
+				var id int64
+				err = rows.Scan(&id)
+				if err != nil {
+					rows.Close()
+					return nil, err
+				}
+				matched[id] = true
+			}
+			rows.Close()
+			if rows.Err() != nil {
+				return nil, rows.Err()
+			}
+		}
+
+		for id := range matched {
+			add(id, point.reason, point.score)
+		}
+	}
+
+	rows, err := db.Query(`SELECT id, name FROM customers WHERE tenant_id = ? AND id != ?;`, tenant_id, customer.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return nil, err
+		}
+
+		similarity := name_similarity(customer.Name, name)
+		if similarity >= duplicate_name_threshold {
+			add(id, "name", similarity)
+		}
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	rows.Close()
+
+	duplicates := []Duplicate{}
+	for id, duplicate := range found {
+		candidate, err := get_customer(db, id)
+		if err != nil {
+			return nil, err
+		}
+		duplicate.Customer = *candidate
+		duplicates = append(duplicates, *duplicate)
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Score != duplicates[j].Score {
+			return duplicates[i].Score > duplicates[j].Score
+		}
+		return duplicates[i].Customer.ID < duplicates[j].Customer.ID
+	})
+
+	if len(duplicates) > max_duplicates {
+		duplicates = duplicates[:max_duplicates]
+	}
+
+	return duplicates, nil
+}
+
+// merge_customers fills the target's empty fields from the source, moves the source's notes, addresses,
+// contact points, tags, attachments, consents, relationships, review flags and referrals to the target, and
+// deletes the source. The source's events and versions stay under its id, the merged event links the two
+func merge_customers(db *sql.DB, source_id int64, target_id int64) (*Customer, error) {
+	merge_record := `
+	UPDATE customers
+	SET dob = CASE WHEN COALESCE(customers.dob, '') = '' THEN source.dob ELSE customers.dob END,
+		email = CASE WHEN COALESCE(customers.email, '') = '' THEN source.email ELSE customers.email END,
+		email_index = CASE WHEN COALESCE(customers.email, '') = '' THEN source.email_index ELSE customers.email_index END,
+		email_verified_at = CASE WHEN COALESCE(customers.email, '') = '' THEN source.email_verified_at ELSE customers.email_verified_at END,
+		contact = CASE WHEN COALESCE(customers.contact, '') = '' THEN source.contact ELSE customers.contact END,
+		contact_index = CASE WHEN COALESCE(customers.contact, '') = '' THEN source.contact_index ELSE customers.contact_index END,
+		country = COALESCE(customers.country, source.country),
+		company_id = COALESCE(customers.company_id, source.company_id),
+		referred_by_customer_id = COALESCE(NULLIF(customers.referred_by_customer_id, source.id), NULLIF(source.referred_by_customer_id, customers.id)),
+		metadata = json_patch(source.metadata, customers.metadata),
+		updated_at = CURRENT_TIMESTAMP
+	FROM (SELECT * FROM customers WHERE id = ?) AS source
+	WHERE customers.id = ?;
+	`
+
+	// a moved primary stays primary only when the target has none of its kind
+	move_records := []string{
+		`UPDATE customer_notes SET customer_id = ?2 WHERE customer_id = ?1;`,
+		`UPDATE customer_attachments SET customer_id = ?2 WHERE customer_id = ?1;`,
+		`UPDATE review_flags SET customer_id = ?2 WHERE customer_id = ?1;`,
+		`UPDATE OR IGNORE customer_consents SET customer_id = ?2 WHERE customer_id = ?1;`,
+		`UPDATE customer_addresses SET customer_id = ?2,
+			is_primary = is_primary AND NOT EXISTS (SELECT 1 FROM customer_addresses WHERE customer_id = ?2 AND is_primary = 1)
+		WHERE customer_id = ?1;`,
+		`UPDATE OR IGNORE customer_contact_points SET customer_id = ?2,
+			is_primary = is_primary AND NOT EXISTS (SELECT 1 FROM customer_contact_points p WHERE p.customer_id = ?2 AND p.kind = customer_contact_points.kind AND p.is_primary = 1)
+		WHERE customer_id = ?1;`,
+		// inserted rather than moved so the tag counts follow
+		`INSERT OR IGNORE INTO customer_tags (customer_id, tag, source, created_at) SELECT ?2, tag, source, created_at FROM customer_tags WHERE customer_id = ?1;`,
+		`UPDATE OR IGNORE customer_relationships SET customer_id = ?2 WHERE customer_id = ?1 AND related_customer_id != ?2;`,
+		`UPDATE OR IGNORE customer_relationships SET related_customer_id = ?2 WHERE related_customer_id = ?1 AND customer_id != ?2;`,
+		`UPDATE customers SET referred_by_customer_id = ?2 WHERE referred_by_customer_id = ?1 AND id != ?2;`,
+	}
+
+	var merged *Customer
+	var events []*CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		source, err := get_customer(tx, source_id)
+		if err != nil {
+			return err
+		}
+
+		before, err := get_customer(tx, target_id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(merge_record, source_id, target_id)
+		if err != nil {
+			return err
+		}
+
+		// external ids are unique, the source gives its up first
+		if before.ExternalID == "" && source.ExternalID != "" {
+			_, err = tx.Exec(`UPDATE customers SET external_id = NULL WHERE id = ?;`, source_id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`UPDATE customers SET external_id = ? WHERE id = ?;`, source.ExternalID, target_id)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, move_records := range move_records {
+			_, err = tx.Exec(move_records, source_id, target_id)
+			if err != nil {
+				return err
+			}
+		}
+
+		merged, err = get_customer(tx, target_id)
+		if err != nil {
+			return err
+		}
+
+		changes, err := customer_changes(before, merged)
+		if err != nil {
+			return err
+		}
+
+		event, err := record_change_event(tx, EventCustomerMerged, target_id, MergedCustomer{Customer: *merged, MergedCustomerID: source_id}, changes)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+
+		// recorded first, the event takes its tenant from the customers row
+		event, err = record_event(tx, EventCustomerDeleted, source_id, source)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+
+		_, err = tx.Exec(`DELETE FROM customers WHERE id = ?;`, source_id)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("Customer not found")
+		}
+		return nil, err
+	}
+
+	for _, event := range events {
+		event_broker.Publish(*event)
+	}
+
+	return merged, nil
+}
+
+// #endregion
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// EmailOptions are EMAIL_FOLD_GMAIL, EMAIL_CHECK_MX and DISPOSABLE_EMAIL, set once at startup
+type EmailOptions struct {
+	FoldGmail  bool   // drop dots and +tags from gmail addresses, which gmail ignores
+	CheckMX    bool   // reject domains that publish no mail exchanger
+	Disposable string // off, flag or reject addresses at disposable mailbox providers
+	MXTimeout  time.Duration
+}
+
+var email_options = EmailOptions{Disposable: "flag", MXTimeout: 3 * time.Second}
+
+var disposable_modes = map[string]bool{
+	"off":    true,
+	"flag":   true,
+	"reject": true,
+}
+
+var gmail_domains = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+}
+
+// canonical_email is the form emails are stored and compared in, lowercased and trimmed, with gmail
+// addresses folded when configured
+func canonical_email(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !email_options.FoldGmail {
+		return email
+	}
+
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || !gmail_domains[domain] {
+		return email
+	}
+
+	local, _, _ = strings.Cut(local, "+")
+	return strings.ReplaceAll(local, ".", "") + "@gmail.com"
+}
+
+// normalize_email checks the address is a bare, well formed address and returns its canonical form.
+// DISPOSABLE_EMAIL=reject turns away throwaway mailboxes, with EMAIL_CHECK_MX the domain must also accept mail
+func normalize_email(ctx context.Context, value string) (string, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(value))
+	if err != nil || address.Address != strings.TrimSpace(value) {
+		return "", &ValidationError{Field: "email", Message: "must be an email address such as name@example.com"}
+	}
+
+	email := canonical_email(address.Address)
+	if email_options.Disposable == "reject" && is_disposable_email(email) {
+		return "", &ValidationError{Field: "email", Message: "disposable email addresses are not accepted"}
+	}
+
+	if !email_options.CheckMX {
+		return email, nil
+	}
+
+	_, domain, _ := strings.Cut(email, "@")
+	err = check_mail_domain(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+
+	return email, nil
+}
+
+// check_mail_domain fails for domains that don't exist or publish neither mx nor address records, which
+// senders fall back to. Lookups that time out or fail on our side let the address through
+func check_mail_domain(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, email_options.MXTimeout)
+	defer cancel()
+
+	undeliverable := &ValidationError{Field: "email", Message: domain + " does not accept email"}
+
+	records, err := net.DefaultResolver.LookupMX(ctx, domain)
+	if err == nil {
+		// a null mx, rfc 7505, says the domain takes no mail at all
+		if len(records) == 1 && records[0].Host == "." {
+			return undeliverable
+		}
+		if len(records) > 0 {
+			return nil
+		}
+	}
+
+	var dns_error *net.DNSError
+	if err != nil && !(errors.As(err, &dns_error) && dns_error.IsNotFound) {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, domain)
+	if err == nil && len(addresses) > 0 {
+		return nil
+	}
+	if err != nil && !(errors.As(err, &dns_error) && dns_error.IsNotFound) {
+		return nil
+	}
+
+	return undeliverable
+}
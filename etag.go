@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag_for is the customer's version followed by a hash of the body, the same version renders
+// differently per role and locale and each rendering needs its own tag, while If-Match only cares about the version
+func etag_for(version int64, body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + strconv.FormatInt(version, 10) + "-" + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// etag_matches implements the weak comparison If-None-Match calls for
+func etag_matches(if_none_match string, etag string) bool {
+	for _, candidate := range strings.Split(if_none_match, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write_with_etag writes a json body with its ETag, or only a 304 when the client already has it
+func write_with_etag(w http.ResponseWriter, r *http.Request, version int64, body []byte) {
+	etag := etag_for(version, body)
+	w.Header().Set("ETag", etag)
+
+	if etag_matches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// expected_version is the version a write replaces, from If-Match or the body's version field,
+// If-Match: * opts out and yields 0
+func expected_version(r *http.Request, req CustomerDetails) (int64, error) {
+	if_match := strings.TrimSpace(r.Header.Get("If-Match"))
+	if if_match == "*" {
+		return 0, nil
+	}
+
+	if if_match != "" {
+		// a bare "3" or an etag "3-<hash>" as returned by GET
+		tag := strings.Trim(strings.TrimPrefix(if_match, "W/"), `"`)
+		version_str, _, _ := strings.Cut(tag, "-")
+		version, err := strconv.ParseInt(version_str, 10, 64)
+		if err != nil || version <= 0 {
+			return 0, errors.New("If-Match must be an ETag returned by this api")
+		}
+		return version, nil
+	}
+
+	if req.Version != nil && *req.Version > 0 {
+		return *req.Version, nil
+	}
+
+	return 0, errors.New("If-Match or version is required")
+}
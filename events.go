@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventCustomerCreated = "customer.created"
+	EventCustomerUpdated = "customer.updated"
+	EventCustomerDeleted = "customer.deleted"
+)
+
+type CustomerEvent struct {
+	ID         int64           `json:"id"`
+	Type       string          `json:"type"`
+	CustomerID int64           `json:"customer_id"`
+	TenantID   string          `json:"tenant_id"`
+	Payload    json.RawMessage `json:"payload"`
+	Changes    []FieldChange   `json:"changes,omitempty"` // what an update changed, field by field
+	CreatedAt  string          `json:"created_at"`
+}
+
+// FieldChange is one field an update changed, Old and New are the json values before and after
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
+
+// customer_changes diffs two snapshots of a customer, leaving out the fields every write bumps
+func customer_changes(before *Customer, after *Customer) ([]FieldChange, error) {
+	old_fields, err := customer_json_fields(before)
+	if err != nil {
+		return nil, err
+	}
+
+	new_fields, err := customer_json_fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	return field_changes(old_fields, new_fields), nil
+}
+
+// field_changes diffs two json objects by field, a field missing on one side is null there
+func field_changes(old_fields map[string]json.RawMessage, new_fields map[string]json.RawMessage) []FieldChange {
+	changes := []FieldChange{}
+	for field, value := range new_fields {
+		old, ok := old_fields[field]
+		if timeline_ignored_fields[field] || (ok && bytes.Equal(old, value)) {
+			continue
+		}
+		if !ok {
+			old = json.RawMessage("null")
+		}
+
+		changes = append(changes, FieldChange{Field: field, Old: old, New: value})
+	}
+	for field, old := range old_fields {
+		_, ok := new_fields[field]
+		if !ok && !timeline_ignored_fields[field] {
+			changes = append(changes, FieldChange{Field: field, Old: old, New: json.RawMessage("null")})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+
+	return changes
+}
+
+func customer_json_fields(customer *Customer) (map[string]json.RawMessage, error) {
+	customer_str, err := json.Marshal(customer)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(customer_str, &fields)
+	return fields, err
+}
+
+// shape_changes drops changes to fields the policy hides
+func shape_changes(hidden map[string]bool, changes []FieldChange) []FieldChange {
+	if len(hidden) == 0 {
+		return changes
+	}
+
+	var shaped []FieldChange
+	for _, change := range changes {
+		if !hidden[change.Field] {
+			shaped = append(shaped, change)
+		}
+	}
+
+	return shaped
+}
+
+// EventBroker fans out recorded events to live subscribers such as the sse stream
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan CustomerEvent]struct{}
+	closed      bool
+}
+
+var event_broker = &EventBroker{subscribers: map[chan CustomerEvent]struct{}{}}
+
+func (b *EventBroker) Subscribe() chan CustomerEvent {
+	ch := make(chan CustomerEvent, 64)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch
+	}
+
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *EventBroker) Unsubscribe(ch chan CustomerEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.subscribers[ch]
+	if ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Close ends every subscription so long-lived streams can wind down on shutdown
+func (b *EventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish never blocks, slow subscribers miss live events and catch up from the events table. It is called
+// after every committed change, so it is also where cached reads of the customer and listing counts are dropped
+func (b *EventBroker) Publish(event CustomerEvent) {
+	customer_cache.Invalidate(customer_cache_key{event.TenantID, event.CustomerID})
+	invalidate_counts()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// #region Database
+
+// record_event appends to the events table, pass the mutation's transaction so both commit together
+// and publish the returned event to event_broker only after the commit
+func record_event(db db_handle, event_type string, customer_id int64, payload any) (*CustomerEvent, error) {
+	return record_change_event(db, event_type, customer_id, payload, nil)
+}
+
+// record_tenant_event is record_event for events about a tenant rather than one of its customers
+func record_tenant_event(db db_handle, event_type string, tenant_id string, payload any) (*CustomerEvent, error) {
+	return insert_event(db, event_type, 0, tenant_id, payload, nil)
+}
+
+// record_change_event is record_event for updates, keeping the field level diff next to the snapshot
+func record_change_event(db db_handle, event_type string, customer_id int64, payload any, changes []FieldChange) (*CustomerEvent, error) {
+	return insert_event(db, event_type, customer_id, "", payload, changes)
+}
+
+// insert_event stores the event under its customer's tenant, or tenant_id when it is about no customer
+func insert_event(db db_handle, event_type string, customer_id int64, tenant_id string, payload any, changes []FieldChange) (*CustomerEvent, error) {
+	payload_str, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stored copies are sealed as the customers columns are, the returned event stays readable
+	sealed_payload, err := seal_pii_json(payload_str)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes_str *string
+	if changes != nil {
+		encoded, err := json.Marshal(changes)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded, err = seal_pii_json(encoded)
+		if err != nil {
+			return nil, err
+		}
+		changes_str = new(string)
+		*changes_str = string(encoded)
+	}
+
+	// the tenant is the customer's, so deletes record their event first. Events about no customer, such as a
+	// disabled webhook, belong to tenant_id, the platform's when it is empty
+	create_record := `
+	INSERT INTO customer_events (type, customer_id, tenant_id, payload, changes)
+	VALUES (?, ?, COALESCE((SELECT tenant_id FROM customers WHERE id = ?), ?), ?, ?)
+	RETURNING id, tenant_id, created_at;
+	`
+
+	event := CustomerEvent{
+		Type:       event_type,
+		CustomerID: customer_id,
+		Payload:    payload_str,
+		Changes:    changes,
+	}
+	err = db.QueryRow(create_record, event_type, customer_id, customer_id, tenant_id, string(sealed_payload), changes_str).Scan(&event.ID, &event.TenantID, &event.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// scan_event_payload opens the stored payload and changes into event
+func scan_event_payload(event *CustomerEvent, payload string, changes *string) error {
+	opened, err := open_pii_json([]byte(payload))
+	if err != nil {
+		return err
+	}
+	event.Payload = json.RawMessage(opened)
+
+	if changes == nil {
+		return nil
+	}
+
+	opened, err = open_pii_json([]byte(*changes))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(opened, &event.Changes)
+}
+
+// get_events_since reads the tenant's events after since, or every tenant's when tenant_id is empty
+func get_events_since(db *sql.DB, tenant_id string, since int64, limit int) ([]CustomerEvent, error) {
+	get_records := `
+	SELECT id, type, customer_id, tenant_id, payload, changes, created_at
+	FROM customer_events
+	WHERE id > ? AND (? = '' OR tenant_id = ?)
+	ORDER BY id
+	LIMIT ?;
+	`
+
+	rows, err := db.Query(get_records, since, tenant_id, tenant_id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var events []CustomerEvent = []CustomerEvent{}
+	for rows.Next() {
+		var event CustomerEvent
+		var payload string
+		var changes *string
+		err = rows.Scan(&event.ID, &event.Type, &event.CustomerID, &event.TenantID, &payload, &changes, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		err = scan_event_payload(&event, payload, changes)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// get_customer_events reads every event recorded for the customer, oldest first
+func get_customer_events(db *sql.DB, customer_id int64) ([]CustomerEvent, error) {
+	get_records := `
+	SELECT id, type, customer_id, tenant_id, payload, changes, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+	FROM customer_events
+	WHERE customer_id = ?
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	events := []CustomerEvent{}
+	for rows.Next() {
+		var event CustomerEvent
+		var payload string
+		var changes *string
+		err = rows.Scan(&event.ID, &event.Type, &event.CustomerID, &event.TenantID, &payload, &changes, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		err = scan_event_payload(&event, payload, changes)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// #endregion
+
+type EventListingResponse struct {
+	Records   []CustomerEvent `json:"records"`
+	NextSince int64           `json:"next_since"` // pass back as ?since= to continue
+}
+
+// list_events replays the change log after ?since= so consumers can catch up at their own pace
+func list_events(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since int64
+		since_str := r.URL.Query().Get("since")
+		if since_str != "" {
+			id, err := strconv.ParseInt(since_str, 10, 64)
+			if err != nil || id < 0 {
+				http.Error(w, "Invalid since", http.StatusBadRequest)
+				return
+			}
+			since = id
+		}
+
+		limit := ConvertInt(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 1000 {
+			limit = 100
+		}
+
+		events, err := get_events_since(db, tenant_from(r), since, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		next_since := since
+		if len(events) > 0 {
+			next_since = events[len(events)-1].ID
+		}
+
+		hidden, masked := request_hidden_fields(r), request_masked_fields(r)
+		for i := range events {
+			events[i] = shape_event(hidden, masked, events[i])
+		}
+
+		response := ApiResponse[EventListingResponse]{
+			Data: EventListingResponse{
+				Records:   events,
+				NextSince: next_since,
+			},
+		}
+
+		response_str, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	}
+}
+
+// stream_customer_events serves customer changes as server-sent events, resuming after Last-Event-ID when given
+func stream_customer_events(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		last_id_str := r.Header.Get("Last-Event-ID")
+		if last_id_str == "" {
+			last_id_str = r.URL.Query().Get("last_event_id")
+		}
+
+		var last_id int64
+		if last_id_str != "" {
+			id, err := strconv.ParseInt(last_id_str, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			last_id = id
+		}
+
+		clear_deadlines(w)
+
+		// subscribe before replaying so nothing recorded in between is lost
+		live := event_broker.Subscribe()
+		defer event_broker.Unsubscribe(live)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		tenant_id := tenant_from(r)
+		hidden, masked := request_hidden_fields(r), request_masked_fields(r)
+		send := func(event CustomerEvent) error {
+			if event.ID <= last_id {
+				return nil
+			}
+
+			// other tenants' events are skipped over, not sent
+			if event.TenantID != tenant_id {
+				last_id = event.ID
+				return nil
+			}
+
+			data, err := json.Marshal(shape_event(hidden, masked, event))
+			if err != nil {
+				return err
+			}
+
+			_, err = w.Write([]byte("id: " + strconv.FormatInt(event.ID, 10) + "\nevent: " + event.Type + "\ndata: " + string(data) + "\n\n"))
+			if err != nil {
+				return err
+			}
+
+			last_id = event.ID
+			return nil
+		}
+
+		// replay whatever was missed, either since the given id or since a live event got dropped
+		catch_up := func() error {
+			for {
+				events, err := get_events_since(db, "", last_id, 100)
+				if err != nil {
+					return err
+				}
+
+				for _, event := range events {
+					err = send(event)
+					if err != nil {
+						return err
+					}
+				}
+
+				flusher.Flush()
+				if len(events) < 100 {
+					return nil
+				}
+			}
+		}
+
+		if last_id_str != "" {
+			err := catch_up()
+			if err != nil {
+				return
+			}
+		}
+
+		keepalive := time.NewTicker(15 * time.Second)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-live:
+				if !ok {
+					return
+				}
+
+				// tenants with their own database files number their events apart, the others' ids say nothing about gaps
+				if tenant_databases != nil && event.TenantID != tenant_id {
+					continue
+				}
+
+				// a gap means the subscriber buffer overflowed, fall back to the events table
+				if event.ID > last_id+1 && last_id != 0 {
+					err := catch_up()
+					if err != nil {
+						return
+					}
+					continue
+				}
+
+				err := send(event)
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-keepalive.C:
+				_, err := w.Write([]byte(": keepalive\n\n"))
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
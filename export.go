@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"filippo.io/age"
+	"github.com/parquet-go/parquet-go"
+)
+
+// CustomerParquetRow is the typed column layout used for parquet exports
+type CustomerParquetRow struct {
+	ID         int64     `parquet:"id"`
+	Name       string    `parquet:"name"`
+	DOB        string    `parquet:"dob"`
+	Email      string    `parquet:"email"`
+	Contact    string    `parquet:"contact"`
+	ExternalID string    `parquet:"external_id,optional"`
+	CreatedAt  time.Time `parquet:"created_at,timestamp(millisecond)"`
+	UpdatedAt  time.Time `parquet:"updated_at,timestamp(millisecond)"`
+}
+
+// ParseTimestamp parses the timestamp formats sqlite hands back, defaults to zero time if parsing fails
+func ParseTimestamp(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// CustomerIterator calls fn for each customer in the export, stopping at the first error
+type CustomerIterator func(fn func(Customer) error) error
+
+var export_formats = map[string]func(w io.Writer, customers CustomerIterator) error{
+	"csv":     export_csv,
+	"json":    export_json,
+	"parquet": export_parquet,
+}
+
+var export_content_types = map[string]string{
+	"csv":     "text/csv",
+	"json":    "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+func export_customers(db *sql.DB, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+
+		export, ok := export_formats[format]
+		if !ok {
+			http.Error(w, "Invalid format", http.StatusBadRequest)
+			return
+		}
+
+		// exports follow the caller's field policy like every other read
+		customers, err := export_source(db, tenant_from(r), r.URL.Query().Get("purpose"), request_hidden_fields(r), request_masked_fields(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// callers with an export recipient only ever get ciphertext
+		recipient, err := export_recipient_for(db, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if recipient == nil && config.ExportRequireEncryption {
+			http.Error(w, "No export recipient key is configured for "+actor_from(r), http.StatusForbidden)
+			return
+		}
+
+		filename, content_type := export_file(format, recipient != nil)
+		w.Header().Set("Content-Type", content_type)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+		// large exports take longer than the write timeout allows
+		clear_deadlines(w)
+
+		// headers are already sent once the body starts streaming, so failures can only be logged
+		if recipient == nil {
+			err = export(w, customers)
+		} else {
+			err = export_encrypted(w, recipient, export, customers)
+		}
+		if err != nil {
+			println("export failed:", err.Error())
+		}
+	}
+}
+
+// export_source reads the customers of an export, shaped by the caller's field policy. Marketing exports
+// never include suppressed addresses
+func export_source(db *sql.DB, tenant_id string, purpose string, hidden map[string]bool, masked map[string]bool) (CustomerIterator, error) {
+	customers := CustomerIterator(func(fn func(Customer) error) error {
+		return each_tenant_customer(db, tenant_id, fn)
+	})
+	if purpose == "marketing" {
+		customers = func(fn func(Customer) error) error {
+			return each_marketable_customer(db, tenant_id, fn)
+		}
+	} else if purpose != "" {
+		return nil, errors.New("Invalid purpose")
+	}
+
+	return func(fn func(Customer) error) error {
+		return customers(func(c Customer) error {
+			shape_customer(hidden, &c)
+			mask_customer(masked, &c)
+			return fn(c)
+		})
+	}, nil
+}
+
+// export_file names an export made now and gives its content type, encrypted ones are age files
+func export_file(format string, encrypted bool) (string, string) {
+	filename := "customers-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	if encrypted {
+		return filename + ".age", "application/octet-stream"
+	}
+
+	return filename, export_content_types[format]
+}
+
+// export_encrypted streams the export through age, nothing is buffered in plaintext
+func export_encrypted(w io.Writer, recipient age.Recipient, export func(w io.Writer, customers CustomerIterator) error, customers CustomerIterator) error {
+	encrypted, err := age.Encrypt(w, recipient)
+	if err != nil {
+		return err
+	}
+
+	err = export(encrypted, customers)
+	if err != nil {
+		return err
+	}
+
+	return encrypted.Close()
+}
+
+func export_csv(w io.Writer, customers CustomerIterator) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"id", "name", "dob", "email", "contact", "external_id", "created_at", "updated_at"})
+	if err != nil {
+		return err
+	}
+
+	err = customers(func(c Customer) error {
+		return writer.Write([]string{strconv.FormatInt(c.ID, 10), c.Name, c.DOB, c.Email, c.Contact, c.ExternalID, c.CreatedAt, c.UpdatedAt})
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func export_json(w io.Writer, customers CustomerIterator) error {
+	encoder := json.NewEncoder(w)
+	return customers(func(c Customer) error {
+		return encoder.Encode(c)
+	})
+}
+
+func export_parquet(w io.Writer, customers CustomerIterator) error {
+	writer := parquet.NewGenericWriter[CustomerParquetRow](w)
+	err := customers(func(c Customer) error {
+		_, err := writer.Write([]CustomerParquetRow{{
+			ID:         c.ID,
+			Name:       c.Name,
+			DOB:        c.DOB,
+			Email:      c.Email,
+			Contact:    c.Contact,
+			ExternalID: c.ExternalID,
+			CreatedAt:  ParseTimestamp(c.CreatedAt),
+			UpdatedAt:  ParseTimestamp(c.UpdatedAt),
+		}})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// each_customer streams every customer ordered by id without loading the table into memory
+func each_customer(db *sql.DB, fn func(Customer) error) error {
+	return each_customer_where(db, "1 = 1", fn)
+}
+
+// each_tenant_customer is each_customer for one tenant
+func each_tenant_customer(db *sql.DB, tenant_id string, fn func(Customer) error) error {
+	return each_customer_where(db, "tenant_id = ?", fn, tenant_id)
+}
+
+// each_marketable_customer skips the tenant's customers whose email is on its suppression list. Emails may be
+// encrypted, so they are checked against the list once read
+func each_marketable_customer(db *sql.DB, tenant_id string, fn func(Customer) error) error {
+	suppressed, err := get_suppressed_emails(db, tenant_id)
+	if err != nil {
+		return err
+	}
+
+	return each_tenant_customer(db, tenant_id, func(customer Customer) error {
+		if suppressed[normalize_suppressed_email(customer.Email)] {
+			return nil
+		}
+
+		return fn(customer)
+	})
+}
+
+func each_customer_where(db *sql.DB, condition string, fn func(Customer) error, args ...any) error {
+	get_records := `
+	SELECT ` + customer_columns + `
+	FROM customers
+	WHERE ` + condition + `
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		customer, err := scan_customer(rows)
+		if err != nil {
+			return err
+		}
+
+		err = fn(customer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"filippo.io/age"
+)
+
+// ExportRecipient is the age public key exports for a subject are encrypted to
+type ExportRecipient struct {
+	Subject   string `json:"subject"` // the principal subject, e.g. a jwt sub or api_key:<id>
+	Recipient string `json:"recipient"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type ExportRecipientDetails struct {
+	Recipient string `json:"recipient"` // age1...
+}
+
+func register_export_recipient_routes(mux *http.ServeMux, db *sql.DB) {
+	// set the key a subject's exports are encrypted to, replacing any previous one
+	mux.HandleFunc("PUT /api/admin/export-recipients/{subject}", func(w http.ResponseWriter, r *http.Request) {
+		var req ExportRecipientDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = age.ParseX25519Recipient(req.Recipient)
+		if err != nil {
+			http.Error(w, "Invalid recipient, expected an age public key", http.StatusBadRequest)
+			return
+		}
+
+		recipient, err := upsert_export_recipient(db, r.PathValue("subject"), req.Recipient)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[ExportRecipient]{Data: *recipient})
+	})
+
+	mux.HandleFunc("GET /api/admin/export-recipients", func(w http.ResponseWriter, r *http.Request) {
+		recipients, err := get_export_recipients(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]ExportRecipient]{Data: recipients})
+	})
+
+	mux.HandleFunc("DELETE /api/admin/export-recipients/{subject}", func(w http.ResponseWriter, r *http.Request) {
+		err := delete_export_recipient(db, r.PathValue("subject"))
+		if err != nil && err.Error() == "Export recipient not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// export_recipient_for returns the age recipient the caller's exports are encrypted to, nil when none is configured
+func export_recipient_for(db *sql.DB, r *http.Request) (age.Recipient, error) {
+	key, err := get_export_recipient_key(db, actor_from(r))
+	if err != nil || key == "" {
+		return nil, err
+	}
+
+	return age.ParseX25519Recipient(key)
+}
+
+// #region Database
+
+// get_export_recipient_key reads the subject's age recipient, empty when they have none
+func get_export_recipient_key(db *sql.DB, subject string) (string, error) {
+	var key string
+	err := db.QueryRow(`SELECT recipient FROM export_recipients WHERE subject = ?;`, subject).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return key, err
+}
+
+const export_recipient_columns = `subject, recipient, created_at, updated_at`
+
+func scan_export_recipient(row row_scanner) (ExportRecipient, error) {
+	var recipient ExportRecipient
+	err := row.Scan(&recipient.Subject, &recipient.Recipient, &recipient.CreatedAt, &recipient.UpdatedAt)
+	return recipient, err
+}
+
+func upsert_export_recipient(db *sql.DB, subject string, key string) (*ExportRecipient, error) {
+	upsert_record := `
+	INSERT INTO export_recipients (subject, recipient)
+	VALUES (?, ?)
+	ON CONFLICT (subject) DO UPDATE SET recipient = excluded.recipient, updated_at = CURRENT_TIMESTAMP
+	RETURNING ` + export_recipient_columns + `;
+	`
+
+	recipient, err := scan_export_recipient(db.QueryRow(upsert_record, subject, key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &recipient, nil
+}
+
+func get_export_recipients(db *sql.DB) ([]ExportRecipient, error) {
+	rows, err := db.Query(`SELECT ` + export_recipient_columns + ` FROM export_recipients ORDER BY subject;`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	recipients := []ExportRecipient{}
+	for rows.Next() {
+		recipient, err := scan_export_recipient(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, rows.Err()
+}
+
+func delete_export_recipient(db *sql.DB, subject string) error {
+	result, err := exec_with_retry(db, `DELETE FROM export_recipients WHERE subject = ?;`, subject)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("Export recipient not found")
+	}
+
+	return nil
+}
+
+// #endregion
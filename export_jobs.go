@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// export_expiry_interval is how often the files of expired download links are deleted
+const export_expiry_interval = 10 * time.Minute
+
+// export_progress_rows is how many customers an export job writes between progress updates
+const export_progress_rows = 1000
+
+const export_download_purpose = "export_download"
+
+// ExportJob is the payload of an export job, what the caller asked for and what they may see
+type ExportJob struct {
+	Format    string          `json:"format"`
+	Purpose   string          `json:"purpose"`
+	Hidden    map[string]bool `json:"hidden"` // the caller's field policy
+	Masked    map[string]bool `json:"masked"`
+	Recipient string          `json:"recipient"` // the caller's age recipient, the file is encrypted to it when set
+}
+
+// ExportArtifact is the result of an export job, its file is deleted once the link expires
+type ExportArtifact struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Rows        int    `json:"rows"`
+	URL         string `json:"url,omitempty"` // download link, it needs no credentials until expires_at
+	ExpiresAt   string `json:"expires_at"`
+	Expired     bool   `json:"expired,omitempty"`
+	Key         string `json:"key,omitempty"`
+}
+
+// ExportDownloadToken is what a download link carries, signed with the session secret
+type ExportDownloadToken struct {
+	Purpose     string `json:"purpose"`
+	Key         string `json:"key"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"type"`
+	Expires     int64  `json:"exp"`
+	TenantID    string `json:"tid,omitempty"` // picks the tenant's blobs with TENANT_ISOLATION=database
+}
+
+// export_key names the blob of an export, random so the link can't be guessed from another
+func export_key(filename string) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return "exports/" + hex.EncodeToString(buf) + "/" + filename, nil
+}
+
+// run_export writes the export to the blob store and signs a link to it. The file is built in memory, the
+// blob store takes whole files
+func run_export(ctx context.Context, db *sql.DB, blobs BlobStore, sessions *SessionSigner, config Config, job *Job, progress func(percent int)) (*ExportArtifact, error) {
+	var payload ExportJob
+	err := json.Unmarshal(job.Payload, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	export, ok := export_formats[payload.Format]
+	if !ok {
+		return nil, errors.New("Invalid format")
+	}
+
+	customers, err := export_source(db, job.TenantID, payload.Purpose, payload.Hidden, payload.Masked)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int
+	err = db.QueryRow(`SELECT COUNT(*) FROM customers WHERE tenant_id = ?;`, job.TenantID).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	// marketing exports skip some, so progress stops short of 100 until the job is done
+	rows := 0
+	counted := CustomerIterator(func(fn func(Customer) error) error {
+		return customers(func(c Customer) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			rows++
+			if rows%export_progress_rows == 0 && total > 0 {
+				progress(min(rows*100/total, 99))
+			}
+			return fn(c)
+		})
+	})
+
+	var buf bytes.Buffer
+	if payload.Recipient == "" {
+		err = export(&buf, counted)
+	} else {
+		var recipient age.Recipient
+		recipient, err = age.ParseX25519Recipient(payload.Recipient)
+		if err == nil {
+			err = export_encrypted(&buf, recipient, export, counted)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	filename, content_type := export_file(payload.Format, payload.Recipient != "")
+	key, err := export_key(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = blobs.Put(ctx, key, buf.Bytes(), content_type)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(config.ExportLinkTTL)
+	token, err := sessions.Encode(ExportDownloadToken{
+		Purpose:     export_download_purpose,
+		Key:         key,
+		Filename:    filename,
+		ContentType: content_type,
+		Expires:     expires.Unix(),
+		TenantID:    job.TenantID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExportArtifact{
+		Filename:    filename,
+		ContentType: content_type,
+		Size:        buf.Len(),
+		Rows:        rows,
+		URL:         strings.TrimSuffix(config.PublicURL, "/") + "/exports?token=" + url.QueryEscape(token),
+		ExpiresAt:   expires.UTC().Format(time.RFC3339),
+		Key:         key,
+	}, nil
+}
+
+// run_export_expiry deletes the files of export jobs whose links expired, the jobs keep their results
+func run_export_expiry(ctx context.Context, db *sql.DB, blobs BlobStore) {
+	ticker := time.NewTicker(export_expiry_interval)
+	defer ticker.Stop()
+
+	for {
+		err := expire_exports(ctx, db, blobs)
+		if err != nil {
+			println("expiring exports failed:", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func expire_exports(ctx context.Context, db *sql.DB, blobs BlobStore) error {
+	exports, err := get_expired_exports(db)
+	if err != nil {
+		return err
+	}
+
+	for id, key := range exports {
+		err = blobs.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		err = set_export_expired(db, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func register_export_job_routes(mux *http.ServeMux, db *sql.DB, config Config, blobs BlobStore, sessions *SessionSigner) {
+	// export in the background, for exports too large to stream in one request. Takes the parameters of
+	// GET /customers/export, poll the job in the response for the download link
+	mux.HandleFunc("POST /api/customers/export", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+
+		_, ok := export_formats[format]
+		if !ok {
+			http.Error(w, "Invalid format", http.StatusBadRequest)
+			return
+		}
+
+		purpose := r.URL.Query().Get("purpose")
+		if purpose != "" && purpose != "marketing" {
+			http.Error(w, "Invalid purpose", http.StatusBadRequest)
+			return
+		}
+
+		// callers with an export recipient only ever get ciphertext
+		recipient, err := get_export_recipient_key(db, actor_from(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if recipient == "" && config.ExportRequireEncryption {
+			http.Error(w, "No export recipient key is configured for "+actor_from(r), http.StatusForbidden)
+			return
+		}
+
+		id, err := enqueue_job(db, config, NewJob{
+			TenantID: tenant_from(r),
+			Type:     "export",
+			Payload: ExportJob{
+				Format:    format,
+				Purpose:   purpose,
+				Hidden:    request_hidden_fields(r),
+				Masked:    request_masked_fields(r),
+				Recipient: recipient,
+			},
+			CreatedBy: actor_from(r),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		job, err := get_job(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", "/api/jobs/"+strconv.FormatInt(id, 10))
+		write_json_response(w, http.StatusAccepted, ApiResponse[Job]{Data: *job})
+	})
+
+	// the download link of a finished export, public until it expires so it can be handed to whoever needs the file
+	mux.HandleFunc("GET /exports", func(w http.ResponseWriter, r *http.Request) {
+		var token ExportDownloadToken
+		err := sessions.Decode(r.URL.Query().Get("token"), export_download_purpose, &token)
+		if err != nil {
+			http.Error(w, "Invalid download link", http.StatusBadRequest)
+			return
+		}
+
+		if time.Now().Unix() > token.Expires {
+			http.Error(w, "Download link has expired, export again", http.StatusGone)
+			return
+		}
+
+		// the link is public so the tenant comes from the token, not the request
+		store := blobs
+		if tenant_databases != nil && token.TenantID != "" && token.TenantID != default_tenant {
+			store = tenant_blobs(blobs, token.TenantID)
+		}
+
+		data, err := store.Get(r.Context(), token.Key)
+		if err != nil && err.Error() == "Blob not found" {
+			http.Error(w, "Download link has expired, export again", http.StatusGone)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", token.ContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+token.Filename+`"`)
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Write(data)
+	})
+}
+
+// #region Database
+
+// get_expired_exports reads the blob keys of export jobs whose links expired, by job id
+func get_expired_exports(db *sql.DB) (map[int64]string, error) {
+	get_records := `
+	SELECT id, json_extract(result, '$.key')
+	FROM jobs
+	WHERE type = 'export' AND status = 'succeeded' AND json_extract(result, '$.key') IS NOT NULL
+		AND json_extract(result, '$.expires_at') <= strftime('%Y-%m-%dT%H:%M:%SZ', 'now');
+	`
+
+	rows, err := db.Query(get_records)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	exports := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var key string
+		err = rows.Scan(&id, &key)
+		if err != nil {
+			return nil, err
+		}
+
+		exports[id] = key
+	}
+
+	return exports, rows.Err()
+}
+
+func set_export_expired(db *sql.DB, id int64) error {
+	_, err := exec_with_retry(db, `UPDATE jobs SET result = json_set(json_remove(result, '$.key', '$.url'), '$.expired', json('true')), updated_at = CURRENT_TIMESTAMP WHERE id = ?;`, id)
+	return err
+}
+
+// #endregion
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldPolicy limits which customer fields a role sees, by json name. Visible is an allow list,
+// hidden a deny list, either may be left out. Masked fields are shown partly, only email, contact
+// and dob can be masked
+type FieldPolicy struct {
+	Visible []string `yaml:"visible"`
+	Hidden  []string `yaml:"hidden"`
+	Masked  []string `yaml:"masked"`
+}
+
+// FieldPolicyFile is the layout of FIELD_POLICY_FILE, e.g.
+//
+//	roles:
+//	  intern:
+//	    hidden: [dob]
+//	  read_only:
+//	    masked: [email, contact, dob]
+//	  webhook:
+//	    visible: [id, name, external_id]
+type FieldPolicyFile struct {
+	Roles map[string]FieldPolicy `yaml:"roles"`
+}
+
+// field_policies is loaded once at startup, empty means every role sees every field
+var field_policies = map[string]FieldPolicy{}
+
+// customer_fields maps json names to the Customer struct field index, id and links are always visible
+var customer_fields = func() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(Customer{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" && name != "id" && name != "links" {
+			fields[name] = i
+		}
+	}
+
+	return fields
+}()
+
+func load_field_policies(path string) (map[string]FieldPolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file FieldPolicyFile
+	err = yaml.Unmarshal(content, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	// a typo would otherwise silently expose the field it meant to hide
+	for role, policy := range file.Roles {
+		for _, field := range append(policy.Visible, policy.Hidden...) {
+			_, ok := customer_fields[field]
+			if !ok && field != "id" {
+				return nil, errors.New("field policy for " + role + " names unknown field " + field)
+			}
+		}
+
+		for _, field := range policy.Masked {
+			if field_masks[field] == nil {
+				return nil, errors.New("field policy for " + role + " masks " + field + ", only email, contact and dob can be masked")
+			}
+		}
+	}
+
+	return file.Roles, nil
+}
+
+// hidden_fields is the union of what each role's policy hides, the most restrictive role wins
+func hidden_fields(roles []string) map[string]bool {
+	hidden := map[string]bool{}
+	for _, role := range roles {
+		policy, ok := field_policies[role]
+		if !ok {
+			continue
+		}
+
+		if len(policy.Visible) > 0 {
+			visible := map[string]bool{}
+			for _, field := range policy.Visible {
+				visible[field] = true
+			}
+			for field := range customer_fields {
+				if !visible[field] {
+					hidden[field] = true
+				}
+			}
+		}
+
+		for _, field := range policy.Hidden {
+			hidden[field] = true
+		}
+	}
+
+	for field, points := range contact_field_points {
+		if hidden[field] {
+			hidden[points] = true
+		}
+	}
+
+	return hidden
+}
+
+// request_hidden_fields is what the caller may not see, nothing is hidden when auth is disabled
+func request_hidden_fields(r *http.Request) map[string]bool {
+	principal := principal_from(r)
+	if principal == nil {
+		return nil
+	}
+
+	return hidden_fields(principal.Roles)
+}
+
+// masked_fields is the union of what each role's policy masks, like hidden_fields
+func masked_fields(roles []string) map[string]bool {
+	masked := map[string]bool{}
+	for _, role := range roles {
+		for _, field := range field_policies[role].Masked {
+			masked[field] = true
+		}
+	}
+
+	return masked
+}
+
+// request_masked_fields is what the caller sees masked, nothing is masked when auth is disabled
+func request_masked_fields(r *http.Request) map[string]bool {
+	principal := principal_from(r)
+	if principal == nil {
+		return nil
+	}
+
+	return masked_fields(principal.Roles)
+}
+
+// field_masks are the fields a policy can mask and how, empty values stay empty
+var field_masks = map[string]func(string) string{
+	"email":   mask_email,
+	"contact": mask_contact,
+	"dob":     mask_dob,
+}
+
+// mask_email keeps the first letter and the domain, john@example.com is j***@example.com
+func mask_email(value string) string {
+	local, domain, ok := strings.Cut(value, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+
+	return string([]rune(local)[:1]) + "***@" + domain
+}
+
+// mask_contact keeps the last four digits and the formatting, +60123456781 is +*******6781
+func mask_contact(value string) string {
+	digits := 0
+	for _, r := range value {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return r
+		}
+		digits--
+		if digits < 4 {
+			return r
+		}
+		return '*'
+	}, value)
+}
+
+// mask_dob keeps the year, 1990-01-05 is 1990-**-**
+func mask_dob(value string) string {
+	year, _, ok := strings.Cut(value, "-")
+	if !ok {
+		return "****-**-**"
+	}
+
+	return year + "-**-**"
+}
+
+// mask_customer masks the fields and their contact point lists. The lists are copied, cached customers
+// share them
+func mask_customer(masked map[string]bool, customer *Customer) {
+	if len(masked) == 0 {
+		return
+	}
+
+	value := reflect.ValueOf(customer).Elem()
+	for field := range masked {
+		mask := field_masks[field]
+		column := value.Field(customer_fields[field])
+		if column.String() != "" {
+			column.SetString(mask(column.String()))
+		}
+
+		list, ok := contact_field_points[field]
+		if !ok {
+			continue
+		}
+
+		points := value.Field(customer_fields[list])
+		if points.Len() == 0 {
+			continue
+		}
+
+		copied := make([]ContactPoint, points.Len())
+		for i := range copied {
+			copied[i] = points.Index(i).Interface().(ContactPoint)
+			copied[i].Value = mask(copied[i].Value)
+		}
+		points.Set(reflect.ValueOf(copied))
+	}
+}
+
+// shape_customer zeroes the hidden fields, it runs before localize so derived dates follow the policy
+func shape_customer(hidden map[string]bool, customer *Customer) {
+	if len(hidden) == 0 {
+		return
+	}
+
+	value := reflect.ValueOf(customer).Elem()
+	for field := range hidden {
+		index, ok := customer_fields[field]
+		if ok {
+			field := value.Field(index)
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+}
+
+// shape_payload drops hidden fields from an event payload, customer payloads share the Customer json names
+func shape_payload(hidden map[string]bool, payload json.RawMessage) json.RawMessage {
+	if len(hidden) == 0 {
+		return payload
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(payload, &fields)
+	if err != nil {
+		return payload
+	}
+
+	for field := range hidden {
+		delete(fields, field)
+	}
+
+	shaped, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+
+	return shaped
+}
+
+// mask_payload masks fields of an event payload and their contact point lists, like mask_customer
+func mask_payload(masked map[string]bool, payload json.RawMessage) json.RawMessage {
+	if len(masked) == 0 {
+		return payload
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(payload, &fields)
+	if err != nil {
+		return payload
+	}
+
+	for field, value := range fields {
+		mask := payload_mask(masked, field)
+		if mask != nil {
+			fields[field] = mask_json(mask, value)
+		}
+	}
+
+	shaped, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+
+	return shaped
+}
+
+// mask_changes masks the old and new values of changes to masked fields
+func mask_changes(masked map[string]bool, changes []FieldChange) []FieldChange {
+	if len(masked) == 0 || len(changes) == 0 {
+		return changes
+	}
+
+	shaped := make([]FieldChange, len(changes))
+	for i, change := range changes {
+		shaped[i] = change
+		mask := payload_mask(masked, change.Field)
+		if mask != nil {
+			shaped[i].Old = mask_json(mask, change.Old)
+			shaped[i].New = mask_json(mask, change.New)
+		}
+	}
+
+	return shaped
+}
+
+// payload_mask is how a payload field is masked, a contact point list as its field is, nil when it isn't
+func payload_mask(masked map[string]bool, field string) func(string) string {
+	if masked[field] {
+		return field_masks[field]
+	}
+
+	for single, list := range contact_field_points {
+		if list == field && masked[single] {
+			return field_masks[single]
+		}
+	}
+
+	return nil
+}
+
+// mask_json masks a json string, or the values of a list of contact points, other values are left as they are
+func mask_json(mask func(string) string, value json.RawMessage) json.RawMessage {
+	var str string
+	if json.Unmarshal(value, &str) == nil {
+		if str == "" {
+			return value
+		}
+
+		masked, _ := json.Marshal(mask(str))
+		return masked
+	}
+
+	var points []ContactPoint
+	if json.Unmarshal(value, &points) == nil && len(points) > 0 {
+		for i := range points {
+			points[i].Value = mask(points[i].Value)
+		}
+
+		masked, err := json.Marshal(points)
+		if err == nil {
+			return masked
+		}
+	}
+
+	return value
+}
+
+// shape_event applies a field policy to an event about to leave the api, over http, a stream or a bus. The
+// event is copied, live events are shared between subscribers
+func shape_event(hidden map[string]bool, masked map[string]bool, event CustomerEvent) CustomerEvent {
+	event.Payload = mask_payload(masked, shape_payload(hidden, event.Payload))
+	event.Changes = mask_changes(masked, shape_changes(hidden, event.Changes))
+	return event
+}
+
+// present_customer applies the caller's field policy and locale to a customer about to be returned,
+// and links the routes that act on it
+func present_customer(r *http.Request, customer *Customer) {
+	hidden := request_hidden_fields(r)
+	shape_customer(hidden, customer)
+	mask_customer(request_masked_fields(r), customer)
+
+	// derived after shaping, so hiding or masking dob hides the age and hiding email the disposable flag
+	if !hidden["age"] {
+		customer.Age = customer_age(customer.DOB, time.Now().UTC())
+	}
+	if email_options.Disposable != "off" && customer.Email != "" && !hidden["disposable_email"] {
+		disposable := is_disposable_email(customer.Email)
+		customer.DisposableEmail = &disposable
+	}
+
+	localize(r, customer)
+	customer.Links = customer_links(r, customer.ID)
+}
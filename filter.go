@@ -0,0 +1,461 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// max_filter_conditions bounds how many comparisons one ?filter= may make
+const max_filter_conditions = 32
+
+// FilterNode is the parsed ?filter= expression, e.g. name co "an" and (status eq "active" or not blocked eq true)
+type FilterNode struct {
+	Op       string        // and, or, not, or a comparison operator
+	Children []*FilterNode // the operands of and, or and not
+	Field    string        // for comparisons
+	Value    *filter_token // nil for pr
+}
+
+// filter_fields maps the fields a filter may name to their columns and how values compare
+var filter_fields = map[string]struct {
+	column string
+	kind   string // text, number, time, date, bool or one of the special cases in compile_comparison
+}{
+	"id":                      {"id", "number"},
+	"version":                 {"version", "number"},
+	"name":                    {"name", "text"},
+	"country":                 {"country", "text"},
+	"status":                  {"status", "text"},
+	"external_id":             {"external_id", "text"},
+	"referral_code":           {"referral_code", "text"},
+	"company_id":              {"company_id", "number"},
+	"referred_by_customer_id": {"referred_by_customer_id", "number"},
+	"created_at":              {"created_at", "time"},
+	"updated_at":              {"updated_at", "time"},
+	"archived_at":             {"archived_at", "time"},
+	"email_verified_at":       {"email_verified_at", "time"},
+	"dob":                     {"dob", "date"},
+	"blocked":                 {"blocked_at IS NOT NULL", "bool"},
+	"verified":                {"email_verified_at IS NOT NULL", "bool"},
+	"email":                   {"email", "email"},
+	"contact":                 {"contact", "contact"},
+	"tags":                    {"tags", "tag"},
+}
+
+var filter_operators = map[string]string{
+	"eq": "=",
+	"ne": "!=",
+	"gt": ">",
+	"ge": ">=",
+	"lt": "<",
+	"le": "<=",
+	"co": "LIKE",
+	"sw": "LIKE",
+	"ew": "LIKE",
+	"pr": "",
+}
+
+type filter_token struct {
+	kind  string // word, string, number, ( or )
+	text  string // the word as written, the unquoted string or the number
+	index int    // where it starts in the expression, for errors
+}
+
+func filter_error(index int, message string) error {
+	return &ValidationError{Field: "filter", Message: message + " at position " + strconv.Itoa(index+1)}
+}
+
+func lex_filter(expression string) ([]filter_token, error) {
+	var tokens []filter_token
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, filter_token{kind: string(r), text: string(r), index: i})
+			i++
+		case r == '"':
+			var value strings.Builder
+			start := i
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, filter_error(start, "unterminated string")
+			}
+			tokens = append(tokens, filter_token{kind: "string", text: value.String(), index: start})
+			i++
+		case r == '-' || unicode.IsDigit(r):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			_, err := strconv.ParseFloat(string(runes[start:i]), 64)
+			if err != nil {
+				return nil, filter_error(start, "invalid number")
+			}
+			tokens = append(tokens, filter_token{kind: "number", text: string(runes[start:i]), index: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_.-", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, filter_token{kind: "word", text: string(runes[start:i]), index: start})
+		default:
+			return nil, filter_error(i, "unexpected "+strconv.QuoteRune(r))
+		}
+	}
+
+	return tokens, nil
+}
+
+type filter_parser struct {
+	tokens     []filter_token
+	position   int
+	end        int
+	conditions int
+}
+
+func (p *filter_parser) peek() *filter_token {
+	if p.position >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.position]
+}
+
+func (p *filter_parser) keyword(word string) bool {
+	token := p.peek()
+	if token != nil && token.kind == "word" && strings.EqualFold(token.text, word) {
+		p.position++
+		return true
+	}
+	return false
+}
+
+// parse_filter reads or binding looser than and, and and looser than not, parentheses group
+func parse_filter(expression string) (*FilterNode, error) {
+	tokens, err := lex_filter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filter_parser{tokens: tokens, end: len([]rune(expression))}
+	node, err := parser.parse_or()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token != nil {
+		return nil, filter_error(token.index, "unexpected "+token.text)
+	}
+
+	return node, nil
+}
+
+func (p *filter_parser) parse_or() (*FilterNode, error) {
+	return p.parse_joined("or", p.parse_and)
+}
+
+func (p *filter_parser) parse_and() (*FilterNode, error) {
+	return p.parse_joined("and", p.parse_not)
+}
+
+func (p *filter_parser) parse_joined(op string, parse_operand func() (*FilterNode, error)) (*FilterNode, error) {
+	node, err := parse_operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword(op) {
+		operand, err := parse_operand()
+		if err != nil {
+			return nil, err
+		}
+
+		if node.Op != op {
+			node = &FilterNode{Op: op, Children: []*FilterNode{node}}
+		}
+		node.Children = append(node.Children, operand)
+	}
+
+	return node, nil
+}
+
+func (p *filter_parser) parse_not() (*FilterNode, error) {
+	if p.keyword("not") {
+		operand, err := p.parse_not()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterNode{Op: "not", Children: []*FilterNode{operand}}, nil
+	}
+
+	token := p.peek()
+	if token != nil && token.kind == "(" {
+		p.position++
+		node, err := p.parse_or()
+		if err != nil {
+			return nil, err
+		}
+
+		closing := p.peek()
+		if closing == nil || closing.kind != ")" {
+			return nil, filter_error(p.index(), "expected )")
+		}
+		p.position++
+		return node, nil
+	}
+
+	return p.parse_comparison()
+}
+
+// index is where the next token starts, or the end of the expression
+func (p *filter_parser) index() int {
+	if token := p.peek(); token != nil {
+		return token.index
+	}
+	return p.end
+}
+
+func (p *filter_parser) parse_comparison() (*FilterNode, error) {
+	field := p.peek()
+	if field == nil || field.kind != "word" {
+		return nil, filter_error(p.index(), "expected a field")
+	}
+	p.position++
+
+	p.conditions++
+	if p.conditions > max_filter_conditions {
+		return nil, filter_error(field.index, "too many conditions, at most "+strconv.Itoa(max_filter_conditions))
+	}
+
+	operator := p.peek()
+	if operator == nil || operator.kind != "word" {
+		return nil, filter_error(p.index(), "expected an operator after "+field.text)
+	}
+
+	op := strings.ToLower(operator.text)
+	if _, ok := filter_operators[op]; !ok {
+		return nil, filter_error(operator.index, "unknown operator "+operator.text+", use eq, ne, co, sw, ew, gt, ge, lt, le or pr")
+	}
+	p.position++
+
+	node := &FilterNode{Op: op, Field: field.text}
+	if op == "pr" {
+		return node, nil
+	}
+
+	value := p.peek()
+	if value == nil || (value.kind != "string" && value.kind != "number" && value.kind != "word") {
+		return nil, filter_error(p.index(), "expected a value after "+operator.text)
+	}
+	if value.kind == "word" && value.text != "true" && value.text != "false" {
+		return nil, filter_error(value.index, "strings must be quoted")
+	}
+	p.position++
+
+	node.Value = value
+	return node, nil
+}
+
+// compile_filter turns the expression into a sql condition on customers, values only ever become args
+func compile_filter(node *FilterNode) (string, []any, error) {
+	switch node.Op {
+	case "and", "or":
+		var conditions []string
+		var args []any
+		for _, child := range node.Children {
+			condition, child_args, err := compile_filter(child)
+			if err != nil {
+				return "", nil, err
+			}
+			conditions = append(conditions, "("+condition+")")
+			args = append(args, child_args...)
+		}
+		return strings.Join(conditions, " "+strings.ToUpper(node.Op)+" "), args, nil
+	case "not":
+		condition, args, err := compile_filter(node.Children[0])
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT (" + condition + ")", args, nil
+	}
+
+	return compile_comparison(node)
+}
+
+// like_pattern escapes the value for LIKE ... ESCAPE '\'
+func like_pattern(op string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+	switch op {
+	case "co":
+		return "%" + value + "%"
+	case "sw":
+		return value + "%"
+	default:
+		return "%" + value
+	}
+}
+
+func filter_time(value string) (string, bool, bool) {
+	date, err := time.Parse("2006-01-02", value)
+	if err == nil {
+		return date.Format("2006-01-02"), true, true
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return timestamp.UTC().Format("2006-01-02 15:04:05"), false, true
+	}
+
+	return "", false, false
+}
+
+func compile_comparison(node *FilterNode) (string, []any, error) {
+	field, ok := filter_fields[node.Field]
+	var metadata_path string
+	if !ok {
+		key, is_metadata := strings.CutPrefix(node.Field, "metadata.")
+		if !is_metadata {
+			return "", nil, &ValidationError{Field: "filter", Message: "unknown field " + node.Field}
+		}
+
+		metadata_path = "$"
+		for _, segment := range strings.Split(key, ".") {
+			if !metadata_key_pattern.MatchString(segment) {
+				return "", nil, &ValidationError{Field: "filter", Message: node.Field + ": keys must be letters, digits, _ or -"}
+			}
+			metadata_path += `."` + segment + `"`
+		}
+		field.kind = "metadata"
+	}
+
+	unsupported := &ValidationError{Field: "filter", Message: node.Field + " does not support " + node.Op}
+	operator := filter_operators[node.Op]
+	is_like := operator == "LIKE"
+	var value string
+	if node.Value != nil {
+		value = node.Value.text
+	}
+
+	switch field.kind {
+	case "text", "metadata":
+		column := "COALESCE(" + field.column + ", '')"
+		var args []any
+		if field.kind == "metadata" {
+			column = `COALESCE(CASE json_type(metadata, ?) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(json_extract(metadata, ?) AS TEXT) END, '')`
+			args = []any{metadata_path, metadata_path}
+		}
+		if node.Op == "pr" {
+			return column + " != ''", args, nil
+		}
+		if is_like {
+			return column + ` LIKE ? ESCAPE '\'`, append(args, like_pattern(node.Op, value)), nil
+		}
+		return column + " " + operator + " ?", append(args, value), nil
+	case "number":
+		if node.Op == "pr" {
+			return field.column + " IS NOT NULL", nil, nil
+		}
+		if is_like || node.Value.kind != "number" {
+			return "", nil, &ValidationError{Field: "filter", Message: node.Field + " compares with numbers"}
+		}
+		number, _ := strconv.ParseFloat(value, 64)
+		return field.column + " " + operator + " ?", []any{number}, nil
+	case "time", "date":
+		if field.kind == "date" && pii_cipher != nil {
+			return "", nil, &ValidationError{Field: "filter", Message: "dob is unavailable while PII_ENCRYPTION_KEY is set"}
+		}
+		if node.Op == "pr" {
+			return "COALESCE(" + field.column + ", '') != ''", nil, nil
+		}
+		if is_like {
+			return "", nil, unsupported
+		}
+		formatted, date_only, ok := filter_time(value)
+		if !ok {
+			return "", nil, &ValidationError{Field: "filter", Message: node.Field + " compares with a date, YYYY-MM-DD, or an rfc 3339 time"}
+		}
+		if date_only {
+			return "date(" + field.column + ") " + operator + " ?", []any{formatted}, nil
+		}
+		return field.column + " " + operator + " ?", []any{formatted}, nil
+	case "bool":
+		if node.Op != "eq" && node.Op != "ne" {
+			return "", nil, unsupported
+		}
+		if value != "true" && value != "false" {
+			return "", nil, &ValidationError{Field: "filter", Message: node.Field + " compares with true or false"}
+		}
+		if (value == "true") != (node.Op == "eq") {
+			return "NOT (" + field.column + ")", nil, nil
+		}
+		return field.column, nil, nil
+	case "email", "contact":
+		// matched through the blind index, which only answers equality
+		index_column := field.column + "_index"
+		if node.Op == "pr" {
+			return "COALESCE(" + field.column + ", '') != ''", nil, nil
+		}
+		if node.Op != "eq" && node.Op != "ne" {
+			return "", nil, unsupported
+		}
+
+		normalized := canonical_email(value)
+		if field.kind == "contact" {
+			var err error
+			normalized, err = normalize_phone(value, "")
+			if err != nil {
+				return "", nil, &ValidationError{Field: "filter", Message: err.Error()}
+			}
+		}
+
+		indexes := pii_lookup_indexes(field.column, normalized)
+		args := make([]any, len(indexes))
+		for i, index := range indexes {
+			args[i] = index
+		}
+		condition := "COALESCE(" + index_column + ", '') IN (?" + strings.Repeat(", ?", len(indexes)-1) + ")"
+		if node.Op == "ne" {
+			condition = "NOT (" + condition + ")"
+		}
+		return condition, args, nil
+	case "tag":
+		if node.Op == "pr" {
+			return "id IN (SELECT customer_id FROM customer_tags)", nil, nil
+		}
+		if node.Op != "eq" && node.Op != "ne" {
+			return "", nil, unsupported
+		}
+		condition := "id IN (SELECT customer_id FROM customer_tags WHERE tag = ?)"
+		if node.Op == "ne" {
+			condition = "NOT (" + condition + ")"
+		}
+		return condition, []any{value}, nil
+	}
+
+	return "", nil, unsupported
+}
+
+// listing_filter reads ?filter= as a sql condition and its args, empty when not given
+func listing_filter(expression string) (string, []any, error) {
+	if strings.TrimSpace(expression) == "" {
+		return "", nil, nil
+	}
+
+	node, err := parse_filter(expression)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return compile_filter(node)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FixturesFile is the layout of the seed file, yaml or json since json is valid yaml
+type FixturesFile struct {
+	Customers []CustomerFixture `yaml:"customers"`
+}
+
+type CustomerFixture struct {
+	ExternalID string `yaml:"external_id"`
+	Name       string `yaml:"name"`
+	DOB        string `yaml:"dob"`
+	Email      string `yaml:"email"`
+	Contact    string `yaml:"contact"`
+	Country    string `yaml:"country"`
+}
+
+// load_fixtures upserts every fixture by external id, so rebooting with the same file changes nothing
+func load_fixtures(db *sql.DB, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fixtures FixturesFile
+	err = yaml.Unmarshal(content, &fixtures)
+	if err != nil {
+		return err
+	}
+
+	created, updated := 0, 0
+	for i, fixture := range fixtures.Customers {
+		if fixture.ExternalID == "" {
+			return errors.New("fixture " + strconv.Itoa(i) + " is missing external_id")
+		}
+
+		dob := strings.TrimSpace(fixture.DOB)
+		if dob != "" {
+			dob, err = normalize_dob(dob)
+			if err != nil {
+				return errors.New("fixture " + fixture.ExternalID + ": " + err.Error())
+			}
+		}
+
+		contact := strings.TrimSpace(fixture.Contact)
+		if contact != "" {
+			contact, err = normalize_phone(contact, fixture.Country)
+			if err != nil {
+				return errors.New("fixture " + fixture.ExternalID + ": " + err.Error())
+			}
+		}
+
+		details := CustomerDetails{
+			Name:       fixture.Name,
+			DOB:        dob,
+			Email:      canonical_email(fixture.Email),
+			Contact:    contact,
+			Country:    strings.ToUpper(fixture.Country),
+			ExternalID: fixture.ExternalID,
+		}
+
+		existing, err := get_customer_by_external_id(db, default_tenant, fixture.ExternalID)
+		if err != nil && err.Error() != "Customer not found" {
+			return err
+		}
+
+		if existing == nil {
+			_, err = create_customer(db, default_tenant, details)
+			if err != nil {
+				return err
+			}
+			created++
+			continue
+		}
+
+		if existing.Name == details.Name && existing.DOB == details.DOB && existing.Email == details.Email && existing.Contact == details.Contact && existing.Country == details.Country {
+			continue
+		}
+
+		_, err = update_customer(db, existing.ID, 0, details)
+		if err != nil {
+			return err
+		}
+		updated++
+	}
+
+	println("fixtures loaded:", created, "created,", updated, "updated")
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"filippo.io/age"
+)
+
+// GdprExport is everything stored about one customer, the answer to a subject access request
+type GdprExport struct {
+	ExportedAt        string             `json:"exported_at"`
+	Customer          Customer           `json:"customer"`
+	Company           *Company           `json:"company"`
+	Tags              []string           `json:"tags"`
+	Addresses         []Address          `json:"addresses"`
+	Notes             []CustomerNote     `json:"notes"`
+	Relationships     []Relationship     `json:"relationships"`
+	StatusTransitions []StatusTransition `json:"status_transitions"`
+	Attachments       []Attachment       `json:"attachments"` // the files are downloaded one by one
+	Consents          []Consent          `json:"consents"`
+	EmailSuppression  *EmailSuppression  `json:"email_suppression"`
+	Versions          []CustomerVersion  `json:"versions"`
+	Events            []CustomerEvent    `json:"events"`
+	AuditLogs         []AuditLog         `json:"audit_logs"`
+}
+
+// gdpr_export_customer compiles the export, shaped by the caller's field policy like every other read
+func gdpr_export_customer(db *sql.DB, id int64, hidden map[string]bool, masked map[string]bool) (*GdprExport, error) {
+	customer, err := get_customer(db, id)
+	if err != nil {
+		return nil, err
+	}
+	shape_customer(hidden, customer)
+
+	export := GdprExport{
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Customer:   *customer,
+	}
+
+	if customer.CompanyID != nil {
+		export.Company, err = get_company(db, *customer.CompanyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	export.Tags, err = get_customer_tags(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Addresses, err = get_addresses(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Notes, _, err = get_customer_notes(db, id, 0, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Relationships, err = get_relationships(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	export.StatusTransitions, err = get_status_transitions(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Attachments, err = get_attachments(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Consents, err = get_consents(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// suppressions are kept per tenant
+	tenant_id, err := get_owning_tenant(db, "customers", id)
+	if err != nil {
+		return nil, err
+	}
+
+	export.EmailSuppression, err = get_suppression(db, tenant_id, customer.Email)
+	if err != nil && err.Error() != "Suppression not found" {
+		return nil, err
+	}
+
+	export.Versions, _, err = get_customer_versions(db, id, 0, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	for i := range export.Versions {
+		shape_version(hidden, masked, &export.Versions[i])
+	}
+
+	export.Events, err = get_customer_events(db, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range export.Events {
+		export.Events[i] = shape_event(hidden, masked, export.Events[i])
+	}
+
+	export.AuditLogs, err = get_customer_audit_logs(db, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range export.AuditLogs {
+		export.AuditLogs[i].Before = mask_payload(masked, shape_payload(hidden, export.AuditLogs[i].Before))
+		export.AuditLogs[i].After = mask_payload(masked, shape_payload(hidden, export.AuditLogs[i].After))
+	}
+
+	return &export, nil
+}
+
+// gdpr_export serves the export as a json file to download. Callers with an export recipient get it
+// encrypted, as with the bulk export
+func gdpr_export(db *sql.DB, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		export, err := gdpr_export_customer(db, id, request_hidden_fields(r), request_masked_fields(r))
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		export_str, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		recipient, err := export_recipient_for(db, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if recipient == nil && config.ExportRequireEncryption {
+			http.Error(w, "No export recipient key is configured for "+actor_from(r), http.StatusForbidden)
+			return
+		}
+
+		filename := "customer-" + strconv.FormatInt(id, 10) + "-gdpr-export.json"
+		content_type := "application/json"
+		if recipient != nil {
+			filename += ".age"
+			content_type = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", content_type)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.Header().Set("Cache-Control", "no-store")
+
+		if recipient == nil {
+			w.Write(export_str)
+			return
+		}
+
+		encrypted, err := age.Encrypt(w, recipient)
+		if err == nil {
+			_, err = encrypted.Write(export_str)
+		}
+		if err == nil {
+			err = encrypted.Close()
+		}
+		if err != nil {
+			println("gdpr export failed:", err.Error())
+		}
+	}
+}
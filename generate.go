@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generate_batch_size is how many generated customers go into one transaction
+const generate_batch_size = 100
+
+// generate_max_errors caps the validation failures a generate response lists
+const generate_max_errors = 10
+
+// FakeLocale is what generated customers of one locale look like, the phone is drawn until it is a valid number
+type FakeLocale struct {
+	Country    string
+	FirstNames []string
+	LastNames  []string
+	Phone      func(r *rand.Rand) string
+}
+
+// fake_locales are the locales ?locale= picks from, all of them by default
+var fake_locales = map[string]FakeLocale{
+	"en_US": {
+		Country:    "US",
+		FirstNames: []string{"James", "Mary", "Robert", "Patricia", "John", "Jennifer", "Michael", "Linda", "David", "Elizabeth", "William", "Susan", "Emily", "Daniel", "Olivia", "Ethan"},
+		LastNames:  []string{"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Rodriguez", "Martinez", "Wilson", "Anderson", "Taylor", "Thomas"},
+		Phone: func(r *rand.Rand) string {
+			areas := []string{"201", "212", "305", "312", "415", "512", "617", "702", "808", "919"}
+			return "+1" + areas[r.IntN(len(areas))] + strconv.Itoa(200+r.IntN(800)) + digits(r, 4)
+		},
+	},
+	"en_GB": {
+		Country:    "GB",
+		FirstNames: []string{"Oliver", "Amelia", "George", "Isla", "Harry", "Ava", "Jack", "Mia", "Charlie", "Sophie", "Thomas", "Grace", "Alfie", "Lily"},
+		LastNames:  []string{"Smith", "Jones", "Taylor", "Brown", "Williams", "Wilson", "Johnson", "Davies", "Evans", "Walker", "Wright", "Thompson", "Hughes", "Roberts"},
+		Phone: func(r *rand.Rand) string {
+			return "+447" + []string{"400", "700", "800", "911", "949"}[r.IntN(5)] + digits(r, 6)
+		},
+	},
+	"ms_MY": {
+		Country:    "MY",
+		FirstNames: []string{"Ahmad", "Nur", "Muhammad", "Siti", "Aiman", "Aisyah", "Hafiz", "Farah", "Wei Jie", "Mei Ling", "Arjun", "Kavitha", "Zul", "Amira"},
+		LastNames:  []string{"Abdullah", "Ibrahim", "Ismail", "Rahman", "Hassan", "Tan", "Lim", "Lee", "Wong", "Ng", "Raj", "Kumar", "Yusof", "Osman"},
+		Phone: func(r *rand.Rand) string {
+			return "+601" + []string{"2", "3", "6", "7", "9"}[r.IntN(5)] + digits(r, 7)
+		},
+	},
+	"id_ID": {
+		Country:    "ID",
+		FirstNames: []string{"Budi", "Siti", "Agus", "Dewi", "Andi", "Sri", "Rizky", "Putri", "Dimas", "Ayu", "Fajar", "Indah", "Yoga", "Wulan"},
+		LastNames:  []string{"Santoso", "Wijaya", "Saputra", "Hidayat", "Kurniawan", "Pratama", "Setiawan", "Lestari", "Nugroho", "Susanto", "Gunawan", "Halim"},
+		Phone: func(r *rand.Rand) string {
+			return "+628" + []string{"11", "12", "13", "21", "52", "57"}[r.IntN(6)] + digits(r, 8)
+		},
+	},
+	"en_SG": {
+		Country:    "SG",
+		FirstNames: []string{"Wei Ming", "Hui Min", "Jun Jie", "Xin Yi", "Darren", "Rachel", "Marcus", "Nicole", "Hakim", "Nurul", "Vikram", "Priya"},
+		LastNames:  []string{"Tan", "Lim", "Lee", "Ng", "Ong", "Wong", "Goh", "Chua", "Koh", "Teo", "Ang", "Yeo", "Rahim", "Pillai"},
+		Phone: func(r *rand.Rand) string {
+			return "+65" + []string{"8", "9"}[r.IntN(2)] + digits(r, 7)
+		},
+	},
+}
+
+// fake_email_domains are reserved for documentation, mail to generated customers goes nowhere
+var fake_email_domains = []string{"example.com", "example.net", "example.org"}
+
+// age_distributions draw an age in years by ?ages= name
+var age_distributions = map[string]func(r *rand.Rand) int{
+	// anyone from 18 to 80 alike
+	"uniform": func(r *rand.Rand) int { return 18 + r.IntN(63) },
+	// mostly in their twenties and early thirties
+	"young": func(r *rand.Rand) int { return normal_age(r, 27, 5, 18, 45) },
+	// working age, around 45
+	"adult": func(r *rand.Rand) int { return normal_age(r, 45, 9, 25, 70) },
+	// retirement age
+	"senior": func(r *rand.Rand) int { return normal_age(r, 70, 7, 60, 95) },
+}
+
+// GenerateResult is what POST /admin/generate made, with the seed to draw the same customers again
+type GenerateResult struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"` // drawn customers validation refused, such as with CHECK_MX on
+	Errors  []ImportRowError `json:"errors"` // the first generate_max_errors, row is the customer's place in the draw
+	Seed    uint64           `json:"seed"`
+	FirstID int64            `json:"first_id,omitempty"`
+	LastID  int64            `json:"last_id,omitempty"`
+}
+
+func digits(r *rand.Rand, n int) string {
+	var b strings.Builder
+	for range n {
+		b.WriteByte(byte('0' + r.IntN(10)))
+	}
+	return b.String()
+}
+
+func normal_age(r *rand.Rand, mean float64, stddev float64, low int, high int) int {
+	return min(max(int(r.NormFloat64()*stddev+mean), low), high)
+}
+
+// fake_customer draws one customer of the locale, born the given number of years ago on a random day
+func fake_customer(r *rand.Rand, locale FakeLocale, age int, now time.Time) CustomerDetails {
+	first := locale.FirstNames[r.IntN(len(locale.FirstNames))]
+	last := locale.LastNames[r.IntN(len(locale.LastNames))]
+	local := strings.ToLower(strings.ReplaceAll(first, " ", "") + "." + strings.ReplaceAll(last, " ", ""))
+
+	var contact string
+	for range 10 {
+		phone, err := normalize_phone(locale.Phone(r), locale.Country)
+		if err == nil {
+			contact = phone
+			break
+		}
+	}
+
+	return CustomerDetails{
+		Name:       first + " " + last,
+		Email:      local + strconv.Itoa(r.IntN(10000)) + "@" + fake_email_domains[r.IntN(len(fake_email_domains))],
+		Contact:    contact,
+		Country:    locale.Country,
+		DOB:        now.AddDate(-age, 0, -r.IntN(365)).Format("2006-01-02"),
+		ExternalID: "generated-" + random_token(8), // apart from the seed, so drawing the same customers again can't collide
+	}
+}
+
+// generate_customers creates count customers in the tenant's database, validated as any new customer is
+func generate_customers(ctx context.Context, db *sql.DB, config Config, tenant_id string, count int, locales []FakeLocale, ages func(r *rand.Rand) int, seed uint64) (*GenerateResult, error) {
+	r := rand.New(rand.NewPCG(seed, seed))
+	now := time.Now().UTC()
+	result := &GenerateResult{Errors: []ImportRowError{}, Seed: seed}
+
+	for start := 0; start < count && ctx.Err() == nil; start += generate_batch_size {
+		var inputs []CustomerDetails
+		for i := start; i < min(start+generate_batch_size, count); i++ {
+			input := fake_customer(r, locales[r.IntN(len(locales))], ages(r), now)
+			err := validate_customer(ctx, db, &input, 0)
+			var validation_error *ValidationError
+			if errors.As(err, &validation_error) {
+				result.Failed++
+				if len(result.Errors) < generate_max_errors {
+					result.Errors = append(result.Errors, ImportRowError{Row: i + 1, Field: validation_error.Field, Message: validation_error.Message})
+				}
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			inputs = append(inputs, input)
+		}
+
+		var events []CustomerEvent
+		var ids []int64
+		err := with_tx(db, func(tx *sql.Tx) error {
+			events, ids = nil, nil
+			for _, input := range inputs {
+				customer, event, err := insert_customer(tx, db, tenant_id, input)
+				if err != nil {
+					return err
+				}
+
+				events = append(events, *event)
+				ids = append(ids, customer.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, event := range events {
+			event_broker.Publish(event)
+		}
+
+		if len(ids) > 0 {
+			if result.FirstID == 0 {
+				result.FirstID = ids[0]
+			}
+			result.LastID = ids[len(ids)-1]
+			result.Created += len(ids)
+		}
+	}
+
+	// the customers are saved either way, a failed quota check must not fail the request
+	if result.LastID != 0 {
+		err := check_quotas(db, config, tenant_id)
+		if err != nil {
+			println("quota check failed:", err.Error())
+		}
+	}
+
+	return result, ctx.Err()
+}
+
+// register_generate_routes adds the fake customer generator for QA and staging, only with GENERATE_ENABLED
+func register_generate_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// create ?count= randomized customers, ?locale=ms_MY,en_SG picks where they are from, ?ages=young how old
+	// they are and ?seed= makes the same ones again
+	mux.HandleFunc("POST /admin/generate", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		count, err := strconv.Atoi(query.Get("count"))
+		if err != nil || count < 1 || count > config.GenerateMaxCount {
+			http.Error(w, (&ValidationError{Field: "count", Message: "must be a number from 1 to " + strconv.Itoa(config.GenerateMaxCount)}).Error(), http.StatusBadRequest)
+			return
+		}
+
+		var locales []FakeLocale
+		for _, name := range split_list(query.Get("locale")) {
+			locale, ok := fake_locales[name]
+			if !ok {
+				http.Error(w, (&ValidationError{Field: "locale", Message: "must be en_US, en_GB, ms_MY, id_ID or en_SG"}).Error(), http.StatusBadRequest)
+				return
+			}
+			locales = append(locales, locale)
+		}
+		if len(locales) == 0 {
+			for _, name := range []string{"en_US", "en_GB", "ms_MY", "id_ID", "en_SG"} {
+				locales = append(locales, fake_locales[name])
+			}
+		}
+
+		ages_name := query.Get("ages")
+		if ages_name == "" {
+			ages_name = "uniform"
+		}
+		ages, ok := age_distributions[ages_name]
+		if !ok {
+			http.Error(w, (&ValidationError{Field: "ages", Message: "must be uniform, young, adult or senior"}).Error(), http.StatusBadRequest)
+			return
+		}
+
+		seed := rand.Uint64()
+		if query.Get("seed") != "" {
+			seed, err = strconv.ParseUint(query.Get("seed"), 10, 64)
+			if err != nil {
+				http.Error(w, (&ValidationError{Field: "seed", Message: "must be a positive number"}).Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// a tenant with a database of its own gets the customers there
+		tenant_id := tenant_from(r)
+		tenant_db := db
+		if tenant_databases != nil && tenant_id != default_tenant {
+			tenant_db, err = tenant_databases.DB(tenant_id)
+			if err != nil && err.Error() == "Tenant not found" {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// thousands of customers take longer than the write timeout allows
+		clear_deadlines(w)
+
+		result, err := generate_customers(r.Context(), tenant_db, config, tenant_id, count, locales, ages, seed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[GenerateResult]{Data: *result})
+	})
+}
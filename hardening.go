@@ -0,0 +1,82 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// harden sets the standard security headers on every response and turns away request bodies that are
+// too large or not in a content type the api reads
+func harden(config Config, next http.HandlerFunc) http.HandlerFunc {
+	content_types := map[string]bool{}
+	for _, content_type := range strings.Split(config.AllowedContentTypes, ",") {
+		content_types[strings.ToLower(strings.TrimSpace(content_type))] = true
+	}
+
+	attachment_types := map[string]bool{}
+	for _, content_type := range split_list(config.AttachmentContentTypes) {
+		attachment_types[strings.ToLower(content_type)] = true
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		header.Set("Cross-Origin-Resource-Policy", "same-site")
+		if r.TLS != nil {
+			header.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+
+		// responses depend on the caller's credentials and language, so only the caller may keep them and
+		// only after revalidating, handlers override this where they know better
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			header.Set("Cache-Control", "private, no-cache")
+			header.Add("Vary", "Authorization, X-API-Key, Cookie, Accept-Language")
+		}
+
+		if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+			next(w, r)
+			return
+		}
+
+		// avatars, attachments and imports are files, larger than any json body
+		max_bytes, allowed, expected := config.MaxBodyBytes, content_types, config.AllowedContentTypes
+		if is_avatar_upload(r) {
+			max_bytes, allowed, expected = config.AvatarMaxBytes, avatar_content_types, "image/jpeg,image/png,image/gif"
+		} else if is_attachment_upload(r) {
+			max_bytes, allowed, expected = config.AttachmentMaxBytes, attachment_types, config.AttachmentContentTypes
+		} else if is_import_upload(r) {
+			max_bytes, allowed, expected = config.ImportMaxBytes, import_content_types, "text/csv"
+		}
+
+		if r.ContentLength > max_bytes {
+			http.Error(w, "Request body exceeds "+strconv.FormatInt(max_bytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// chunked bodies have no length up front, the reader stops them at the limit instead
+		r.Body = http.MaxBytesReader(w, r.Body, max_bytes)
+
+		// bodyless writes such as unblocking need no content type
+		if r.ContentLength != 0 || r.Header.Get("Content-Type") != "" {
+			media_type, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || !allowed[media_type] {
+				http.Error(w, "Unsupported Content-Type, expected "+expected, http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// clear_deadlines exempts long lived streams from the server read and write timeouts
+func clear_deadlines(w http.ResponseWriter) {
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// health_check_timeout bounds each dependency check so a hung dependency can't hang the probe
+const health_check_timeout = 2 * time.Second
+
+// HealthChecker is implemented by dependencies that can report whether they are reachable
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+type HealthCheckFunc func(ctx context.Context) error
+
+func (f HealthCheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+type DependencyStatus struct {
+	Status    string `json:"status"` // ok or error
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Status       string                      `json:"status"` // ok, error or shutting_down
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// HealthChecks are the dependencies /readyz reports on, registered in main as they are set up
+type HealthChecks struct {
+	checks   map[string]HealthChecker
+	draining atomic.Bool
+}
+
+func new_health_checks(db *sql.DB) *HealthChecks {
+	return &HealthChecks{checks: map[string]HealthChecker{
+		"database": HealthCheckFunc(func(ctx context.Context) error {
+			var one int
+			return db.QueryRowContext(ctx, `SELECT 1;`).Scan(&one)
+		}),
+	}}
+}
+
+// Add registers dependency when it supports health checks, so optional backends need no special casing
+func (h *HealthChecks) Add(name string, dependency any) {
+	checker, ok := dependency.(HealthChecker)
+	if ok {
+		h.checks[name] = checker
+	}
+}
+
+// Drain makes readiness fail from now on, so load balancers stop routing here before shutdown
+func (h *HealthChecks) Drain() {
+	h.draining.Store(true)
+}
+
+func (h *HealthChecks) readiness(ctx context.Context) Readiness {
+	readiness := Readiness{Status: "ok", Dependencies: map[string]DependencyStatus{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, checker := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			check_ctx, cancel := context.WithTimeout(ctx, health_check_timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := checker.Check(check_ctx)
+			status := DependencyStatus{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				status.Status = "error"
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			readiness.Dependencies[name] = status
+			if err != nil {
+				readiness.Status = "error"
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if h.draining.Load() {
+		readiness.Status = "shutting_down"
+	}
+
+	return readiness
+}
+
+func register_health_routes(mux *http.ServeMux, health *HealthChecks) {
+	// liveness, the process is up and serving, deliberately checks nothing else
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"status":"ok"}}`))
+	})
+
+	// readiness, every dependency answers, 503 otherwise
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		readiness := health.readiness(r.Context())
+
+		response_str, err := json.Marshal(ApiResponse[Readiness]{Data: readiness})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if readiness.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(response_str)
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// CustomerVersion is the customer row as one write left it. Related records such as emails, phones and tags
+// are not versioned
+type CustomerVersion struct {
+	Version    int64           `json:"version"`
+	Customer   json.RawMessage `json:"customer"`
+	ReplacedAt *string         `json:"replaced_at"` // when the next write replaced this version, null for the current one
+	Deleted    bool            `json:"deleted"`     // the replacing write deleted the customer
+	Changes    []FieldChange   `json:"changes"`     // what this version changed from the one before, empty for the oldest
+}
+
+type CustomerVersionListingResponse struct {
+	Records []CustomerVersion `json:"records"`
+	Pagination
+}
+
+// customer_snapshot is the customers row as json with the Customer field names. The customer_versions
+// triggers record the same object for OLD, a change here needs a migration recreating them
+const customer_snapshot = `json_object(
+	'id', id, 'version', version, 'name', COALESCE(name, ''), 'dob', COALESCE(dob, ''), 'email', COALESCE(email, ''), 'contact', COALESCE(contact, ''),
+	'country', COALESCE(country, ''), 'metadata', json(metadata), 'external_id', COALESCE(external_id, ''),
+	'created_at', strftime('%Y-%m-%dT%H:%M:%SZ', created_at), 'updated_at', strftime('%Y-%m-%dT%H:%M:%SZ', updated_at),
+	'referral_code', COALESCE(referral_code, ''), 'referred_by_customer_id', referred_by_customer_id, 'company_id', company_id,
+	'blocked', json(CASE WHEN blocked_at IS NULL THEN 'false' ELSE 'true' END),
+	'block', CASE WHEN blocked_at IS NOT NULL THEN json_object('reason', COALESCE(blocked_reason, ''), 'blocked_by', COALESCE(blocked_by, ''), 'blocked_at', strftime('%Y-%m-%dT%H:%M:%SZ', blocked_at)) END,
+	'status', status, 'archived_at', strftime('%Y-%m-%dT%H:%M:%SZ', archived_at), 'email_verified_at', strftime('%Y-%m-%dT%H:%M:%SZ', email_verified_at),
+	'avatar_updated_at', strftime('%Y-%m-%dT%H:%M:%SZ', avatar_updated_at), 'verified', json(CASE WHEN email_verified_at IS NULL THEN 'false' ELSE 'true' END)
+)`
+
+// diff_versions fills in each version's changes from the one after it in the slice, which is newest first.
+// The last one is left alone, its predecessor is not in the slice
+func diff_versions(versions []CustomerVersion) error {
+	for i := 0; i < len(versions)-1; i++ {
+		var old_fields, new_fields map[string]json.RawMessage
+		err := json.Unmarshal(versions[i+1].Customer, &old_fields)
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal(versions[i].Customer, &new_fields)
+		if err != nil {
+			return err
+		}
+
+		versions[i].Changes = field_changes(old_fields, new_fields)
+	}
+
+	return nil
+}
+
+// shape_version applies the caller's field policy to a version about to be returned
+func shape_version(hidden map[string]bool, masked map[string]bool, version *CustomerVersion) {
+	version.Customer = mask_payload(masked, shape_payload(hidden, version.Customer))
+	version.Changes = mask_changes(masked, shape_changes(hidden, version.Changes))
+	if version.Changes == nil {
+		version.Changes = []FieldChange{}
+	}
+}
+
+func register_history_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// every recorded version of the customer newest first, each with what it changed. Deleted customers keep
+	// their history
+	mux.HandleFunc("GET /api/customers/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		page, limit := page_params(config, r, 20)
+
+		records, total_records, err := get_customer_versions(db, id, (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if total_records == 0 {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+
+		hidden, masked := request_hidden_fields(r), request_masked_fields(r)
+		for i := range records {
+			shape_version(hidden, masked, &records[i])
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[CustomerVersionListingResponse]{
+			Data: CustomerVersionListingResponse{
+				Records:    records,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+
+	// the version in effect at ?at=, an rfc 3339 timestamp
+	mux.HandleFunc("GET /api/customers/{id}/history/as-of", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+		if err != nil {
+			http.Error(w, "Invalid at, expected a timestamp like 2024-01-31T12:00:00Z", http.StatusBadRequest)
+			return
+		}
+
+		version, err := get_customer_version_at(db, id, at.UTC())
+		if err != nil && err.Error() == "Customer version not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		shape_version(request_hidden_fields(r), request_masked_fields(r), version)
+		write_json_response(w, http.StatusOK, ApiResponse[CustomerVersion]{Data: *version})
+	})
+}
+
+// #region Database
+
+// without_version_triggers runs fn with the triggers that bump the version and record history dropped, for
+// rewrites that are not an edit such as scrubbing or encrypting values in place
+func without_version_triggers(tx *sql.Tx, fn func() error) error {
+	var triggers []string
+	for _, name := range []string{"customers_version", "customer_versions_update"} {
+		var trigger string
+		err := tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = ?;`, name).Scan(&trigger)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DROP TRIGGER ` + name + `;`)
+		if err != nil {
+			return err
+		}
+
+		triggers = append(triggers, trigger)
+	}
+
+	err := fn()
+	if err != nil {
+		return err
+	}
+
+	for _, trigger := range triggers {
+		_, err = tx.Exec(trigger)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// customer_versions_query lists the recorded versions and the current row together, the current one
+// has no replaced_at
+const customer_versions_query = `
+	SELECT version, snapshot, strftime('%Y-%m-%dT%H:%M:%SZ', recorded_at) AS replaced_at, operation = 'delete' AS deleted
+	FROM customer_versions
+	WHERE customer_id = ?
+	UNION ALL
+	SELECT version, ` + customer_snapshot + `, NULL, 0
+	FROM customers
+	WHERE id = ?
+`
+
+func scan_customer_version(row row_scanner) (CustomerVersion, error) {
+	var version CustomerVersion
+	var snapshot string
+	err := row.Scan(&version.Version, &snapshot, &version.ReplacedAt, &version.Deleted)
+	if err != nil {
+		return version, err
+	}
+
+	var fields map[string]any
+	err = json.Unmarshal([]byte(snapshot), &fields)
+	if err != nil {
+		return version, err
+	}
+
+	err = decrypt_snapshot_fields(fields)
+	if err != nil {
+		return version, err
+	}
+
+	version.Customer, err = json.Marshal(fields)
+	return version, err
+}
+
+// get_customer_versions reads one page of versions newest first, plus the version before the page to diff
+// its oldest against
+func get_customer_versions(db *sql.DB, customer_id int64, offset int, limit int) ([]CustomerVersion, int, error) {
+	rows, err := db.Query(customer_versions_query+` ORDER BY version DESC LIMIT ? OFFSET ?;`, customer_id, customer_id, limit+1, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	versions := []CustomerVersion{}
+	for rows.Next() {
+		version, err := scan_customer_version(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		versions = append(versions, version)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, rows.Err()
+	}
+
+	err = diff_versions(versions)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(versions) > limit {
+		versions = versions[:limit]
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM (`+customer_versions_query+`);`, customer_id, customer_id).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return versions, count, nil
+}
+
+// get_customer_version_at finds the first version replaced after at, or the current row when none was.
+// Times before the customer was created, after it was deleted or before its history was recorded have none
+func get_customer_version_at(db *sql.DB, customer_id int64, at time.Time) (*CustomerVersion, error) {
+	get_record := `
+	SELECT * FROM (` + customer_versions_query + `)
+	WHERE replaced_at IS NULL OR replaced_at > ?
+	ORDER BY replaced_at IS NULL, version
+	LIMIT 1;
+	`
+
+	found, err := scan_customer_version(db.QueryRow(get_record, customer_id, customer_id, at.Format("2006-01-02T15:04:05Z")))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Customer version not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := scan_customer_version(db.QueryRow(`SELECT * FROM (`+customer_versions_query+`) WHERE version < ? ORDER BY version DESC LIMIT 1;`, customer_id, customer_id, found.Version))
+	if err == sql.ErrNoRows {
+		// the oldest version known, when it was written after at what was there before was never recorded
+		var fields struct {
+			UpdatedAt string `json:"updated_at"`
+		}
+		err = json.Unmarshal(found.Customer, &fields)
+		if err != nil {
+			return nil, err
+		}
+
+		updated_at, err := time.Parse(time.RFC3339, fields.UpdatedAt)
+		if err != nil || updated_at.After(at) {
+			return nil, errors.New("Customer version not found")
+		}
+
+		found.Changes = []FieldChange{}
+		return &found, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []CustomerVersion{found, previous}
+	err = diff_versions(versions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &versions[0], nil
+}
+
+// #endregion
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// view_files are the pages the customer reads render as for browsers, asking with Accept: text/html
+//
+//go:embed views
+var view_files embed.FS
+
+var view_html = template.Must(template.New("views").Funcs(template.FuncMap{
+	"indent": func(raw json.RawMessage) string {
+		var indented bytes.Buffer
+		if json.Indent(&indented, raw, "", "  ") != nil {
+			return string(raw)
+		}
+		return indented.String()
+	},
+}).ParseFS(view_files, "views/*.html"))
+
+// CustomerListView is a page of customers, listed or found by a search
+type CustomerListView struct {
+	Title      string
+	Query      string // the search, empty when listing
+	ListPath   string
+	SearchPath string
+	Customers  []Customer
+	Pagination Pagination
+	Htmx       HtmxScript
+}
+
+// CustomerView is one customer's page
+type CustomerView struct {
+	Title    string
+	ListPath string
+	Customer Customer
+	Htmx     HtmxScript
+}
+
+// HtmxScript is the htmx the pages load, pinned to the HTMX_INTEGRITY hash so a changed file at HTMX_URL
+// does not run on pages showing customers
+type HtmxScript struct {
+	URL       string
+	Integrity string
+}
+
+// wants_html is whether the request is from a browser, which gets pages from the routes that have them
+func wants_html(r *http.Request) bool {
+	return response_format(r) == "html"
+}
+
+// is_htmx_partial is whether htmx asked for the part of the page it swaps, boosted links and history it
+// restores still get the whole page
+func is_htmx_partial(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true" && r.Header.Get("HX-Boosted") != "true" && r.Header.Get("HX-History-Restore-Request") != "true"
+}
+
+func write_customer_list_html(w http.ResponseWriter, r *http.Request, config Config, query string, customers []Customer, pagination Pagination) {
+	view := CustomerListView{
+		Title:      "Customers",
+		Query:      query,
+		ListPath:   public_path(r, "/api/customers"),
+		SearchPath: public_path(r, "/api/customers/search"),
+		Customers:  customers,
+		Pagination: pagination,
+		Htmx:       HtmxScript{config.HtmxURL, config.HtmxIntegrity},
+	}
+	if query != "" {
+		view.Title = "Customers matching " + query
+	}
+
+	name := "customers.html"
+	if is_htmx_partial(r) {
+		name = "customer_results"
+	}
+
+	write_view(w, config, name, view)
+}
+
+func write_customer_html(w http.ResponseWriter, r *http.Request, config Config, customer Customer) {
+	write_view(w, config, "customer.html", CustomerView{
+		Title:    customer.Name,
+		ListPath: public_path(r, "/api/customers"),
+		Customer: customer,
+		Htmx:     HtmxScript{config.HtmxURL, config.HtmxIntegrity},
+	})
+}
+
+func write_view(w http.ResponseWriter, config Config, name string, view any) {
+	var body bytes.Buffer
+	err := view_html.ExecuteTemplate(&body, name, view)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the pages load htmx and style themselves inline, the api's default-src 'none' would block both
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Security-Policy", "default-src 'none'; script-src "+script_source(config.HtmxURL)+"; style-src 'unsafe-inline'; connect-src 'self'; img-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'")
+	header.Add("Vary", "HX-Request")
+	w.Write(body.Bytes())
+}
+
+// script_source is the csp source allowing only the script at src, the page's own origin for a path
+func script_source(src string) string {
+	parsed, err := url.Parse(src)
+	if err != nil || parsed.Host == "" {
+		return "'self'"
+	}
+
+	return parsed.Scheme + "://" + parsed.Host + parsed.EscapedPath()
+}
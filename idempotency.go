@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// idempotency_key_max is the longest Idempotency-Key accepted
+const idempotency_key_max = 255
+
+// idempotent_headers are the response headers a replay repeats, the rest belong to the request that replays
+var idempotent_headers = []string{"Content-Type", "Location", "ETag", "Last-Modified", "Link"}
+
+// idempotent_body_field is what a stored response body is sealed as, so it opens as nothing else
+const idempotent_body_field = "idempotent_body"
+
+// IdempotentResponse is what a POST with an Idempotency-Key answered, replayed for retries with the same key
+type IdempotentResponse struct {
+	Fingerprint string      `json:"fingerprint"` // of the method, path and body that used the key
+	Status      int         `json:"status"`      // 0 while the first request is still running
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// IdempotencyStore holds responses by key, in memory or in redis so a retry may land on another replica
+type IdempotencyStore interface {
+	// Claim reserves key for a request, returning nil when it did and what the key holds when it was taken
+	Claim(ctx context.Context, key string, fingerprint string, ttl time.Duration) (*IdempotentResponse, error)
+	Save(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+	// Expire drops the responses past their ttl, on the IDEMPOTENCY_EXPIRY_SCHEDULE
+	Expire(ctx context.Context) error
+}
+
+func new_idempotency_store(config Config) (IdempotencyStore, error) {
+	switch config.IdempotencyStore {
+	case "off":
+		return nil, nil
+	case "", "memory":
+		return &MemoryIdempotencyStore{responses: map[string]memory_idempotent_response{}}, nil
+	case "redis":
+		client, err := shared_redis(config)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisIdempotencyStore{client: client}, nil
+	default:
+		return nil, errors.New("Unknown idempotency store " + config.IdempotencyStore)
+	}
+}
+
+type memory_idempotent_response struct {
+	response   IdempotentResponse
+	expires_at time.Time
+}
+
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]memory_idempotent_response
+}
+
+func (s *MemoryIdempotencyStore) Claim(ctx context.Context, key string, fingerprint string, ttl time.Duration) (*IdempotentResponse, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.responses[key]
+	if ok && now.Before(stored.expires_at) {
+		return &stored.response, nil
+	}
+
+	s.responses[key] = memory_idempotent_response{IdempotentResponse{Fingerprint: fingerprint}, now.Add(ttl)}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Save(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses[key] = memory_idempotent_response{response, time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.responses, key)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Expire(ctx context.Context) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, stored := range s.responses {
+		if !now.Before(stored.expires_at) {
+			delete(s.responses, key)
+		}
+	}
+	return nil
+}
+
+// RedisIdempotencyStore claims with SET NX, so two replicas given the same key don't both run the request
+type RedisIdempotencyStore struct {
+	client *redis.Client
+}
+
+func (s *RedisIdempotencyStore) Claim(ctx context.Context, key string, fingerprint string, ttl time.Duration) (*IdempotentResponse, error) {
+	claim, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := s.client.SetNX(ctx, "idempotency:"+key, claim, ttl).Result()
+	if err != nil || claimed {
+		return nil, err
+	}
+
+	stored, err := s.client.Get(ctx, "idempotency:"+key).Bytes()
+	if err == redis.Nil {
+		// expired or released in between, the next retry claims it
+		return &IdempotentResponse{Fingerprint: fingerprint}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var response IdempotentResponse
+	err = json.Unmarshal(stored, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := decrypt_pii(idempotent_body_field, string(response.Body))
+	if err != nil {
+		return nil, err
+	}
+	response.Body = []byte(body)
+
+	return &response, nil
+}
+
+// Save seals the body with PII_ENCRYPTION_KEY, a replayed customer sits in redis no more readable than in
+// the database. The body is sealed whole so the replay is the same bytes as the first response
+func (s *RedisIdempotencyStore) Save(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	body, err := encrypt_pii(idempotent_body_field, string(response.Body))
+	if err != nil {
+		return err
+	}
+	response.Body = []byte(body)
+
+	stored, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(ctx, "idempotency:"+key, stored, ttl).Err()
+}
+
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, "idempotency:"+key).Err()
+}
+
+// Expire has nothing to do, redis drops the keys itself when their ttl runs out
+func (s *RedisIdempotencyStore) Expire(ctx context.Context) error {
+	return nil
+}
+
+func (s *RedisIdempotencyStore) Check(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// idempotency_writer passes the response through, keeping all of it for the store
+type idempotency_writer struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (iw *idempotency_writer) WriteHeader(status int) {
+	if iw.status == 0 {
+		iw.status = status
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *idempotency_writer) Write(b []byte) (int, error) {
+	if iw.status == 0 {
+		iw.status = http.StatusOK
+	}
+	iw.body.Write(b)
+	return iw.ResponseWriter.Write(b)
+}
+
+func (iw *idempotency_writer) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// idempotency makes a POST with an Idempotency-Key header run once per caller and key. Retries get the first
+// response again with Idempotent-Replayed, server errors are not kept so a retry runs the request anew
+func idempotency(store IdempotencyStore, config Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if store == nil || key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		if len(key) > idempotency_key_max {
+			http.Error(w, (&ValidationError{Field: "Idempotency-Key", Message: "must be at most 255 characters"}).Error(), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		// keys are the caller's own, two callers may pick the same one
+		store_key := tenant_from(r) + ":" + actor_from(r) + ":" + key
+
+		ctx, cancel := context.WithTimeout(r.Context(), redis_timeout)
+		stored, err := store.Claim(ctx, store_key, fingerprint, config.IdempotencyTTL)
+		cancel()
+		if err != nil {
+			http.Error(w, "Idempotency store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if stored != nil {
+			if stored.Fingerprint != fingerprint {
+				http.Error(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+
+			if stored.Status == 0 {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+				return
+			}
+
+			for _, name := range idempotent_headers {
+				if value := stored.Header.Get(name); value != "" {
+					w.Header().Set(name, value)
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		iw := &idempotency_writer{ResponseWriter: w}
+		next(iw, r)
+
+		// the response is out, saving it must not depend on the client still waiting
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(r.Context()), redis_timeout)
+		defer cancel()
+
+		if iw.status == 0 || iw.status >= 500 {
+			err = store.Release(ctx, store_key)
+		} else {
+			response := IdempotentResponse{Fingerprint: fingerprint, Status: iw.status, Header: http.Header{}, Body: iw.body.Bytes()}
+			for _, name := range idempotent_headers {
+				if value := iw.Header().Get(name); value != "" {
+					response.Header.Set(name, value)
+				}
+			}
+			err = store.Save(ctx, store_key, response, config.IdempotencyTTL)
+		}
+		if err != nil {
+			println("idempotency store failed:", err.Error())
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// import_batch_size is how many rows go into one transaction, together with the job's checkpoint
+const import_batch_size = 100
+
+// import_max_errors bounds the error report, importing the wrong file would otherwise list every row
+const import_max_errors = 1000
+
+var import_content_types = map[string]bool{"text/csv": true}
+
+// import_columns are the csv headers an import reads. Other columns, such as the id and timestamps of a csv
+// export, are ignored so an export imports as it is
+var import_columns = map[string]func(input *CustomerDetails, value string){
+	"name":        func(input *CustomerDetails, value string) { input.Name = value },
+	"dob":         func(input *CustomerDetails, value string) { input.DOB = value },
+	"email":       func(input *CustomerDetails, value string) { input.Email = value },
+	"contact":     func(input *CustomerDetails, value string) { input.Contact = value },
+	"country":     func(input *CustomerDetails, value string) { input.Country = value },
+	"external_id": func(input *CustomerDetails, value string) { input.ExternalID = value },
+	"status":      func(input *CustomerDetails, value string) { input.Status = value },
+}
+
+// ImportJob is the payload of an import job, the upload waits in the blob store
+type ImportJob struct {
+	Key string `json:"key"`
+}
+
+// ImportReport is the result of an import job, and its progress while it runs
+type ImportReport struct {
+	TotalRows int              `json:"total_rows"`
+	Rows      int              `json:"rows"` // rows processed so far
+	Imported  int              `json:"imported"`
+	Failed    int              `json:"failed"`
+	Errors    []ImportRowError `json:"errors"` // the first 1000 rows that failed
+}
+
+// ImportRowError says why a row was not imported
+type ImportRowError struct {
+	Row     int    `json:"row"` // the record's place in the file, the header is row 1
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// is_import_upload tells harden to take a csv file of up to IMPORT_MAX_BYTES rather than a json body
+func is_import_upload(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == "/api/customers/import"
+}
+
+// read_import parses the whole file, so a malformed one is refused on upload rather than failing its job
+func read_import(data []byte) ([][]string, []func(input *CustomerDetails, value string), error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, &ValidationError{Field: "body", Message: err.Error()}
+	}
+
+	var columns []func(input *CustomerDetails, value string)
+	known := false
+	if len(records) > 0 {
+		for _, header := range records[0] {
+			set := import_columns[strings.ToLower(strings.TrimSpace(header))]
+			columns = append(columns, set)
+			known = known || set != nil
+		}
+	}
+
+	if !known {
+		return nil, nil, &ValidationError{Field: "body", Message: "must start with a header naming at least one of name, dob, email, contact, country, external_id and status"}
+	}
+
+	return records[1:], columns, nil
+}
+
+// import_key names the blob of an upload, random so two imports never share one
+func import_key() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return "imports/" + hex.EncodeToString(buf), nil
+}
+
+// run_import creates a customer for each row of the upload, a batch of rows at a time. A job that resumes
+// after a failure or restart skips the rows its checkpoint says are done, so none is imported twice
+func run_import(ctx context.Context, db *sql.DB, blobs BlobStore, config Config, job *Job) (*ImportReport, error) {
+	var payload ImportJob
+	err := json.Unmarshal(job.Payload, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	report := ImportReport{Errors: []ImportRowError{}}
+	if job.Result != nil {
+		err = json.Unmarshal(job.Result, &report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the last batch committed but the job was not marked succeeded, its upload may already be gone
+	if report.TotalRows > 0 && report.Rows == report.TotalRows {
+		return &report, nil
+	}
+
+	data, err := blobs.Get(ctx, payload.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, columns, err := read_import(data)
+	if err != nil {
+		return nil, err
+	}
+	report.TotalRows = len(rows)
+
+	// validation looks up referrers and companies in the job's tenant
+	ctx = context.WithValue(ctx, tenant_key{}, job.TenantID)
+
+	for report.Rows < len(rows) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		batch := rows[report.Rows:min(report.Rows+import_batch_size, len(rows))]
+		err = import_batch(ctx, db, config, job, columns, batch, &report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = blobs.Delete(ctx, payload.Key)
+	if err != nil {
+		println("deleting an import upload failed:", err.Error())
+	}
+
+	return &report, nil
+}
+
+// import_batch validates the rows, then creates the valid ones and checkpoints the report in one transaction.
+// A row the database refuses, such as one with a taken external id, is rolled back alone
+func import_batch(ctx context.Context, db *sql.DB, config Config, job *Job, columns []func(input *CustomerDetails, value string), batch [][]string, report *ImportReport) error {
+	first_row := report.Rows + 2
+
+	inputs := make([]CustomerDetails, len(batch))
+	failures := map[int]ImportRowError{}
+	for i, record := range batch {
+		for column, value := range record {
+			if column < len(columns) && columns[column] != nil {
+				columns[column](&inputs[i], value)
+			}
+		}
+
+		err := validate_customer(ctx, db, &inputs[i], 0)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			failures[i] = ImportRowError{Row: first_row + i, Field: validation_error.Field, Message: validation_error.Message}
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	var checkpoint ImportReport
+	var events []CustomerEvent
+	var last_id int64
+	err := with_tx(db, func(tx *sql.Tx) error {
+		checkpoint = *report
+		checkpoint.Errors = append([]ImportRowError{}, report.Errors...)
+		events = nil
+
+		for i := range batch {
+			failure, failed := failures[i]
+			if !failed {
+				_, err := tx.Exec(`SAVEPOINT import_row;`)
+				if err != nil {
+					return err
+				}
+
+				customer, event, err := insert_customer(tx, db, job.TenantID, inputs[i])
+				if err != nil && !is_constraint(err) {
+					return err
+				}
+
+				if err != nil {
+					_, err = tx.Exec(`ROLLBACK TO import_row;`)
+					if err != nil {
+						return err
+					}
+					failure, failed = ImportRowError{Row: first_row + i, Message: "conflicts with a stored customer"}, true
+				} else {
+					events = append(events, *event)
+					last_id = customer.ID
+				}
+
+				_, err = tx.Exec(`RELEASE import_row;`)
+				if err != nil {
+					return err
+				}
+			}
+
+			if failed {
+				checkpoint.Failed++
+				if len(checkpoint.Errors) < import_max_errors {
+					checkpoint.Errors = append(checkpoint.Errors, failure)
+				}
+			} else {
+				checkpoint.Imported++
+			}
+		}
+
+		checkpoint.Rows += len(batch)
+		return checkpoint_job(tx, job.ID, checkpoint.Rows*100/checkpoint.TotalRows, checkpoint, config.JobLease)
+	})
+	if err != nil {
+		return err
+	}
+
+	*report = checkpoint
+	for _, event := range events {
+		event_broker.Publish(event)
+	}
+
+	// the customers are saved either way, a failed quota check must not fail the import
+	if last_id != 0 {
+		err = check_quotas(db, config, job.TenantID)
+		if err != nil {
+			println("quota check failed:", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func register_import_routes(mux *http.ServeMux, db *sql.DB, config Config, blobs BlobStore) {
+	// import customers from a csv file sent as the body, its header naming the columns. The rows are created
+	// in the background, poll the job in the response for progress and the rows that failed
+	mux.HandleFunc("POST /api/customers/import", func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		var max_bytes_error *http.MaxBytesError
+		if errors.As(err, &max_bytes_error) {
+			http.Error(w, "Import exceeds "+strconv.FormatInt(max_bytes_error.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, _, err = read_import(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key, err := import_key()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = blobs.Put(r.Context(), key, data, "text/csv")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		id, err := enqueue_job(db, config, NewJob{
+			TenantID:  tenant_from(r),
+			Type:      "import",
+			Payload:   ImportJob{Key: key},
+			CreatedBy: actor_from(r),
+		})
+		if err != nil {
+			blobs.Delete(r.Context(), key)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		job, err := get_job(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", "/api/jobs/"+strconv.FormatInt(id, 10))
+		write_json_response(w, http.StatusAccepted, ApiResponse[Job]{Data: *job})
+	})
+}
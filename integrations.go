@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IntegrationHealth tracks how calls to one external system went, recorded by the worker that makes them
+type IntegrationHealth struct {
+	mu                   sync.Mutex
+	name                 string
+	critical             bool
+	last_success         time.Time
+	last_failure         time.Time
+	last_error           string
+	error_count          int64
+	consecutive_failures int64
+}
+
+type IntegrationStatus struct {
+	Name                string  `json:"name"`
+	Critical            bool    `json:"critical"` // failing critical integrations fail readiness
+	Status              string  `json:"status"`   // ok, failing or unknown before the first attempt
+	LastSuccessAt       *string `json:"last_success_at"`
+	LastFailureAt       *string `json:"last_failure_at"`
+	LastError           string  `json:"last_error,omitempty"`
+	ErrorCount          int64   `json:"error_count"`
+	ConsecutiveFailures int64   `json:"consecutive_failures"`
+}
+
+// Record notes the outcome of one attempt, err is nil on success
+func (h *IntegrationHealth) Record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		h.last_success = time.Now()
+		h.consecutive_failures = 0
+		return
+	}
+
+	h.last_failure = time.Now()
+	h.last_error = err.Error()
+	h.error_count++
+	h.consecutive_failures++
+}
+
+// Check fails while the latest attempt failed, so a critical integration can gate readiness
+func (h *IntegrationHealth) Check(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.consecutive_failures > 0 {
+		return errors.New(h.last_error)
+	}
+
+	return nil
+}
+
+func (h *IntegrationHealth) status() IntegrationStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := IntegrationStatus{
+		Name:                h.name,
+		Critical:            h.critical,
+		Status:              "unknown",
+		LastError:           h.last_error,
+		ErrorCount:          h.error_count,
+		ConsecutiveFailures: h.consecutive_failures,
+	}
+
+	if !h.last_success.IsZero() {
+		at := h.last_success.UTC().Format(time.RFC3339)
+		status.LastSuccessAt = &at
+		status.Status = "ok"
+	}
+
+	if !h.last_failure.IsZero() {
+		at := h.last_failure.UTC().Format(time.RFC3339)
+		status.LastFailureAt = &at
+	}
+
+	if h.consecutive_failures > 0 {
+		status.Status = "failing"
+	}
+
+	return status
+}
+
+// Integrations holds the health of every configured integration by name
+type Integrations struct {
+	mu       sync.Mutex
+	list     map[string]*IntegrationHealth
+	critical map[string]bool
+}
+
+var integrations = &Integrations{list: map[string]*IntegrationHealth{}, critical: map[string]bool{}}
+
+// SetCritical names the integrations readiness depends on, from INTEGRATIONS_CRITICAL
+func (i *Integrations) SetCritical(names []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, name := range names {
+		i.critical[name] = true
+	}
+	for name, health := range i.list {
+		health.critical = i.critical[name]
+	}
+}
+
+// Get returns the integration's health, registering it on first use
+func (i *Integrations) Get(name string) *IntegrationHealth {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	health, ok := i.list[name]
+	if !ok {
+		health = &IntegrationHealth{name: name, critical: i.critical[name]}
+		i.list[name] = health
+	}
+
+	return health
+}
+
+// Check fails when any critical integration is failing
+func (i *Integrations) Check(ctx context.Context) error {
+	i.mu.Lock()
+	var critical []*IntegrationHealth
+	for _, health := range i.list {
+		if health.critical {
+			critical = append(critical, health)
+		}
+	}
+	i.mu.Unlock()
+
+	var errs []error
+	for _, health := range critical {
+		err := health.Check(ctx)
+		if err != nil {
+			errs = append(errs, errors.New(health.name+": "+err.Error()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (i *Integrations) statuses() []IntegrationStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	statuses := []IntegrationStatus{}
+	for _, health := range i.list {
+		statuses = append(statuses, health.status())
+	}
+
+	sort.Slice(statuses, func(a, b int) bool {
+		return statuses[a].Name < statuses[b].Name
+	})
+
+	return statuses
+}
+
+func register_integration_routes(mux *http.ServeMux) {
+	// how every configured integration is doing
+	mux.HandleFunc("GET /api/admin/integrations", func(w http.ResponseWriter, r *http.Request) {
+		response_str, err := json.Marshal(ApiResponse[[]IntegrationStatus]{Data: integrations.statuses()})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(response_str)
+	})
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// job_max_backoff caps the wait between attempts, however many have failed
+const job_max_backoff = time.Hour
+
+// job_statuses are the states a job goes through. A failed attempt goes back to queued until max_attempts,
+// then the job is dead and waits for POST /api/jobs/{id}/retry
+var job_statuses = map[string]bool{"queued": true, "running": true, "succeeded": true, "dead": true}
+
+// Job is a unit of background work, persisted so it survives restarts and is retried with backoff
+type Job struct {
+	ID          int64           `json:"id"`
+	TenantID    string          `json:"tenant_id"`
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`   // queued, running, succeeded or dead
+	Progress    int             `json:"progress"` // percent, as last reported by the handler
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	Payload     json.RawMessage `json:"payload"`
+	Result      json.RawMessage `json:"result"` // set once succeeded, jobs that checkpoint keep their progress here while running
+	LastError   *string         `json:"last_error"`
+	RunAt       string          `json:"run_at"` // not before, the next attempt for a failed job
+	CreatedBy   string          `json:"created_by"`
+	CreatedAt   string          `json:"created_at"`
+	UpdatedAt   string          `json:"updated_at"`
+	FinishedAt  *string         `json:"finished_at"`
+}
+
+type JobListingResponse struct {
+	Records []Job `json:"records"`
+	Pagination
+}
+
+// NewJob is what enqueue_job stores. A job with a dedupe key is not queued again while one with the same
+// key is queued, running or dead
+type NewJob struct {
+	TenantID  string
+	Type      string
+	Payload   any
+	RunAt     time.Time // now when zero
+	DedupeKey string
+	CreatedBy string
+}
+
+// JobHandler does the work of one job type and returns its result. progress reports how far it got in
+// percent, which also extends the lease of long jobs
+type JobHandler func(ctx context.Context, job *Job, progress func(percent int)) (any, error)
+
+// job_handlers are the job types the workers of db run
+func job_handlers(db *sql.DB, blobs BlobStore, sessions *SessionSigner, config Config) map[string]JobHandler {
+	return map[string]JobHandler{
+		// anonymizations whose grace period is over, one cancelled while queued is left alone
+		"anonymize": func(ctx context.Context, job *Job, progress func(percent int)) (any, error) {
+			var payload struct {
+				CustomerID int64 `json:"customer_id"`
+			}
+			err := json.Unmarshal(job.Payload, &payload)
+			if err != nil {
+				return nil, err
+			}
+
+			request, err := get_anonymization_request(db, payload.CustomerID)
+			if err != nil && err.Error() == "Anonymization request not found" {
+				return nil, nil
+			}
+			if err != nil || request.ExecutedAt != nil {
+				return request, err
+			}
+
+			err = anonymize_customer(ctx, db, blobs, payload.CustomerID)
+			if err != nil {
+				return nil, err
+			}
+
+			return get_anonymization_request(db, payload.CustomerID)
+		},
+		// csv uploads to POST /customers/import
+		"import": func(ctx context.Context, job *Job, progress func(percent int)) (any, error) {
+			return run_import(ctx, db, blobs, config, job)
+		},
+		// POST /customers/export, the file waits in the blob store behind a signed link
+		"export": func(ctx context.Context, job *Job, progress func(percent int)) (any, error) {
+			return run_export(ctx, db, blobs, sessions, config, job, progress)
+		},
+	}
+}
+
+// job_backoff is the wait after the attempt-th failed attempt, doubling from JOB_BACKOFF
+func job_backoff(config Config, attempt int) time.Duration {
+	backoff := config.JobBackoff
+	for i := 1; i < attempt && backoff < job_max_backoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, job_max_backoff)
+}
+
+// run_jobs runs JOB_WORKERS workers, each claiming the next due job whenever it is free
+func run_jobs(ctx context.Context, db *sql.DB, blobs BlobStore, sessions *SessionSigner, config Config) {
+	handlers := job_handlers(db, blobs, sessions, config)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(config.JobWorkers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run_job_worker(ctx, db, config, handlers)
+		}()
+	}
+	wg.Wait()
+}
+
+func run_job_worker(ctx context.Context, db *sql.DB, config Config, handlers map[string]JobHandler) {
+	ticker := time.NewTicker(config.JobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := claim_job(db, config.JobLease)
+		if err != nil {
+			println("claiming a job failed:", err.Error())
+		}
+
+		if job != nil {
+			run_job(ctx, db, config, handlers, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run_job runs one claimed job and records how it went. A job interrupted by shutdown is queued again
+// without the attempt counting
+func run_job(ctx context.Context, db *sql.DB, config Config, handlers map[string]JobHandler, job *Job) {
+	handler, ok := handlers[job.Type]
+	if !ok {
+		err := fail_job(db, job.ID, errors.New("Unknown job type "+job.Type), nil)
+		if err != nil {
+			println("recording a job failure failed:", err.Error())
+		}
+		return
+	}
+
+	progress := func(percent int) {
+		err := set_job_progress(db, job.ID, min(max(percent, 0), 100), config.JobLease)
+		if err != nil {
+			println("recording job progress failed:", err.Error())
+		}
+	}
+
+	result, err := handler(ctx, job, progress)
+	if ctx.Err() != nil {
+		err = requeue_job(db, job.ID)
+	} else if err != nil && job.Attempts >= job.MaxAttempts {
+		err = fail_job(db, job.ID, err, nil)
+	} else if err != nil {
+		retry_at := time.Now().Add(job_backoff(config, job.Attempts))
+		err = fail_job(db, job.ID, err, &retry_at)
+	} else {
+		err = complete_job(db, job.ID, result)
+	}
+	if err != nil {
+		println("recording a job outcome failed:", err.Error())
+	}
+}
+
+// path_job_id reads the {id} of /jobs/{id}
+func path_job_id(r *http.Request) (int64, error) {
+	return strconv.ParseInt(r.PathValue("id"), 10, 64)
+}
+
+func register_job_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// the tenant's jobs, newest first, ?status= narrows them to one status
+	mux.HandleFunc("GET /api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		if status != "" && !job_statuses[status] {
+			http.Error(w, (&ValidationError{Field: "status", Message: "must be queued, running, succeeded or dead"}).Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, limit := page_params(config, r, 20)
+
+		records, total_records, err := get_jobs(db, tenant_from(r), status, (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[JobListingResponse]{
+			Data: JobListingResponse{
+				Records:    records,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+
+	// poll a job for its progress and result
+	mux.HandleFunc("GET /api/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_job_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		job, err := get_job(db, id)
+		if err != nil && err.Error() == "Job not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// clients polling a running job come back after this
+		if job.Status == "queued" || job.Status == "running" {
+			w.Header().Set("Retry-After", strconv.Itoa(max(int(config.JobPollInterval.Seconds()), 1)))
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Job]{Data: *job})
+	})
+
+	// queue a dead job again with fresh attempts
+	mux.HandleFunc("POST /api/jobs/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_job_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		job, err := retry_job(db, id)
+		if err != nil && err.Error() == "Job not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil && err.Error() == "Only dead jobs can be retried" {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Job]{Data: *job})
+	})
+}
+
+// #region Database
+
+// run_at and locked_until are unix milliseconds, like the leader leases
+const job_columns = `id, tenant_id, type, status, progress, attempts, max_attempts, payload, result, last_error,
+	strftime('%Y-%m-%dT%H:%M:%SZ', run_at / 1000, 'unixepoch'), created_by, strftime('%Y-%m-%dT%H:%M:%SZ', created_at),
+	strftime('%Y-%m-%dT%H:%M:%SZ', updated_at), strftime('%Y-%m-%dT%H:%M:%SZ', finished_at)`
+
+func scan_job(row row_scanner) (Job, error) {
+	var job Job
+	var payload, result []byte
+	err := row.Scan(&job.ID, &job.TenantID, &job.Type, &job.Status, &job.Progress, &job.Attempts, &job.MaxAttempts, &payload, &result, &job.LastError, &job.RunAt, &job.CreatedBy, &job.CreatedAt, &job.UpdatedAt, &job.FinishedAt)
+	job.Payload = payload
+	if result != nil {
+		job.Result = result
+	}
+	return job, err
+}
+
+// enqueue_job stores a job for the workers, returning 0 when a job with its dedupe key already exists
+func enqueue_job(db db_handle, config Config, input NewJob) (int64, error) {
+	create_record := `
+	INSERT INTO jobs (tenant_id, type, payload, max_attempts, run_at, dedupe_key, created_by)
+	VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)
+	ON CONFLICT DO NOTHING;
+	`
+
+	payload, err := json.Marshal(input.Payload)
+	if err != nil {
+		return 0, err
+	}
+
+	run_at := input.RunAt
+	if run_at.IsZero() {
+		run_at = time.Now()
+	}
+
+	result, err := db.Exec(create_record, input.TenantID, input.Type, string(payload), max(config.JobMaxAttempts, 1), run_at.UnixMilli(), input.DedupeKey, input.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+
+	created, err := result.RowsAffected()
+	if err != nil || created == 0 {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// claim_job takes the next due job, or one whose worker let its lease run out, nil when there is none
+func claim_job(db *sql.DB, lease time.Duration) (*Job, error) {
+	claim_record := `
+	UPDATE jobs
+	SET status = 'running', attempts = attempts + 1, locked_until = ?1, updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE (status = 'queued' AND run_at <= ?2) OR (status = 'running' AND locked_until < ?2)
+		ORDER BY run_at, id
+		LIMIT 1
+	)
+	RETURNING ` + job_columns + `;
+	`
+
+	var job Job
+	err := retry_busy(func() error {
+		now := time.Now()
+		var err error
+		job, err = scan_job(db.QueryRow(claim_record, now.Add(lease).UnixMilli(), now.UnixMilli()))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func set_job_progress(db *sql.DB, id int64, percent int, lease time.Duration) error {
+	_, err := exec_with_retry(db, `UPDATE jobs SET progress = ?, locked_until = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'running';`, percent, time.Now().Add(lease).UnixMilli(), id)
+	return err
+}
+
+// checkpoint_job records progress in the transaction doing the work it reports, so a job resumed after a
+// failure starts where the last committed work ended
+func checkpoint_job(tx *sql.Tx, id int64, percent int, checkpoint any, lease time.Duration) error {
+	encoded, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE jobs SET progress = ?, result = ?, locked_until = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?;`, percent, string(encoded), time.Now().Add(lease).UnixMilli(), id)
+	return err
+}
+
+func complete_job(db *sql.DB, id int64, result any) error {
+	update_record := `
+	UPDATE jobs
+	SET status = 'succeeded', progress = 100, result = ?, locked_until = NULL, updated_at = CURRENT_TIMESTAMP, finished_at = CURRENT_TIMESTAMP
+	WHERE id = ?;
+	`
+
+	var result_str *string
+	if result != nil {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		result_str = new(string)
+		*result_str = string(encoded)
+	}
+
+	_, err := exec_with_retry(db, update_record, result_str, id)
+	return err
+}
+
+// fail_job queues the job again at retry_at, or marks it dead when there is no retry
+func fail_job(db *sql.DB, id int64, cause error, retry_at *time.Time) error {
+	if retry_at == nil {
+		_, err := exec_with_retry(db, `UPDATE jobs SET status = 'dead', last_error = ?, locked_until = NULL, updated_at = CURRENT_TIMESTAMP, finished_at = CURRENT_TIMESTAMP WHERE id = ?;`, cause.Error(), id)
+		return err
+	}
+
+	_, err := exec_with_retry(db, `UPDATE jobs SET status = 'queued', run_at = ?, last_error = ?, locked_until = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?;`, retry_at.UnixMilli(), cause.Error(), id)
+	return err
+}
+
+// requeue_job puts back a job its worker gave up on when shutting down
+func requeue_job(db *sql.DB, id int64) error {
+	_, err := exec_with_retry(db, `UPDATE jobs SET status = 'queued', attempts = attempts - 1, locked_until = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'running';`, id)
+	return err
+}
+
+func retry_job(db *sql.DB, id int64) (*Job, error) {
+	var job *Job
+	err := with_tx(db, func(tx *sql.Tx) error {
+		var err error
+		job, err = get_job(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if job.Status != "dead" {
+			return errors.New("Only dead jobs can be retried")
+		}
+
+		_, err = tx.Exec(`UPDATE jobs SET status = 'queued', attempts = 0, run_at = ?, finished_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?;`, time.Now().UnixMilli(), id)
+		if err != nil {
+			return err
+		}
+
+		job, err = get_job(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func get_job(db db_handle, id int64) (*Job, error) {
+	job, err := scan_job(db.QueryRow(`SELECT `+job_columns+` FROM jobs WHERE id = ?;`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Job not found")
+		}
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func get_jobs(db *sql.DB, tenant_id string, status string, offset int, limit int) ([]Job, int, error) {
+	get_records := `
+	SELECT ` + job_columns + `
+	FROM jobs
+	WHERE tenant_id = ?1 AND (?2 = '' OR status = ?2)
+	ORDER BY id DESC
+	LIMIT ?3 OFFSET ?4;
+	`
+
+	rows, err := db.Query(get_records, tenant_id, status, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scan_job(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		jobs = append(jobs, job)
+	}
+	if rows.Err() != nil {
+		return nil, 0, rows.Err()
+	}
+
+	var total int
+	err = db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE tenant_id = ?1 AND (?2 = '' OR status = ?2);`, tenant_id, status).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return jobs, total, nil
+}
+
+// #endregion
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type JwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// JwtClaims keeps the raw claims so the configured roles claim can be looked up by name
+type JwtClaims map[string]any
+
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JwtVerifier validates bearer tokens against a shared HS256 secret or keys published at a JWKS url
+type JwtVerifier struct {
+	secret   []byte
+	jwks_url string
+	issuer   string
+	audience string
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	fetched_at time.Time
+	fetches    singleflight.Group // one jwks fetch at a time, tokens needing it wait for the same one
+}
+
+// jwks_min_refresh stops unknown kids from hammering the jwks endpoint
+const jwks_min_refresh = time.Minute
+
+func new_jwt_verifier(config Config) *JwtVerifier {
+	if config.JwtSecret == "" && config.JwksURL == "" {
+		return nil
+	}
+
+	return &JwtVerifier{
+		secret:   []byte(config.JwtSecret),
+		jwks_url: config.JwksURL,
+		issuer:   config.JwtIssuer,
+		audience: config.JwtAudience,
+		keys:     map[string]crypto.PublicKey{},
+	}
+}
+
+func decode_segment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Verify checks the signature and registered claims, returning the claims of a valid token
+func (v *JwtVerifier) Verify(token string) (JwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+
+	var header JwtHeader
+	err := decode_segment(parts[0], &header)
+	if err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	switch header.Alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errors.New("Invalid token signature")
+		}
+	case "RS256":
+		key, err := v.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		rsa_key, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("Key type does not match token algorithm")
+		}
+		err = rsa.VerifyPKCS1v15(rsa_key, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return nil, errors.New("Invalid token signature")
+		}
+	case "ES256":
+		key, err := v.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		ec_key, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, errors.New("Key type does not match token algorithm")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ec_key, digest[:], r, s) {
+			return nil, errors.New("Invalid token signature")
+		}
+	default:
+		return nil, errors.New("Unsupported token algorithm")
+	}
+
+	var claims JwtClaims
+	err = decode_segment(parts[1], &claims)
+	if err != nil {
+		return nil, errors.New("Malformed token claims")
+	}
+
+	now := float64(time.Now().Unix())
+	exp, ok := claims["exp"].(float64)
+	if !ok || now >= exp {
+		return nil, errors.New("Token expired")
+	}
+
+	nbf, ok := claims["nbf"].(float64)
+	if ok && now < nbf {
+		return nil, errors.New("Token not yet valid")
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, errors.New("Invalid token issuer")
+	}
+
+	if v.audience != "" && !claims.has_audience(v.audience) {
+		return nil, errors.New("Invalid token audience")
+	}
+
+	return claims, nil
+}
+
+func (c JwtClaims) has_audience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c JwtClaims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// Tenant reads the claim naming the tenant the token is bound to, empty when it has none
+func (c JwtClaims) Tenant(claim string) string {
+	tenant_id, _ := c[claim].(string)
+	return tenant_id
+}
+
+// Roles reads a dotted claim path such as "realm_access.roles", as an array or a space separated string
+func (c JwtClaims) Roles(path string) []string {
+	var value any = map[string]any(c)
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+
+	switch roles := value.(type) {
+	case string:
+		return strings.Fields(roles)
+	case []any:
+		var result []string
+		for _, role := range roles {
+			role_str, ok := role.(string)
+			if ok {
+				result = append(result, role_str)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+// key returns the jwks key for kid, refetching the set when the kid is unknown. The fetch happens outside the
+// lock, so tokens signed with known keys keep verifying while it waits on the provider
+func (v *JwtVerifier) key(kid string) (crypto.PublicKey, error) {
+	if v.jwks_url == "" {
+		return nil, errors.New("Asymmetric tokens are not accepted")
+	}
+
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	recent := time.Since(v.fetched_at) < jwks_min_refresh
+	v.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if recent {
+		return nil, errors.New("Unknown token key")
+	}
+
+	_, err, _ := v.fetches.Do("jwks", func() (any, error) {
+		keys, err := fetch_jwks(v.jwks_url)
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		v.fetched_at = time.Now()
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	key, ok = v.keys[kid]
+	v.mu.Unlock()
+
+	if !ok {
+		return nil, errors.New("Unknown token key")
+	}
+
+	return key, nil
+}
+
+func fetch_jwks(url string) (map[string]crypto.PublicKey, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("JWKS fetch failed: " + res.Status)
+	}
+
+	var set struct {
+		Keys []Jwk `json:"keys"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		key, err := jwk.public_key()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k Jwk) public_key() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("Unsupported curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, errors.New("Unsupported key type")
+}
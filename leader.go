@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+)
+
+// run_as_leader runs fn only while this process holds the named lease, so with several replicas on
+// one database the background workers run exactly once across them. fn's context is cancelled as soon
+// as a renewal fails, and the lease is released on shutdown so another replica can take over right away
+func run_as_leader(ctx context.Context, db *sql.DB, config Config, name string, fn func(ctx context.Context)) {
+	hostname, _ := os.Hostname()
+	holder := hostname + "/" + random_token(6)
+	renew_every := max(config.LeaderLeaseTTL/3, time.Second)
+
+	ticker := time.NewTicker(renew_every)
+	defer ticker.Stop()
+
+	for {
+		leader, err := acquire_lease(db, name, holder, config.LeaderLeaseTTL)
+		if err != nil {
+			println("leader lease check failed:", err.Error())
+		}
+
+		if leader {
+			println("leading " + name + " as " + holder)
+			lead(ctx, db, name, holder, config.LeaderLeaseTTL, renew_every, fn)
+			println("stopped leading " + name)
+		}
+
+		select {
+		case <-ctx.Done():
+			err = release_lease(db, name, holder)
+			if err != nil {
+				println("leader lease release failed:", err.Error())
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead runs fn and keeps renewing the lease until ctx ends or a renewal fails, then waits for fn to return
+func lead(ctx context.Context, db *sql.DB, name string, holder string, ttl time.Duration, renew_every time.Duration, fn func(ctx context.Context)) {
+	lead_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(lead_ctx)
+	}()
+
+	ticker := time.NewTicker(renew_every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-lead_ctx.Done():
+			<-done
+			return
+		case <-ticker.C:
+		}
+
+		leader, err := acquire_lease(db, name, holder, ttl)
+		if err != nil || !leader {
+			// another replica may take over once the lease runs out, stop before that can happen
+			cancel()
+			<-done
+			return
+		}
+	}
+}
+
+// #region Database
+
+// acquire_lease takes or renews the lease, true when holder has it until now + ttl
+func acquire_lease(db *sql.DB, name string, holder string, ttl time.Duration) (bool, error) {
+	acquire_record := `
+	INSERT INTO leader_leases (name, holder, expires_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+	WHERE leader_leases.holder = excluded.holder OR leader_leases.expires_at < ?;
+	`
+
+	now := time.Now()
+	result, err := db.Exec(acquire_record, name, holder, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func release_lease(db *sql.DB, name string, holder string) error {
+	_, err := db.Exec(`DELETE FROM leader_leases WHERE name = ? AND holder = ?;`, name, holder)
+	return err
+}
+
+// #endregion
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Link is a hypermedia control, method is left out for plain GETs
+type Link struct {
+	Href   string `json:"href"`
+	Method string `json:"method,omitempty"`
+}
+
+// customer_link_routes are the mux patterns behind each customer link, check_link_routes holds them to the mux
+var customer_link_routes = map[string]string{
+	"self":   "GET /api/customers/{id}",
+	"update": "PUT /api/customers/{id}",
+	"delete": "DELETE /api/customers/{id}",
+}
+
+// route_link fills the pattern's {id} in
+func route_link(pattern string, id int64) Link {
+	method, path, _ := strings.Cut(pattern, " ")
+	link := Link{Href: strings.ReplaceAll(path, "{id}", strconv.FormatInt(id, 10))}
+	if method != http.MethodGet {
+		link.Method = method
+	}
+
+	return link
+}
+
+func customer_links(r *http.Request, id int64) map[string]Link {
+	links := map[string]Link{}
+	for rel, pattern := range customer_link_routes {
+		link := route_link(pattern, id)
+		link.Href = public_path(r, link.Href)
+		links[rel] = link
+	}
+
+	return links
+}
+
+// check_link_routes fails when a link would point at a route the mux does not serve, so a renamed route
+// cannot leave clients following dead links
+func check_link_routes(mux *http.ServeMux) error {
+	for rel, pattern := range customer_link_routes {
+		link := route_link(pattern, 1)
+		method := link.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		req, err := http.NewRequest(method, link.Href, nil)
+		if err != nil {
+			return err
+		}
+
+		_, matched := mux.Handler(req)
+		if matched != pattern {
+			return errors.New("customer link " + rel + " names " + pattern + " but the mux routes it to " + matched)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalizedDates carries display versions of the date fields, the canonical ISO fields are left untouched
+type LocalizedDates struct {
+	Locale    string `json:"locale"`
+	DOB       string `json:"dob,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+type LocaleFormat struct {
+	Date string
+	Time string
+}
+
+// locale_formats is keyed by lowercase language tag, a bare language is the fallback for its regions
+var locale_formats = map[string]LocaleFormat{
+	"en":    {Date: "01/02/2006", Time: "3:04 PM"},
+	"en-us": {Date: "01/02/2006", Time: "3:04 PM"},
+	"en-gb": {Date: "02/01/2006", Time: "15:04"},
+	"en-au": {Date: "02/01/2006", Time: "3:04 pm"},
+	"en-sg": {Date: "02/01/2006", Time: "3:04 pm"},
+	"ms":    {Date: "02/01/2006", Time: "15:04"},
+	"de":    {Date: "02.01.2006", Time: "15:04"},
+	"fr":    {Date: "02/01/2006", Time: "15:04"},
+	"es":    {Date: "02/01/2006", Time: "15:04"},
+	"it":    {Date: "02/01/2006", Time: "15:04"},
+	"pt":    {Date: "02/01/2006", Time: "15:04"},
+	"nl":    {Date: "02-01-2006", Time: "15:04"},
+	"ru":    {Date: "02.01.2006", Time: "15:04"},
+	"ja":    {Date: "2006/01/02", Time: "15:04"},
+	"zh":    {Date: "2006/01/02", Time: "15:04"},
+	"ko":    {Date: "2006. 01. 02.", Time: "15:04"},
+}
+
+// resolve_locale picks ?locale= first, then the best supported Accept-Language entry, empty if neither matches
+func resolve_locale(r *http.Request) string {
+	locale := r.URL.Query().Get("locale")
+	if locale != "" {
+		return match_locale(locale)
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		if strings.HasPrefix(strings.TrimSpace(params), "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(params), "q="), 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		tags = append(tags, weighted{tag: tag, q: q})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+
+	for _, tag := range tags {
+		match := match_locale(tag.tag)
+		if match != "" {
+			return match
+		}
+	}
+
+	return ""
+}
+
+func match_locale(tag string) string {
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	_, ok := locale_formats[tag]
+	if ok {
+		return tag
+	}
+
+	language, _, _ := strings.Cut(tag, "-")
+	_, ok = locale_formats[language]
+	if ok {
+		return language
+	}
+
+	return ""
+}
+
+// localize fills in the localized block for the request's locale, leaving the customer as is without one
+func localize(r *http.Request, customer *Customer) {
+	locale := resolve_locale(r)
+	if locale == "" {
+		return
+	}
+
+	format := locale_formats[locale]
+	localized := &LocalizedDates{Locale: locale}
+
+	dob, err := time.Parse("2006-01-02", customer.DOB)
+	if err == nil {
+		localized.DOB = dob.Format(format.Date)
+	}
+
+	created_at := ParseTimestamp(customer.CreatedAt)
+	if !created_at.IsZero() {
+		localized.CreatedAt = created_at.Format(format.Date + " " + format.Time)
+	}
+
+	updated_at := ParseTimestamp(customer.UpdatedAt)
+	if !updated_at.IsZero() {
+		localized.UpdatedAt = updated_at.Format(format.Date + " " + format.Time)
+	}
+
+	customer.Localized = localized
+}
@@ -1,41 +1,104 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
 type Customer struct {
-	ID        int64  `json:"id"` // incremental id
-	Name      string `json:"name"`
-	DOB       string `json:"dob"`
-	Email     string `json:"email"`
-	Contact   string `json:"contact"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID         int64           `json:"id"`      // incremental id
+	Version    int64           `json:"version"` // bumped by every write, PUT must name the version it replaces
+	Name       string          `json:"name"`
+	DOB        string          `json:"dob"`
+	Email      string          `json:"email"`
+	Contact    string          `json:"contact"` // the primary phone
+	Country    string          `json:"country"` // iso 3166-1 alpha-2, empty when unknown
+	Emails     []ContactPoint  `json:"emails"`
+	Phones     []ContactPoint  `json:"phones"`
+	Metadata   json.RawMessage `json:"metadata"`              // custom fields, an object matching the metadata schema
+	ExternalID string          `json:"external_id,omitempty"` // stable key for fixtures and integrations
+	CreatedAt  string          `json:"created_at"`
+	UpdatedAt  string          `json:"updated_at"`
+
+	ReferralCode         string `json:"referral_code"` // shareable code identifying this customer as a referrer
+	ReferredByCustomerID *int64 `json:"referred_by_customer_id"`
+	CompanyID            *int64 `json:"company_id"`
+
+	Blocked bool           `json:"blocked"`
+	Block   *CustomerBlock `json:"block,omitempty"`
+
+	Status          string  `json:"status"` // active, inactive or blocked
+	ArchivedAt      *string `json:"archived_at"`
+	EmailVerifiedAt *string `json:"email_verified_at"` // cleared whenever the email changes
+	AvatarUpdatedAt *string `json:"avatar_updated_at"` // set while the customer has an avatar at GET /customers/{id}/avatar
+	Verified        bool    `json:"verified"`          // email_verified_at is set
+
+	Age             *int            `json:"age,omitempty"`              // whole years today, derived from dob
+	DisposableEmail *bool           `json:"disposable_email,omitempty"` // email is at a disposable mailbox provider, unset with DISPOSABLE_EMAIL=off
+	Localized       *LocalizedDates `json:"localized,omitempty"`        // display formats for ?locale= / Accept-Language
+	PrimaryAddress  *Address        `json:"primary_address,omitempty"`  // set with ?expand=addresses
+	Company         *Company        `json:"company,omitempty"`          // set with ?expand=company
+
+	Links map[string]Link `json:"links,omitempty"` // self, update and delete, set when the customer is returned
 }
 
 type CustomerDetails struct {
-	Name    string `json:"name"`
-	DOB     string `json:"dob"`
-	Email   string `json:"email"`
-	Contact string `json:"contact"`
+	Name       string `json:"name"`
+	DOB        string `json:"dob"`
+	Email      string `json:"email"`
+	Contact    string `json:"contact"`
+	Country    string `json:"country"`
+	ExternalID string `json:"external_id"`
+
+	// every email and phone, replacing what is stored when given. email and contact name the primary ones,
+	// left empty the first point or the one marked primary is used
+	Emails *[]ContactPoint `json:"emails,omitempty"`
+	Phones *[]ContactPoint `json:"phones,omitempty"`
+
+	Metadata json.RawMessage `json:"metadata,omitempty"` // custom fields, left out of an update it is kept
+
+	ReferralCode         string `json:"referral_code"` // generated on create when left empty
+	ReferredByCustomerID *int64 `json:"referred_by_customer_id"`
+	CompanyID            *int64 `json:"company_id"` // the company the customer works for, kept when an update leaves it out
+
+	Status string `json:"status"` // active or inactive, new customers default to active. Updates may only repeat the current one
+
+	Version *int64 `json:"version,omitempty"` // the version an update replaces, an alternative to If-Match
 }
 
 type GetListingResponse struct {
-	Records    []Customer `json:"records"`
-	TotalPages int        `json:"total_pages"`
+	Records []Customer `json:"records"`
+	Pagination
 }
 
 type ApiResponse[T any] struct {
 	Data T `json:"data"`
 }
 
+// write_json_response writes the response as json with the status
+func write_json_response(w http.ResponseWriter, status int, response any) {
+	response_str, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response_str)
+}
+
 // ConvertInt converts string to int, defaults to 0 if conversion fails
 func ConvertInt(s string) int {
 	if s == "" {
@@ -50,41 +113,490 @@ func ConvertInt(s string) int {
 	return i
 }
 
-func cors(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+func main() {
+	// `serv scrub <source.db> <target.db>` makes a copy without personal data instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		err := run_scrub(os.Args[2:])
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+	// `serv rotate-keys <database.db>` re-encrypts customer fields with a new PII_ENCRYPTION_KEY
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		err := run_rotate_keys(os.Args[2:])
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
 		}
+		return
+	}
 
-		next(w, r)
+	// `serv restore <backup> <target.db>` writes a database from a backup, optionally replaying events since
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		err := run_restore(os.Args[2:])
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+		return
 	}
-}
 
-func main() {
+	// `serv restore-replica <target.db>` writes the database from the wal replica
+	if len(os.Args) > 1 && os.Args[1] == "restore-replica" {
+		err := run_restore_replica(os.Args[2:])
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	config := load_config()
+
 	// initialize sqlite database connection
-	db, err := sql.Open("sqlite", "./database.db")
+	db, err := open_database("./database.db", config)
+	if err != nil {
+		panic(err)
+	}
+
+	// cancelled on SIGINT/SIGTERM to stop background workers and the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// create or upgrade the tables
+	err = migrate(db)
+	if err != nil {
+		panic(err)
+	}
+
+	statements = new_statement_cache(config)
+	err = statements.Warm(db)
+	if err != nil {
+		panic(err)
+	}
+
+	// emails are stored lowercased, and folded or checked for a mail exchanger when configured
+	email_options.FoldGmail = config.EmailFoldGmail
+	email_options.CheckMX = config.EmailCheckMX
+	if !disposable_modes[config.DisposableEmail] {
+		panic("DISPOSABLE_EMAIL must be off, flag or reject")
+	}
+	email_options.Disposable = config.DisposableEmail
+
+	// email, contact and dob are encrypted at rest with PII_ENCRYPTION_KEY, rows saved before it was set are sealed
+	// once their contacts are normalized
+	pii_cipher, err = new_pii_cipher(config.PIIEncryptionKey, config.PIIPreviousKey)
+	if err != nil {
+		panic(err)
+	}
+
+	// contacts are stored in e.164, numbers without a country code are read in the customer's country or this region
+	default_phone_region = config.PhoneDefaultRegion
+	err = normalize_stored_contacts(db)
+	if err != nil {
+		panic(err)
+	}
+
+	err = encrypt_stored_pii(db)
+	if err != nil {
+		panic(err)
+	}
+
+	// seed the known demo dataset when a fixtures file is configured
+	if config.FixturesFile != "" {
+		err = load_fixtures(db, config.FixturesFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// ship change events to the analytics warehouse when configured
+	sink, err := new_warehouse_sink(config)
+	if err != nil {
+		panic(err)
+	}
+
+	// publish change events to nats or kafka when configured
+	publisher, err := new_event_publisher(config)
+	if err != nil {
+		panic(err)
+	}
+
+	// read only mode, for migrations and restores on the live database. Everything below that writes in the
+	// background pauses while it is on
+	maintenance_mode = new_read_only_mode(config)
+
+	// checkpoint the wal and record how it went, the replicator checkpoints itself once frames are shipped
+	replicas, err := new_replica_store(config)
+	if err != nil {
+		panic(err)
+	}
+	if replicas == nil {
+		go maintenance_mode.while_writable(ctx, func(ctx context.Context) { run_checkpoints(ctx, db, config) })
+	}
+
+	// ping the database between requests so /metrics notices it failing
+	go run_database_pings(ctx, db, config)
+
+	// which customer fields each role may see
+	if config.FieldPolicyFile != "" {
+		field_policies, err = load_field_policies(config.FieldPolicyFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	customer_cache, err = new_customer_cache(config)
+	if err != nil {
+		panic(err)
+	}
+	count_cache = new_count_cache(config)
+
+	// avatars and other files, kept outside the database
+	blobs, err := new_blob_store(config)
 	if err != nil {
 		panic(err)
 	}
 
-	// create the table
-	err = create_table(db)
+	// snapshots of the databases, in their own directory or bucket
+	backups, err := new_backup_store(config)
 	if err != nil {
 		panic(err)
 	}
 
+	// signs login sessions, verification links and export downloads
+	sessions := new_session_signer(config)
+
+	// when each maintenance task runs
+	schedules, err := parse_schedules(config)
+	if err != nil {
+		panic(err)
+	}
+
+	// the event consumers, ship to the warehouse, publish to the bus, deliver webhooks and evaluate rules,
+	// queue anonymizations whose grace period is over, run the job queue, delete expired exports and run
+	// the scheduled maintenance
+	workers := func(ctx context.Context, db *sql.DB, blobs BlobStore) {
+		var wg sync.WaitGroup
+		run := func(worker func(ctx context.Context)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				worker(ctx)
+			}()
+		}
+
+		if sink != nil {
+			run(func(ctx context.Context) { run_warehouse_sink(ctx, db, sink, config) })
+		}
+		if publisher != nil {
+			run(func(ctx context.Context) { run_event_publisher(ctx, db, publisher, config) })
+		}
+		run(func(ctx context.Context) { run_webhooks(ctx, db, config) })
+		run(func(ctx context.Context) { run_rules(ctx, db, config) })
+		run(func(ctx context.Context) { run_anonymizations(ctx, db, config) })
+		run(func(ctx context.Context) { run_jobs(ctx, db, blobs, sessions, config) })
+		run(func(ctx context.Context) { run_export_expiry(ctx, db, blobs) })
+		run(func(ctx context.Context) { run_scheduler(ctx, maintenance_tasks(db, blobs, config, schedules)) })
+		wg.Wait()
+	}
+
+	// with several replicas on one database only the lease holder runs them
+	run_workers := func(ctx context.Context, db *sql.DB, blobs BlobStore) {
+		maintenance_mode.while_writable(ctx, func(ctx context.Context) {
+			if config.LeaderElection {
+				run_as_leader(ctx, db, config, "workers", func(ctx context.Context) { workers(ctx, db, blobs) })
+			} else {
+				workers(ctx, db, blobs)
+			}
+		})
+	}
+
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		run_workers(ctx, db, blobs)
+	}()
+
+	// not leader only, every replica checks emails against its own copy of the blocklist
+	if config.DisposableDomainsURL != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run_disposable_refresh(ctx, config)
+		}()
+	}
+
+	// dependencies reported by the readiness probe
+	health := new_health_checks(db)
+	health.Add("event_bus", publisher)
+
+	// integrations named in INTEGRATIONS_CRITICAL fail readiness while they are failing
+	integrations.SetCritical(split_list(config.IntegrationsCritical))
+	health.Add("integrations", integrations)
+
+	health.Add("blob_store", blobs)
+
 	mux := http.NewServeMux()
 
-	// health check api
-	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Service is up!"))
-	})
+	// liveness and readiness probes
+	register_health_routes(mux, health)
+
+	// build and runtime version
+	register_version_routes(mux)
+
+	// the api description, also what requests are validated against
+	register_openapi_routes(mux)
+
+	// pprof and runtime stats for admins
+	register_debug_routes(mux)
+
+	// health of the event bus, warehouse, webhooks and sentry
+	register_integration_routes(mux)
+
+	// customers and everything stored about them
+	register_data_routes(mux, db, config, blobs, sessions)
+
+	// storage contention, connection pool and database ping metrics
+	register_metrics_routes(mux, db)
+
+	// api key management
+	register_api_key_routes(mux, db)
 
+	// tenants and the admin keys they start with
+	register_tenant_routes(mux, db)
+
+	// online backups of every database
+	register_backup_routes(mux, db, backups, config)
+
+	// read only mode, for migrations and restores on the live database
+	register_maintenance_routes(mux, maintenance_mode, config)
+
+	// the admin ui for staff, on top of the api
+	register_admin_ui_routes(mux, config)
+
+	// request rates, the database, the job queue and recent writes at a glance
+	register_dashboard_routes(mux, db, config, maintenance_mode)
+
+	// fake customers for staging and QA, never on in production
+	if config.GenerateEnabled {
+		register_generate_routes(mux, db, config)
+	}
+
+	// with TENANT_ISOLATION=database every tenant but the default one keeps its data in a file of its own, opened
+	// with its routes and workers at startup
+	switch config.TenantIsolation {
+	case "row":
+	case "database":
+		tenant_databases, err = new_tenant_databases(ctx, db, config, blobs, func(db *sql.DB, blobs BlobStore) http.HandlerFunc {
+			tenant_mux := http.NewServeMux()
+			register_data_routes(tenant_mux, db, config, blobs, sessions)
+			return audit(db, tenant_mux, tenant_mux.ServeHTTP)
+		}, run_workers)
+		if err != nil {
+			panic(err)
+		}
+
+		err = tenant_databases.OpenAll()
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic("TENANT_ISOLATION must be row or database")
+	}
+
+	// scheduled backups, once the tenant databases they include are open. Apart from the workers so a long
+	// backup and the workers' lease don't hold each other up
+	backup_tasks := []ScheduledTask{{Name: "backup", Schedule: schedules["backup"], Run: func(ctx context.Context) error {
+		_, err := create_backup(ctx, db, backups, config, "scheduled", "scheduler")
+		return err
+	}}}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		maintenance_mode.while_writable(ctx, func(ctx context.Context) {
+			if config.LeaderElection {
+				run_as_leader(ctx, db, config, "backups", func(ctx context.Context) { run_scheduler(ctx, backup_tasks) })
+			} else {
+				run_scheduler(ctx, backup_tasks)
+			}
+		})
+	}()
+
+	// ship the wal to the replica store, from the lease holder only. It outlives ctx so the writes made while
+	// shutting down are shipped too
+	replication_ctx, stop_replication := context.WithCancel(context.Background())
+	var replication sync.WaitGroup
+	if replicas != nil {
+		replicator := new_replicator(db, "./database.db", replicas, config)
+		replication.Add(1)
+		go func() {
+			defer replication.Done()
+			maintenance_mode.while_writable(replication_ctx, func(ctx context.Context) {
+				if config.LeaderElection {
+					run_as_leader(ctx, db, config, "replication", replicator.Run)
+				} else {
+					replicator.Run(ctx)
+				}
+			})
+		}()
+	}
+
+	// interactive login through an openid connect provider
+	verifier := new_jwt_verifier(config)
+	oidc, err := new_oidc_provider(config, sessions)
+	if err != nil {
+		panic(err)
+	}
+	if oidc != nil {
+		oidc.register_routes(mux, config)
+
+		// bearer tokens from the same provider work for api calls unless a key source is configured
+		if verifier == nil {
+			verifier = oidc.APIVerifier(config)
+		}
+	}
+
+	// per caller request budget, in memory or shared through redis
+	limiter, err := new_rate_limit_store(config)
+	if err != nil {
+		panic(err)
+	}
+	health.Add("rate_limit_store", limiter)
+	health.Add("cache_store", customer_cache)
+
+	// responses to POSTs with an Idempotency-Key, replayed to retries
+	idempotency_store, err := new_idempotency_store(config)
+	if err != nil {
+		panic(err)
+	}
+	health.Add("idempotency_store", idempotency_store)
+
+	// not leader only, each replica keeps its own keys when they are in memory
+	if idempotency_store != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run_scheduler(ctx, []ScheduledTask{{Name: "idempotency_expiry", Schedule: schedules["idempotency_expiry"], Run: idempotency_store.Expire}})
+		}()
+	}
+
+	spec_router, err := load_openapi_router()
+	if err != nil {
+		panic(err)
+	}
+
+	// the links in responses must lead to routes that exist
+	err = check_link_routes(mux)
+	if err != nil {
+		panic(err)
+	}
+
+	// wrap the mux with the audit log, the tenant database, idempotency keys, request validation, format negotiation, compression, tenant scoping,
+	// read only mode, role checks, rate limiting by principal, auth, rate limiting by client ip, cors, hardening, panic recovery,
+	// request counts and request ids
+	handler := with_request_id(count_requests(recover_panics(config, harden(config, cors(config, rate_limit(limiter, config, client_rate_limit_key, authenticate(db, config, verifier, sessions, rate_limit(limiter, config, principal_rate_limit_key, authorize(config, read_only(maintenance_mode, scope_tenant(db, compress(config, negotiate(validate_requests(spec_router, idempotency(idempotency_store, config, route_tenant_database(audit(db, mux, mux.ServeHTTP)))))))))))))))))
+
+	// /v1 is the current api, the unversioned /api paths stay as deprecated aliases until LEGACY_SUNSET
+	api, err := route_versions(config, []ApiVersion{{Prefix: "/v1", Handler: handler}}, handler)
+	if err != nil {
+		panic(err)
+	}
+
+	server := &http.Server{
+		Addr:              config.ListenAddr,
+		Handler:           api,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	// end sse and websocket streams so shutdown doesn't wait on them
+	server.RegisterOnShutdown(event_broker.Close)
+
+	// https from certificate files or acme, with plain http redirected
+	redirect_server, err := configure_tls(config, server)
+	if err != nil {
+		panic(err)
+	}
+	if redirect_server != nil {
+		go func() {
+			err := redirect_server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
+
+	// the same debug routes on a private port, for profiling without an admin credential
+	debug_server := new_debug_server(config)
+	if debug_server != nil {
+		go func() {
+			println("Debug server is running on " + config.DebugAddr)
+			err := debug_server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
+
+	go func() {
+		println("Server is running on " + config.ListenAddr)
+		err := listen(config, server)
+		if err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	<-ctx.Done()
+	println("Shutting down")
+	// fail readiness first so load balancers stop sending traffic before the listener closes
+	health.Drain()
+	time.Sleep(config.ShutdownDrainDelay)
+
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = server.Shutdown(shutdown_ctx)
+	if err != nil {
+		println("shutdown failed:", err.Error())
+	}
+
+	if redirect_server != nil {
+		redirect_server.Shutdown(shutdown_ctx)
+	}
+
+	// an in-flight profile would hold up shutdown for its whole duration
+	if debug_server != nil {
+		debug_server.Close()
+	}
+
+	// websockets are hijacked so Shutdown doesn't track them
+	websocket_connections.Wait()
+
+	// workers finish their batch and the leader lease is handed back before the database closes
+	background.Wait()
+
+	// the last writes are done, the replicator ships them before the database closes
+	stop_replication()
+	replication.Wait()
+	if tenant_databases != nil {
+		tenant_databases.Close()
+	}
+	if publisher != nil {
+		publisher.Close()
+	}
+	statements.Close(db)
+	db.Close()
+}
+
+// register_data_routes adds the routes serving what a tenant stores
+func register_data_routes(mux *http.ServeMux, db *sql.DB, config Config, blobs BlobStore, sessions *SessionSigner) {
 	// register the customer
 	mux.HandleFunc("POST /api/customers", func(w http.ResponseWriter, r *http.Request) {
 		// receive the request in json body
@@ -95,13 +607,32 @@ func main() {
 			return
 		}
 
+		err = validate_customer(r.Context(), db, &req, 0)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		// create the customer
-		customer, err := create_customer(db, req)
+		customer, err := create_customer(db, tenant_from(r), req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		// the customer is saved either way, a failed quota check must not fail the request
+		err = check_quotas(db, config, tenant_from(r))
+		if err != nil {
+			println("quota check failed:", err.Error())
+		}
+
+		present_customer(r, customer)
 		response := ApiResponse[Customer]{
 			Data: *customer,
 		}
@@ -117,7 +648,7 @@ func main() {
 	})
 
 	// update the customer
-	mux.HandleFunc("PUT /api/customers/{id}", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("PUT /api/customers/{id}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
 		id_str := r.PathValue("id")
 		if id_str == "" {
 			http.Error(w, "Invalid id", http.StatusBadRequest)
@@ -136,12 +667,53 @@ func main() {
 			return
 		}
 
-		customer, err := update_customer(db, id, req)
+		// concurrent updates must not silently overwrite each other
+		version, err := expected_version(r, req)
+		if err != nil && err.Error() == "If-Match or version is required" {
+			http.Error(w, err.Error(), http.StatusPreconditionRequired)
+			return
+		}
+
+		// a malformed tag can't match the current version
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+
+		err = validate_customer(r.Context(), db, &req, id)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		customer, err := update_customer(db, id, version, req)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil && err.Error() == "Version mismatch" {
+			http.Error(w, "Customer was changed since version "+strconv.FormatInt(version, 10)+", fetch it again", http.StatusPreconditionFailed)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = check_quotas(db, config, tenant_from(r))
+		if err != nil {
+			println("quota check failed:", err.Error())
+		}
+
+		present_customer(r, customer)
 		response := ApiResponse[Customer]{
 			Data: *customer,
 		}
@@ -150,13 +722,14 @@ func main() {
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		} else {
+			w.Header().Set("ETag", etag_for(customer.Version, response_str))
 			w.Header().Set("Content-Type", "application/json")
 			w.Write(response_str)
 		}
-	})
+	}))
 
 	// delete the customer
-	mux.HandleFunc("DELETE /api/customers/{id}", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("DELETE /api/customers/{id}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
 		id_str := r.PathValue("id")
 		if id_str == "" {
 			http.Error(w, "Invalid id", http.StatusBadRequest)
@@ -168,25 +741,50 @@ func main() {
 			return
 		}
 
-		_, err = get_customer(db, id)
+		customer, err := get_customer(db, id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
 
-		delete_record := `
-		DELETE FROM customers
-		WHERE id = ?;
-		`
-
-		_, err = db.Exec(delete_record, id)
+		err = delete_customer(db, customer)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		// the customer is gone either way, a file left behind is only wasted space
+		err = purge_customer_blobs(r.Context(), db, blobs, id)
+		if err != nil {
+			println("deleting customer files failed:", err.Error())
+		}
+
+		// re-arms the thresholds the customer count dropped below
+		err = check_quotas(db, config, tenant_from(r))
+		if err != nil {
+			println("quota check failed:", err.Error())
+		}
+
 		w.WriteHeader(http.StatusOK)
-	})
+	}))
+
+	// stream customer changes as server-sent events
+	mux.HandleFunc("GET /api/customers/stream", stream_customer_events(db))
+
+	// signups, email domains and ages of the customers the listing filters select
+	mux.HandleFunc("GET /api/customers/stats", customer_stats(db, config))
+
+	// the number of customers the listing filters select
+	register_count_routes(mux, db, config)
+
+	// export all customers as csv, json or parquet, ?purpose=marketing drops suppressed emails
+	mux.HandleFunc("GET /api/customers/export", export_customers(db, config))
+
+	// the same in the background for large exports, downloaded through a signed link
+	register_export_job_routes(mux, db, config, blobs, sessions)
+
+	// import customers from a csv file in the background
+	register_import_routes(mux, db, config, blobs)
 
 	// get customers
 	mux.HandleFunc("GET /api/customers/{id}", func(w http.ResponseWriter, r *http.Request) {
@@ -202,8 +800,15 @@ func main() {
 			return
 		}
 
-		// try to find the customer
-		customer, err := get_customer(db, id)
+		// ?fields=id,name,email trims the response
+		fields, err := requested_fields(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// try to find the customer, hot and missing ids are served from the cache
+		customer, err := get_cached_customer(db, tenant_from(r), id)
 		if err != nil && err.Error() == "Customer not found" {
 			http.Error(w, "Customer not found", http.StatusNotFound)
 			return
@@ -214,143 +819,485 @@ func main() {
 			return
 		}
 
-		response := ApiResponse[Customer]{
-			Data: *customer,
+		// ?expand=addresses,company adds the primary address and company, before presenting so field policies apply to them
+		customers := []Customer{*customer}
+		err = expand_customers(db, r, customers)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		response_str, err := json.Marshal(response)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// return response
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(response_str)
+		customer = &customers[0]
+		present_customer(r, customer)
+		if wants_html(r) {
+			write_customer_html(w, r, config, *customer)
+			return
+		}
+
+		var response_str []byte
+		if fields == nil {
+			response_str, err = json.Marshal(ApiResponse[Customer]{Data: *customer})
+		} else {
+			var sparse map[string]json.RawMessage
+			sparse, err = sparse_customer(*customer, fields)
+			if err == nil {
+				response_str, err = json.Marshal(ApiResponse[map[string]json.RawMessage]{Data: sparse})
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// return response, or 304 to pollers that already have this version
+		write_with_etag(w, r, customer.Version, response_str)
 	})
 
 	mux.HandleFunc("GET /api/customers", func(w http.ResponseWriter, r *http.Request) {
 		// get params for pagination
-		page := ConvertInt(r.URL.Query().Get("page"))
-		limit := ConvertInt(r.URL.Query().Get("limit"))
+		page, limit := page_params(config, r, 10)
 
-		if page <= 0 {
-			page = 1
+		// the filters in the query, archived, unverified or inactive customers are left out as configured
+		scope, err := filtered_listing_scope(config, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ?fields=id,name,email selects and returns only those fields
+		fields, err := requested_fields(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		if limit == 0 {
-			limit = 10
+		var result []Customer
+		if fields == nil {
+			result, err = get_customers(db, scope, (page-1)*limit, limit)
+		} else {
+			result, err = get_sparse_customers(db, scope, fields, (page-1)*limit, limit)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		result, err := get_customers(db, (page-1)*limit, limit)
+		total_records, estimated, err := listing_total(db, r, scope)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		total_records, err := get_total_customers(db)
+		pagination := new_pagination(r, page, limit, total_records)
+		pagination.TotalEstimated = estimated
+
+		err = expand_customers(db, r, result)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		total_pages := (total_records + limit - 1) / limit
+		for i := range result {
+			present_customer(r, &result[i])
+		}
 
-		response := ApiResponse[GetListingResponse]{
-			Data: GetListingResponse{
-				Records:    result,
-				TotalPages: total_pages,
-			},
+		// a browser gets the page
+		if wants_html(r) {
+			write_customer_list_html(w, r, config, "", result, pagination)
+			return
+		}
+
+		var response_str []byte
+		if fields == nil {
+			response_str, err = json.Marshal(ApiResponse[GetListingResponse]{
+				Data: GetListingResponse{
+					Records:    result,
+					Pagination: pagination,
+				},
+			})
+		} else {
+			response_str, err = sparse_listing_response(result, fields, pagination)
 		}
-		response_str, err := json.Marshal(response)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		// return response
+		set_link_header(w, pagination)
+		set_total_count_header(w, total_records, estimated)
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(response_str)
 	})
 
-	// wrap the mux with cors middleware
-	server := cors(mux.ServeHTTP)
+	// block status and block/unblock
+	register_blocking_routes(mux, db)
+
+	// archiving and email verification, which decide the default listing scope
+	register_scope_routes(mux, db)
+
+	// status lifecycle transitions and their history
+	register_status_routes(mux, db)
+
+	// customers referred by a customer
+	mux.HandleFunc("GET /api/customers/{id}/referrals", list_referrals(db, config))
+
+	// top referrers
+	mux.HandleFunc("GET /api/stats/referrals", referral_leaderboard(db))
+
+	// age keys exports are encrypted to, per requester
+	register_export_recipient_routes(mux, db)
+
+	// dashboard counts by status, tag and country
+	mux.HandleFunc("GET /api/stats/overview", stats_overview(db))
+
+	// replay the change log
+	mux.HandleFunc("GET /api/events", list_events(db))
+
+	// live customer events over websocket
+	mux.HandleFunc("GET /ws", websocket_events())
+
+	// email suppression list
+	register_suppression_routes(mux, db, config)
+
+	// webhook subscriptions
+	register_webhook_routes(mux, db)
 
-	println("Server is running on port 3000")
-	http.ListenAndServe(":3000", server)
+	// the customer's history as an html or pdf report for support handoffs
+	mux.HandleFunc("GET /api/customers/{id}/timeline/export", export_customer_timeline(db))
+
+	// everything stored about a customer in one file, for subject access requests
+	mux.HandleFunc("GET /api/customers/{id}/gdpr-export", gdpr_export(db, config))
+
+	// the right to be forgotten, now or after a grace period
+	register_anonymization_routes(mux, db, config, blobs)
+
+	// data hygiene rules and the review queue
+	register_rule_routes(mux, db)
+
+	// customer tags and their counts
+	register_tag_routes(mux, db)
+
+	// support notes, the contact history per customer
+	register_note_routes(mux, db, config)
+
+	// postal addresses, one of them primary
+	register_address_routes(mux, db)
+	register_metadata_routes(mux, db)
+	register_company_routes(mux, db, config)
+	register_relationship_routes(mux, db)
+	register_consent_routes(mux, db)
+	register_avatar_routes(mux, db, blobs)
+	register_attachment_routes(mux, db, config, blobs)
+	register_history_routes(mux, db, config)
+
+	// likely duplicates and merging them
+	register_duplicate_routes(mux, db, config, blobs)
+
+	// fuzzy name search, "Jon Smyth" finds John Smith
+	register_search_routes(mux, db, config)
+
+	// saved listings with their member counts
+	register_segment_routes(mux, db, config)
+
+	// who changed what, for compliance reviews
+	register_audit_routes(mux, db, config)
+
+	// poll and retry background jobs
+	register_job_routes(mux, db, config)
+
+	// verification emails, the links in them are signed with the session secret
+	register_verification_routes(mux, db, config, sessions)
 }
 
 // #region Database
-func create_table(db *sql.DB) error {
-	sql_table := `
-	CREATE TABLE IF NOT EXISTS customers (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT,
-		dob TEXT,
-		email TEXT,
-		contact TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-	`
 
-	_, err := db.Exec(sql_table)
-	return err
+// customer_columns is the select list read by scan_customer
+const customer_columns = `id, name, dob, email, contact, COALESCE(external_id, ''), created_at, updated_at, COALESCE(referral_code, ''), referred_by_customer_id,
+	blocked_at IS NOT NULL, COALESCE(blocked_reason, ''), COALESCE(blocked_by, ''), COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', blocked_at), ''),
+	status, strftime('%Y-%m-%dT%H:%M:%SZ', archived_at), strftime('%Y-%m-%dT%H:%M:%SZ', email_verified_at), COALESCE(country, ''), version, metadata, company_id, strftime('%Y-%m-%dT%H:%M:%SZ', avatar_updated_at),
+	` + contact_point_columns
+
+// db_handle is satisfied by both *sql.DB and *sql.Tx so reads can join a transaction
+type db_handle interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
 }
 
-func create_customer(db *sql.DB, input CustomerDetails) (*Customer, error) {
-	create_record := `
-	INSERT INTO customers (name, dob, email, contact)
-	VALUES (?, ?, ?, ?);
-	`
+// with_tx runs fn in a transaction, committing if it returns nil and rolling back otherwise. fn runs again
+// from the start when the transaction failed on a lock, so it must not keep state from an earlier run
+func with_tx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	return retry_busy(func() error {
+		return try_tx(db, fn)
+	})
+}
+
+func try_tx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	start := time.Now()
+	tx, err := db.Begin()
+	if err == nil || is_transient(err) {
+		storage_metrics.observe_lock_wait(time.Since(start))
+	}
+	if err != nil {
+		return err
+	}
 
-	result, err := db.Exec(create_record, input.Name, input.DOB, input.Email, input.Contact)
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type row_scanner interface {
+	Scan(dest ...any) error
+}
+
+func scan_customer(row row_scanner) (Customer, error) {
+	var customer Customer
+	var block CustomerBlock
+	var metadata_str, emails_str, phones_str string
+	err := row.Scan(&customer.ID, &customer.Name, &customer.DOB, &customer.Email, &customer.Contact, &customer.ExternalID, &customer.CreatedAt, &customer.UpdatedAt, &customer.ReferralCode, &customer.ReferredByCustomerID,
+		&customer.Blocked, &block.Reason, &block.BlockedBy, &block.BlockedAt,
+		&customer.Status, &customer.ArchivedAt, &customer.EmailVerifiedAt, &customer.Country, &customer.Version, &metadata_str, &customer.CompanyID, &customer.AvatarUpdatedAt,
+		&emails_str, &phones_str)
+	if err != nil {
+		return customer, err
+	}
+	if customer.Blocked {
+		customer.Block = &block
+	}
+	customer.Verified = customer.EmailVerifiedAt != nil
+	customer.Metadata = json.RawMessage(metadata_str)
+
+	err = decrypt_customer_pii(&customer)
+	if err != nil {
+		return customer, err
+	}
+
+	customer.Emails, err = scan_contact_points(emails_str, "email")
+	if err != nil {
+		return customer, err
+	}
+	customer.Phones, err = scan_contact_points(phones_str, "phone")
+	return customer, err
+}
+
+const create_customer_record = `
+INSERT INTO customers (tenant_id, name, dob, email, contact, email_index, contact_index, external_id, referral_code, referred_by_customer_id, status, country, metadata, company_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, COALESCE(NULLIF(?, ''), 'active'), NULLIF(?, ''), COALESCE(?, '{}'), ?);
+`
+
+func create_customer(db *sql.DB, tenant_id string, input CustomerDetails) (*Customer, error) {
+	var customer *Customer
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		var err error
+		customer, event, err = insert_customer(tx, db, tenant_id, input)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	event_broker.Publish(*event)
+
+	return customer, nil
+}
+
+// insert_customer creates the customer in tx, the caller publishes the event once tx commits
+func insert_customer(tx *sql.Tx, db *sql.DB, tenant_id string, input CustomerDetails) (*Customer, *CustomerEvent, error) {
+	if input.ReferralCode == "" {
+		code, err := generate_referral_code()
+		if err != nil {
+			return nil, nil, err
+		}
+		input.ReferralCode = code
+	}
+
+	dob, email, contact, err := encrypt_customer_pii(input.DOB, input.Email, input.Contact)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := tx_exec(tx, db, create_customer_record, tenant_id, input.Name, dob, email, contact, pii_index("email", input.Email), pii_index("contact", input.Contact), input.ExternalID, input.ReferralCode, input.ReferredByCustomerID, input.Status, input.Country, metadata_arg(input.Metadata), input.CompanyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	id, err := result.LastInsertId()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	err = save_contact_points(tx, id, "email", input.Email, input.Emails)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = save_contact_points(tx, id, "phone", input.Contact, input.Phones)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// get the customer
-	customer, err := get_customer(db, id)
+	customer, err := get_customer(tx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	event, err := record_event(tx, EventCustomerCreated, customer.ID, customer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return customer, event, nil
+}
+
+const update_customer_record = `
+UPDATE customers
+SET name = ?, dob = ?, email = ?, contact = ?, email_index = ?, contact_index = ?, external_id = COALESCE(NULLIF(?, ''), external_id),
+	referral_code = COALESCE(NULLIF(?, ''), referral_code), referred_by_customer_id = COALESCE(?, referred_by_customer_id), status = COALESCE(NULLIF(?, ''), status),
+	email_verified_at = CASE WHEN ? THEN email_verified_at END, country = NULLIF(?, ''), metadata = COALESCE(?, metadata), company_id = COALESCE(?, company_id), updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND (? = 0 OR version = ?);
+`
+
+// update_customer replaces the customer's details if it is still at version, 0 updates unconditionally
+func update_customer(db *sql.DB, i int64, version int64, input CustomerDetails) (*Customer, error) {
+	dob, email, contact, err := encrypt_customer_pii(input.DOB, input.Email, input.Contact)
 	if err != nil {
 		return nil, err
 	}
 
-	return customer, nil
+	var updated_customer *Customer
+	var event *CustomerEvent
+	err = with_tx(db, func(tx *sql.Tx) error {
+		before, err := get_customer(tx, i)
+		if err != nil {
+			return err
+		}
+
+		// a new email address needs verifying again
+		result, err := tx_exec(tx, db, update_customer_record, input.Name, dob, email, contact, pii_index("email", input.Email), pii_index("contact", input.Contact), input.ExternalID, input.ReferralCode, input.ReferredByCustomerID, input.Status, before.Email == input.Email, input.Country, metadata_arg(input.Metadata), input.CompanyID, i, version, version)
+		if err != nil {
+			return err
+		}
+
+		changed, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if changed == 0 {
+			return errors.New("Version mismatch")
+		}
+
+		err = save_contact_points(tx, i, "email", input.Email, input.Emails)
+		if err != nil {
+			return err
+		}
+
+		err = save_contact_points(tx, i, "phone", input.Contact, input.Phones)
+		if err != nil {
+			return err
+		}
+
+		updated_customer, err = get_customer(tx, i)
+		if err != nil {
+			return err
+		}
+
+		changes, err := customer_changes(before, updated_customer)
+		if err != nil {
+			return err
+		}
+
+		event, err = record_change_event(tx, EventCustomerUpdated, updated_customer.ID, updated_customer, changes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	event_broker.Publish(*event)
+
+	return updated_customer, nil
 }
 
-func update_customer(db *sql.DB, i int64, input CustomerDetails) (*Customer, error) {
-	update_record := `
-	UPDATE customers
-	SET name = ?, dob = ?, email = ?, contact = ?, updated_at = CURRENT_TIMESTAMP
+func delete_customer(db *sql.DB, customer *Customer) error {
+	delete_record := `
+	DELETE FROM customers
 	WHERE id = ?;
 	`
 
-	_, err := db.Exec(update_record, input.Name, input.DOB, input.Email, input.Contact, i)
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		// recorded first, the event takes its tenant from the customers row
+		var err error
+		event, err = record_event(tx, EventCustomerDeleted, customer.ID, customer)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(delete_record, customer.ID)
+		if err != nil {
+			return err
+		}
+
+		// referrals outlive their referrer
+		_, err = tx.Exec(`UPDATE customers SET referred_by_customer_id = NULL WHERE referred_by_customer_id = ?;`, customer.ID)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	updated_customer, err := get_customer(db, i)
+	event_broker.Publish(*event)
+
+	return nil
+}
+
+var get_customer_record = `
+SELECT ` + customer_columns + `
+FROM customers
+WHERE id = ?;
+`
+
+func get_customer(db db_handle, i int64) (*Customer, error) {
+	customer, err := scan_customer(query_row(db, get_customer_record, i))
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Customer not found")
+		}
 		return nil, err
 	}
 
-	return updated_customer, nil
+	return &customer, nil
 }
 
-func get_customer(db *sql.DB, i int64) (*Customer, error) {
+func get_customer_by_external_id(db *sql.DB, tenant_id string, external_id string) (*Customer, error) {
 	get_record := `
-	SELECT id, name, dob, email, contact, created_at, updated_at
+	SELECT ` + customer_columns + `
 	FROM customers
-	WHERE id = ?;
+	WHERE tenant_id = ? AND external_id = ?;
 	`
 
-	var customer Customer
-	err := db.QueryRow(get_record, i).Scan(&customer.ID, &customer.Name, &customer.DOB, &customer.Email, &customer.Contact, &customer.CreatedAt, &customer.UpdatedAt)
+	customer, err := scan_customer(db.QueryRow(get_record, tenant_id, external_id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, errors.New("Customer not found")
@@ -361,14 +1308,35 @@ func get_customer(db *sql.DB, i int64) (*Customer, error) {
 	return &customer, nil
 }
 
-func get_customers(db *sql.DB, offset int, limit int) ([]Customer, error) {
+// customer_listing_query is the query of a page of the scope's customers, without the limit and offset args
+func customer_listing_query(scope ListingScope) (string, []any) {
+	where, args := scope.where()
 	get_records := `
-	SELECT id, name, dob, email, contact, created_at, updated_at
+	SELECT ` + customer_columns + `
 	FROM customers
+	` + where + `
+	ORDER BY ` + scope.order_by() + `
 	LIMIT ? OFFSET ?;
 	`
 
-	rows, err := db.Query(get_records, limit, offset)
+	return get_records, args
+}
+
+// customer_count_query is the query counting the scope's customers
+func customer_count_query(scope ListingScope) (string, []any) {
+	where, args := scope.where()
+	get_records := `
+	SELECT COUNT(*)
+	FROM customers
+	` + where + `;
+	`
+
+	return get_records, args
+}
+
+func get_customers(db *sql.DB, scope ListingScope, offset int, limit int) ([]Customer, error) {
+	get_records, args := customer_listing_query(scope)
+	rows, err := query_rows(db, get_records, append(args, limit, offset)...)
 	if err != nil {
 		return nil, err
 	}
@@ -377,8 +1345,7 @@ func get_customers(db *sql.DB, offset int, limit int) ([]Customer, error) {
 
 	var customers []Customer = []Customer{}
 	for rows.Next() {
-		var customer Customer
-		err = rows.Scan(&customer.ID, &customer.Name, &customer.DOB, &customer.Email, &customer.Contact, &customer.CreatedAt, &customer.UpdatedAt)
+		customer, err := scan_customer(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -389,14 +1356,11 @@ func get_customers(db *sql.DB, offset int, limit int) ([]Customer, error) {
 	return customers, nil
 }
 
-func get_total_customers(db *sql.DB) (int, error) {
-	get_records := `
-	SELECT COUNT(*)
-	FROM customers;
-	`
+func get_total_customers(db *sql.DB, scope ListingScope) (int, error) {
+	get_records, args := customer_count_query(scope)
 
 	var count int
-	err := db.QueryRow(get_records).Scan(&count)
+	err := query_row(db, get_records, args...).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// maintenance_batch_size is how many rows a purge deletes per transaction, so writers never wait on one long delete
+const maintenance_batch_size = 1000
+
+// parse_schedules reads the schedule of every maintenance task by name, a malformed one fails startup rather
+// than leaving its task never to run
+func parse_schedules(config Config) (map[string]Schedule, error) {
+	schedules := map[string]Schedule{}
+	for name, spec := range map[string]string{
+		"analyze":            config.AnalyzeSchedule,
+		"vacuum":             config.VacuumSchedule,
+		"archive_purge":      config.ArchivePurgeSchedule,
+		"audit_prune":        config.AuditPruneSchedule,
+		"event_prune":        config.EventPruneSchedule,
+		"idempotency_expiry": config.IdempotencyExpirySchedule,
+		"backup":             config.BackupSchedule,
+	} {
+		schedule, err := parse_schedule(spec)
+		if err != nil {
+			return nil, err
+		}
+		schedules[name] = schedule
+	}
+
+	return schedules, nil
+}
+
+// maintenance_tasks keep db in shape, they run with the other workers on the leader. The purges only run
+// with a retention set, nothing is deleted by default
+func maintenance_tasks(db *sql.DB, blobs BlobStore, config Config, schedules map[string]Schedule) []ScheduledTask {
+	tasks := []ScheduledTask{
+		// fresh statistics for the query planner
+		{Name: "analyze", Schedule: schedules["analyze"], Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, `ANALYZE;`)
+			return err
+		}},
+		// return the pages deletes freed, writes wait while it runs
+		{Name: "vacuum", Schedule: schedules["vacuum"], Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, `VACUUM;`)
+			return err
+		}},
+	}
+
+	if config.ArchiveRetention > 0 {
+		tasks = append(tasks, ScheduledTask{Name: "archive_purge", Schedule: schedules["archive_purge"], Run: func(ctx context.Context) error {
+			return purge_archived_customers(ctx, db, blobs, config.ArchiveRetention)
+		}})
+	}
+
+	if config.AuditRetention > 0 {
+		tasks = append(tasks, ScheduledTask{Name: "audit_prune", Schedule: schedules["audit_prune"], Run: func(ctx context.Context) error {
+			return prune_rows(ctx, db, `DELETE FROM audit_logs WHERE id IN (SELECT id FROM audit_logs WHERE created_at < datetime('now', ?) LIMIT ?);`, config.AuditRetention)
+		}})
+	}
+
+	// events the webhooks, warehouse or publisher have yet to deliver are kept however old
+	if config.EventRetention > 0 {
+		tasks = append(tasks, ScheduledTask{Name: "event_prune", Schedule: schedules["event_prune"], Run: func(ctx context.Context) error {
+			return prune_rows(ctx, db, `
+			DELETE FROM customer_events WHERE id IN (
+				SELECT id FROM customer_events
+				WHERE created_at < datetime('now', ?1) AND id <= COALESCE((SELECT MIN(last_event_id) FROM sink_offsets), id)
+				LIMIT ?2
+			);`, config.EventRetention)
+		}})
+	}
+
+	return tasks
+}
+
+// retention_modifier turns a retention into the datetime() modifier of the time it reaches back to
+func retention_modifier(retention time.Duration) string {
+	return "-" + strconv.FormatInt(int64(retention.Seconds()), 10) + " seconds"
+}
+
+// purge_archived_customers deletes the customers archived longer than the retention, as DELETE /customers/{id} would
+func purge_archived_customers(ctx context.Context, db *sql.DB, blobs BlobStore, retention time.Duration) error {
+	for ctx.Err() == nil {
+		ids, err := get_expired_archived_customers(db, retention)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		for _, id := range ids {
+			customer, err := get_customer(db, id)
+			if err != nil && err.Error() == "Customer not found" {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			err = delete_customer(db, customer)
+			if err != nil {
+				return err
+			}
+
+			// the customer is gone either way, a file left behind is only wasted space
+			err = purge_customer_blobs(ctx, db, blobs, id)
+			if err != nil {
+				println("deleting customer files failed:", err.Error())
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+// prune_rows runs a batched delete taking the retention and a batch size until it deletes nothing
+func prune_rows(ctx context.Context, db *sql.DB, delete_records string, retention time.Duration) error {
+	for ctx.Err() == nil {
+		result, err := exec_with_retry(db, delete_records, retention_modifier(retention), maintenance_batch_size)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil || deleted == 0 {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
+// #region Database
+
+func get_expired_archived_customers(db *sql.DB, retention time.Duration) ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM customers WHERE archived_at < datetime('now', ?) ORDER BY archived_at LIMIT ?;`, retention_modifier(retention), maintenance_batch_size)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// #endregion
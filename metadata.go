@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// metadata_max_bytes keeps metadata to a handful of custom fields
+const metadata_max_bytes = 16384
+
+// metadata_key_pattern is one segment of a ?metadata.<key>= filter, dots reach into nested objects
+var metadata_key_pattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// MetadataSchema is the json schema every customer's metadata must match, set by an admin
+type MetadataSchema struct {
+	Schema    json.RawMessage `json:"schema"`
+	UpdatedBy string          `json:"updated_by"`
+	UpdatedAt string          `json:"updated_at"`
+}
+
+type MetadataSchemaDetails struct {
+	Schema json.RawMessage `json:"schema"`
+}
+
+// parse_metadata_schema reads a json schema, in the openapi 3 dialect the request validation uses
+func parse_metadata_schema(schema_str []byte) (*openapi3.Schema, error) {
+	var schema openapi3.Schema
+	err := json.Unmarshal(schema_str, &schema)
+	if err != nil {
+		return nil, err
+	}
+
+	err = schema.Validate(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
+
+// validate_metadata checks the metadata is an object within metadata_max_bytes that matches the configured
+// schema, and compacts it. Metadata left out of an update keeps what is stored
+func validate_metadata(db *sql.DB, input *CustomerDetails) error {
+	if input.Metadata == nil {
+		return nil
+	}
+
+	if len(input.Metadata) > metadata_max_bytes {
+		return &ValidationError{Field: "metadata", Message: "must be at most " + strconv.Itoa(metadata_max_bytes) + " bytes"}
+	}
+
+	var metadata map[string]any
+	err := json.Unmarshal(input.Metadata, &metadata)
+	if err != nil {
+		return &ValidationError{Field: "metadata", Message: "must be an object"}
+	}
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+
+	schema, err := get_metadata_schema(db)
+	if err != nil && err.Error() != "Metadata schema not found" {
+		return err
+	}
+
+	if schema != nil {
+		parsed, err := parse_metadata_schema(schema.Schema)
+		if err != nil {
+			return err
+		}
+
+		err = parsed.VisitJSON(metadata)
+		var schema_error *openapi3.SchemaError
+		if errors.As(err, &schema_error) {
+			field := strings.Join(append([]string{"metadata"}, schema_error.JSONPointer()...), ".")
+			return &ValidationError{Field: field, Message: schema_error.Reason}
+		}
+		if err != nil {
+			return &ValidationError{Field: "metadata", Message: err.Error()}
+		}
+	}
+
+	input.Metadata, err = json.Marshal(metadata)
+	return err
+}
+
+// listing_metadata reads ?metadata.plan=gold filters as json paths and values, nil when there are none
+func listing_metadata(r *http.Request) (map[string]string, error) {
+	var filters map[string]string
+	for param, values := range r.URL.Query() {
+		key, ok := strings.CutPrefix(param, "metadata.")
+		if !ok {
+			continue
+		}
+
+		path := "$"
+		for _, segment := range strings.Split(key, ".") {
+			if !metadata_key_pattern.MatchString(segment) {
+				return nil, &ValidationError{Field: param, Message: "keys must be letters, digits, _ or -"}
+			}
+			path += `."` + segment + `"`
+		}
+
+		if filters == nil {
+			filters = map[string]string{}
+		}
+		filters[path] = values[0]
+	}
+
+	return filters, nil
+}
+
+// metadata_condition compares a metadata value as the text it is written as in a query string,
+// so ?metadata.seats=3 and ?metadata.trial=true match numbers and booleans
+const metadata_condition = `CASE json_type(metadata, ?) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false'
+	ELSE CAST(json_extract(metadata, ?) AS TEXT) END = ?`
+
+// metadata_where is the conditions and args for the filters, in a stable order
+func metadata_where(filters map[string]string) ([]string, []any) {
+	paths := make([]string, 0, len(filters))
+	for path := range filters {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var conditions []string
+	var args []any
+	for _, path := range paths {
+		conditions = append(conditions, metadata_condition)
+		args = append(args, path, path, filters[path])
+	}
+
+	return conditions, args
+}
+
+// metadata_arg is the metadata as a query argument, NULL when it was left out
+func metadata_arg(metadata json.RawMessage) any {
+	if metadata == nil {
+		return nil
+	}
+
+	return string(metadata)
+}
+
+func register_metadata_routes(mux *http.ServeMux, db *sql.DB) {
+	// the schema customer metadata is validated against
+	mux.HandleFunc("GET /api/admin/metadata-schema", func(w http.ResponseWriter, r *http.Request) {
+		schema, err := get_metadata_schema(db)
+		if err != nil && err.Error() == "Metadata schema not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[MetadataSchema]{Data: *schema})
+	})
+
+	// replace the schema, metadata already stored is checked again on its next write
+	mux.HandleFunc("PUT /api/admin/metadata-schema", func(w http.ResponseWriter, r *http.Request) {
+		var req MetadataSchemaDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = parse_metadata_schema(req.Schema)
+		if err != nil {
+			http.Error(w, "Invalid schema: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		schema, err := set_metadata_schema(db, req.Schema, actor_from(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[MetadataSchema]{Data: *schema})
+	})
+
+	// accept any metadata object again
+	mux.HandleFunc("DELETE /api/admin/metadata-schema", func(w http.ResponseWriter, r *http.Request) {
+		_, err := db.Exec(`DELETE FROM metadata_schema;`)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// #region Database
+const metadata_schema_columns = `schema, updated_by, strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)`
+
+func scan_metadata_schema(row row_scanner) (*MetadataSchema, error) {
+	var schema MetadataSchema
+	var schema_str string
+	err := row.Scan(&schema_str, &schema.UpdatedBy, &schema.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Metadata schema not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schema.Schema = json.RawMessage(schema_str)
+	return &schema, nil
+}
+
+func get_metadata_schema(db *sql.DB) (*MetadataSchema, error) {
+	return scan_metadata_schema(db.QueryRow(`SELECT ` + metadata_schema_columns + ` FROM metadata_schema WHERE id = 1;`))
+}
+
+func set_metadata_schema(db *sql.DB, schema json.RawMessage, actor string) (*MetadataSchema, error) {
+	upsert_record := `
+	INSERT INTO metadata_schema (id, schema, updated_by)
+	VALUES (1, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET schema = excluded.schema, updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP
+	RETURNING ` + metadata_schema_columns + `;
+	`
+
+	return scan_metadata_schema(db.QueryRow(upsert_record, string(schema), actor))
+}
+
+// #endregion
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// migrations are applied in order and tracked in schema_migrations, only ever append to this list
+var migrations = []string{
+	`
+	CREATE TABLE IF NOT EXISTS customers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		dob TEXT,
+		email TEXT,
+		contact TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS customer_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		customer_id INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS sink_offsets (
+		name TEXT PRIMARY KEY,
+		last_event_id INTEGER NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN external_id TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_customers_external_id ON customers (external_id);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS quota_warnings (
+		resource TEXT NOT NULL,
+		threshold INTEGER NOT NULL,
+		reached_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (resource, threshold)
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		label TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN referral_code TEXT;
+	ALTER TABLE customers ADD COLUMN referred_by_customer_id INTEGER REFERENCES customers (id) ON DELETE SET NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_customers_referral_code ON customers (referral_code);
+	CREATE INDEX IF NOT EXISTS idx_customers_referred_by ON customers (referred_by_customer_id);
+	UPDATE customers SET referral_code = upper(hex(randomblob(4))) WHERE referral_code IS NULL;
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN blocked_at TIMESTAMP;
+	ALTER TABLE customers ADD COLUMN blocked_reason TEXT;
+	ALTER TABLE customers ADD COLUMN blocked_by TEXT;
+	`,
+	`
+	ALTER TABLE api_keys ADD COLUMN role TEXT NOT NULL DEFAULT 'editor';
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS email_suppressions (
+		email TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		source TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		event_types TEXT NOT NULL DEFAULT '',
+		consecutive_failures INTEGER NOT NULL DEFAULT 0,
+		failing_since TIMESTAMP,
+		last_error TEXT,
+		disabled_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		event TEXT NOT NULL,
+		conditions TEXT NOT NULL,
+		actions TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS customer_tags (
+		customer_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		source TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (customer_id, tag)
+	);
+	CREATE INDEX IF NOT EXISTS customer_tags_tag ON customer_tags (tag);
+	CREATE TABLE IF NOT EXISTS review_flags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		rule_id INTEGER,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP,
+		resolved_by TEXT
+	);
+	CREATE INDEX IF NOT EXISTS review_flags_open ON review_flags (customer_id, reason) WHERE resolved_at IS NULL;
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+	ALTER TABLE customers ADD COLUMN archived_at TIMESTAMP;
+	ALTER TABLE customers ADD COLUMN email_verified_at TIMESTAMP;
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN country TEXT;
+	CREATE TABLE IF NOT EXISTS customer_counts (
+		dimension TEXT NOT NULL,
+		value TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (dimension, value)
+	);
+	INSERT INTO customer_counts (dimension, value, count) SELECT 'total', '', COUNT(*) FROM customers;
+	INSERT INTO customer_counts (dimension, value, count) SELECT 'status', status, COUNT(*) FROM customers GROUP BY status;
+	INSERT INTO customer_counts (dimension, value, count) SELECT 'country', '', COUNT(*) FROM customers GROUP BY country;
+	INSERT INTO customer_counts (dimension, value, count) SELECT 'tag', tag, COUNT(*) FROM customer_tags WHERE customer_id IN (SELECT id FROM customers) GROUP BY tag;
+	DELETE FROM customer_tags WHERE customer_id NOT IN (SELECT id FROM customers);
+	CREATE TRIGGER IF NOT EXISTS customer_counts_insert AFTER INSERT ON customers BEGIN
+		INSERT INTO customer_counts (dimension, value, count) VALUES ('total', '', 1) ON CONFLICT (dimension, value) DO UPDATE SET count = count + 1;
+		INSERT INTO customer_counts (dimension, value, count) VALUES ('status', NEW.status, 1) ON CONFLICT (dimension, value) DO UPDATE SET count = count + 1;
+		INSERT INTO customer_counts (dimension, value, count) VALUES ('country', COALESCE(NEW.country, ''), 1) ON CONFLICT (dimension, value) DO UPDATE SET count = count + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_update AFTER UPDATE OF status, country ON customers
+	WHEN OLD.status IS NOT NEW.status OR OLD.country IS NOT NEW.country BEGIN
+		UPDATE customer_counts SET count = count - 1 WHERE (dimension = 'status' AND value = OLD.status) OR (dimension = 'country' AND value = COALESCE(OLD.country, ''));
+		INSERT INTO customer_counts (dimension, value, count) VALUES ('status', NEW.status, 1) ON CONFLICT (dimension, value) DO UPDATE SET count = count + 1;
+		INSERT INTO customer_counts (dimension, value, count) VALUES ('country', COALESCE(NEW.country, ''), 1) ON CONFLICT (dimension, value) DO UPDATE SET count = count + 1;
+		DELETE FROM customer_counts WHERE count <= 0 AND dimension != 'total';
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_delete AFTER DELETE ON customers BEGIN
+		UPDATE customer_counts SET count = count - 1 WHERE (dimension = 'total') OR (dimension = 'status' AND value = OLD.status) OR (dimension = 'country' AND value = COALESCE(OLD.country, ''));
+		DELETE FROM customer_tags WHERE customer_id = OLD.id;
+		DELETE FROM customer_counts WHERE count <= 0 AND dimension != 'total';
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_tag_insert AFTER INSERT ON customer_tags BEGIN
+		INSERT INTO customer_counts (dimension, value, count) VALUES ('tag', NEW.tag, 1) ON CONFLICT (dimension, value) DO UPDATE SET count = count + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_tag_delete AFTER DELETE ON customer_tags BEGIN
+		UPDATE customer_counts SET count = count - 1 WHERE dimension = 'tag' AND value = OLD.tag;
+		DELETE FROM customer_counts WHERE count <= 0 AND dimension = 'tag';
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS export_recipients (
+		subject TEXT PRIMARY KEY,
+		recipient TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+	CREATE TRIGGER IF NOT EXISTS customers_version AFTER UPDATE ON customers
+	WHEN NEW.version = OLD.version BEGIN
+		UPDATE customers SET version = version + 1 WHERE id = NEW.id;
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS leader_leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	`,
+	`
+	ALTER TABLE customer_events ADD COLUMN changes TEXT;
+	`,
+	`
+	UPDATE customers SET dob = date(dob) WHERE date(dob) IS NOT NULL AND dob != date(dob);
+	CREATE INDEX IF NOT EXISTS idx_customers_dob ON customers (dob);
+	`,
+	`
+	CREATE INDEX IF NOT EXISTS idx_customers_contact ON customers (contact);
+	`,
+	`
+	UPDATE customers SET email = lower(trim(email)) WHERE email != lower(trim(email));
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS email_verifications (
+		customer_id INTEGER PRIMARY KEY REFERENCES customers (id) ON DELETE CASCADE,
+		sent_at INTEGER NOT NULL
+	);
+	`,
+	`
+	UPDATE customers SET status = 'blocked' WHERE blocked_at IS NOT NULL AND status != 'blocked';
+	CREATE TABLE IF NOT EXISTS customer_status_transitions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL REFERENCES customers (id) ON DELETE CASCADE,
+		from_status TEXT NOT NULL,
+		to_status TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		actor TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_customer_status_transitions_customer ON customer_status_transitions (customer_id, id);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS tags (
+		name TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT OR IGNORE INTO tags (name) SELECT DISTINCT tag FROM customer_tags;
+	CREATE TRIGGER IF NOT EXISTS tags_register AFTER INSERT ON customer_tags BEGIN
+		INSERT OR IGNORE INTO tags (name) VALUES (NEW.tag);
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS customer_notes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL,
+		author TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_customer_notes_customer ON customer_notes (customer_id, id);
+	-- foreign keys are not enforced, so the per customer records go with the customer here
+	CREATE TRIGGER IF NOT EXISTS customer_records_delete AFTER DELETE ON customers BEGIN
+		DELETE FROM customer_notes WHERE customer_id = OLD.id;
+		DELETE FROM customer_status_transitions WHERE customer_id = OLD.id;
+		DELETE FROM email_verifications WHERE customer_id = OLD.id;
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS customer_addresses (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		line1 TEXT NOT NULL,
+		line2 TEXT NOT NULL DEFAULT '',
+		city TEXT NOT NULL,
+		postal_code TEXT NOT NULL DEFAULT '',
+		country TEXT NOT NULL,
+		is_primary INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_customer_addresses_customer ON customer_addresses (customer_id, id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_customer_addresses_primary ON customer_addresses (customer_id) WHERE is_primary = 1;
+	CREATE TRIGGER IF NOT EXISTS customer_addresses_delete AFTER DELETE ON customers BEGIN
+		DELETE FROM customer_addresses WHERE customer_id = OLD.id;
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS customer_contact_points (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT 'other',
+		value TEXT NOT NULL,
+		is_primary INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (customer_id, kind, value)
+	);
+	CREATE INDEX IF NOT EXISTS idx_customer_contact_points_value ON customer_contact_points (kind, value);
+	INSERT OR IGNORE INTO customer_contact_points (customer_id, kind, label, value, is_primary)
+	SELECT id, 'email', 'other', email, 1 FROM customers WHERE email != '';
+	INSERT OR IGNORE INTO customer_contact_points (customer_id, kind, label, value, is_primary)
+	SELECT id, 'phone', 'other', contact, 1 FROM customers WHERE contact != '';
+	CREATE TRIGGER IF NOT EXISTS customer_contact_points_delete AFTER DELETE ON customers BEGIN
+		DELETE FROM customer_contact_points WHERE customer_id = OLD.id;
+	END;
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';
+	CREATE TABLE IF NOT EXISTS metadata_schema (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		schema TEXT NOT NULL,
+		updated_by TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS companies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		domain TEXT UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_companies_name ON companies (name, id);
+	ALTER TABLE customers ADD COLUMN company_id INTEGER;
+	CREATE INDEX IF NOT EXISTS idx_customers_company ON customers (company_id, id);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS customer_relationships (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL,
+		related_customer_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (customer_id, related_customer_id, type),
+		CHECK (customer_id != related_customer_id)
+	);
+	CREATE TRIGGER IF NOT EXISTS customer_relationships_delete AFTER DELETE ON customers BEGIN
+		DELETE FROM customer_relationships WHERE customer_id = OLD.id OR related_customer_id = OLD.id;
+	END;
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN avatar_updated_at TIMESTAMP;
+	`,
+	// no delete trigger, deleting a customer reads the storage keys first to remove the files
+	`
+	CREATE TABLE IF NOT EXISTS customer_attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		uploaded_by TEXT NOT NULL DEFAULT '',
+		storage_key TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS customer_attachments_customer_id ON customer_attachments (customer_id);
+	`,
+	// the row before each write, kept after the customer is deleted. The snapshots match customer_snapshot,
+	// the version bump is a second update and is not recorded
+	`
+	CREATE TABLE IF NOT EXISTS customer_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		customer_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		snapshot TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS customer_versions_customer_id ON customer_versions (customer_id, version);
+	CREATE TRIGGER IF NOT EXISTS customer_versions_update AFTER UPDATE ON customers
+	WHEN NEW.version = OLD.version BEGIN
+		INSERT INTO customer_versions (customer_id, version, snapshot, operation)
+		VALUES (OLD.id, OLD.version, json_object(
+		'id', OLD.id, 'version', OLD.version, 'name', COALESCE(OLD.name, ''), 'dob', COALESCE(OLD.dob, ''), 'email', COALESCE(OLD.email, ''), 'contact', COALESCE(OLD.contact, ''),
+		'country', COALESCE(OLD.country, ''), 'metadata', json(OLD.metadata), 'external_id', COALESCE(OLD.external_id, ''),
+		'created_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.created_at), 'updated_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.updated_at),
+		'referral_code', COALESCE(OLD.referral_code, ''), 'referred_by_customer_id', OLD.referred_by_customer_id, 'company_id', OLD.company_id,
+		'blocked', json(CASE WHEN OLD.blocked_at IS NULL THEN 'false' ELSE 'true' END),
+		'block', CASE WHEN OLD.blocked_at IS NOT NULL THEN json_object('reason', COALESCE(OLD.blocked_reason, ''), 'blocked_by', COALESCE(OLD.blocked_by, ''), 'blocked_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.blocked_at)) END,
+		'status', OLD.status, 'archived_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.archived_at), 'email_verified_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.email_verified_at),
+		'avatar_updated_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.avatar_updated_at), 'verified', json(CASE WHEN OLD.email_verified_at IS NULL THEN 'false' ELSE 'true' END)
+	), 'update');
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_versions_delete AFTER DELETE ON customers BEGIN
+		INSERT INTO customer_versions (customer_id, version, snapshot, operation)
+		VALUES (OLD.id, OLD.version, json_object(
+		'id', OLD.id, 'version', OLD.version, 'name', COALESCE(OLD.name, ''), 'dob', COALESCE(OLD.dob, ''), 'email', COALESCE(OLD.email, ''), 'contact', COALESCE(OLD.contact, ''),
+		'country', COALESCE(OLD.country, ''), 'metadata', json(OLD.metadata), 'external_id', COALESCE(OLD.external_id, ''),
+		'created_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.created_at), 'updated_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.updated_at),
+		'referral_code', COALESCE(OLD.referral_code, ''), 'referred_by_customer_id', OLD.referred_by_customer_id, 'company_id', OLD.company_id,
+		'blocked', json(CASE WHEN OLD.blocked_at IS NULL THEN 'false' ELSE 'true' END),
+		'block', CASE WHEN OLD.blocked_at IS NOT NULL THEN json_object('reason', COALESCE(OLD.blocked_reason, ''), 'blocked_by', COALESCE(OLD.blocked_by, ''), 'blocked_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.blocked_at)) END,
+		'status', OLD.status, 'archived_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.archived_at), 'email_verified_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.email_verified_at),
+		'avatar_updated_at', strftime('%Y-%m-%dT%H:%M:%SZ', OLD.avatar_updated_at), 'verified', json(CASE WHEN OLD.email_verified_at IS NULL THEN 'false' ELSE 'true' END)
+	), 'delete');
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS audit_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor TEXT NOT NULL,
+		key_id INTEGER,
+		action TEXT NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		route TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		before TEXT,
+		after TEXT,
+		request_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS audit_logs_actor ON audit_logs (actor);
+	CREATE INDEX IF NOT EXISTS audit_logs_created_at ON audit_logs (created_at);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS anonymization_requests (
+		customer_id INTEGER PRIMARY KEY,
+		requested_by TEXT NOT NULL,
+		requested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		execute_at TIMESTAMP NOT NULL,
+		executed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS anonymization_requests_due ON anonymization_requests (execute_at) WHERE executed_at IS NULL;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS customer_consents (
+		customer_id INTEGER NOT NULL,
+		purpose TEXT NOT NULL,
+		granted BOOLEAN NOT NULL,
+		source TEXT NOT NULL,
+		recorded_by TEXT NOT NULL,
+		granted_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (customer_id, purpose)
+	);
+	CREATE INDEX IF NOT EXISTS customer_consents_granted ON customer_consents (purpose, customer_id) WHERE granted;
+	CREATE TRIGGER IF NOT EXISTS customer_consents_delete AFTER DELETE ON customers BEGIN
+		DELETE FROM customer_consents WHERE customer_id = OLD.id;
+	END;
+	`,
+	`
+	ALTER TABLE customers ADD COLUMN email_index TEXT;
+	ALTER TABLE customers ADD COLUMN contact_index TEXT;
+	UPDATE customers SET email_index = email, contact_index = contact;
+	CREATE INDEX IF NOT EXISTS idx_customers_email_index ON customers (email_index);
+	CREATE INDEX IF NOT EXISTS idx_customers_contact_index ON customers (contact_index);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS pii_key_rotations (
+		key_id TEXT NOT NULL,
+		table_name TEXT NOT NULL,
+		last_id INTEGER NOT NULL,
+		rotated INTEGER NOT NULL DEFAULT 0,
+		finished_at TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (key_id, table_name)
+	);
+	`,
+	`
+	-- every row belongs to a tenant, what was stored before tenants belongs to the default one
+	CREATE TABLE IF NOT EXISTS tenants (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT OR IGNORE INTO tenants (id, name) VALUES ('default', 'Default');
+	ALTER TABLE customers ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+	CREATE INDEX IF NOT EXISTS idx_customers_tenant ON customers (tenant_id, id);
+	DROP INDEX IF EXISTS idx_customers_external_id;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_customers_external_id ON customers (tenant_id, external_id);
+	ALTER TABLE customer_events ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+	CREATE INDEX IF NOT EXISTS idx_customer_events_tenant ON customer_events (tenant_id, id);
+	ALTER TABLE audit_logs ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+	CREATE INDEX IF NOT EXISTS audit_logs_tenant ON audit_logs (tenant_id, id);
+	-- keys without a tenant are platform keys
+	ALTER TABLE api_keys ADD COLUMN tenant_id TEXT;
+
+	-- company domains, suppressed emails and tag names are unique per tenant
+	CREATE TABLE companies_by_tenant (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		domain TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (tenant_id, domain)
+	);
+	INSERT INTO companies_by_tenant (id, tenant_id, name, domain, created_at, updated_at) SELECT id, 'default', name, domain, created_at, updated_at FROM companies;
+	DROP TABLE companies;
+	ALTER TABLE companies_by_tenant RENAME TO companies;
+	CREATE INDEX IF NOT EXISTS idx_companies_name ON companies (tenant_id, name, id);
+
+	CREATE TABLE email_suppressions_by_tenant (
+		tenant_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		source TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (tenant_id, email)
+	);
+	INSERT INTO email_suppressions_by_tenant (tenant_id, email, reason, source, created_at) SELECT 'default', email, reason, source, created_at FROM email_suppressions;
+	DROP TABLE email_suppressions;
+	ALTER TABLE email_suppressions_by_tenant RENAME TO email_suppressions;
+
+	DROP TRIGGER IF EXISTS tags_register;
+	CREATE TABLE tags_by_tenant (
+		tenant_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (tenant_id, name)
+	);
+	INSERT INTO tags_by_tenant (tenant_id, name, created_at) SELECT 'default', name, created_at FROM tags;
+	DROP TABLE tags;
+	ALTER TABLE tags_by_tenant RENAME TO tags;
+	CREATE TRIGGER IF NOT EXISTS tags_register AFTER INSERT ON customer_tags BEGIN
+		INSERT OR IGNORE INTO tags (tenant_id, name) SELECT tenant_id, NEW.tag FROM customers WHERE id = NEW.customer_id;
+	END;
+
+	-- the dashboard counts are kept per tenant
+	DROP TRIGGER IF EXISTS customer_counts_insert;
+	DROP TRIGGER IF EXISTS customer_counts_update;
+	DROP TRIGGER IF EXISTS customer_counts_delete;
+	DROP TRIGGER IF EXISTS customer_counts_tag_insert;
+	DROP TRIGGER IF EXISTS customer_counts_tag_delete;
+	DROP TABLE customer_counts;
+	CREATE TABLE customer_counts (
+		tenant_id TEXT NOT NULL,
+		dimension TEXT NOT NULL,
+		value TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (tenant_id, dimension, value)
+	);
+	INSERT INTO customer_counts (tenant_id, dimension, value, count) SELECT id, 'total', '', 0 FROM tenants;
+	UPDATE customer_counts SET count = (SELECT COUNT(*) FROM customers WHERE customers.tenant_id = customer_counts.tenant_id);
+	INSERT INTO customer_counts (tenant_id, dimension, value, count) SELECT tenant_id, 'status', status, COUNT(*) FROM customers GROUP BY tenant_id, status;
+	INSERT INTO customer_counts (tenant_id, dimension, value, count) SELECT tenant_id, 'country', COALESCE(country, ''), COUNT(*) FROM customers GROUP BY tenant_id, COALESCE(country, '');
+	INSERT INTO customer_counts (tenant_id, dimension, value, count)
+		SELECT customers.tenant_id, 'tag', customer_tags.tag, COUNT(*) FROM customer_tags JOIN customers ON customers.id = customer_tags.customer_id GROUP BY customers.tenant_id, customer_tags.tag;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_insert AFTER INSERT ON customers BEGIN
+		INSERT INTO customer_counts (tenant_id, dimension, value, count) VALUES (NEW.tenant_id, 'total', '', 1) ON CONFLICT (tenant_id, dimension, value) DO UPDATE SET count = count + 1;
+		INSERT INTO customer_counts (tenant_id, dimension, value, count) VALUES (NEW.tenant_id, 'status', NEW.status, 1) ON CONFLICT (tenant_id, dimension, value) DO UPDATE SET count = count + 1;
+		INSERT INTO customer_counts (tenant_id, dimension, value, count) VALUES (NEW.tenant_id, 'country', COALESCE(NEW.country, ''), 1) ON CONFLICT (tenant_id, dimension, value) DO UPDATE SET count = count + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_update AFTER UPDATE OF status, country ON customers
+	WHEN OLD.status IS NOT NEW.status OR OLD.country IS NOT NEW.country BEGIN
+		UPDATE customer_counts SET count = count - 1 WHERE tenant_id = OLD.tenant_id AND ((dimension = 'status' AND value = OLD.status) OR (dimension = 'country' AND value = COALESCE(OLD.country, '')));
+		INSERT INTO customer_counts (tenant_id, dimension, value, count) VALUES (NEW.tenant_id, 'status', NEW.status, 1) ON CONFLICT (tenant_id, dimension, value) DO UPDATE SET count = count + 1;
+		INSERT INTO customer_counts (tenant_id, dimension, value, count) VALUES (NEW.tenant_id, 'country', COALESCE(NEW.country, ''), 1) ON CONFLICT (tenant_id, dimension, value) DO UPDATE SET count = count + 1;
+		DELETE FROM customer_counts WHERE count <= 0 AND dimension != 'total';
+	END;
+	-- the tags are counted down here, once the customer is gone the tag trigger can't find its tenant
+	CREATE TRIGGER IF NOT EXISTS customer_counts_delete AFTER DELETE ON customers BEGIN
+		UPDATE customer_counts SET count = count - 1 WHERE tenant_id = OLD.tenant_id AND ((dimension = 'total') OR (dimension = 'status' AND value = OLD.status) OR (dimension = 'country' AND value = COALESCE(OLD.country, ''))
+			OR (dimension = 'tag' AND value IN (SELECT tag FROM customer_tags WHERE customer_id = OLD.id)));
+		DELETE FROM customer_tags WHERE customer_id = OLD.id;
+		DELETE FROM customer_counts WHERE count <= 0 AND dimension != 'total';
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_tag_insert AFTER INSERT ON customer_tags BEGIN
+		INSERT INTO customer_counts (tenant_id, dimension, value, count) SELECT tenant_id, 'tag', NEW.tag, 1 FROM customers WHERE id = NEW.customer_id
+		ON CONFLICT (tenant_id, dimension, value) DO UPDATE SET count = count + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS customer_counts_tag_delete AFTER DELETE ON customer_tags BEGIN
+		UPDATE customer_counts SET count = count - 1 WHERE tenant_id = (SELECT tenant_id FROM customers WHERE id = OLD.customer_id) AND dimension = 'tag' AND value = OLD.tag;
+		DELETE FROM customer_counts WHERE count <= 0 AND dimension = 'tag';
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS segments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id TEXT NOT NULL DEFAULT 'default',
+		name TEXT NOT NULL,
+		filter TEXT NOT NULL DEFAULT '',
+		sort TEXT NOT NULL DEFAULT '',
+		member_count INTEGER,
+		counted_at TIMESTAMP,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (tenant_id, name)
+	);
+	`,
+	// listings sorted or filtered by name and created_at, and the archived_at IS NULL default, read an index
+	// within the tenant. Email and contact already go through idx_customers_email_index and idx_customers_contact_index,
+	// archived_at is the soft delete
+	`
+	CREATE INDEX IF NOT EXISTS idx_customers_name ON customers (tenant_id, name, id);
+	CREATE INDEX IF NOT EXISTS idx_customers_created_at ON customers (tenant_id, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_customers_archived_at ON customers (tenant_id, archived_at, id);
+	ANALYZE customers;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id TEXT NOT NULL DEFAULT 'default',
+		type TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '{}',
+		status TEXT NOT NULL DEFAULT 'queued',
+		progress INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		result TEXT,
+		last_error TEXT,
+		dedupe_key TEXT,
+		run_at INTEGER NOT NULL,
+		locked_until INTEGER,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		finished_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_jobs_due ON jobs (status, run_at);
+	CREATE INDEX IF NOT EXISTS idx_jobs_tenant ON jobs (tenant_id, status, id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_dedupe_key ON jobs (tenant_id, dedupe_key) WHERE status != 'succeeded';
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS backups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		trigger TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		files TEXT NOT NULL DEFAULT '[]',
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	UPDATE customer_events SET customer_id = 0 WHERE type = 'quota.warning';
+	`,
+	`
+	-- the values are sealed as the customers columns are, lookups and dedupe go through the blind index
+	ALTER TABLE customer_contact_points ADD COLUMN value_index TEXT NOT NULL DEFAULT '';
+	UPDATE customer_contact_points SET value_index = value;
+	DROP INDEX IF EXISTS idx_customer_contact_points_value;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_customer_contact_points_value_index ON customer_contact_points (customer_id, kind, value_index);
+	CREATE INDEX IF NOT EXISTS idx_customer_contact_points_lookup ON customer_contact_points (kind, value_index);
+	`,
+	`
+	-- warnings are per tenant, the platform's under ''. The old platform wide ones are dropped and warn again
+	-- for the tenants past a threshold on their next write
+	DROP TABLE quota_warnings;
+	CREATE TABLE quota_warnings (
+		tenant_id TEXT NOT NULL,
+		resource TEXT NOT NULL,
+		threshold INTEGER NOT NULL,
+		reached_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (tenant_id, resource, threshold)
+	);
+	`,
+}
+
+func migrate(db *sql.DB) error {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations;`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?);`, i+1)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
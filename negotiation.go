@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// xml_name matches json keys that can be used as xml element names as they are
+var xml_name = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// response_format picks xml, msgpack or html when the Accept header ranks it above json, json stays the default.
+// xml and html are only offered on reads, msgpack on every route
+func response_format(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "json"
+	}
+
+	weights := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		media_type, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if q_str, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(q_str, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		format := "json"
+		switch media_type {
+		case "application/xml", "text/xml":
+			format = "xml"
+		case "application/msgpack", "application/x-msgpack":
+			format = "msgpack"
+		case "text/html", "application/xhtml+xml":
+			format = "html"
+		case "application/json", "application/*", "*/*":
+		default:
+			continue
+		}
+		weights[format] = max(weights[format], q)
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		delete(weights, "xml")
+		delete(weights, "html")
+	}
+
+	best := "json"
+	for _, format := range []string{"msgpack", "xml", "html"} {
+		if weights[format] > weights[best] {
+			best = format
+		}
+	}
+
+	return best
+}
+
+// negotiate lets callers send msgpack bodies and receive xml or msgpack, handlers only ever see and
+// write json. Bodies are converted before request validation so the openapi schemas apply to every format,
+// and responses are re-encoded with the json field names so all formats describe the same document
+func negotiate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if media_type == "application/msgpack" || media_type == "application/x-msgpack" {
+			err := msgpack_request_to_json(r)
+			if err != nil {
+				http.Error(w, "Invalid msgpack body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// the customer listing, search and reads render html themselves, every other route answers browsers with json
+		format := response_format(r)
+		if format == "json" || format == "html" {
+			next(w, r)
+			return
+		}
+
+		// the etag of another format is the json one with -<format> appended, so the handler can compare it as its own
+		if_none_match := r.Header.Get("If-None-Match")
+		if if_none_match != "" {
+			r.Header.Set("If-None-Match", strings.ReplaceAll(if_none_match, "-"+format+`"`, `"`))
+		}
+
+		nw := &negotiated_writer{ResponseWriter: w, format: format, status: http.StatusOK}
+		next(nw, r)
+		nw.finish()
+	}
+}
+
+func msgpack_request_to_json(r *http.Request) error {
+	var body any
+	err := msgpack.NewDecoder(r.Body).Decode(&body)
+	r.Body.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	body_str, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body_str))
+	r.ContentLength = int64(len(body_str))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Del("Content-Length")
+	return nil
+}
+
+// negotiated_writer holds back successful json responses until they can be converted, other responses are written straight through
+type negotiated_writer struct {
+	http.ResponseWriter
+	format    string
+	status    int
+	wrote     bool
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (nw *negotiated_writer) WriteHeader(status int) {
+	if nw.wrote {
+		return
+	}
+	nw.wrote = true
+	nw.status = status
+
+	media_type, _, _ := mime.ParseMediaType(nw.Header().Get("Content-Type"))
+	if status >= 200 && status < 300 && status != http.StatusNoContent && media_type == "application/json" {
+		nw.buffering = true
+		return
+	}
+
+	if status == http.StatusNotModified {
+		nw.tag_etag()
+	}
+
+	nw.ResponseWriter.WriteHeader(status)
+}
+
+func (nw *negotiated_writer) Write(b []byte) (int, error) {
+	if !nw.wrote {
+		nw.WriteHeader(http.StatusOK)
+	}
+
+	if nw.buffering {
+		return nw.body.Write(b)
+	}
+
+	return nw.ResponseWriter.Write(b)
+}
+
+// Flush passes through for responses that are not held back, so event streams stream whatever the Accept
+func (nw *negotiated_writer) Flush() {
+	if !nw.wrote {
+		nw.WriteHeader(http.StatusOK)
+	}
+
+	if !nw.buffering {
+		http.NewResponseController(nw.ResponseWriter).Flush()
+	}
+}
+
+func (nw *negotiated_writer) Unwrap() http.ResponseWriter {
+	return nw.ResponseWriter
+}
+
+func (nw *negotiated_writer) finish() {
+	if !nw.buffering {
+		return
+	}
+
+	var body bytes.Buffer
+	var err error
+	content_type := "application/msgpack"
+	if nw.format == "xml" {
+		content_type = "application/xml; charset=utf-8"
+		body.WriteString(xml.Header)
+		err = json_to_xml(xml.NewEncoder(&body), &nw.body)
+	} else {
+		err = json_to_msgpack(&body, &nw.body)
+	}
+	if err != nil {
+		http.Error(nw.ResponseWriter, "Cannot render as "+nw.format+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	header := nw.Header()
+	header.Set("Content-Type", content_type)
+	header.Del("Content-Length")
+	nw.tag_etag()
+
+	nw.ResponseWriter.WriteHeader(nw.status)
+	nw.ResponseWriter.Write(body.Bytes())
+}
+
+func (nw *negotiated_writer) tag_etag() {
+	header := nw.Header()
+	etag := header.Get("ETag")
+	if strings.HasSuffix(etag, `"`) {
+		header.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+nw.format+`"`)
+	}
+}
+
+// json_to_msgpack re-encodes a json document, whole numbers become integers and map keys are sorted
+// so the same document always encodes the same way
+func json_to_msgpack(w io.Writer, body io.Reader) error {
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+
+	var document any
+	err := dec.Decode(&document)
+	if err != nil {
+		return err
+	}
+
+	enc := msgpack.NewEncoder(w)
+	enc.SetSortMapKeys(true)
+	return enc.Encode(msgpack_numbers(document))
+}
+
+// msgpack_numbers swaps json.Number for int64 or float64, msgpack would otherwise encode them as strings
+func msgpack_numbers(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, field := range value {
+			value[key] = msgpack_numbers(field)
+		}
+	case []any:
+		for i, item := range value {
+			value[i] = msgpack_numbers(item)
+		}
+	case json.Number:
+		integer, err := value.Int64()
+		if err == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		return float
+	}
+
+	return value
+}
+
+// json_to_xml writes a json document as <response>, objects become nested elements in their key order,
+// array entries <item> elements and null an element with nil="true". Keys that are not valid element
+// names, such as free form tags, become <entry key="...">. It works from the json rather than xml struct
+// tags because encoding/xml can't marshal the map[string]any of metadata, and so the xml can't drift from
+// the json fields it mirrors
+func json_to_xml(enc *xml.Encoder, body io.Reader) error {
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+
+	err := json_value_to_xml(enc, dec, xml.StartElement{Name: xml.Name{Local: "response"}})
+	if err != nil {
+		return err
+	}
+
+	return enc.Flush()
+}
+
+func json_value_to_xml(enc *xml.Encoder, dec *json.Decoder, start xml.StartElement) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch value := token.(type) {
+	case json.Delim:
+		err = enc.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+
+		for dec.More() {
+			child := xml.StartElement{Name: xml.Name{Local: "item"}}
+			if value == '{' {
+				key_token, err := dec.Token()
+				if err != nil {
+					return err
+				}
+
+				key, _ := key_token.(string)
+				child.Name.Local = key
+				if !xml_name.MatchString(key) || strings.HasPrefix(strings.ToLower(key), "xml") {
+					child.Name.Local = "entry"
+					child.Attr = []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}}
+				}
+			}
+
+			err = json_value_to_xml(enc, dec, child)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the closing delimiter
+		_, err = dec.Token()
+		if err != nil {
+			return err
+		}
+
+		return enc.EncodeToken(start.End())
+	case nil:
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "nil"}, Value: "true"})
+		return enc.EncodeElement("", start)
+	case string, json.Number, bool:
+		return enc.EncodeElement(value, start)
+	}
+
+	return errors.New("unexpected json token")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// note_max_length keeps notes to a contact summary, attachments belong elsewhere
+const note_max_length = 10000
+
+// CustomerNote is an entry in the customer's contact history, written by support staff
+type CustomerNote struct {
+	ID         int64  `json:"id"`
+	CustomerID int64  `json:"customer_id"`
+	Author     string `json:"author"` // the caller who wrote it
+	Body       string `json:"body"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type NoteDetails struct {
+	Body string `json:"body"`
+}
+
+type NoteListingResponse struct {
+	Records []CustomerNote `json:"records"`
+	Pagination
+}
+
+func register_note_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// the customer's notes, newest first
+	mux.HandleFunc("GET /api/customers/{id}/notes", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		page, limit := page_params(config, r, 20)
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		records, total_records, err := get_customer_notes(db, id, (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[NoteListingResponse]{
+			Data: NoteListingResponse{
+				Records:    records,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+
+	// add a note, the caller is its author
+	mux.HandleFunc("POST /api/customers/{id}/notes", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req NoteDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req.Body = strings.TrimSpace(req.Body)
+		if req.Body == "" || utf8.RuneCountInString(req.Body) > note_max_length {
+			http.Error(w, "Body must be 1 to "+strconv.Itoa(note_max_length)+" characters", http.StatusBadRequest)
+			return
+		}
+
+		note, err := create_customer_note(db, id, actor_from(r), req.Body)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[CustomerNote]{Data: *note})
+	}))
+
+	// remove a note
+	mux.HandleFunc("DELETE /api/customers/{id}/notes/{note_id}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		note_id, err := strconv.ParseInt(r.PathValue("note_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid note id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_customer_note(db, id, note_id)
+		if err != nil && err.Error() == "Note not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// #region Database
+const note_columns = `id, customer_id, author, body, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)`
+
+func scan_note(row row_scanner) (CustomerNote, error) {
+	var note CustomerNote
+	err := row.Scan(&note.ID, &note.CustomerID, &note.Author, &note.Body, &note.CreatedAt)
+	return note, err
+}
+
+func create_customer_note(db *sql.DB, customer_id int64, author string, body string) (*CustomerNote, error) {
+	create_record := `
+	INSERT INTO customer_notes (customer_id, author, body)
+	SELECT id, ?, ? FROM customers WHERE id = ?;
+	`
+
+	var note CustomerNote
+	err := with_tx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(create_record, author, body, customer_id)
+		if err != nil {
+			return err
+		}
+
+		created, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if created == 0 {
+			return errors.New("Customer not found")
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		note, err = scan_note(tx.QueryRow(`SELECT `+note_columns+` FROM customer_notes WHERE id = ?;`, id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &note, nil
+}
+
+func get_customer_notes(db *sql.DB, customer_id int64, offset int, limit int) ([]CustomerNote, int, error) {
+	get_records := `
+	SELECT ` + note_columns + `
+	FROM customer_notes
+	WHERE customer_id = ?
+	ORDER BY id DESC
+	LIMIT ? OFFSET ?;
+	`
+
+	rows, err := db.Query(get_records, customer_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	var notes []CustomerNote = []CustomerNote{}
+	for rows.Next() {
+		note, err := scan_note(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		notes = append(notes, note)
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM customer_notes WHERE customer_id = ?;`, customer_id).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return notes, count, nil
+}
+
+func delete_customer_note(db *sql.DB, customer_id int64, note_id int64) error {
+	result, err := exec_with_retry(db, `DELETE FROM customer_notes WHERE id = ? AND customer_id = ?;`, note_id, customer_id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return errors.New("Note not found")
+	}
+
+	return nil
+}
+
+// #endregion
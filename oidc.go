@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	session_cookie   = "session"
+	oidc_flow_cookie = "oidc_flow"
+	oidc_flow_ttl    = 10 * time.Minute
+)
+
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// OIDCProvider runs the authorization code + PKCE login against a discovered provider such as Keycloak or Auth0
+type OIDCProvider struct {
+	discovery     OIDCDiscovery
+	client_id     string
+	client_secret string
+	redirect_url  string
+	scopes        string
+	id_tokens     *JwtVerifier
+	sessions      *SessionSigner
+	session_ttl   time.Duration
+}
+
+// session_purpose and oidc_flow_purpose tell the cookies apart from the other payloads signed with the
+// session secret, which Decode refuses as either
+const (
+	session_purpose   = "session"
+	oidc_flow_purpose = "oidc_flow"
+)
+
+// OIDCFlow is kept in a short lived signed cookie between the login redirect and the callback
+type OIDCFlow struct {
+	Purpose  string `json:"purpose"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+	Expires  int64  `json:"exp"`
+}
+
+// Session is the signed cookie payload identifying a logged in user
+type Session struct {
+	Purpose  string   `json:"purpose"`
+	Subject  string   `json:"sub"`
+	Roles    []string `json:"roles"`
+	TenantID string   `json:"tenant_id,omitempty"`
+	Expires  int64    `json:"exp"`
+}
+
+// SessionSigner signs cookie payloads so they can be trusted without server side storage
+type SessionSigner struct {
+	secret []byte
+}
+
+func (s *SessionSigner) Encode(payload any) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(body))
+
+	return body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Decode checks the signature and that the payload was signed for purpose, before decoding it into payload
+func (s *SessionSigner) Decode(value string, purpose string, payload any) error {
+	body, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return errors.New("Malformed cookie")
+	}
+
+	expected := hmac.New(sha256.New, s.secret)
+	expected.Write([]byte(body))
+	actual, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected.Sum(nil), actual) {
+		return errors.New("Invalid cookie signature")
+	}
+
+	var signed struct {
+		Purpose string `json:"purpose"`
+	}
+	err = decode_segment(body, &signed)
+	if err != nil {
+		return err
+	}
+
+	if signed.Purpose != purpose {
+		return errors.New("Cookie signed for another purpose")
+	}
+
+	return decode_segment(body, payload)
+}
+
+func random_token(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func new_session_signer(config Config) *SessionSigner {
+	secret := []byte(config.SessionSecret)
+	if len(secret) == 0 {
+		println("SESSION_SECRET is not set, sessions will not survive a restart")
+		secret = []byte(random_token(32))
+	}
+
+	return &SessionSigner{secret: secret}
+}
+
+func new_oidc_provider(config Config, sessions *SessionSigner) (*OIDCProvider, error) {
+	if config.OIDCIssuer == "" {
+		return nil, nil
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(strings.TrimSuffix(config.OIDCIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("OIDC discovery failed: " + res.Status)
+	}
+
+	var discovery OIDCDiscovery
+	err = json.NewDecoder(res.Body).Decode(&discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCProvider{
+		discovery:     discovery,
+		client_id:     config.OIDCClientID,
+		client_secret: config.OIDCClientSecret,
+		redirect_url:  config.OIDCRedirectURL,
+		scopes:        config.OIDCScopes,
+		id_tokens: &JwtVerifier{
+			jwks_url: discovery.JwksURI,
+			issuer:   discovery.Issuer,
+			audience: config.OIDCClientID,
+			keys:     map[string]crypto.PublicKey{},
+		},
+		sessions:    sessions,
+		session_ttl: config.SessionTTL,
+	}, nil
+}
+
+// APIVerifier validates bearer access tokens from the same provider so API clients can reuse their login
+func (p *OIDCProvider) APIVerifier(config Config) *JwtVerifier {
+	return &JwtVerifier{
+		jwks_url: p.discovery.JwksURI,
+		issuer:   p.discovery.Issuer,
+		audience: config.JwtAudience,
+		keys:     map[string]crypto.PublicKey{},
+	}
+}
+
+func (p *OIDCProvider) set_cookie(w http.ResponseWriter, r *http.Request, name string, value string, ttl time.Duration) {
+	// a negative ttl deletes the cookie
+	max_age := int(ttl.Seconds())
+	if ttl < 0 {
+		max_age = -1
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   max_age,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(p.redirect_url, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *OIDCProvider) register_routes(mux *http.ServeMux, config Config) {
+	// start the login, ?return_to= is where the browser ends up afterwards
+	mux.HandleFunc("GET /auth/login", func(w http.ResponseWriter, r *http.Request) {
+		return_to := r.URL.Query().Get("return_to")
+		// only same site paths, never an open redirect
+		if !strings.HasPrefix(return_to, "/") || strings.HasPrefix(return_to, "//") {
+			return_to = "/auth/me"
+		}
+
+		flow := OIDCFlow{
+			Purpose:  oidc_flow_purpose,
+			State:    random_token(16),
+			Nonce:    random_token(16),
+			Verifier: random_token(32),
+			ReturnTo: return_to,
+			Expires:  time.Now().Add(oidc_flow_ttl).Unix(),
+		}
+
+		cookie, err := p.sessions.Encode(flow)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.set_cookie(w, r, oidc_flow_cookie, cookie, oidc_flow_ttl)
+
+		challenge := sha256.Sum256([]byte(flow.Verifier))
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {p.client_id},
+			"redirect_uri":          {p.redirect_url},
+			"scope":                 {p.scopes},
+			"state":                 {flow.State},
+			"nonce":                 {flow.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+
+		http.Redirect(w, r, p.discovery.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+	})
+
+	// provider redirects back here with the authorization code
+	mux.HandleFunc("GET /auth/callback", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(oidc_flow_cookie)
+		if err != nil {
+			http.Error(w, "Login flow expired", http.StatusBadRequest)
+			return
+		}
+		p.set_cookie(w, r, oidc_flow_cookie, "", -1)
+
+		var flow OIDCFlow
+		err = p.sessions.Decode(cookie.Value, oidc_flow_purpose, &flow)
+		if err != nil || time.Now().Unix() > flow.Expires {
+			http.Error(w, "Login flow expired", http.StatusBadRequest)
+			return
+		}
+
+		if r.URL.Query().Get("error") != "" {
+			http.Error(w, "Login failed: "+r.URL.Query().Get("error"), http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Query().Get("state") != flow.State {
+			http.Error(w, "Invalid state", http.StatusBadRequest)
+			return
+		}
+
+		claims, err := p.exchange(r.URL.Query().Get("code"), flow)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		principal := principal_from_claims(config, claims)
+		session, err := p.sessions.Encode(Session{
+			Purpose:  session_purpose,
+			Subject:  principal.Subject,
+			Roles:    principal.Roles,
+			TenantID: principal.TenantID,
+			Expires:  time.Now().Add(p.session_ttl).Unix(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		p.set_cookie(w, r, session_cookie, session, p.session_ttl)
+		http.Redirect(w, r, flow.ReturnTo, http.StatusFound)
+	})
+
+	// who the session belongs to
+	mux.HandleFunc("GET /auth/me", func(w http.ResponseWriter, r *http.Request) {
+		response_str, err := json.Marshal(ApiResponse[*Principal]{Data: principal_from(r)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	})
+
+	// clear the session and end it at the provider when supported
+	mux.HandleFunc("GET /auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		p.set_cookie(w, r, session_cookie, "", -1)
+
+		if p.discovery.EndSessionEndpoint == "" {
+			w.Write([]byte("Logged out"))
+			return
+		}
+
+		query := url.Values{"client_id": {p.client_id}}
+		http.Redirect(w, r, p.discovery.EndSessionEndpoint+"?"+query.Encode(), http.StatusFound)
+	})
+}
+
+// exchange trades the code for tokens and returns the verified id token claims
+func (p *OIDCProvider) exchange(code string, flow OIDCFlow) (JwtClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirect_url},
+		"client_id":     {p.client_id},
+		"code_verifier": {flow.Verifier},
+	}
+	if p.client_secret != "" {
+		form.Set("client_secret", p.client_secret)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.PostForm(p.discovery.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("Token exchange failed: " + res.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := p.id_tokens.Verify(tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims["nonce"] != flow.Nonce {
+		return nil, errors.New("Invalid nonce")
+	}
+
+	return claims, nil
+}
+
+// session_principal reads the session cookie, nil when there is none or it is invalid
+func session_principal(sessions *SessionSigner, r *http.Request) *Principal {
+	if sessions == nil {
+		return nil
+	}
+
+	cookie, err := r.Cookie(session_cookie)
+	if err != nil {
+		return nil
+	}
+
+	var session Session
+	err = sessions.Decode(cookie.Value, session_purpose, &session)
+	if err != nil || time.Now().Unix() > session.Expires {
+		return nil
+	}
+
+	return &Principal{Subject: session.Subject, Roles: session.Roles, TenantID: session.TenantID}
+}
+
+// same_origin guards cookie authenticated writes against cross site requests
+func same_origin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host == r.Host
+}
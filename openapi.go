@@ -0,0 +1,112 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+)
+
+// openapi_spec documents the api and is the single source of truth for the input it accepts
+//
+//go:embed openapi.yaml
+var openapi_spec []byte
+
+func load_openapi_router() (routers.Router, error) {
+	// avatar uploads are raw images, read like any other file
+	for content_type := range avatar_content_types {
+		openapi3filter.RegisterBodyDecoder(content_type, openapi3filter.FileBodyDecoder)
+	}
+
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openapi_spec)
+	if err != nil {
+		return nil, err
+	}
+
+	err = doc.Validate(loader.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	return legacy.NewRouter(doc)
+}
+
+func register_openapi_routes(mux *http.ServeMux) {
+	// the spec requests are validated against
+	mux.HandleFunc("GET /openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openapi_spec)
+	})
+}
+
+// validate_requests checks params and bodies against the spec before the handler runs,
+// routes the spec doesn't describe are passed through
+func validate_requests(router routers.Router, next http.HandlerFunc) http.HandlerFunc {
+	options := &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, path_params, err := router.FindRoute(r)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		// the body is read here and put back for the handler
+		err = openapi3filter.ValidateRequest(r.Context(), &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: path_params,
+			Route:      route,
+			Options:    options,
+		})
+		if err != nil {
+			write_request_error(w, r, err)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// write_request_error answers malformed params and bodies with 400, bodies that parse but break the schema with 422
+func write_request_error(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadRequest
+	response := ErrorResponse{Error: err.Error(), RequestID: request_id_from(r)}
+
+	var request_error *openapi3filter.RequestError
+	if errors.As(err, &request_error) {
+		response.Error = request_error.Reason
+		if request_error.Parameter != nil {
+			response.Field = request_error.Parameter.Name
+		}
+
+		var schema_error *openapi3.SchemaError
+		if errors.As(request_error.Err, &schema_error) {
+			response.Field = strings.Join(append(strings.Fields(response.Field), schema_error.JSONPointer()...), ".")
+			response.Error = schema_error.Reason
+			if request_error.RequestBody != nil {
+				status = http.StatusUnprocessableEntity
+			}
+		} else if request_error.Err != nil && response.Error != "" {
+			response.Error += ": " + request_error.Err.Error()
+		} else if request_error.Err != nil {
+			response.Error = request_error.Err.Error()
+		}
+	}
+
+	response_str, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response_str)
+}
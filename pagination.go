@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pagination is the page metadata every listing response carries next to its records
+type Pagination struct {
+	TotalRecords int  `json:"total_records"`
+	TotalPages   int  `json:"total_pages"`
+	Page         int  `json:"page"`
+	Limit        int  `json:"limit"` // after clamping to MAX_PAGE_LIMIT
+	HasNext      bool `json:"has_next"`
+	HasPrev      bool `json:"has_prev"`
+
+	TotalEstimated bool `json:"total_estimated,omitempty"` // total_records and total_pages come from ?estimate=true
+
+	Links map[string]Link `json:"links"` // first, prev, next and last, the same as the Link header
+}
+
+// page_params reads ?page= and ?limit=, falling back to the first page and default_limit
+// and never going over MAX_PAGE_LIMIT when it is set
+func page_params(config Config, r *http.Request, default_limit int) (int, int) {
+	page := ConvertInt(r.URL.Query().Get("page"))
+	limit := ConvertInt(r.URL.Query().Get("limit"))
+
+	if page <= 0 {
+		page = 1
+	}
+
+	if limit <= 0 {
+		limit = default_limit
+	}
+
+	if config.MaxPageLimit > 0 {
+		limit = min(limit, config.MaxPageLimit)
+	}
+
+	return page, limit
+}
+
+// new_pagination also links the neighbouring pages, keeping the request's other query params
+func new_pagination(r *http.Request, page int, limit int, total_records int) Pagination {
+	total_pages := (total_records + limit - 1) / limit
+	pagination := Pagination{
+		TotalRecords: total_records,
+		TotalPages:   total_pages,
+		Page:         page,
+		Limit:        limit,
+		HasNext:      page < total_pages,
+		HasPrev:      page > 1,
+		Links:        map[string]Link{},
+	}
+
+	link := func(page int) Link {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("limit", strconv.Itoa(limit))
+		return Link{Href: public_path(r, r.URL.Path) + "?" + query.Encode()}
+	}
+
+	last := max(total_pages, 1)
+	pagination.Links["first"] = link(1)
+	if pagination.HasPrev {
+		pagination.Links["prev"] = link(min(page-1, last))
+	}
+	if pagination.HasNext {
+		pagination.Links["next"] = link(page + 1)
+	}
+	pagination.Links["last"] = link(last)
+
+	return pagination
+}
+
+// set_link_header sends the pagination links as an rfc 5988 Link header
+func set_link_header(w http.ResponseWriter, pagination Pagination) {
+	var links []string
+	for _, rel := range []string{"first", "prev", "next", "last"} {
+		link, ok := pagination.Links[rel]
+		if ok {
+			links = append(links, "<"+link.Href+`>; rel="`+rel+`"`)
+		}
+	}
+
+	w.Header().Add("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	pdf_lines_per_page = 54
+	pdf_line_width     = 95 // characters of 10pt courier that fit between the margins
+)
+
+// write_text_pdf renders lines of plain text as a paginated a4 pdf with the title on the first line,
+// enough for shareable reports without pulling in a pdf library
+func write_text_pdf(w io.Writer, title string, lines []string) error {
+	var wrapped []string
+	for _, line := range append([]string{title, ""}, lines...) {
+		wrapped = append(wrapped, wrap_pdf_line(line)...)
+	}
+
+	var pages [][]string
+	for len(wrapped) > 0 {
+		n := min(len(wrapped), pdf_lines_per_page)
+		pages = append(pages, wrapped[:n])
+		wrapped = wrapped[n:]
+	}
+
+	// objects: 1 catalog, 2 page tree, 3 font, then a page and its content stream per page
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+i*2))
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 10 Tf 14 TL 50 800 Td\n")
+		for _, line := range page {
+			content.WriteString("(" + escape_pdf_text(line) + ") '\n")
+		}
+		content.WriteString("ET")
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+i*2))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func wrap_pdf_line(line string) []string {
+	runes := []rune(line)
+	if len(runes) <= pdf_line_width {
+		return []string{line}
+	}
+
+	var lines []string
+	for len(runes) > pdf_line_width {
+		cut := pdf_line_width
+		// break at the last space when there is one
+		for i := pdf_line_width; i > pdf_line_width/2; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		lines = append(lines, string(runes[:cut]))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+		runes = append([]rune("    "), runes...)
+	}
+
+	return append(lines, string(runes))
+}
+
+// escape_pdf_text escapes string delimiters, the standard fonts only cover latin-1 so anything else becomes ?
+func escape_pdf_text(s string) string {
+	var out strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			out.WriteRune('\\')
+			out.WriteRune(r)
+		case r >= 32 && r < 127:
+			out.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&out, "\\%03o", r)
+		default:
+			out.WriteRune('?')
+		}
+	}
+
+	return out.String()
+}
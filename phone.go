@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// default_phone_region is PHONE_DEFAULT_REGION, used for numbers written without a country code
+// when the customer has no country either
+var default_phone_region = ""
+
+// normalize_phone validates a contact number and returns it in e.164, region is an iso 3166-1 code
+// for numbers given in national format and may be empty when only international numbers are expected
+func normalize_phone(value string, region string) (string, error) {
+	if region == "" {
+		region = default_phone_region
+	}
+
+	number, err := phonenumbers.Parse(value, strings.ToUpper(region))
+	if err != nil || !phonenumbers.IsValidNumber(number) {
+		message := "must be a valid phone number"
+		if region == "" && !strings.HasPrefix(strings.TrimSpace(value), "+") {
+			message = "must be a valid phone number with its country code"
+		}
+		return "", &ValidationError{Field: "contact", Message: message}
+	}
+
+	return phonenumbers.Format(number, phonenumbers.E164), nil
+}
+
+// #region Database
+
+// normalize_stored_contacts rewrites contacts saved before numbers were normalized, numbers that
+// don't parse are left for a person to fix. Encrypted contacts were always normalized before they were sealed
+func normalize_stored_contacts(db *sql.DB) error {
+	get_records := `
+	SELECT id, contact, COALESCE(country, '')
+	FROM customers
+	WHERE contact != '' AND contact NOT LIKE 'enc:%' AND (contact NOT LIKE '+%' OR contact GLOB '*[^0-9+]*');
+	`
+
+	rows, err := db.Query(get_records)
+	if err != nil {
+		return err
+	}
+
+	type stored_contact struct {
+		id      int64
+		contact string
+	}
+
+	var contacts []stored_contact
+	for rows.Next() {
+		var id int64
+		var contact, country string
+		err = rows.Scan(&id, &contact, &country)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		normalized, err := normalize_phone(contact, country)
+		if err == nil && normalized != contact {
+			contacts = append(contacts, stored_contact{id: id, contact: normalized})
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	// the customer and its primary phone change together
+	for _, c := range contacts {
+		err = with_tx(db, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`UPDATE customers SET contact = ?, contact_index = ? WHERE id = ?;`, c.contact, pii_index("contact", c.contact), c.id)
+			if err != nil {
+				return err
+			}
+
+			sealed, err := encrypt_pii("contact", c.contact)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`UPDATE OR IGNORE customer_contact_points SET value = ?, value_index = ? WHERE customer_id = ? AND kind = 'phone' AND is_primary = 1;`, sealed, pii_index("contact", c.contact), c.id)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// #endregion
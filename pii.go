@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+)
+
+// pii_prefix marks an encrypted column value, values without it are stored plainly
+const pii_prefix = "enc:v1:"
+
+// pii_fields are the customers columns encrypted at rest
+var pii_fields = []string{"dob", "email", "contact"}
+
+// PIICipher encrypts the email, contact and dob columns, and the copies of them in contact points, events and
+// the audit log, with AES-GCM. The field name is the additional data, so a value copied into another field
+// does not decrypt
+type PIICipher struct {
+	aead      cipher.AEAD
+	index_key []byte
+	key_id    string     // a fingerprint of the key, safe to store
+	previous  *PIICipher // PII_ENCRYPTION_PREVIOUS_KEY while rows are rotated away from it, only ever read with
+}
+
+// pii_cipher is built from PII_ENCRYPTION_KEY, nil stores the columns plainly
+var pii_cipher *PIICipher
+
+// new_pii_cipher reads base64 encoded 32 byte keys, nil when key is empty. previous_key is optional and
+// only decrypts, see rotate-keys
+func new_pii_cipher(key string, previous_key string) (*PIICipher, error) {
+	if key == "" {
+		if previous_key != "" {
+			return nil, errors.New("PII_ENCRYPTION_PREVIOUS_KEY is set without PII_ENCRYPTION_KEY")
+		}
+		return nil, nil
+	}
+
+	current, err := new_pii_key("PII_ENCRYPTION_KEY", key)
+	if err != nil || previous_key == "" {
+		return current, err
+	}
+
+	current.previous, err = new_pii_key("PII_ENCRYPTION_PREVIOUS_KEY", previous_key)
+	if err != nil {
+		return nil, err
+	}
+	if current.previous.key_id == current.key_id {
+		return nil, errors.New("PII_ENCRYPTION_PREVIOUS_KEY is the same key as PII_ENCRYPTION_KEY")
+	}
+
+	return current, nil
+}
+
+func new_pii_key(name string, key string) (*PIICipher, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New(name + " must be 32 bytes in base64, e.g. from openssl rand -base64 32")
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the blind index gets its own key so an index never doubles as a check on a guessed ciphertext key
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("blind index"))
+
+	fingerprint := sha256.Sum256(append([]byte("key id "), raw...))
+
+	return &PIICipher{aead: aead, index_key: mac.Sum(nil), key_id: hex.EncodeToString(fingerprint[:8])}, nil
+}
+
+// open decrypts a value sealed with this key alone
+func (c *PIICipher) open(field string, value string) (string, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, pii_prefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("Customer " + field + " is not a valid encrypted value")
+	}
+
+	nonce, sealed := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	opened, err := c.aead.Open(nil, nonce, sealed, []byte(field))
+	if err != nil {
+		return "", errors.New("Customer " + field + " does not decrypt with PII_ENCRYPTION_KEY")
+	}
+
+	return string(opened), nil
+}
+
+func (c *PIICipher) index(field string, value string) string {
+	mac := hmac.New(sha256.New, c.index_key)
+	mac.Write([]byte(field + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encrypt_pii seals a value for field, empty values stay empty so presence checks keep working in sql
+func encrypt_pii(field string, value string) (string, error) {
+	if pii_cipher == nil || value == "" {
+		return value, nil
+	}
+
+	nonce := make([]byte, pii_cipher.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := pii_cipher.aead.Seal(nonce, nonce, []byte(value), []byte(field))
+	return pii_prefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt_pii opens a value of field, plain values written before encryption was configured pass through
+func decrypt_pii(field string, value string) (string, error) {
+	if !strings.HasPrefix(value, pii_prefix) {
+		return value, nil
+	}
+
+	if pii_cipher == nil {
+		return "", errors.New("Customer " + field + " is encrypted and PII_ENCRYPTION_KEY is not set")
+	}
+
+	opened, err := pii_cipher.open(field, value)
+	if err != nil && pii_cipher.previous != nil {
+		opened, err = pii_cipher.previous.open(field, value)
+	}
+
+	return opened, err
+}
+
+// pii_index is the blind index stored next to an encrypted column for exact match lookups, an hmac of
+// the value. Without a key it is the value itself
+func pii_index(field string, value string) string {
+	if pii_cipher == nil || value == "" {
+		return value
+	}
+
+	return pii_cipher.index(field, value)
+}
+
+// pii_lookup_indexes are the blind indexes a stored value may have, rows not yet rotated still carry the
+// previous key's
+func pii_lookup_indexes(field string, value string) []string {
+	indexes := []string{pii_index(field, value)}
+	if pii_cipher != nil && pii_cipher.previous != nil && value != "" {
+		indexes = append(indexes, pii_cipher.previous.index(field, value))
+	}
+
+	return indexes
+}
+
+// encrypt_customer_pii seals the values about to be written to the dob, email and contact columns
+func encrypt_customer_pii(dob string, email string, contact string) (string, string, string, error) {
+	sealed := []string{dob, email, contact}
+	for i, field := range pii_fields {
+		var err error
+		sealed[i], err = encrypt_pii(field, sealed[i])
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	return sealed[0], sealed[1], sealed[2], nil
+}
+
+// decrypt_customer_pii opens the columns scanned into customer
+func decrypt_customer_pii(customer *Customer) error {
+	for _, value := range []struct {
+		field string
+		to    *string
+	}{{"dob", &customer.DOB}, {"email", &customer.Email}, {"contact", &customer.Contact}} {
+		var err error
+		*value.to, err = decrypt_pii(value.field, *value.to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decrypt_snapshot_fields opens the columns in a customer snapshot recorded by the customer_versions
+// triggers, which copy them as stored, and the pii in event payloads and audit entries
+func decrypt_snapshot_fields(fields map[string]any) error {
+	return walk_pii(fields, decrypt_pii)
+}
+
+// pii_field is the customers column a json key holds a copy of, the single field for the emails and
+// phones lists
+func pii_field(key string) (string, bool) {
+	if slices.Contains(pii_fields, key) {
+		return key, true
+	}
+
+	for single, list := range contact_field_points {
+		if list == key {
+			return single, true
+		}
+	}
+
+	return "", false
+}
+
+// walk_pii replaces every customer pii value in a decoded json document with fn's result: the dob, email
+// and contact fields at any depth, the values of emails and phones lists, and the old and new values of a
+// change to one of them
+func walk_pii(document any, fn func(field string, value string) (string, error)) error {
+	switch document := document.(type) {
+	case []any:
+		for _, item := range document {
+			err := walk_pii(item, fn)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		// a FieldChange, the field names what old and new hold
+		changed, _ := document["field"].(string)
+		if _, ok := pii_field(changed); !ok {
+			changed = ""
+		}
+
+		for key, value := range document {
+			field, ok := pii_field(key)
+			if changed != "" && (key == "old" || key == "new") {
+				field, ok = changed, true
+			}
+
+			if !ok {
+				err := walk_pii(value, fn)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			var err error
+			document[key], err = walk_pii_value(field, value, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// walk_pii_value applies fn to the value of a pii key, a string or a list of contact points
+func walk_pii_value(field string, value any, fn func(field string, value string) (string, error)) (any, error) {
+	switch value := value.(type) {
+	case string:
+		single, _ := pii_field(field)
+		return fn(single, value)
+	case []any:
+		single, _ := pii_field(field)
+		for _, point := range value {
+			point, ok := point.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			str, ok := point["value"].(string)
+			if !ok {
+				continue
+			}
+
+			var err error
+			point["value"], err = fn(single, str)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return value, nil
+}
+
+// map_pii_json decodes a json document, replaces its pii with fn's results and encodes it again
+func map_pii_json(raw []byte, fn func(field string, value string) (string, error)) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var document any
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	err = walk_pii(document, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(document)
+}
+
+// seal_pii_json encrypts the customer pii in a json document about to be stored, an event payload, an
+// audit entry or a customer cached in redis, so the copies are as protected as the customers columns.
+// Without a key it is left as is
+func seal_pii_json(raw []byte) ([]byte, error) {
+	if pii_cipher == nil || len(raw) == 0 {
+		return raw, nil
+	}
+
+	return map_pii_json(raw, encrypt_pii)
+}
+
+// open_pii_json decrypts what seal_pii_json encrypted, documents stored without a key pass through
+func open_pii_json(raw []byte) ([]byte, error) {
+	if !bytes.Contains(raw, []byte(pii_prefix)) {
+		return raw, nil
+	}
+
+	return map_pii_json(raw, decrypt_pii)
+}
+
+// #region Database
+
+// encrypt_stored_pii seals the columns of customers and their contact points saved in plain before
+// PII_ENCRYPTION_KEY was set. Without a key it refuses to start on a database that already holds encrypted values
+func encrypt_stored_pii(db *sql.DB) error {
+	if pii_cipher == nil {
+		var encrypted bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM customers WHERE dob LIKE 'enc:%' OR email LIKE 'enc:%' OR contact LIKE 'enc:%') OR EXISTS (SELECT 1 FROM customer_contact_points WHERE value LIKE 'enc:%');`).Scan(&encrypted)
+		if err == nil && encrypted {
+			err = errors.New("customers are encrypted, PII_ENCRYPTION_KEY is required")
+		}
+		return err
+	}
+
+	err := encrypt_stored_contact_points(db)
+	if err != nil {
+		return err
+	}
+
+	get_records := `
+	SELECT id, COALESCE(dob, ''), COALESCE(email, ''), COALESCE(contact, '')
+	FROM customers
+	WHERE (dob != '' AND dob NOT LIKE 'enc:%') OR (email != '' AND email NOT LIKE 'enc:%') OR (contact != '' AND contact NOT LIKE 'enc:%');
+	`
+
+	rows, err := db.Query(get_records)
+	if err != nil {
+		return err
+	}
+
+	type stored_pii struct {
+		id                  int64
+		dob, email, contact string
+	}
+
+	var customers []stored_pii
+	for rows.Next() {
+		var c stored_pii
+		err = rows.Scan(&c.id, &c.dob, &c.email, &c.contact)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		customers = append(customers, c)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	update_record := `
+	UPDATE customers
+	SET dob = ?, email = ?, contact = ?, email_index = ?, contact_index = ?
+	WHERE id = ?;
+	`
+
+	// sealing changes nothing a caller can see, so it is not a new version
+	return with_tx(db, func(tx *sql.Tx) error {
+		return without_version_triggers(tx, func() error {
+			for _, c := range customers {
+				values := []string{c.dob, c.email, c.contact}
+				opened := make([]string, len(values))
+				for i, field := range pii_fields {
+					var err error
+					opened[i], err = decrypt_pii(field, values[i])
+					if err != nil {
+						return err
+					}
+
+					values[i], err = encrypt_pii(field, opened[i])
+					if err != nil {
+						return err
+					}
+				}
+
+				_, err := tx.Exec(update_record, values[0], values[1], values[2], pii_index("email", opened[1]), pii_index("contact", opened[2]), c.id)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+// encrypt_stored_contact_points seals the contact points saved in plain and indexes the ones whose blind index
+// is not keyed yet, such as the copies of encrypted customers the contact points migration made
+func encrypt_stored_contact_points(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, kind, value FROM customer_contact_points WHERE value NOT LIKE 'enc:%' OR value_index = value;`)
+	if err != nil {
+		return err
+	}
+
+	type stored_point struct {
+		id          int64
+		kind, value string
+	}
+
+	var points []stored_point
+	for rows.Next() {
+		var p stored_point
+		err = rows.Scan(&p.id, &p.kind, &p.value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		points = append(points, p)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	return with_tx(db, func(tx *sql.Tx) error {
+		for _, p := range points {
+			field := contact_point_kinds[p.kind]
+			opened, err := decrypt_pii(field, p.value)
+			if err != nil {
+				return err
+			}
+
+			sealed, err := encrypt_pii(field, opened)
+			if err != nil {
+				return err
+			}
+
+			result, err := tx.Exec(`UPDATE OR IGNORE customer_contact_points SET value = ?, value_index = ? WHERE id = ?;`, sealed, pii_index(field, opened), p.id)
+			if err != nil {
+				return err
+			}
+
+			// the customer already has the value as a sealed point, the plain one is a leftover copy
+			updated, err := result.RowsAffected()
+			if err == nil && updated == 0 {
+				_, err = tx.Exec(`DELETE FROM customer_contact_points WHERE id = ?;`, p.id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// #endregion
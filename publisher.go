@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// event_schema_version is bumped whenever EventMessage changes incompatibly
+const event_schema_version = 1
+
+// EventMessage is the envelope published to the message bus for every customer event
+type EventMessage struct {
+	SchemaVersion int             `json:"schema_version"`
+	ID            int64           `json:"id"`
+	Type          string          `json:"type"`
+	CustomerID    int64           `json:"customer_id"`
+	TenantID      string          `json:"tenant_id"`
+	OccurredAt    string          `json:"occurred_at"`
+	Data          json.RawMessage `json:"data"`
+	Changes       []FieldChange   `json:"changes,omitempty"` // set on updates, the fields that changed with their old and new values
+}
+
+// EventPublisher delivers messages to a message bus, returning only once the bus has accepted them
+type EventPublisher interface {
+	Name() string
+	Publish(ctx context.Context, messages []EventMessage) error
+	Close() error
+}
+
+func new_event_publisher(config Config) (EventPublisher, error) {
+	switch config.EventBus {
+	case "":
+		return nil, nil
+	case "nats":
+		conn, err := nats.Connect(config.NatsURL, nats.Name("customer-api"), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, err
+		}
+		return &NatsPublisher{conn: conn, subject: config.NatsSubject}, nil
+	case "kafka":
+		writer := &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(config.KafkaBrokers, ",")...),
+			Topic:        config.KafkaTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}
+		return &KafkaPublisher{writer: writer}, nil
+	default:
+		return nil, errors.New("Unknown event bus " + config.EventBus)
+	}
+}
+
+// run_event_publisher drains the events table to the bus, the cursor only moves after the bus acknowledges,
+// so a crash in between redelivers rather than loses events
+func run_event_publisher(ctx context.Context, db *sql.DB, publisher EventPublisher, config Config) {
+	name := "bus:" + publisher.Name()
+	health := integrations.Get("event_bus")
+	wake := event_broker.Subscribe()
+	defer event_broker.Unsubscribe(wake)
+	ticker := time.NewTicker(config.EventBusInterval)
+	defer ticker.Stop()
+
+	for {
+		err := flush_event_publisher(ctx, db, publisher, name, config.EventBusBatchSize)
+		if err != nil {
+			println("event publishing failed:", err.Error())
+		}
+		if ctx.Err() == nil {
+			health.Record(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
+			}
+		}
+	}
+}
+
+func flush_event_publisher(ctx context.Context, db *sql.DB, publisher EventPublisher, name string, batch_size int) error {
+	// bus consumers get what webhook receivers get
+	hidden, masked := hidden_fields([]string{webhook_role}), masked_fields([]string{webhook_role})
+
+	for {
+		offset, _, err := get_sink_offset(db, name)
+		if err != nil {
+			return err
+		}
+
+		events, err := get_events_since(db, "", offset, batch_size)
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		messages := make([]EventMessage, 0, len(events))
+		for _, event := range events {
+			event = shape_event(hidden, masked, event)
+			messages = append(messages, EventMessage{
+				SchemaVersion: event_schema_version,
+				ID:            event.ID,
+				Type:          event.Type,
+				CustomerID:    event.CustomerID,
+				TenantID:      event.TenantID,
+				OccurredAt:    ParseTimestamp(event.CreatedAt).Format(time.RFC3339),
+				Data:          event.Payload,
+				Changes:       event.Changes,
+			})
+		}
+
+		err = publisher.Publish(ctx, messages)
+		if err != nil {
+			return err
+		}
+
+		err = set_sink_offset(db, name, events[len(events)-1].ID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// #region NATS
+type NatsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (p *NatsPublisher) Name() string {
+	return "nats"
+}
+
+func (p *NatsPublisher) Publish(ctx context.Context, messages []EventMessage) error {
+	for _, message := range messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+
+		msg := nats.NewMsg(p.subject)
+		msg.Data = data
+		// lets jetstream drop redeliveries
+		msg.Header.Set(nats.MsgIdHdr, strconv.FormatInt(message.ID, 10))
+		msg.Header.Set("Event-Type", message.Type)
+
+		err = p.conn.PublishMsg(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// make sure the server has everything before the cursor moves
+	return p.conn.FlushWithContext(ctx)
+}
+
+func (p *NatsPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+func (p *NatsPublisher) Check(ctx context.Context) error {
+	if !p.conn.IsConnected() {
+		return errors.New("NATS is " + p.conn.Status().String())
+	}
+
+	return nil
+}
+
+// #endregion
+
+// #region Kafka
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (p *KafkaPublisher) Name() string {
+	return "kafka"
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, messages []EventMessage) error {
+	kafka_messages := make([]kafka.Message, 0, len(messages))
+	for _, message := range messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+
+		// keyed by customer so each customer's events stay ordered within a partition
+		kafka_messages = append(kafka_messages, kafka.Message{
+			Key:   []byte(strconv.FormatInt(message.CustomerID, 10)),
+			Value: data,
+			Headers: []kafka.Header{
+				{Key: "event-id", Value: []byte(strconv.FormatInt(message.ID, 10))},
+				{Key: "event-type", Value: []byte(message.Type)},
+			},
+		})
+	}
+
+	return p.writer.WriteMessages(ctx, kafka_messages...)
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+func (p *KafkaPublisher) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", strings.Split(p.writer.Addr.String(), ",")[0])
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// #endregion
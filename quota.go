@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+)
+
+const EventQuotaWarning = "quota.warning"
+
+// quota_thresholds are the usage percentages that raise a warning, each at most once per crossing
+var quota_thresholds = []int{80, 95}
+
+type QuotaWarning struct {
+	Resource  string `json:"resource"` // customers or storage
+	Threshold int    `json:"threshold"`
+	Usage     int64  `json:"usage"`
+	Limit     int64  `json:"limit"`
+	Percent   int    `json:"percent"`
+}
+
+// check_quotas records a quota.warning event for the tenant for every threshold newly crossed, and re-arms
+// thresholds once usage drops below them again. It runs after the tenant's customers are created, updated and
+// deleted
+func check_quotas(db *sql.DB, config Config, tenant_id string) error {
+	if config.CustomerQuota > 0 {
+		count, err := get_total_customers(db, ListingScope{TenantID: tenant_id})
+		if err != nil {
+			return err
+		}
+
+		err = check_quota(db, tenant_id, "customers", int64(count), config.CustomerQuota)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.StorageQuotaBytes > 0 {
+		size, err := get_database_size(db)
+		if err != nil {
+			return err
+		}
+
+		// a shared database file is the platform's, with TENANT_ISOLATION=database it is the tenant's own
+		storage_tenant := ""
+		if tenant_databases != nil {
+			storage_tenant = tenant_id
+		}
+
+		err = check_quota(db, storage_tenant, "storage", size, config.StorageQuotaBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func check_quota(db *sql.DB, tenant_id string, resource string, usage int64, limit int64) error {
+	percent := int(usage * 100 / limit)
+
+	for _, threshold := range quota_thresholds {
+		if percent < threshold {
+			_, err := exec_with_retry(db, `DELETE FROM quota_warnings WHERE tenant_id = ? AND resource = ? AND threshold = ?;`, tenant_id, resource, threshold)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		result, err := exec_with_retry(db, `INSERT OR IGNORE INTO quota_warnings (tenant_id, resource, threshold) VALUES (?, ?, ?);`, tenant_id, resource, threshold)
+		if err != nil {
+			return err
+		}
+
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		// already warned for this crossing
+		if inserted == 0 {
+			continue
+		}
+
+		// the warning is about the tenant, not the customer whose write crossed the threshold
+		event, err := record_tenant_event(db, EventQuotaWarning, tenant_id, QuotaWarning{
+			Resource:  resource,
+			Threshold: threshold,
+			Usage:     usage,
+			Limit:     limit,
+			Percent:   percent,
+		})
+		if err != nil {
+			return err
+		}
+
+		event_broker.Publish(*event)
+	}
+
+	return nil
+}
+
+func get_database_size(db *sql.DB) (int64, error) {
+	var size int64
+	err := db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size();`).Scan(&size)
+	return size, err
+}
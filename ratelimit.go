@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rate_limit_sweep_interval is how often idle buckets are dropped from the in-memory store
+const rate_limit_sweep_interval = time.Minute
+
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // until a token is available, zero when allowed
+	Reset      time.Duration // until the bucket is full again
+}
+
+// RateLimitStore holds token buckets, Take spends one token from the bucket for key
+type RateLimitStore interface {
+	Take(ctx context.Context, key string) (RateLimitResult, error)
+}
+
+// RateLimitBucket refills at rate tokens per second up to burst
+type RateLimitBucket struct {
+	tokens     float64
+	updated_at time.Time
+}
+
+type MemoryRateLimitStore struct {
+	rate  float64
+	burst int
+
+	mu       sync.Mutex
+	buckets  map[string]*RateLimitBucket
+	swept_at time.Time
+}
+
+func new_rate_limit_store(config Config) (RateLimitStore, error) {
+	if config.RateLimitRPM <= 0 {
+		return nil, nil
+	}
+
+	rate := float64(config.RateLimitRPM) / 60
+	burst := config.RateLimitBurst
+	if burst <= 0 {
+		burst = config.RateLimitRPM
+	}
+
+	switch config.RateLimitStore {
+	case "", "memory":
+		return &MemoryRateLimitStore{rate: rate, burst: burst, buckets: map[string]*RateLimitBucket{}, swept_at: time.Now()}, nil
+	case "redis":
+		client, err := shared_redis(config)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisRateLimitStore{client: client, rate: rate, burst: burst}, nil
+	default:
+		return nil, errors.New("Unknown rate limit store " + config.RateLimitStore)
+	}
+}
+
+// bucket_result is the shared token bucket arithmetic, tokens is the count after refilling
+func bucket_result(tokens float64, rate float64, burst int) (float64, RateLimitResult) {
+	result := RateLimitResult{Allowed: tokens >= 1}
+	if result.Allowed {
+		tokens--
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((float64(burst) - tokens) / rate * float64(time.Second))
+
+	return tokens, result
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string) (RateLimitResult, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// buckets idle long enough to have refilled are the same as new ones
+	if now.Sub(s.swept_at) > rate_limit_sweep_interval {
+		for k, bucket := range s.buckets {
+			if now.Sub(bucket.updated_at).Seconds()*s.rate >= float64(s.burst) {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept_at = now
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &RateLimitBucket{tokens: float64(s.burst), updated_at: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens := math.Min(float64(s.burst), bucket.tokens+now.Sub(bucket.updated_at).Seconds()*s.rate)
+	tokens, result := bucket_result(tokens, s.rate, s.burst)
+	bucket.tokens = tokens
+	bucket.updated_at = now
+
+	return result, nil
+}
+
+// RedisRateLimitStore shares buckets between instances, the refill and take happen atomically in a script
+type RedisRateLimitStore struct {
+	client *redis.Client
+	rate   float64
+	burst  int
+}
+
+// rate_limit_script refills and stores the bucket, returning the tokens left before taking one
+var rate_limit_script = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated_at")
+local tokens = tonumber(bucket[1]) or burst
+local updated_at = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated_at) / 1000 * rate)
+
+local available = tokens
+if tokens >= 1 then
+	tokens = tokens - 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "updated_at", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return tostring(available)
+`)
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string) (RateLimitResult, error) {
+	args := []any{s.rate, s.burst, time.Now().UnixMilli()}
+	available, err := rate_limit_script.Run(ctx, s.client, []string{"ratelimit:" + key}, args...).Text()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	tokens, err := strconv.ParseFloat(available, 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	_, result := bucket_result(tokens, s.rate, s.burst)
+	return result, nil
+}
+
+func (s *RedisRateLimitStore) Check(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// client_rate_limit_key identifies the caller by client ip, the bucket every request takes before authenticate
+// looks at its credentials, so guessing keys and tokens is throttled before each guess costs a lookup
+func client_rate_limit_key(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// principal_rate_limit_key identifies the caller by the principal authenticate resolved, hashed so subjects
+// never sit in redis. It is empty for anonymous requests, which only take the client ip's bucket
+func principal_rate_limit_key(r *http.Request) string {
+	principal := principal_from(r)
+	if principal == nil {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(principal.TenantID + "\x00" + principal.Subject))
+	return "principal:" + hex.EncodeToString(sum[:16])
+}
+
+// rate_limit answers 429 once the bucket key picks for the caller is empty, a failing store lets requests through
+func rate_limit(store RateLimitStore, config Config, key func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	if store == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := key(r)
+		if bucket == "" {
+			next(w, r)
+			return
+		}
+
+		result, err := store.Take(r.Context(), bucket)
+		if err != nil {
+			println("rate limit store failed:", err.Error())
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(config.RateLimitRPM))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleReadOnly = "read_only" // may read customers
+	RoleEditor   = "editor"    // may also create, update and delete customers
+	RoleAdmin    = "admin"     // may also use the /api/admin endpoints and read the audit log
+)
+
+// role_ranks orders the roles, every role may do what lower ranked roles can
+var role_ranks = map[string]int{
+	RoleReadOnly: 1,
+	RoleEditor:   2,
+	RoleAdmin:    3,
+}
+
+// required_role is the least role allowed to make the request
+func required_role(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/api/admin/") || r.URL.Path == "/api/audit-logs" || r.URL.Path == "/admin/dashboard" || r.URL.Path == "/admin/generate" {
+		return RoleAdmin
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RoleReadOnly
+	default:
+		return RoleEditor
+	}
+}
+
+func (p *Principal) Rank() int {
+	rank := 0
+	for _, role := range p.Roles {
+		rank = max(rank, role_ranks[role])
+	}
+
+	return rank
+}
+
+// authorize answers 403 when the authenticated principal's role is below what the request needs
+func authorize(config Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AuthDisabled || public_paths[r.URL.Path] {
+			next(w, r)
+			return
+		}
+
+		role := required_role(r)
+		principal := principal_from(r)
+		if principal == nil || principal.Rank() < role_ranks[role] {
+			http.Error(w, "Requires the "+role+" role", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
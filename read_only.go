@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceMode is whether the api only serves reads, so migrations or a restore can run on the live database
+type MaintenanceMode struct {
+	ReadOnly       bool   `json:"read_only"`
+	Reason         string `json:"reason,omitempty"`
+	RetryAfter     int    `json:"retry_after"` // seconds, what rejected writes are told to wait
+	Since          string `json:"since,omitempty"`
+	UpdatedBy      string `json:"updated_by,omitempty"`
+	WritesInFlight int64  `json:"writes_in_flight"` // the database is only still once this is 0 while read only
+}
+
+type MaintenanceModeRequest struct {
+	ReadOnly   *bool  `json:"read_only"`
+	Reason     string `json:"reason"`
+	RetryAfter *int   `json:"retry_after"` // seconds, READ_ONLY_RETRY_AFTER when left out
+}
+
+// ReadOnlyMode holds the mode of this process. It is not shared, with several replicas each one is switched
+// on its own. Write requests and the background workers count themselves in writes, so switching read only
+// on can wait until the database is still
+type ReadOnlyMode struct {
+	mu      sync.RWMutex
+	mode    MaintenanceMode
+	changed chan struct{} // closed and replaced whenever read only is switched on or off
+
+	writes atomic.Int64
+}
+
+// maintenance_mode is the mode of this process, the workers and the api key stamp check it as the api does
+var maintenance_mode = &ReadOnlyMode{changed: make(chan struct{})}
+
+func new_read_only_mode(config Config) *ReadOnlyMode {
+	mode := MaintenanceMode{ReadOnly: config.ReadOnly, RetryAfter: retry_after_seconds(config.ReadOnlyRetryAfter)}
+	if config.ReadOnly {
+		mode.Reason = "READ_ONLY is set"
+		mode.Since = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	return &ReadOnlyMode{mode: mode, changed: make(chan struct{})}
+}
+
+func (m *ReadOnlyMode) Get() MaintenanceMode {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	mode := m.mode
+	mode.WritesInFlight = m.writes.Load()
+	return mode
+}
+
+// Set switches the mode, then while read only waits for the writes in flight until ctx ends. The mode is
+// switched either way, the error only says the database may still change
+func (m *ReadOnlyMode) Set(ctx context.Context, mode MaintenanceMode) error {
+	m.mu.Lock()
+	// since is when the api stopped taking writes, switching again while read only keeps it
+	if mode.ReadOnly && m.mode.ReadOnly {
+		mode.Since = m.mode.Since
+	} else if mode.ReadOnly {
+		mode.Since = time.Now().UTC().Format(time.RFC3339)
+	}
+	if mode.ReadOnly != m.mode.ReadOnly {
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+	m.mode = mode
+	m.mu.Unlock()
+
+	if !mode.ReadOnly {
+		return nil
+	}
+
+	ticker := time.NewTicker(read_only_drain_poll)
+	defer ticker.Stop()
+
+	for m.writes.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// read_only_drain_poll is how often switching read only on checks whether the writes in flight are done
+const read_only_drain_poll = 10 * time.Millisecond
+
+// begin_write counts a write in flight, false while read only. Every true must be followed by end_write
+func (m *ReadOnlyMode) begin_write() bool {
+	// counted before the mode is read, so Set either sees the write or the write sees the mode
+	m.writes.Add(1)
+	if m.Get().ReadOnly {
+		m.writes.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+func (m *ReadOnlyMode) end_write() {
+	m.writes.Add(-1)
+}
+
+// while_writable runs fn while the database takes writes, counted as a write in flight. Switching read only
+// on cancels fn's context and waits for it to return, switching it off starts fn again
+func (m *ReadOnlyMode) while_writable(ctx context.Context, fn func(ctx context.Context)) {
+	for ctx.Err() == nil {
+		m.mu.RLock()
+		changed := m.changed
+		m.mu.RUnlock()
+
+		if !m.begin_write() {
+			select {
+			case <-ctx.Done():
+			case <-changed:
+			}
+			continue
+		}
+
+		run_ctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			fn(run_ctx)
+		}()
+
+		select {
+		case <-done:
+			// fn had nothing to run, such as a scheduler without schedules, it is started again with the next switch
+			cancel()
+			m.end_write()
+			select {
+			case <-ctx.Done():
+			case <-changed:
+			}
+			continue
+		case <-changed:
+		case <-ctx.Done():
+		}
+
+		cancel()
+		<-done
+		m.end_write()
+	}
+}
+
+func retry_after_seconds(retry_after time.Duration) int {
+	return max(int(math.Ceil(retry_after.Seconds())), 1)
+}
+
+// maintenance_path stays writable in read only mode, it is how the mode is switched off again
+const maintenance_path = "/api/admin/maintenance"
+
+// read_only answers every request but reads with 503 and a Retry-After while the api is read only, and counts
+// the writes it lets through so switching read only on waits for them. The probes, login flow and export
+// links in public_paths are let through as they keep no customer data, the verification link writes
+func read_only(mode *ReadOnlyMode, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if r.URL.Path != "/verify" {
+				next(w, r)
+				return
+			}
+		}
+
+		if r.URL.Path == maintenance_path || (public_paths[r.URL.Path] && r.URL.Path != "/verify") {
+			next(w, r)
+			return
+		}
+
+		if mode.begin_write() {
+			defer mode.end_write()
+			next(w, r)
+			return
+		}
+
+		current := mode.Get()
+
+		message := "The API is read only for maintenance"
+		if current.Reason != "" {
+			message += ": " + current.Reason
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(current.RetryAfter))
+		http.Error(w, message, http.StatusServiceUnavailable)
+	}
+}
+
+func register_maintenance_routes(mux *http.ServeMux, mode *ReadOnlyMode, config Config) {
+	mux.HandleFunc("GET "+maintenance_path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		write_json_response(w, http.StatusOK, ApiResponse[MaintenanceMode]{Data: mode.Get()})
+	})
+
+	// switch read only mode on or off. Switching it on pauses the background workers and waits up to
+	// READ_ONLY_DRAIN_TIMEOUT for the writes in flight, a 202 means some are still going and GET shows when
+	// writes_in_flight is down to 0
+	mux.HandleFunc("POST "+maintenance_path, func(w http.ResponseWriter, r *http.Request) {
+		var req MaintenanceModeRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.ReadOnly == nil {
+			http.Error(w, "read_only is required", http.StatusBadRequest)
+			return
+		}
+
+		retry_after := retry_after_seconds(config.ReadOnlyRetryAfter)
+		if req.RetryAfter != nil {
+			if *req.RetryAfter <= 0 {
+				http.Error(w, "retry_after must be a positive number of seconds", http.StatusBadRequest)
+				return
+			}
+			retry_after = *req.RetryAfter
+		}
+
+		updated := MaintenanceMode{ReadOnly: *req.ReadOnly, RetryAfter: retry_after, UpdatedBy: actor_from(r)}
+		if updated.ReadOnly {
+			updated.Reason = req.Reason
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), config.ReadOnlyDrainTimeout)
+		defer cancel()
+
+		status := http.StatusOK
+		if mode.Set(ctx, updated) != nil {
+			status = http.StatusAccepted
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		write_json_response(w, status, ApiResponse[MaintenanceMode]{Data: mode.Get()})
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+type request_id_key struct{}
+
+var error_log = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+// with_request_id tags every request with the caller's X-Request-ID or a new one, echoed in the response
+func with_request_id(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = random_token(12)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next(w, r.WithContext(context.WithValue(r.Context(), request_id_key{}, id)))
+	}
+}
+
+func request_id_from(r *http.Request) string {
+	id, _ := r.Context().Value(request_id_key{}).(string)
+	return id
+}
+
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Field     string `json:"field,omitempty"` // the offending param or body field, for invalid requests
+	RequestID string `json:"request_id"`
+}
+
+// recover_panics turns a handler panic into a logged report and a 500, instead of a dropped connection
+func recover_panics(config Config, next http.HandlerFunc) http.HandlerFunc {
+	sentry := new_sentry_reporter(config)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			// ErrAbortHandler is how handlers deliberately abort a response, net/http handles it
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			stack := string(debug.Stack())
+			message := fmt.Sprint(recovered)
+			error_log.Error("panic",
+				"request_id", request_id_from(r),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"error", message,
+				"stack", stack,
+			)
+
+			if sentry != nil {
+				go sentry.Report(request_id_from(r), r, message, stack)
+			}
+
+			response_str, err := json.Marshal(ErrorResponse{Error: "Internal server error", RequestID: request_id_from(r)})
+			if err != nil {
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(response_str)
+		}()
+
+		next(w, r)
+	}
+}
+
+// SentryReporter forwards panics to sentry's store endpoint, configured with SENTRY_DSN
+type SentryReporter struct {
+	store_url   string
+	public_key  string
+	environment string
+	client      http.Client
+}
+
+func new_sentry_reporter(config Config) *SentryReporter {
+	if config.SentryDSN == "" {
+		return nil
+	}
+
+	// dsn is https://<public_key>@<host>/<project_id>
+	dsn, err := url.Parse(config.SentryDSN)
+	if err != nil || dsn.User == nil {
+		println("invalid SENTRY_DSN, panics will only be logged")
+		return nil
+	}
+
+	project := strings.TrimPrefix(dsn.Path, "/")
+	integrations.Get("sentry")
+	return &SentryReporter{
+		store_url:   dsn.Scheme + "://" + dsn.Host + "/api/" + project + "/store/",
+		public_key:  dsn.User.Username(),
+		environment: config.SentryEnvironment,
+		client:      http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *SentryReporter) Report(request_id string, r *http.Request, message string, stack string) {
+	event_id := make([]byte, 16)
+	rand.Read(event_id)
+
+	body, err := json.Marshal(map[string]any{
+		"event_id":    hex.EncodeToString(event_id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       "fatal",
+		"platform":    "go",
+		"environment": s.environment,
+		"message":     map[string]string{"formatted": message},
+		"tags":        map[string]string{"request_id": request_id},
+		"request":     map[string]string{"method": r.Method, "url": r.URL.Path},
+		"extra":       map[string]string{"stack": stack},
+	})
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.store_url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=customer-api/1.0, sentry_key="+s.public_key)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		integrations.Get("sentry").Record(err)
+		println("sentry report failed:", err.Error())
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		integrations.Get("sentry").Record(errors.New("sentry answered " + res.Status))
+		return
+	}
+	integrations.Get("sentry").Record(nil)
+}
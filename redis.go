@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redis_timeout bounds each cache or idempotency call, a slow redis falls back to the database
+const redis_timeout = 500 * time.Millisecond
+
+var (
+	redis_once   sync.Once
+	redis_client *redis.Client
+	redis_err    error
+)
+
+// shared_redis is the one client for REDIS_URL, the rate limit, cache and idempotency stores share its pool
+func shared_redis(config Config) (*redis.Client, error) {
+	redis_once.Do(func() {
+		options, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			redis_err = err
+			return
+		}
+		redis_client = redis.NewClient(options)
+	})
+
+	return redis_client, redis_err
+}
+
+// CustomerCache fronts get_customer, in memory per instance or in redis shared by every replica
+type CustomerCache interface {
+	Get(key customer_cache_key, load func() (Customer, error)) (Customer, error)
+	Invalidate(key customer_cache_key)
+	write_metrics(w http.ResponseWriter, name string, help string)
+}
+
+// RedisCustomerCache keeps customers as json under customer:<tenant>:<id>, with the pii sealed as it is in
+// the database, an empty value is a cached not found. A write on any replica deletes the key, so none of them
+// serves it after the write returns. Unlike the memory cache a read racing the write can still store what it
+// read before, for at most the ttl
+type RedisCustomerCache struct {
+	client       *redis.Client
+	ttl          time.Duration
+	negative_ttl time.Duration
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func (c *RedisCustomerCache) key(key customer_cache_key) string {
+	return "customer:" + key.tenant_id + ":" + strconv.FormatInt(key.id, 10)
+}
+
+// Get loads from the database when redis fails, a cache outage only costs the reads it was absorbing
+func (c *RedisCustomerCache) Get(key customer_cache_key, load func() (Customer, error)) (Customer, error) {
+	if c.ttl <= 0 {
+		return load()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redis_timeout)
+	defer cancel()
+
+	cached, err := c.client.Get(ctx, c.key(key)).Bytes()
+	if err == nil {
+		c.hits.Add(1)
+		if len(cached) == 0 {
+			return Customer{}, errors.New("Customer not found")
+		}
+
+		var customer Customer
+		cached, err = open_pii_json(cached)
+		if err == nil {
+			err = json.Unmarshal(cached, &customer)
+		}
+		if err == nil {
+			return customer, nil
+		}
+	}
+
+	c.misses.Add(1)
+	customer, err := load()
+	if err != nil && err.Error() != "Customer not found" {
+		return customer, err
+	}
+
+	value, ttl := []byte{}, c.negative_ttl
+	if err == nil {
+		value, ttl = nil, c.ttl
+		encoded, marshal_err := json.Marshal(customer)
+		if marshal_err == nil {
+			value, _ = seal_pii_json(encoded)
+		}
+	}
+
+	// a customer that didn't seal is left out of the cache rather than stored in plain
+	if ttl > 0 && value != nil {
+		c.client.Set(ctx, c.key(key), value, ttl)
+	}
+
+	return customer, err
+}
+
+func (c *RedisCustomerCache) Invalidate(key customer_cache_key) {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_timeout)
+	defer cancel()
+
+	err := c.client.Del(ctx, c.key(key)).Err()
+	if err != nil {
+		println("customer cache invalidation failed:", err.Error())
+	}
+}
+
+func (c *RedisCustomerCache) write_metrics(w http.ResponseWriter, name string, help string) {
+	write_metric(w, name+"_hits_total", "counter", "Reads of "+help+" answered from the cache.", c.hits.Load())
+	write_metric(w, name+"_misses_total", "counter", "Reads of "+help+" that went to the database.", c.misses.Load())
+}
+
+func (c *RedisCustomerCache) Check(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+type ReferralLeader struct {
+	CustomerID   int64  `json:"customer_id"`
+	Name         string `json:"name"`
+	ReferralCode string `json:"referral_code"`
+	Referrals    int    `json:"referrals"`
+}
+
+// referral_code_alphabet leaves out characters that are easy to misread
+const referral_code_alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func generate_referral_code() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range buf {
+		buf[i] = referral_code_alphabet[int(buf[i])%len(referral_code_alphabet)]
+	}
+
+	return string(buf), nil
+}
+
+func list_referrals(db *sql.DB, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		page, limit := page_params(config, r, 10)
+
+		result, total_records, err := get_referrals(db, id, (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range result {
+			present_customer(r, &result[i])
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[GetListingResponse]{
+			Data: GetListingResponse{
+				Records:    result,
+				Pagination: pagination,
+			},
+		}
+
+		response_str, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		set_link_header(w, pagination)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	}
+}
+
+func referral_leaderboard(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := ConvertInt(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 100 {
+			limit = 10
+		}
+
+		leaders, err := get_referral_leaders(db, tenant_from(r), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := ApiResponse[[]ReferralLeader]{
+			Data: leaders,
+		}
+
+		response_str, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	}
+}
+
+// #region Database
+func get_referrals(db *sql.DB, referrer_id int64, offset int, limit int) ([]Customer, int, error) {
+	get_records := `
+	SELECT ` + customer_columns + `
+	FROM customers
+	WHERE referred_by_customer_id = ?
+	ORDER BY id
+	LIMIT ? OFFSET ?;
+	`
+
+	rows, err := db.Query(get_records, referrer_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	var customers []Customer = []Customer{}
+	for rows.Next() {
+		customer, err := scan_customer(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		customers = append(customers, customer)
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM customers WHERE referred_by_customer_id = ?;`, referrer_id).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return customers, count, nil
+}
+
+func get_referral_leaders(db *sql.DB, tenant_id string, limit int) ([]ReferralLeader, error) {
+	get_records := `
+	SELECT referrer.id, referrer.name, COALESCE(referrer.referral_code, ''), COUNT(*) AS referrals
+	FROM customers referred
+	JOIN customers referrer ON referrer.id = referred.referred_by_customer_id
+	WHERE referrer.tenant_id = ?
+	GROUP BY referrer.id
+	ORDER BY referrals DESC, referrer.id
+	LIMIT ?;
+	`
+
+	rows, err := db.Query(get_records, tenant_id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var leaders []ReferralLeader = []ReferralLeader{}
+	for rows.Next() {
+		var leader ReferralLeader
+		err = rows.Scan(&leader.CustomerID, &leader.Name, &leader.ReferralCode, &leader.Referrals)
+		if err != nil {
+			return nil, err
+		}
+
+		leaders = append(leaders, leader)
+	}
+
+	return leaders, rows.Err()
+}
+
+// #endregion
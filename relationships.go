@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// relationship_types maps each type to how the related customer sees it, a link is stored from both sides
+var relationship_types = map[string]string{
+	"spouse":           "spouse",
+	"household_member": "household_member",
+	"parent":           "child",
+	"child":            "parent",
+	"referrer":         "referred",
+	"referred":         "referrer",
+	"other":            "other",
+}
+
+// Relationship links the customer to another one, type is what the related customer is to them
+type Relationship struct {
+	CustomerID        int64  `json:"customer_id"`
+	RelatedCustomerID int64  `json:"related_customer_id"`
+	Type              string `json:"type"`
+	CreatedAt         string `json:"created_at"`
+}
+
+type RelationshipDetails struct {
+	RelatedCustomerID int64  `json:"related_customer_id"`
+	Type              string `json:"type"`
+}
+
+func validate_relationship(db *sql.DB, customer_id int64, input *RelationshipDetails) error {
+	input.Type = strings.ToLower(strings.TrimSpace(input.Type))
+	_, ok := relationship_types[input.Type]
+	if !ok {
+		return &ValidationError{Field: "type", Message: "must be spouse, household_member, parent, child, referrer, referred or other"}
+	}
+
+	if input.RelatedCustomerID == customer_id {
+		return &ValidationError{Field: "related_customer_id", Message: "cannot be the customer themselves"}
+	}
+
+	// only customers of the same tenant can be related
+	related_tenant, err := get_owning_tenant(db, "customers", input.RelatedCustomerID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	tenant_id, err := get_owning_tenant(db, "customers", customer_id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if related_tenant == "" || related_tenant != tenant_id {
+		return &ValidationError{Field: "related_customer_id", Message: "does not exist"}
+	}
+
+	return nil
+}
+
+func register_relationship_routes(mux *http.ServeMux, db *sql.DB) {
+	// the customer's relations, from the customer's side
+	mux.HandleFunc("GET /api/customers/{id}/relationships", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		relationships, err := get_relationships(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Relationship]{Data: relationships})
+	})
+
+	// link another customer, the related customer gets the inverse link
+	mux.HandleFunc("POST /api/customers/{id}/relationships", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req RelationshipDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = validate_relationship(db, id, &req)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		relationship, err := create_relationship(db, id, req)
+		if err != nil && err.Error() == "Relationship already exists" {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[Relationship]{Data: *relationship})
+	}))
+
+	// unlink a customer from both sides, ?type= removes only that link
+	mux.HandleFunc("DELETE /api/customers/{id}/relationships/{related_id}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		related_id, err := strconv.ParseInt(r.PathValue("related_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid related id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_relationship(db, id, related_id, r.URL.Query().Get("type"))
+		if err != nil && err.Error() == "Relationship not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// #region Database
+const relationship_columns = `customer_id, related_customer_id, type, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)`
+
+func scan_relationship(row row_scanner) (Relationship, error) {
+	var relationship Relationship
+	err := row.Scan(&relationship.CustomerID, &relationship.RelatedCustomerID, &relationship.Type, &relationship.CreatedAt)
+	return relationship, err
+}
+
+func get_relationships(db *sql.DB, customer_id int64) ([]Relationship, error) {
+	get_records := `
+	SELECT ` + relationship_columns + `
+	FROM customer_relationships
+	WHERE customer_id = ?
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	relationships := []Relationship{}
+	for rows.Next() {
+		relationship, err := scan_relationship(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		relationships = append(relationships, relationship)
+	}
+
+	return relationships, rows.Err()
+}
+
+// create_relationship stores the link and its inverse, a pair can be linked once per type
+func create_relationship(db *sql.DB, customer_id int64, input RelationshipDetails) (*Relationship, error) {
+	create_record := `
+	INSERT INTO customer_relationships (customer_id, related_customer_id, type)
+	VALUES (?, ?, ?);
+	`
+
+	var relationship Relationship
+	err := with_tx(db, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM customer_relationships WHERE customer_id = ? AND related_customer_id = ? AND type = ?);`, customer_id, input.RelatedCustomerID, input.Type).Scan(&exists)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return errors.New("Relationship already exists")
+		}
+
+		result, err := tx.Exec(create_record, customer_id, input.RelatedCustomerID, input.Type)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(create_record, input.RelatedCustomerID, customer_id, relationship_types[input.Type])
+		if err != nil {
+			return err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		relationship, err = scan_relationship(tx.QueryRow(`SELECT `+relationship_columns+` FROM customer_relationships WHERE id = ?;`, id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &relationship, nil
+}
+
+// delete_relationship removes the links between the pair from both sides, only those of link_type when it is set
+func delete_relationship(db *sql.DB, customer_id int64, related_id int64, link_type string) error {
+	delete_record := `
+	DELETE FROM customer_relationships
+	WHERE ((customer_id = ? AND related_customer_id = ? AND (? = '' OR type = ?))
+		OR (customer_id = ? AND related_customer_id = ? AND (? = '' OR type = ?)));
+	`
+
+	inverse, ok := relationship_types[link_type]
+	if link_type != "" && !ok {
+		return errors.New("Relationship not found")
+	}
+
+	result, err := exec_with_retry(db, delete_record, customer_id, related_id, link_type, link_type, related_id, customer_id, inverse, inverse)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return errors.New("Relationship not found")
+	}
+
+	return nil
+}
+
+// #endregion
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const restore_replica_usage = `usage: serv restore-replica [-generation <id>] <target.db>
+
+Restores the database from the replica REPLICA_STORE ships to, as of the last wal segment shipped.
+-generation picks an older generation, a snapshot of the database and the wal written after it, by the id
+in generations.json. <target.db> must not exist, stop the server and move it over database.db.`
+
+// replica_checkpoint_frames is how long the wal grows before the replicator checkpoints it, sqlite's own
+// autocheckpoint threshold
+const replica_checkpoint_frames = 1000
+
+const (
+	wal_header_size       = 32
+	wal_frame_header_size = 24
+)
+
+// ReplicaGeneration is a snapshot of the database file and the wal segments shipped after it, restoring
+// takes the snapshot and applies the segments in order
+type ReplicaGeneration struct {
+	ID        string `json:"id"`
+	StartedAt string `json:"started_at"`
+	Segments  int    `json:"segments"` // shipped so far, the current generation's is updated on checkpoints
+}
+
+// wal_position is how far the current wal has been shipped. The salt changes whenever a checkpoint
+// restarts the wal from its start, and the checksum carries sqlite's chain on to the next frame
+type wal_position struct {
+	salt     [8]byte
+	offset   int64
+	checksum [2]uint32
+	frames   int // shipped since the last checkpoint
+}
+
+// Replicator ships the main database's wal to REPLICA_STORE as it is written, so a lost disk loses at most
+// the last REPLICA_SYNC_INTERVAL. It is the only checkpointer, autocheckpoints are off while it runs, so no
+// frame is checkpointed away before it is shipped
+type Replicator struct {
+	db     *sql.DB
+	path   string
+	store  BlobStore
+	config Config
+
+	generations []ReplicaGeneration
+	position    wal_position
+	snapshot_at time.Time
+	checkpoint  time.Time
+}
+
+// new_replica_store keeps the replica in REPLICA_DIR or, with REPLICA_STORE=s3, under replica/ in
+// REPLICA_S3_BUCKET, nil when replication is off
+func new_replica_store(config Config) (BlobStore, error) {
+	if config.ReplicaStore == "" {
+		return nil, nil
+	}
+
+	if config.DatabasePassphrase != "" {
+		return nil, errors.New("REPLICA_STORE can't replicate a database encrypted with DATABASE_PASSPHRASE, its wal is encrypted too. Take encrypted backups with BACKUP_SCHEDULE instead")
+	}
+
+	if config.DatabaseMaxOpenConns == 1 {
+		return nil, errors.New("REPLICA_STORE needs DATABASE_MAX_OPEN_CONNS of at least 2, checkpoints run while the write lock is held")
+	}
+
+	return new_store_in(config, config.ReplicaStore, config.ReplicaDir, config.ReplicaS3Bucket, "replica/")
+}
+
+func new_replicator(db *sql.DB, path string, store BlobStore, config Config) *Replicator {
+	return &Replicator{db: db, path: path, store: store, config: config}
+}
+
+func replica_snapshot_key(generation string) string {
+	return generation + "/snapshot.db.gz"
+}
+
+func replica_segment_key(generation string, index int) string {
+	return fmt.Sprintf("%s/wal/%08d.wal.gz", generation, index)
+}
+
+// Run ships the wal every REPLICA_SYNC_INTERVAL until ctx ends, then ships what is left. Each run starts a
+// new generation, the wal may have been checkpointed without it while the server was down or the database
+// restored while it was read only
+func (r *Replicator) Run(ctx context.Context) {
+	r.snapshot_at = time.Time{}
+
+	ticker := time.NewTicker(r.config.ReplicaSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		err := r.sync(ctx)
+		if err != nil {
+			println("replicating the database failed:", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			err = r.ship(context.Background())
+			if err == nil && len(r.generations) > 0 {
+				err = r.save_generations(context.Background())
+			}
+			if err != nil {
+				println("replicating the database failed:", err.Error())
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync starts a generation when one is due, ships the new frames and checkpoints when the wal has grown
+// or REPLICA_CHECKPOINT_INTERVAL has passed
+func (r *Replicator) sync(ctx context.Context) error {
+	if len(r.generations) == 0 || time.Since(r.snapshot_at) >= r.config.ReplicaSnapshotInterval {
+		return r.start_generation(ctx)
+	}
+
+	err := r.ship(ctx)
+	if err != nil {
+		return err
+	}
+
+	if r.position.frames >= replica_checkpoint_frames || (r.position.frames > 0 && time.Since(r.checkpoint) >= r.config.ReplicaCheckpointInterval) {
+		return r.checkpoint_wal(ctx)
+	}
+
+	return nil
+}
+
+// with_write_lock holds the write lock while fn runs, writers wait for it
+func (r *Replicator) with_write_lock(fn func() error) error {
+	// the dsn's _txlock=immediate takes the write lock on begin
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn()
+}
+
+// start_generation copies the database file and the whole current wal under the write lock so the two match,
+// then ships them as the snapshot and first segment once writers can go on. The file only changes on
+// checkpoints, which only the replicator runs
+func (r *Replicator) start_generation(ctx context.Context) error {
+	now := time.Now()
+	generation := ReplicaGeneration{ID: now.UTC().Format("20060102T150405.000Z"), StartedAt: now.UTC().Format(time.RFC3339)}
+
+	// generations.json is read once, after that this replicator is the one writing it
+	generations := r.generations
+	if generations == nil {
+		var err error
+		generations, err = get_replica_generations(ctx, r.store)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(r.path), "replica")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// a local copy is quick, the upload is not and writers would fail on busy_timeout waiting for it
+	snapshot := filepath.Join(dir, "snapshot.db")
+	var segment []byte
+	var position wal_position
+	err = r.with_write_lock(func() error {
+		err := copy_file(r.path, snapshot)
+		if err != nil {
+			return err
+		}
+
+		segment, position, err = read_wal(r.path+"-wal", wal_position{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.upload_snapshot(ctx, generation, snapshot)
+	if err == nil {
+		r.generations = append(generations, generation)
+		r.position = wal_position{}
+		err = r.upload_segment(ctx, segment, position)
+	}
+	if err != nil {
+		r.generations = nil
+		return err
+	}
+
+	r.snapshot_at, r.checkpoint = now, now
+	println("replicating the database to generation " + generation.ID)
+
+	err = r.save_generations(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.prune_generations(ctx)
+}
+
+// ship uploads the committed frames written since the last shipped position as the generation's next
+// segment. A wal restarted by a checkpoint is shipped from its header, restoring applies it anew
+func (r *Replicator) ship(ctx context.Context) error {
+	if len(r.generations) == 0 {
+		return nil
+	}
+
+	segment, position, err := read_wal(r.path+"-wal", r.position)
+	if err != nil {
+		return err
+	}
+
+	return r.upload_segment(ctx, segment, position)
+}
+
+// upload_segment ships frames read up to position as the generation's next segment, nothing when segment is nil
+func (r *Replicator) upload_segment(ctx context.Context, segment []byte, position wal_position) error {
+	if segment == nil {
+		return nil
+	}
+
+	generation := &r.generations[len(r.generations)-1]
+	err := r.store.Put(ctx, replica_segment_key(generation.ID, generation.Segments), gzip_bytes(segment), "application/gzip")
+	if err != nil {
+		return err
+	}
+
+	generation.Segments++
+	r.position = position
+	return nil
+}
+
+// checkpoint_wal reads the last frames and checkpoints them into the database under the write lock, so no
+// frame is written that the checkpoint could copy before it is read, and ships them once writers can go on.
+// With every frame copied the next write restarts the wal, which ship notices by its new salt
+func (r *Replicator) checkpoint_wal(ctx context.Context) error {
+	var segment []byte
+	var position wal_position
+	err := r.with_write_lock(func() error {
+		var err error
+		segment, position, err = read_wal(r.path+"-wal", r.position)
+		if err != nil {
+			return err
+		}
+
+		return storage_metrics.checkpoint(r.db)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the frames are gone from the wal, when they can't be shipped the replica has a gap only a new
+	// generation closes
+	err = r.upload_segment(ctx, segment, position)
+	if err != nil {
+		r.snapshot_at = time.Time{}
+		return err
+	}
+
+	r.position.frames = 0
+	r.checkpoint = time.Now()
+	return r.save_generations(ctx)
+}
+
+func (r *Replicator) save_generations(ctx context.Context) error {
+	encoded, err := json.Marshal(r.generations)
+	if err != nil {
+		return err
+	}
+
+	return r.store.Put(ctx, "generations.json", encoded, "application/json")
+}
+
+// prune_generations deletes the generations started before REPLICA_RETENTION, never the current one
+func (r *Replicator) prune_generations(ctx context.Context) error {
+	cutoff := time.Now().Add(-r.config.ReplicaRetention)
+	for len(r.generations) > 1 && ParseTimestamp(r.generations[0].StartedAt).Before(cutoff) {
+		err := delete_replica_generation(ctx, r.store, r.generations[0])
+		if err != nil {
+			return err
+		}
+
+		r.generations = r.generations[1:]
+		err = r.save_generations(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// delete_replica_generation deletes its snapshot and segments, past the recorded count too since a crash
+// may have shipped more than generations.json says
+func delete_replica_generation(ctx context.Context, store BlobStore, generation ReplicaGeneration) error {
+	for index := 0; ; index++ {
+		key := replica_segment_key(generation.ID, index)
+		if index >= generation.Segments {
+			_, err := store.Get(ctx, key)
+			if err != nil && err.Error() == "Blob not found" {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		err := store.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.Delete(ctx, replica_snapshot_key(generation.ID))
+}
+
+func get_replica_generations(ctx context.Context, store BlobStore) ([]ReplicaGeneration, error) {
+	encoded, err := store.Get(ctx, "generations.json")
+	if err != nil && err.Error() == "Blob not found" {
+		return []ReplicaGeneration{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []ReplicaGeneration
+	err = json.Unmarshal(encoded, &generations)
+	return generations, err
+}
+
+// read_wal reads the frames of committed transactions after position, validated by their salt and checksum
+// as sqlite does on recovery. A partly written transaction at the end is left for the next read. It returns
+// nil when there is nothing new
+func read_wal(path string, position wal_position) ([]byte, wal_position, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, position, nil
+	}
+	if err != nil {
+		return nil, position, err
+	}
+	defer file.Close()
+
+	header := make([]byte, wal_header_size)
+	_, err = io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, position, nil
+	}
+	if err != nil {
+		return nil, position, err
+	}
+
+	magic := binary.BigEndian.Uint32(header)
+	if magic != 0x377f0682 && magic != 0x377f0683 {
+		return nil, position, errors.New(path + " is not a wal file")
+	}
+
+	// the checksums are over big endian words with the magic's low bit set, little endian otherwise
+	order := binary.ByteOrder(binary.LittleEndian)
+	if magic&1 == 1 {
+		order = binary.BigEndian
+	}
+
+	start := position.offset
+	var salt [8]byte
+	copy(salt[:], header[16:24])
+	if salt != position.salt {
+		checksum := wal_checksum(order, header[:24], [2]uint32{})
+		if checksum != [2]uint32{binary.BigEndian.Uint32(header[24:]), binary.BigEndian.Uint32(header[28:])} {
+			return nil, position, nil
+		}
+
+		start = 0
+		position = wal_position{salt: salt, offset: wal_header_size, checksum: checksum, frames: position.frames}
+	}
+
+	page_size := int64(binary.BigEndian.Uint32(header[8:]))
+	frame := make([]byte, wal_frame_header_size+page_size)
+	committed := position
+	for offset, checksum, frames := position.offset, position.checksum, position.frames; ; offset += int64(len(frame)) {
+		_, err = file.ReadAt(frame, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, position, err
+		}
+
+		if !bytes.Equal(frame[8:16], salt[:]) {
+			break
+		}
+
+		checksum = wal_checksum(order, frame[wal_frame_header_size:], wal_checksum(order, frame[:8], checksum))
+		if checksum != [2]uint32{binary.BigEndian.Uint32(frame[16:]), binary.BigEndian.Uint32(frame[20:])} {
+			break
+		}
+
+		// a commit frame records the database size after the transaction
+		frames++
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			committed = wal_position{salt: salt, offset: offset + int64(len(frame)), checksum: checksum, frames: frames}
+		}
+	}
+
+	if committed.offset == position.offset {
+		return nil, position, nil
+	}
+
+	segment := make([]byte, committed.offset-start)
+	_, err = file.ReadAt(segment, start)
+	if err != nil {
+		return nil, position, err
+	}
+
+	return segment, committed, nil
+}
+
+// wal_checksum continues sqlite's wal checksum over data, whose length is a multiple of 8
+func wal_checksum(order binary.ByteOrder, data []byte, checksum [2]uint32) [2]uint32 {
+	s0, s1 := checksum[0], checksum[1]
+	for i := 0; i+8 <= len(data); i += 8 {
+		s0 += order.Uint32(data[i:]) + s1
+		s1 += order.Uint32(data[i+4:]) + s0
+	}
+
+	return [2]uint32{s0, s1}
+}
+
+// upload_snapshot ships the copy of the database at path as the generation's snapshot
+func (r *Replicator) upload_snapshot(ctx context.Context, generation ReplicaGeneration, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err = io.Copy(writer, file)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return r.store.Put(ctx, replica_snapshot_key(generation.ID), compressed.Bytes(), "application/gzip")
+}
+
+func copy_file(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, source)
+	if err != nil {
+		target.Close()
+		return err
+	}
+
+	return target.Close()
+}
+
+func gzip_bytes(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+func gunzip_bytes(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// run_restore_replica is the restore-replica subcommand, args are what follows it on the command line
+func run_restore_replica(args []string) error {
+	flags := flag.NewFlagSet("restore-replica", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	id := flags.String("generation", "", "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 1 {
+		return errors.New(restore_replica_usage)
+	}
+
+	target := flags.Arg(0)
+	_, err = os.Stat(target)
+	if err == nil {
+		return errors.New(target + " already exists, restore-replica only writes new files")
+	}
+
+	config := load_config()
+	store, err := new_replica_store(config)
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return errors.New("REPLICA_STORE is not set\n\n" + restore_replica_usage)
+	}
+
+	ctx := context.Background()
+	generations, err := get_replica_generations(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var generation *ReplicaGeneration
+	for i := range generations {
+		if generations[i].ID == *id || (*id == "" && i == len(generations)-1) {
+			generation = &generations[i]
+		}
+	}
+	if generation == nil {
+		return errors.New("No generation " + *id + " in the " + store.Name() + " replica store")
+	}
+
+	restoring := target + ".restoring"
+	segments, err := restore_generation(ctx, store, *generation, restoring)
+	if err != nil {
+		os.Remove(restoring)
+		os.Remove(restoring + "-wal")
+		os.Remove(restoring + "-shm")
+		return err
+	}
+
+	err = os.Rename(restoring, target)
+	if err != nil {
+		return err
+	}
+
+	println(fmt.Sprintf("restored generation %s with %d wal segments to %s", generation.ID, segments, target))
+	return nil
+}
+
+// restore_generation writes the snapshot to path and applies the segments in order. The segments of one
+// wal are written out together and checkpointed into the file before a restarted wal's are
+func restore_generation(ctx context.Context, store BlobStore, generation ReplicaGeneration, path string) (int, error) {
+	snapshot, err := store.Get(ctx, replica_snapshot_key(generation.ID))
+	if err == nil {
+		snapshot, err = gunzip_bytes(snapshot)
+	}
+	if err == nil {
+		err = os.WriteFile(path, snapshot, 0o600)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var wal []byte
+	index := 0
+	for ; ; index++ {
+		segment, err := store.Get(ctx, replica_segment_key(generation.ID, index))
+		if err != nil && err.Error() == "Blob not found" {
+			break
+		}
+		if err == nil {
+			segment, err = gunzip_bytes(segment)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if len(segment) >= 4 && (binary.BigEndian.Uint32(segment) == 0x377f0682 || binary.BigEndian.Uint32(segment) == 0x377f0683) && wal != nil {
+			err = apply_wal(path, wal)
+			if err != nil {
+				return 0, err
+			}
+			wal = nil
+		}
+		wal = append(wal, segment...)
+	}
+
+	if wal != nil {
+		err = apply_wal(path, wal)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	err = check_integrity(db)
+	if err != nil {
+		return 0, errors.New("the restored database failed its integrity check: " + err.Error())
+	}
+
+	return index, db.Close()
+}
+
+// apply_wal writes wal next to the database at path and checkpoints it in, sqlite recovers the frames on open
+func apply_wal(path string, wal []byte) error {
+	err := os.WriteFile(path+"-wal", wal, 0o600)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var busy, frames, checkpointed int
+	err = db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE);`).Scan(&busy, &frames, &checkpointed)
+	if err == nil && (busy != 0 || checkpointed != frames) {
+		err = errors.New("the wal did not checkpoint completely")
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.Close()
+}
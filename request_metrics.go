@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// request_window is how many minutes of request counts are kept for the dashboard's rates
+const request_window = 15
+
+// RequestMinute counts the responses of one minute
+type RequestMinute struct {
+	Start        time.Time
+	Requests     int64
+	ClientErrors int64 // 4xx
+	ServerErrors int64 // 5xx
+}
+
+// RequestMetrics counts the responses of this process by status class, since it started for /metrics and
+// per minute for the dashboard
+type RequestMetrics struct {
+	started time.Time
+	classes [6]atomic.Int64 // by status / 100, 1xx to 5xx
+
+	mu      sync.Mutex
+	minutes [request_window]RequestMinute // a ring indexed by the minute since the epoch
+}
+
+var request_metrics = &RequestMetrics{started: time.Now()}
+
+func (m *RequestMetrics) record(status int, now time.Time) {
+	class := status / 100
+	if class >= 1 && class <= 5 {
+		m.classes[class].Add(1)
+	}
+
+	start := now.Truncate(time.Minute)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	minute := &m.minutes[(start.Unix()/60)%request_window]
+	if !minute.Start.Equal(start) {
+		*minute = RequestMinute{Start: start}
+	}
+	minute.Requests++
+	switch class {
+	case 4:
+		minute.ClientErrors++
+	case 5:
+		minute.ServerErrors++
+	}
+}
+
+// recent is the last request_window minutes oldest first, the current one included, with quiet minutes as zeros
+func (m *RequestMetrics) recent(now time.Time) []RequestMinute {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := now.Truncate(time.Minute)
+	minutes := make([]RequestMinute, request_window)
+	for i := range minutes {
+		start := current.Add(-time.Duration(request_window-1-i) * time.Minute)
+		minute := m.minutes[(start.Unix()/60)%request_window]
+		if !minute.Start.Equal(start) {
+			minute = RequestMinute{Start: start}
+		}
+		minutes[i] = minute
+	}
+
+	return minutes
+}
+
+func (m *RequestMetrics) write(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP http_responses_total Responses sent, by status class.\n# TYPE http_responses_total counter\n")
+	for class := 1; class <= 5; class++ {
+		fmt.Fprintf(w, "http_responses_total{class=\"%dxx\"} %d\n", class, m.classes[class].Load())
+	}
+}
+
+// status_writer passes the response through, keeping its status
+type status_writer struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *status_writer) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *status_writer) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush keeps event streams streaming through the wrapper
+func (sw *status_writer) Flush() {
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *status_writer) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// count_requests records every response in request_metrics, rejected and failed ones included
+func count_requests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &status_writer{ResponseWriter: w}
+		next(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		request_metrics.record(sw.status, time.Now())
+	}
+}
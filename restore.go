@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const restore_usage = `usage: serv restore [-tenant <id>] [-replay <database.db>] [-until <time>] <backup> <target.db>
+
+Restores a database from a backup taken by POST /api/admin/backup or on BACKUP_SCHEDULE, read from the
+store BACKUP_STORE, BACKUP_DIR and BACKUP_S3_BUCKET name. <backup> is the backup's name, such as
+backup-20240131T120000.000Z, and -tenant picks a tenant's database from a backup taken with
+TENANT_ISOLATION=database, the main database by default.
+
+The file is checked against the manifest, migrated to this build's schema and must pass PRAGMA
+integrity_check before it is written to <target.db>, which must not exist. Stop the server and move it over
+database.db, or the tenant's file under TENANT_DATABASE_DIR, to put it in service.
+
+-replay applies the events another database recorded after the backup, usually the database being
+replaced, up to -until when given as a timestamp like 2024-01-31T12:00:00Z. Events carry the customer as
+it was written, so customers with their emails and phones come back as of the last event replayed. Notes,
+consents and the other records events don't carry stay as of the backup. Webhooks and the warehouse
+deliver the replayed events again.`
+
+// replay_batch_size is how many events are replayed per transaction
+const replay_batch_size = 500
+
+// replayed_snapshots are the events whose payload is the customer after the write
+var replayed_snapshots = map[string]bool{
+	EventCustomerCreated:       true,
+	EventCustomerUpdated:       true,
+	EventCustomerArchived:      true,
+	EventCustomerUnarchived:    true,
+	EventCustomerStatusChanged: true,
+	EventCustomerAnonymized:    true,
+	EventCustomerMerged:        true,
+	EventCustomerBlocked:       true,
+	EventCustomerUnblocked:     true,
+}
+
+// run_restore is the restore subcommand, args are what follows it on the command line
+func run_restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	tenant_id := flags.String("tenant", default_tenant, "")
+	replay := flags.String("replay", "", "")
+	until_str := flags.String("until", "", "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 2 {
+		return errors.New(restore_usage)
+	}
+
+	name, target := flags.Arg(0), flags.Arg(1)
+	_, err = os.Stat(target)
+	if err == nil {
+		return errors.New(target + " already exists, restore only writes new files")
+	}
+
+	var until time.Time
+	if *until_str != "" {
+		until, err = time.Parse(time.RFC3339, *until_str)
+		if err != nil {
+			return errors.New("Invalid -until, expected a timestamp like 2024-01-31T12:00:00Z")
+		}
+	}
+
+	config := load_config()
+
+	// replayed customers are stored with the server's key
+	pii_cipher, err = new_pii_cipher(config.PIIEncryptionKey, config.PIIPreviousKey)
+	if err != nil {
+		return err
+	}
+
+	store, err := new_backup_store(config)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	file, err := get_backup_file(ctx, store, name, *tenant_id, config)
+	if err != nil {
+		return err
+	}
+
+	data, err := read_backup_file(ctx, store, file)
+	if err != nil {
+		return err
+	}
+
+	// written next to the target and renamed once it is whole, a failed restore leaves nothing at target
+	restoring := target + ".restoring"
+	os.Remove(restoring)
+	err = os.WriteFile(restoring, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	err = restore_database(restoring, config, file, *replay, until)
+	if err != nil {
+		os.Remove(restoring)
+		return err
+	}
+
+	err = os.Rename(restoring, target)
+	if err != nil {
+		return err
+	}
+
+	println("restored " + name + " to " + target)
+	return nil
+}
+
+// get_backup_file reads the backup's manifest and picks the tenant's file from it
+func get_backup_file(ctx context.Context, store BlobStore, name string, tenant_id string, config Config) (*BackupFile, error) {
+	encoded, err := store.Get(ctx, backup_manifest_key(name))
+	if err != nil && err.Error() == "Blob not found" {
+		return nil, errors.New("No backup " + name + " in the " + store.Name() + " backup store")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest BackupManifest
+	err = json.Unmarshal(encoded, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Encrypted && config.DatabasePassphrase == "" {
+		return nil, errors.New(name + " is encrypted, set the DATABASE_PASSPHRASE it was taken with")
+	}
+
+	for _, file := range manifest.Files {
+		if file.TenantID == tenant_id {
+			return &file, nil
+		}
+	}
+
+	return nil, errors.New(name + " has no database of tenant " + tenant_id)
+}
+
+// read_backup_file downloads the file and unzips it once its checksum matches the manifest's
+func read_backup_file(ctx context.Context, store BlobStore, file *BackupFile) ([]byte, error) {
+	compressed, err := store.Get(ctx, file.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(compressed)
+	if hex.EncodeToString(sum[:]) != file.SHA256 {
+		return nil, errors.New(file.Key + " does not match the checksum in its manifest")
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// restore_database checks and migrates the restored file at path, then replays the events from replay
+func restore_database(path string, config Config, file *BackupFile, replay string, until time.Time) error {
+	db, err := open_database(path, config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = check_integrity(db)
+	if err != nil {
+		return errors.New("the backup failed its integrity check: " + err.Error())
+	}
+
+	err = migrate(db)
+	if err != nil {
+		return err
+	}
+
+	if replay != "" {
+		err = replay_events(db, replay, config, file.LastEventID, until)
+		if err != nil {
+			return err
+		}
+
+		err = check_integrity(db)
+		if err != nil {
+			return errors.New("the replayed database failed its integrity check: " + err.Error())
+		}
+	}
+
+	// closing checkpoints the wal into the file that is renamed
+	return db.Close()
+}
+
+// replay_events copies the events source recorded after since into db and applies their customers, in order
+func replay_events(db *sql.DB, source string, config Config, since int64, until time.Time) error {
+	// the source is only read, an encrypted one with the server's passphrase
+	driver, dsn := "sqlite", "file:"+source+"?mode=ro"
+	if config.DatabasePassphrase != "" {
+		driver, dsn = "sqlite3", encrypted_dsn(source, config.DatabasePassphrase)+"&mode=ro"
+	}
+
+	source_db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer source_db.Close()
+
+	replayed := 0
+	for {
+		events, err := get_events_since(source_db, "", since, replay_batch_size)
+		if err != nil {
+			return err
+		}
+
+		for i, event := range events {
+			if !until.IsZero() && ParseTimestamp(event.CreatedAt).After(until) {
+				events = events[:i]
+				break
+			}
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		err = with_tx(db, func(tx *sql.Tx) error {
+			for _, event := range events {
+				err := replay_event(tx, event)
+				if err != nil {
+					return errors.New("replaying event " + strconv.FormatInt(event.ID, 10) + ": " + err.Error())
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		replayed += len(events)
+		since = events[len(events)-1].ID
+		if len(events) < replay_batch_size {
+			break
+		}
+	}
+
+	println("replayed " + strconv.Itoa(replayed) + " events, up to event " + strconv.FormatInt(since, 10))
+	return nil
+}
+
+// replay_event records the event and writes its customer as the event has it. A write after the backup
+// is replayed as a write, so the version triggers keep the customer's history as the original did
+func replay_event(tx *sql.Tx, event CustomerEvent) error {
+	var changes *string
+	if event.Changes != nil {
+		encoded, err := json.Marshal(event.Changes)
+		if err != nil {
+			return err
+		}
+		changes = new(string)
+		*changes = string(encoded)
+	}
+
+	_, err := tx.Exec(`INSERT INTO customer_events (id, type, customer_id, tenant_id, payload, changes, created_at) VALUES (?, ?, ?, ?, ?, ?, datetime(?));`,
+		event.ID, event.Type, event.CustomerID, event.TenantID, string(event.Payload), changes, event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if event.Type == EventCustomerDeleted {
+		_, err = tx.Exec(`DELETE FROM customers WHERE id = ?;`, event.CustomerID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE customers SET referred_by_customer_id = NULL WHERE referred_by_customer_id = ?;`, event.CustomerID)
+		return err
+	}
+
+	if !replayed_snapshots[event.Type] {
+		return nil
+	}
+
+	// blocking through /block records the customer's status rather than the customer
+	var status CustomerStatus
+	err = json.Unmarshal(event.Payload, &status)
+	if err != nil {
+		return err
+	}
+	if status.CustomerID != 0 {
+		return replay_status(tx, event, status)
+	}
+
+	var customer Customer
+	err = json.Unmarshal(event.Payload, &customer)
+	if err != nil {
+		return err
+	}
+
+	return replay_customer(tx, event, customer)
+}
+
+func check_integrity(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA integrity_check;`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var problem string
+		err = rows.Scan(&problem)
+		if err != nil {
+			return err
+		}
+
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	err = rows.Err()
+	if err == nil && len(problems) > 0 {
+		err = errors.New(strings.Join(problems, "; "))
+	}
+
+	return err
+}
+
+// #region Database
+
+// replay_customer_record inserts the customer or, if it exists, updates it without naming the version so
+// the triggers bump it and record the row it replaces
+const replay_customer_record = `
+INSERT INTO customers (id, tenant_id, version, name, dob, email, contact, email_index, contact_index, external_id, referral_code, referred_by_customer_id,
+	blocked_at, blocked_reason, blocked_by, status, archived_at, email_verified_at, country, metadata, company_id, avatar_updated_at, created_at, updated_at)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, NULLIF(?10, ''), NULLIF(?11, ''), ?12,
+	datetime(NULLIF(?13, '')), NULLIF(?14, ''), NULLIF(?15, ''), ?16, datetime(?17), datetime(?18), NULLIF(?19, ''), ?20, ?21, datetime(?22), datetime(?23), datetime(?24))
+ON CONFLICT (id) DO UPDATE SET
+	name = excluded.name, dob = excluded.dob, email = excluded.email, contact = excluded.contact, email_index = excluded.email_index,
+	contact_index = excluded.contact_index, external_id = excluded.external_id, referral_code = excluded.referral_code,
+	referred_by_customer_id = excluded.referred_by_customer_id, blocked_at = excluded.blocked_at, blocked_reason = excluded.blocked_reason,
+	blocked_by = excluded.blocked_by, status = excluded.status, archived_at = excluded.archived_at, email_verified_at = excluded.email_verified_at,
+	country = excluded.country, metadata = excluded.metadata, company_id = excluded.company_id, avatar_updated_at = excluded.avatar_updated_at,
+	updated_at = excluded.updated_at;
+`
+
+func replay_customer(tx *sql.Tx, event CustomerEvent, customer Customer) error {
+	dob, email, contact, err := encrypt_customer_pii(customer.DOB, customer.Email, customer.Contact)
+	if err != nil {
+		return err
+	}
+
+	block := CustomerBlock{}
+	if customer.Block != nil {
+		block = *customer.Block
+	}
+
+	metadata := string(customer.Metadata)
+	if metadata == "" || metadata == "null" {
+		metadata = "{}"
+	}
+
+	_, err = tx.Exec(replay_customer_record, customer.ID, event.TenantID, customer.Version, customer.Name, dob, email, contact,
+		pii_index("email", customer.Email), pii_index("contact", customer.Contact), customer.ExternalID, customer.ReferralCode, customer.ReferredByCustomerID,
+		block.BlockedAt, block.Reason, block.BlockedBy, customer.Status, customer.ArchivedAt, customer.EmailVerifiedAt, customer.Country, metadata,
+		customer.CompanyID, customer.AvatarUpdatedAt, customer.CreatedAt, customer.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = save_contact_points(tx, customer.ID, "email", customer.Email, &customer.Emails)
+	if err != nil {
+		return err
+	}
+
+	return save_contact_points(tx, customer.ID, "phone", customer.Contact, &customer.Phones)
+}
+
+func replay_status(tx *sql.Tx, event CustomerEvent, status CustomerStatus) error {
+	update_record := `
+	UPDATE customers
+	SET status = ?, blocked_at = datetime(NULLIF(?, '')), blocked_reason = NULLIF(?, ''), blocked_by = NULLIF(?, ''), updated_at = datetime(?)
+	WHERE id = ?;
+	`
+
+	block := CustomerBlock{}
+	if status.Block != nil {
+		block = *status.Block
+	}
+
+	_, err := tx.Exec(update_record, status.Status, block.BlockedAt, block.Reason, block.BlockedBy, event.CreatedAt, event.CustomerID)
+	return err
+}
+
+// #endregion
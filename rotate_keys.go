@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const rotate_keys_usage = `usage: serv rotate-keys <database.db>
+
+Re-encrypts the customer email, contact and dob columns, and the copies of them in customer versions,
+contact points, events and the audit log, from PII_ENCRYPTION_PREVIOUS_KEY to PII_ENCRYPTION_KEY. Run servers
+with both keys set first, they read either key and write with the new one, so the api keeps working while
+rows are rotated. Values stored in plain are encrypted too, so with only PII_ENCRYPTION_KEY set it seals the
+events and audit entries recorded before the key was.
+
+Rows are rotated PII_ROTATE_BATCH_SIZE at a time, one transaction each, and progress is saved with every
+batch. Running it again with the same new key continues where it stopped. Once it reports done, remove
+PII_ENCRYPTION_PREVIOUS_KEY from the servers.`
+
+// rotation_tables are rotated in this order, the version triggers copy the customers row as stored so
+// versions recorded once customers are done already hold the new key
+var rotation_tables = []string{"customers", "customer_versions", "customer_contact_points", "customer_events", "audit_logs"}
+
+// run_rotate_keys is the rotate-keys subcommand, args are what follows it on the command line
+func run_rotate_keys(args []string) error {
+	if len(args) != 1 {
+		return errors.New(rotate_keys_usage)
+	}
+
+	config := load_config()
+	if config.PIIEncryptionKey == "" {
+		return errors.New("PII_ENCRYPTION_KEY must be set\n\n" + rotate_keys_usage)
+	}
+
+	if config.PIIRotateBatchSize < 1 {
+		return errors.New("PII_ROTATE_BATCH_SIZE must be at least 1")
+	}
+
+	var err error
+	pii_cipher, err = new_pii_cipher(config.PIIEncryptionKey, config.PIIPreviousKey)
+	if err != nil {
+		return err
+	}
+
+	db, err := open_database(args[0], config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = migrate(db)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range rotation_tables {
+		err = rotate_table(db, table, config.PIIRotateBatchSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if pii_cipher.previous == nil {
+		println("done, every row is encrypted with key " + pii_cipher.key_id)
+		return nil
+	}
+
+	println("done, every row is encrypted with key " + pii_cipher.key_id + ". PII_ENCRYPTION_PREVIOUS_KEY can be removed")
+	return nil
+}
+
+// rotate_table re-encrypts the table batch by batch from its saved progress
+func rotate_table(db *sql.DB, table string, batch_size int) error {
+	progress, err := get_rotation_progress(db, pii_cipher.key_id, table)
+	if err != nil {
+		return err
+	}
+
+	if progress.FinishedAt != nil {
+		println(table + ": already rotated")
+		return nil
+	}
+
+	var total int
+	err = db.QueryRow(`SELECT COUNT(*) FROM ` + table + `;`).Scan(&total)
+	if err != nil {
+		return err
+	}
+
+	if progress.LastID > 0 {
+		println(table + ": resuming after id " + strconv.FormatInt(progress.LastID, 10))
+	}
+
+	for {
+		// with_tx may run the batch again when the database is busy, so it works on a copy of progress
+		var batch RotationProgress
+		var done bool
+		err = with_tx(db, func(tx *sql.Tx) error {
+			// re-encrypting is not an edit, customers keep their version
+			return without_version_triggers(tx, func() error {
+				batch = progress
+
+				var rotated int
+				var err error
+				switch table {
+				case "customers":
+					batch.LastID, rotated, done, err = rotate_customers_batch(tx, progress.LastID, batch_size)
+				case "customer_versions":
+					batch.LastID, rotated, done, err = rotate_versions_batch(tx, progress.LastID, batch_size)
+				case "customer_contact_points":
+					batch.LastID, rotated, done, err = rotate_contact_points_batch(tx, progress.LastID, batch_size)
+				case "customer_events":
+					batch.LastID, rotated, done, err = rotate_json_batch(tx, "customer_events", "payload", "changes", progress.LastID, batch_size)
+				case "audit_logs":
+					batch.LastID, rotated, done, err = rotate_json_batch(tx, "audit_logs", "before", "after", progress.LastID, batch_size)
+				}
+				if err != nil {
+					return err
+				}
+
+				batch.Rotated += rotated
+				return save_rotation_progress(tx, pii_cipher.key_id, table, batch, done)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		progress = batch
+
+		var checked int
+		err = db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE id <= ?;`, progress.LastID).Scan(&checked)
+		if err != nil {
+			return err
+		}
+		println(table + ": " + strconv.Itoa(checked) + " of " + strconv.Itoa(total) + " checked, " + strconv.Itoa(progress.Rotated) + " re-encrypted")
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// rotate_pii re-encrypts a stored value with the current key, or encrypts a plain one, false when it needs
+// nothing: empty or already under the current key
+func rotate_pii(field string, value string) (string, bool, error) {
+	if value == "" {
+		return value, false, nil
+	}
+
+	if !strings.HasPrefix(value, pii_prefix) {
+		sealed, err := encrypt_pii(field, value)
+		return sealed, true, err
+	}
+
+	_, err := pii_cipher.open(field, value)
+	if err == nil {
+		return value, false, nil
+	}
+
+	opened, err := decrypt_pii(field, value)
+	if err != nil {
+		return "", false, err
+	}
+
+	sealed, err := encrypt_pii(field, opened)
+	return sealed, true, err
+}
+
+// #region Database
+
+// RotationProgress is how far rotate-keys got through a table for one new key
+type RotationProgress struct {
+	LastID     int64
+	Rotated    int
+	FinishedAt *string
+}
+
+func get_rotation_progress(db *sql.DB, key_id string, table string) (RotationProgress, error) {
+	var progress RotationProgress
+	err := db.QueryRow(`SELECT last_id, rotated, finished_at FROM pii_key_rotations WHERE key_id = ? AND table_name = ?;`, key_id, table).Scan(&progress.LastID, &progress.Rotated, &progress.FinishedAt)
+	if err == sql.ErrNoRows {
+		return RotationProgress{}, nil
+	}
+
+	return progress, err
+}
+
+func save_rotation_progress(tx *sql.Tx, key_id string, table string, progress RotationProgress, done bool) error {
+	upsert_record := `
+	INSERT INTO pii_key_rotations (key_id, table_name, last_id, rotated, finished_at)
+	VALUES (?, ?, ?, ?, CASE WHEN ? THEN CURRENT_TIMESTAMP END)
+	ON CONFLICT (key_id, table_name) DO UPDATE SET
+		last_id = excluded.last_id, rotated = excluded.rotated, finished_at = excluded.finished_at, updated_at = CURRENT_TIMESTAMP;
+	`
+
+	_, err := tx.Exec(upsert_record, key_id, table, progress.LastID, progress.Rotated, done)
+	return err
+}
+
+// rotate_customers_batch rotates the customers after after_id, returning the last id read and whether
+// none are left
+func rotate_customers_batch(tx *sql.Tx, after_id int64, batch_size int) (int64, int, bool, error) {
+	rows, err := tx.Query(`SELECT id, COALESCE(dob, ''), COALESCE(email, ''), COALESCE(contact, '') FROM customers WHERE id > ? ORDER BY id LIMIT ?;`, after_id, batch_size)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	type stored_pii struct {
+		id     int64
+		values []string
+	}
+
+	var customers []stored_pii
+	for rows.Next() {
+		c := stored_pii{values: make([]string, len(pii_fields))}
+		err = rows.Scan(&c.id, &c.values[0], &c.values[1], &c.values[2])
+		if err != nil {
+			rows.Close()
+			return 0, 0, false, err
+		}
+		customers = append(customers, c)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, 0, false, rows.Err()
+	}
+
+	update_record := `
+	UPDATE customers
+	SET dob = ?, email = ?, contact = ?, email_index = ?, contact_index = ?
+	WHERE id = ?;
+	`
+
+	rotated := 0
+	for _, c := range customers {
+		after_id = c.id
+
+		changed := false
+		for i, field := range pii_fields {
+			sealed, rotate, err := rotate_pii(field, c.values[i])
+			if err != nil {
+				return 0, 0, false, errors.New("customer " + strconv.FormatInt(c.id, 10) + ": " + err.Error())
+			}
+			c.values[i] = sealed
+			changed = changed || rotate
+		}
+
+		if !changed {
+			continue
+		}
+
+		// the blind indexes are keyed too
+		email, err := decrypt_pii("email", c.values[1])
+		if err != nil {
+			return 0, 0, false, err
+		}
+		contact, err := decrypt_pii("contact", c.values[2])
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		_, err = tx.Exec(update_record, c.values[0], c.values[1], c.values[2], pii_index("email", email), pii_index("contact", contact), c.id)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		rotated++
+	}
+
+	return after_id, rotated, len(customers) < batch_size, nil
+}
+
+// rotate_versions_batch rotates the encrypted fields of the customer snapshots after after_id
+func rotate_versions_batch(tx *sql.Tx, after_id int64, batch_size int) (int64, int, bool, error) {
+	rows, err := tx.Query(`SELECT id, snapshot FROM customer_versions WHERE id > ? ORDER BY id LIMIT ?;`, after_id, batch_size)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	type version_snapshot struct {
+		id       int64
+		snapshot string
+	}
+
+	var versions []version_snapshot
+	for rows.Next() {
+		var v version_snapshot
+		err = rows.Scan(&v.id, &v.snapshot)
+		if err != nil {
+			rows.Close()
+			return 0, 0, false, err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, 0, false, rows.Err()
+	}
+
+	rotated := 0
+	for _, v := range versions {
+		after_id = v.id
+
+		var fields map[string]any
+		err = json.Unmarshal([]byte(v.snapshot), &fields)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		changed := false
+		for _, field := range pii_fields {
+			value, ok := fields[field].(string)
+			if !ok {
+				continue
+			}
+
+			sealed, rotate, err := rotate_pii(field, value)
+			if err != nil {
+				return 0, 0, false, errors.New("customer version " + strconv.FormatInt(v.id, 10) + ": " + err.Error())
+			}
+			fields[field] = sealed
+			changed = changed || rotate
+		}
+
+		if !changed {
+			continue
+		}
+
+		snapshot, err := json.Marshal(fields)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		_, err = tx.Exec(`UPDATE customer_versions SET snapshot = ? WHERE id = ?;`, string(snapshot), v.id)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		rotated++
+	}
+
+	return after_id, rotated, len(versions) < batch_size, nil
+}
+
+// rotate_contact_points_batch rotates the contact point values after after_id along with their blind indexes
+func rotate_contact_points_batch(tx *sql.Tx, after_id int64, batch_size int) (int64, int, bool, error) {
+	rows, err := tx.Query(`SELECT id, kind, value FROM customer_contact_points WHERE id > ? ORDER BY id LIMIT ?;`, after_id, batch_size)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	type stored_point struct {
+		id          int64
+		kind, value string
+	}
+
+	var points []stored_point
+	for rows.Next() {
+		var p stored_point
+		err = rows.Scan(&p.id, &p.kind, &p.value)
+		if err != nil {
+			rows.Close()
+			return 0, 0, false, err
+		}
+		points = append(points, p)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, 0, false, rows.Err()
+	}
+
+	rotated := 0
+	for _, p := range points {
+		after_id = p.id
+
+		field := contact_point_kinds[p.kind]
+		sealed, rotate, err := rotate_pii(field, p.value)
+		if err != nil {
+			return 0, 0, false, errors.New("contact point " + strconv.FormatInt(p.id, 10) + ": " + err.Error())
+		}
+
+		if !rotate {
+			continue
+		}
+
+		opened, err := decrypt_pii(field, sealed)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		_, err = tx.Exec(`UPDATE customer_contact_points SET value = ?, value_index = ? WHERE id = ?;`, sealed, pii_index(field, opened), p.id)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		rotated++
+	}
+
+	return after_id, rotated, len(points) < batch_size, nil
+}
+
+// rotate_json_batch rotates the customer pii in the two json columns of table after after_id, the event
+// payloads and changes or the audit entries' before and after
+func rotate_json_batch(tx *sql.Tx, table string, first string, second string, after_id int64, batch_size int) (int64, int, bool, error) {
+	rows, err := tx.Query(`SELECT id, `+first+`, `+second+` FROM `+table+` WHERE id > ? ORDER BY id LIMIT ?;`, after_id, batch_size)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	type stored_json struct {
+		id      int64
+		columns [2]*string
+	}
+
+	var records []stored_json
+	for rows.Next() {
+		var r stored_json
+		err = rows.Scan(&r.id, &r.columns[0], &r.columns[1])
+		if err != nil {
+			rows.Close()
+			return 0, 0, false, err
+		}
+		records = append(records, r)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, 0, false, rows.Err()
+	}
+
+	rotated := 0
+	for _, r := range records {
+		after_id = r.id
+
+		changed := false
+		for _, column := range r.columns {
+			if column == nil {
+				continue
+			}
+
+			sealed, err := map_pii_json([]byte(*column), func(field string, value string) (string, error) {
+				sealed, rotate, err := rotate_pii(field, value)
+				changed = changed || rotate
+				return sealed, err
+			})
+			if err != nil {
+				return 0, 0, false, errors.New(table + " " + strconv.FormatInt(r.id, 10) + ": " + err.Error())
+			}
+			*column = string(sealed)
+		}
+
+		if !changed {
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE `+table+` SET `+first+` = ?, `+second+` = ? WHERE id = ?;`, r.columns[0], r.columns[1], r.id)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		rotated++
+	}
+
+	return after_id, rotated, len(records) < batch_size, nil
+}
+
+// #endregion
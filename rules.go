@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rules_offset_name is the sink_offsets cursor of the rules worker
+const rules_offset_name = "rules"
+
+// RuleCondition compares a customer field, by json name or the derived email_domain, against a value
+type RuleCondition struct {
+	Field string `json:"field"`
+	Op    string `json:"op"` // eq, neq, contains, ends_with, missing or present
+	Value string `json:"value"`
+}
+
+// RuleAction is what a matching rule does to the customer
+type RuleAction struct {
+	Type  string `json:"type"`  // add_tag or flag_for_review
+	Value string `json:"value"` // the tag, or the reason shown in the review queue
+}
+
+// Rule runs its actions when an event of its type carries a customer matching every condition, e.g.
+// "when customer.created and email_domain eq example.com, add_tag partner"
+type Rule struct {
+	ID         int64           `json:"id"`
+	Name       string          `json:"name"`
+	Event      string          `json:"event"`
+	Conditions []RuleCondition `json:"conditions"`
+	Actions    []RuleAction    `json:"actions"`
+	Enabled    bool            `json:"enabled"`
+	CreatedAt  string          `json:"created_at"`
+	UpdatedAt  string          `json:"updated_at"`
+}
+
+type RuleDetails struct {
+	Name       string          `json:"name"`
+	Event      string          `json:"event"`
+	Conditions []RuleCondition `json:"conditions"`
+	Actions    []RuleAction    `json:"actions"`
+	Enabled    *bool           `json:"enabled"` // defaults to true
+}
+
+// ReviewFlag is an entry in the data review queue
+type ReviewFlag struct {
+	ID         int64   `json:"id"`
+	CustomerID int64   `json:"customer_id"`
+	Reason     string  `json:"reason"`
+	RuleID     *int64  `json:"rule_id"`
+	CreatedAt  string  `json:"created_at"`
+	ResolvedAt *string `json:"resolved_at"`
+	ResolvedBy *string `json:"resolved_by"`
+}
+
+var rule_events = map[string]bool{
+	EventCustomerCreated: true,
+	EventCustomerUpdated: true,
+}
+
+var rule_ops = map[string]func(value string, present bool, expected string) bool{
+	"eq":  func(value string, present bool, expected string) bool { return strings.EqualFold(value, expected) },
+	"neq": func(value string, present bool, expected string) bool { return !strings.EqualFold(value, expected) },
+	"contains": func(value string, present bool, expected string) bool {
+		return strings.Contains(strings.ToLower(value), strings.ToLower(expected))
+	},
+	"ends_with": func(value string, present bool, expected string) bool {
+		return strings.HasSuffix(strings.ToLower(value), strings.ToLower(expected))
+	},
+	"missing": func(value string, present bool, expected string) bool { return !present },
+	"present": func(value string, present bool, expected string) bool { return present },
+}
+
+var rule_actions = map[string]bool{
+	"add_tag":         true,
+	"flag_for_review": true,
+}
+
+func validate_rule(input RuleDetails) error {
+	if input.Name == "" {
+		return errors.New("Name is required")
+	}
+
+	if !rule_events[input.Event] {
+		return errors.New("Unsupported event " + input.Event)
+	}
+
+	for _, condition := range input.Conditions {
+		_, ok := customer_fields[condition.Field]
+		if !ok && condition.Field != "id" && condition.Field != "email_domain" {
+			return errors.New("Unknown field " + condition.Field)
+		}
+		if rule_ops[condition.Op] == nil {
+			return errors.New("Unknown op " + condition.Op)
+		}
+	}
+
+	if len(input.Actions) == 0 {
+		return errors.New("At least one action is required")
+	}
+
+	for _, action := range input.Actions {
+		if !rule_actions[action.Type] {
+			return errors.New("Unknown action " + action.Type)
+		}
+		if action.Value == "" {
+			return errors.New("Action " + action.Type + " needs a value")
+		}
+	}
+
+	return nil
+}
+
+// rule_field reads a field off the event's customer payload, empty strings and nulls count as missing
+func rule_field(customer map[string]any, field string) (string, bool) {
+	if field == "email_domain" {
+		email, _ := customer["email"].(string)
+		_, domain, ok := strings.Cut(email, "@")
+		return domain, ok && domain != ""
+	}
+
+	value, ok := customer[field]
+	if !ok || value == nil {
+		return "", false
+	}
+
+	value_str := fmt.Sprint(value)
+	return value_str, value_str != ""
+}
+
+func (rule *Rule) matches(customer map[string]any) bool {
+	for _, condition := range rule.Conditions {
+		value, present := rule_field(customer, condition.Field)
+		if !rule_ops[condition.Op](value, present, condition.Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// run_rules evaluates the enabled rules against each new event, the cursor only moves once an event's
+// actions are applied so a crash re-applies them, which is harmless as every action is idempotent
+func run_rules(ctx context.Context, db *sql.DB, config Config) {
+	// rules only look forward, history is not re-evaluated when the worker first starts
+	_, found, err := get_sink_offset(db, rules_offset_name)
+	if err == nil && !found {
+		err = set_sink_offset(db, rules_offset_name, latest_event_id(db))
+	}
+	if err != nil {
+		println("rules offset setup failed:", err.Error())
+		return
+	}
+
+	wake := event_broker.Subscribe()
+	defer event_broker.Unsubscribe(wake)
+
+	ticker := time.NewTicker(config.RulesInterval)
+	defer ticker.Stop()
+
+	for {
+		err := evaluate_rules(db)
+		if err != nil {
+			println("rule evaluation failed:", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
+			}
+		}
+	}
+}
+
+func evaluate_rules(db *sql.DB) error {
+	rules, err := get_rules(db, false)
+	if err != nil {
+		return err
+	}
+
+	for {
+		offset, _, err := get_sink_offset(db, rules_offset_name)
+		if err != nil {
+			return err
+		}
+
+		events, err := get_events_since(db, "", offset, 100)
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		for _, event := range events {
+			err = apply_rules(db, rules, event)
+			if err != nil {
+				return err
+			}
+
+			err = set_sink_offset(db, rules_offset_name, event.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func apply_rules(db *sql.DB, rules []Rule, event CustomerEvent) error {
+	if !rule_events[event.Type] {
+		return nil
+	}
+
+	// numbers stay as written so ids compare as "1000000" rather than "1e+06"
+	var customer map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(event.Payload))
+	decoder.UseNumber()
+	err := decoder.Decode(&customer)
+	if err != nil {
+		return nil
+	}
+
+	for _, rule := range rules {
+		if rule.Event != event.Type || !rule.matches(customer) {
+			continue
+		}
+
+		for _, action := range rule.Actions {
+			switch action.Type {
+			case "add_tag":
+				err = add_customer_tag(db, event.CustomerID, action.Value, "rule:"+strconv.FormatInt(rule.ID, 10))
+			case "flag_for_review":
+				err = flag_for_review(db, event.CustomerID, action.Value, rule.ID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func register_rule_routes(mux *http.ServeMux, db *sql.DB) {
+	// create a rule, it applies to events from now on
+	mux.HandleFunc("POST /api/admin/rules", func(w http.ResponseWriter, r *http.Request) {
+		var req RuleDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_rule(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rule, err := create_rule(db, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[Rule]{Data: *rule})
+	})
+
+	// list rules
+	mux.HandleFunc("GET /api/admin/rules", func(w http.ResponseWriter, r *http.Request) {
+		rules, err := get_rules(db, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Rule]{Data: rules})
+	})
+
+	// replace a rule, also how rules are enabled and disabled
+	mux.HandleFunc("PUT /api/admin/rules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req RuleDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_rule(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rule, err := update_rule(db, id, req)
+		if err != nil && err.Error() == "Rule not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Rule]{Data: *rule})
+	})
+
+	// delete a rule, tags and flags it already applied stay
+	mux.HandleFunc("DELETE /api/admin/rules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_rule(db, id)
+		if err != nil && err.Error() == "Rule not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// the review queue, ?resolved=true shows handled flags instead
+	mux.HandleFunc("GET /api/review-flags", func(w http.ResponseWriter, r *http.Request) {
+		flags, err := get_review_flags(db, tenant_from(r), r.URL.Query().Get("resolved") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]ReviewFlag]{Data: flags})
+	})
+
+	// mark a flag as handled
+	mux.HandleFunc("POST /api/review-flags/{id}/resolve", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		flag, err := resolve_review_flag(db, tenant_from(r), id, actor_from(r))
+		if err != nil && err.Error() == "Review flag not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[ReviewFlag]{Data: *flag})
+	})
+}
+
+// #region Database
+const rule_columns = `id, name, event, conditions, actions, enabled, created_at, updated_at`
+
+func scan_rule(row row_scanner) (Rule, error) {
+	var rule Rule
+	var conditions, actions string
+	err := row.Scan(&rule.ID, &rule.Name, &rule.Event, &conditions, &actions, &rule.Enabled, &rule.CreatedAt, &rule.UpdatedAt)
+	if err != nil {
+		return rule, err
+	}
+
+	err = json.Unmarshal([]byte(conditions), &rule.Conditions)
+	if err != nil {
+		return rule, err
+	}
+
+	err = json.Unmarshal([]byte(actions), &rule.Actions)
+	return rule, err
+}
+
+// rule_record turns the details into the stored columns, conditions and actions are kept as json
+func rule_record(input RuleDetails) (string, string, bool, error) {
+	if input.Conditions == nil {
+		input.Conditions = []RuleCondition{}
+	}
+
+	conditions, err := json.Marshal(input.Conditions)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	actions, err := json.Marshal(input.Actions)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return string(conditions), string(actions), input.Enabled == nil || *input.Enabled, nil
+}
+
+func create_rule(db *sql.DB, input RuleDetails) (*Rule, error) {
+	create_record := `
+	INSERT INTO rules (name, event, conditions, actions, enabled)
+	VALUES (?, ?, ?, ?, ?)
+	RETURNING ` + rule_columns + `;
+	`
+
+	conditions, actions, enabled, err := rule_record(input)
+	if err != nil {
+		return nil, err
+	}
+
+	rule, err := scan_rule(db.QueryRow(create_record, input.Name, input.Event, conditions, actions, enabled))
+	if err != nil {
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+func update_rule(db *sql.DB, id int64, input RuleDetails) (*Rule, error) {
+	update_record := `
+	UPDATE rules
+	SET name = ?, event = ?, conditions = ?, actions = ?, enabled = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	RETURNING ` + rule_columns + `;
+	`
+
+	conditions, actions, enabled, err := rule_record(input)
+	if err != nil {
+		return nil, err
+	}
+
+	rule, err := scan_rule(db.QueryRow(update_record, input.Name, input.Event, conditions, actions, enabled, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Rule not found")
+		}
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+// get_rules lists the enabled rules, or every rule when include_disabled is set
+func get_rules(db *sql.DB, include_disabled bool) ([]Rule, error) {
+	get_records := `
+	SELECT ` + rule_columns + `
+	FROM rules
+	WHERE ? OR enabled
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, include_disabled)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var rules []Rule = []Rule{}
+	for rows.Next() {
+		rule, err := scan_rule(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func delete_rule(db *sql.DB, id int64) error {
+	result, err := exec_with_retry(db, `DELETE FROM rules WHERE id = ?;`, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("Rule not found")
+	}
+
+	return nil
+}
+
+func latest_event_id(db *sql.DB) int64 {
+	var id int64
+	db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM customer_events;`).Scan(&id)
+	return id
+}
+
+// flag_for_review keeps at most one open flag per customer and reason
+func flag_for_review(db *sql.DB, customer_id int64, reason string, rule_id int64) error {
+	insert_record := `
+	INSERT INTO review_flags (customer_id, reason, rule_id)
+	SELECT id, ?, ? FROM customers
+	WHERE id = ? AND NOT EXISTS (
+		SELECT 1 FROM review_flags WHERE customer_id = ? AND reason = ? AND resolved_at IS NULL
+	);
+	`
+
+	_, err := exec_with_retry(db, insert_record, reason, rule_id, customer_id, customer_id, reason)
+	return err
+}
+
+const review_flag_columns = `id, customer_id, reason, rule_id, created_at, resolved_at, resolved_by`
+
+func scan_review_flag(row row_scanner) (ReviewFlag, error) {
+	var flag ReviewFlag
+	err := row.Scan(&flag.ID, &flag.CustomerID, &flag.Reason, &flag.RuleID, &flag.CreatedAt, &flag.ResolvedAt, &flag.ResolvedBy)
+	return flag, err
+}
+
+// get_review_flags reads the flags on the tenant's customers
+func get_review_flags(db *sql.DB, tenant_id string, resolved bool) ([]ReviewFlag, error) {
+	get_records := `
+	SELECT ` + review_flag_columns + `
+	FROM review_flags
+	WHERE (resolved_at IS NOT NULL) = ? AND customer_id IN (SELECT id FROM customers WHERE tenant_id = ?)
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, resolved, tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var flags []ReviewFlag = []ReviewFlag{}
+	for rows.Next() {
+		flag, err := scan_review_flag(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		flags = append(flags, flag)
+	}
+
+	return flags, rows.Err()
+}
+
+func resolve_review_flag(db *sql.DB, tenant_id string, id int64, actor string) (*ReviewFlag, error) {
+	update_record := `
+	UPDATE review_flags
+	SET resolved_at = COALESCE(resolved_at, CURRENT_TIMESTAMP), resolved_by = COALESCE(resolved_by, ?)
+	WHERE id = ? AND customer_id IN (SELECT id FROM customers WHERE tenant_id = ?)
+	RETURNING ` + review_flag_columns + `;
+	`
+
+	flag, err := scan_review_flag(db.QueryRow(update_record, actor, id, tenant_id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Review flag not found")
+		}
+		return nil, err
+	}
+
+	return &flag, nil
+}
+
+// #endregion
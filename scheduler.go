@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schedule_horizon is how far ahead a schedule is searched, one that matches no date, such as 30 2 30 2 *, never runs
+const schedule_horizon = 5 * 366 * 24 * time.Hour
+
+// schedule_aliases are the named schedules cron understands
+var schedule_aliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// Schedule is when a scheduled task runs next
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// ScheduledTask is maintenance run on a schedule, a nil schedule disables it
+type ScheduledTask struct {
+	Name     string
+	Schedule Schedule
+	Run      func(ctx context.Context) error
+}
+
+// parse_schedule reads a cron expression of minute, hour, day of month, month and day of week, one of the
+// @hourly style aliases or @every and a duration. off disables the task, nil is returned for it
+func parse_schedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "off" {
+		return nil, nil
+	}
+
+	if interval, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || every <= 0 {
+			return nil, errors.New("Invalid schedule " + spec + ", @every takes a duration such as 1h")
+		}
+		return every_schedule(every), nil
+	}
+
+	if alias, ok := schedule_aliases[spec]; ok {
+		spec = alias
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("Invalid schedule " + spec + ", expected minute, hour, day of month, month and day of week")
+	}
+
+	var schedule cron_schedule
+	var err error
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&schedule.minutes, 0, 59},
+		{&schedule.hours, 0, 23},
+		{&schedule.days, 1, 31},
+		{&schedule.months, 1, 12},
+		{&schedule.weekdays, 0, 7},
+	} {
+		*field.bits, err = parse_schedule_field(fields[i], field.min, field.max)
+		if err != nil {
+			return nil, errors.New("Invalid schedule " + spec + ", " + err.Error())
+		}
+	}
+
+	// 7 is sunday as well as 0
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+	schedule.any_day = fields[2] == "*"
+	schedule.any_weekday = fields[4] == "*"
+
+	return schedule, nil
+}
+
+// parse_schedule_field reads a comma separated list of *, values and ranges, each with an optional /step
+func parse_schedule_field(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		span, step_str, has_step := strings.Cut(part, "/")
+		step := 1
+		if has_step {
+			var err error
+			step, err = strconv.Atoi(step_str)
+			if err != nil || step <= 0 {
+				return 0, errors.New(part + " has an invalid step")
+			}
+		}
+
+		from, to := min, max
+		if span != "*" {
+			first, last, is_range := strings.Cut(span, "-")
+			var err error
+			from, err = strconv.Atoi(first)
+			if err != nil {
+				return 0, errors.New(part + " is not a number")
+			}
+
+			to = from
+			if is_range {
+				to, err = strconv.Atoi(last)
+				if err != nil {
+					return 0, errors.New(part + " is not a number")
+				}
+			} else if has_step {
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return 0, errors.New(part + " is outside " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+
+		for value := from; value <= to; value += step {
+			bits |= 1 << value
+		}
+	}
+
+	return bits, nil
+}
+
+type every_schedule time.Duration
+
+func (s every_schedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// cron_schedule holds each field's matching values as bits. As in cron, when both the day of month and the
+// day of week are restricted a day matching either one runs
+type cron_schedule struct {
+	minutes, hours, days, months, weekdays uint64
+	any_day, any_weekday                   bool
+}
+
+func (s cron_schedule) day_matches(t time.Time) bool {
+	day := s.days&(1<<t.Day()) != 0
+	weekday := s.weekdays&(1<<t.Weekday()) != 0
+	if s.any_day || s.any_weekday {
+		return day && weekday
+	}
+
+	return day || weekday
+}
+
+// Next is the first matching minute after after, in its location. The zero time when none comes within
+// schedule_horizon
+func (s cron_schedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(schedule_horizon)
+
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.day_matches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// run_scheduler runs each task at the times of its schedule until ctx ends. Tasks wait for nothing but their
+// own schedule, a long vacuum doesn't hold up the others, and a run that overlaps its next time skips it
+func run_scheduler(ctx context.Context, tasks []ScheduledTask) {
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		if task.Schedule == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run_scheduled_task(ctx, task)
+		}()
+	}
+	wg.Wait()
+}
+
+func run_scheduled_task(ctx context.Context, task ScheduledTask) {
+	for {
+		next := task.Schedule.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := task.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			println("scheduled task "+task.Name+" failed:", err.Error())
+		}
+	}
+}
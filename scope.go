@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	EventCustomerArchived   = "customer.archived"
+	EventCustomerUnarchived = "customer.unarchived"
+)
+
+var customer_statuses = map[string]bool{
+	"active":   true,
+	"inactive": true,
+	"blocked":  true,
+}
+
+// ListingScope narrows what GET /api/customers returns, the defaults come from config
+// and each part can be widened per request with include_archived, include_unverified or include_inactive
+type ListingScope struct {
+	TenantID          string // empty only for platform wide counts
+	ExcludeArchived   bool
+	ExcludeUnverified bool
+	OnlyActive        bool
+
+	DOBFrom  string // inclusive YYYY-MM-DD bounds from the dob and age filters, empty when open
+	DOBTo    string
+	Contact  string   // e.164
+	Email    string   // canonical, matched through the blind index
+	Statuses []string // from ?status=, replaces OnlyActive when given
+	Tags     []string // from ?tags=
+	AllTags  bool     // customers must carry every tag rather than any of them
+	Consents []string // from ?consent=, purposes every customer has granted
+
+	Metadata  map[string]string // json path to value, from ?metadata.<key>=
+	CompanyID *int64            // only the company's customers
+
+	Sort string // one of listing_sorts, by id when empty
+
+	Filter     string // the compiled ?filter= expression, see filter.go
+	FilterArgs []any
+}
+
+// listing_sorts are the orders a listing can take, a leading - sorts descending. Ties go by id
+var listing_sorts = map[string]string{
+	"id":          "id",
+	"-id":         "id DESC",
+	"name":        "name, id",
+	"-name":       "name DESC, id",
+	"created_at":  "created_at, id",
+	"-created_at": "created_at DESC, id",
+	"updated_at":  "updated_at, id",
+	"-updated_at": "updated_at DESC, id",
+}
+
+func listing_scope(config Config, r *http.Request) ListingScope {
+	query := r.URL.Query()
+	return ListingScope{
+		TenantID:          tenant_from(r),
+		ExcludeArchived:   config.ListingExcludeArchived && query.Get("include_archived") != "true",
+		ExcludeUnverified: config.ListingExcludeUnverified && query.Get("include_unverified") != "true",
+		OnlyActive:        config.ListingOnlyActive && query.Get("include_inactive") != "true",
+	}
+}
+
+// filtered_listing_scope is listing_scope narrowed by the filters in the request's query
+func filtered_listing_scope(config Config, r *http.Request) (ListingScope, error) {
+	scope := listing_scope(config, r)
+
+	// ?dob_from=, ?dob_to=, ?min_age= and ?max_age= narrow it by date of birth
+	var err error
+	scope.DOBFrom, scope.DOBTo, err = dob_range(r)
+	if err != nil {
+		return scope, err
+	}
+
+	// ?status=active,inactive lists only those statuses
+	scope.Statuses, err = listing_statuses(r)
+	if err != nil {
+		return scope, err
+	}
+
+	// ?tags=vip,newsletter lists customers with all of them, or any with ?tag_match=any
+	scope.Tags, scope.AllTags, err = listing_tags(r)
+	if err != nil {
+		return scope, err
+	}
+
+	// ?consent=marketing_email,sms lists customers who granted all of them
+	scope.Consents, err = listing_consents(r)
+	if err != nil {
+		return scope, err
+	}
+
+	// ?metadata.plan=gold matches a metadata value, dots reach into nested objects
+	scope.Metadata, err = listing_metadata(r)
+	if err != nil {
+		return scope, err
+	}
+
+	// ?email= finds a customer by their primary email, written in any case
+	scope.Email = canonical_email(r.URL.Query().Get("email"))
+
+	// ?contact= finds a number however it is written
+	contact := r.URL.Query().Get("contact")
+	if contact != "" {
+		scope.Contact, err = normalize_phone(contact, "")
+		if err != nil {
+			return scope, err
+		}
+	}
+
+	// ?filter=name co "an" and created_at ge "2024-01-01" combines conditions with and, or and not
+	scope.Filter, scope.FilterArgs, err = listing_filter(r.URL.Query().Get("filter"))
+	if err != nil {
+		return scope, err
+	}
+
+	// ?sort=-created_at lists the newest first
+	scope.Sort = r.URL.Query().Get("sort")
+	if _, ok := listing_sorts[scope.Sort]; scope.Sort != "" && !ok {
+		return scope, &ValidationError{Field: "sort", Message: "must be id, name, created_at or updated_at, with - for descending"}
+	}
+
+	return scope, nil
+}
+
+func (s ListingScope) order_by() string {
+	order, ok := listing_sorts[s.Sort]
+	if !ok {
+		return "id"
+	}
+
+	return order
+}
+
+// where is the scope as a sql condition and its args, empty when nothing is excluded
+func (s ListingScope) where() (string, []any) {
+	var conditions []string
+	var args []any
+	if s.TenantID != "" {
+		conditions = append(conditions, "tenant_id = ?")
+		args = append(args, s.TenantID)
+	}
+	if s.ExcludeArchived {
+		conditions = append(conditions, "archived_at IS NULL")
+	}
+	if s.ExcludeUnverified {
+		conditions = append(conditions, "email_verified_at IS NOT NULL")
+	}
+	if len(s.Statuses) > 0 {
+		conditions = append(conditions, "status IN (?"+strings.Repeat(", ?", len(s.Statuses)-1)+")")
+		for _, status := range s.Statuses {
+			args = append(args, status)
+		}
+	} else if s.OnlyActive {
+		conditions = append(conditions, "status = 'active'")
+	}
+	if s.DOBFrom != "" {
+		conditions = append(conditions, "dob >= ?")
+		args = append(args, s.DOBFrom)
+	}
+	if s.DOBTo != "" {
+		conditions = append(conditions, "dob <= ?")
+		args = append(args, s.DOBTo)
+	}
+	if s.CompanyID != nil {
+		conditions = append(conditions, "company_id = ?")
+		args = append(args, *s.CompanyID)
+	}
+	if s.Email != "" {
+		indexes := pii_lookup_indexes("email", s.Email)
+		conditions = append(conditions, "email_index IN (?"+strings.Repeat(", ?", len(indexes)-1)+")")
+		for _, index := range indexes {
+			args = append(args, index)
+		}
+	}
+	if s.Contact != "" {
+		indexes := pii_lookup_indexes("contact", s.Contact)
+		conditions = append(conditions, "id IN (SELECT customer_id FROM customer_contact_points WHERE kind = 'phone' AND value_index IN (?"+strings.Repeat(", ?", len(indexes)-1)+"))")
+		for _, index := range indexes {
+			args = append(args, index)
+		}
+	}
+
+	if len(s.Tags) > 0 {
+		tagged := "id IN (SELECT customer_id FROM customer_tags WHERE tag IN (?" + strings.Repeat(", ?", len(s.Tags)-1) + ")"
+		for _, tag := range s.Tags {
+			args = append(args, tag)
+		}
+		if s.AllTags {
+			tagged += " GROUP BY customer_id HAVING COUNT(*) = ?"
+			args = append(args, len(s.Tags))
+		}
+		conditions = append(conditions, tagged+")")
+	}
+
+	if len(s.Consents) > 0 {
+		conditions = append(conditions, "id IN (SELECT customer_id FROM customer_consents WHERE granted AND purpose IN (?"+strings.Repeat(", ?", len(s.Consents)-1)+") GROUP BY customer_id HAVING COUNT(*) = ?)")
+		for _, purpose := range s.Consents {
+			args = append(args, purpose)
+		}
+		args = append(args, len(s.Consents))
+	}
+
+	metadata_conditions, metadata_args := metadata_where(s.Metadata)
+	conditions = append(conditions, metadata_conditions...)
+	args = append(args, metadata_args...)
+
+	if s.Filter != "" {
+		conditions = append(conditions, "("+s.Filter+")")
+		args = append(args, s.FilterArgs...)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// where_is_tenant_only is true when the scope selects every customer of its tenant
+func (s ListingScope) where_is_tenant_only() bool {
+	where, _ := s.where()
+	tenant_where, _ := ListingScope{TenantID: s.TenantID}.where()
+	return where == tenant_where
+}
+
+func register_scope_routes(mux *http.ServeMux, db *sql.DB) {
+	// archive the customer, archived customers drop out of listings by default but stay readable
+	mux.HandleFunc("POST /api/customers/{id}/archive", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		write_scope_change(w, r, func(id int64) (*Customer, error) {
+			return set_customer_archived(db, id, true)
+		})
+	}))
+
+	// bring an archived customer back
+	mux.HandleFunc("DELETE /api/customers/{id}/archive", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		write_scope_change(w, r, func(id int64) (*Customer, error) {
+			return set_customer_archived(db, id, false)
+		})
+	}))
+
+	// record that the customer confirmed their current email address
+	mux.HandleFunc("POST /api/customers/{id}/email-verification", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		write_scope_change(w, r, func(id int64) (*Customer, error) {
+			return set_customer_email_verified(db, id)
+		})
+	}))
+}
+
+func write_scope_change(w http.ResponseWriter, r *http.Request, change func(id int64) (*Customer, error)) {
+	id, err := path_customer_id(r)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	customer, err := change(id)
+	if err != nil && err.Error() == "Customer not found" {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	present_customer(r, customer)
+	response_str, err := json.Marshal(ApiResponse[Customer]{Data: *customer})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response_str)
+}
+
+// #region Database
+
+// set_customer_archived archives or unarchives the customer, repeating either changes nothing and records nothing
+func set_customer_archived(db *sql.DB, id int64, archived bool) (*Customer, error) {
+	archive_record := `
+	UPDATE customers
+	SET archived_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND archived_at IS NULL;
+	`
+
+	unarchive_record := `
+	UPDATE customers
+	SET archived_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND archived_at IS NOT NULL;
+	`
+
+	event_type := EventCustomerArchived
+	update_record := archive_record
+	if !archived {
+		event_type = EventCustomerUnarchived
+		update_record = unarchive_record
+	}
+
+	return change_customer(db, id, update_record, event_type)
+}
+
+// set_customer_email_verified marks the current email as verified, updating the email clears it again
+func set_customer_email_verified(db *sql.DB, id int64) (*Customer, error) {
+	verify_record := `
+	UPDATE customers
+	SET email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND email_verified_at IS NULL AND email != '';
+	`
+
+	return change_customer(db, id, verify_record, EventCustomerUpdated)
+}
+
+// change_customer runs update_record for the customer and records event_type when it changed a row
+func change_customer(db *sql.DB, id int64, update_record string, event_type string) (*Customer, error) {
+	var customer *Customer
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		before, err := get_customer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(update_record, id)
+		if err != nil {
+			return err
+		}
+
+		customer, err = get_customer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		changed, err := result.RowsAffected()
+		if err != nil || changed == 0 {
+			return err
+		}
+
+		changes, err := customer_changes(before, customer)
+		if err != nil {
+			return err
+		}
+
+		event, err = record_change_event(tx, event_type, id, customer, changes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if event != nil {
+		event_broker.Publish(*event)
+	}
+
+	return customer, nil
+}
+
+// #endregion
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scrub_usage is printed for `serv scrub` without its arguments
+const scrub_usage = `usage: serv scrub <source.db> <target.db>
+
+Copies the source database to target, a new file, replacing every customer's personal data with
+realistic fakes. Ids, timestamps, statuses, countries, cities, tags and referrals are kept as they are, and
+the same real value always gets the same fake, so duplicates, suppressions and event history still
+line up. Credentials, webhooks and export keys are not copied. Encrypted customer fields need
+PII_ENCRYPTION_KEY and an encrypted source file DATABASE_PASSPHRASE, the copy stores its fakes unencrypted.`
+
+var scrub_first_names = []string{
+	"James", "Mary", "Wei", "Siti", "Arjun", "Emma", "Lucas", "Aisha", "Hiroshi", "Sofia",
+	"Daniel", "Mei", "Omar", "Chloe", "Ravi", "Nur", "Liam", "Yuki", "Mateo", "Priya",
+	"Noah", "Hannah", "Kenji", "Fatimah", "Ethan", "Olivia", "Jun", "Grace", "Amir", "Isabel",
+}
+
+var scrub_last_names = []string{
+	"Tan", "Smith", "Lim", "Kumar", "Wong", "Garcia", "Ahmad", "Nguyen", "Brown", "Lee",
+	"Rahman", "Muller", "Chen", "Silva", "Sato", "Ong", "Patel", "Martin", "Ibrahim", "Rossi",
+	"Walker", "Ng", "Kim", "Lopez", "Singh", "Dubois", "Teo", "Jones", "Hassan", "Novak",
+}
+
+// Scrubber maps real values to fakes. Fakes are derived from an hmac of the value under a key that only
+// lives for one run, so they are stable within a copy but cannot be matched back to a list of real values.
+// With placeholders set, as when a customer is anonymized, the fakes are plainly not real and custom fields are erased
+type Scrubber struct {
+	key          []byte
+	placeholders bool
+}
+
+func new_scrubber() (*Scrubber, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Scrubber{key: key}, nil
+}
+
+func new_anonymizer() (*Scrubber, error) {
+	scrubber, err := new_scrubber()
+	if err != nil {
+		return nil, err
+	}
+
+	scrubber.placeholders = true
+	return scrubber, nil
+}
+
+// anonymized_fields are erased rather than faked when anonymizing, they may hold anything
+var anonymized_fields = map[string]any{
+	"external_id": "",
+	"metadata":    map[string]any{},
+}
+
+func (s *Scrubber) hash(kind string, value string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(kind + "\x00" + value))
+	return mac.Sum(nil)
+}
+
+func (s *Scrubber) pick(kind string, value string, n int) int {
+	return int(binary.BigEndian.Uint64(s.hash(kind, value)) % uint64(n))
+}
+
+func (s *Scrubber) Name(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	if s.placeholders {
+		return "Anonymized " + hex.EncodeToString(s.hash("name", value)[:4])
+	}
+
+	return scrub_first_names[s.pick("first", value, len(scrub_first_names))] + " " + scrub_last_names[s.pick("last", value, len(scrub_last_names))]
+}
+
+// Email keeps the address unique with a short hash and sends everything to example.com
+func (s *Scrubber) Email(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	value = strings.ToLower(value)
+	if s.placeholders {
+		return "anonymized." + hex.EncodeToString(s.hash("email", value)[:6]) + "@anonymized.invalid"
+	}
+
+	first := scrub_first_names[s.pick("first", value, len(scrub_first_names))]
+	last := scrub_last_names[s.pick("last", value, len(scrub_last_names))]
+	return strings.ToLower(first+"."+last) + "." + hex.EncodeToString(s.hash("email", value)[:3]) + "@example.com"
+}
+
+// Contact replaces every digit and keeps the rest, so number formats and lengths survive. Anonymized numbers
+// are removed, a placeholder would not be a number
+func (s *Scrubber) Contact(value string) string {
+	if s.placeholders {
+		return ""
+	}
+
+	digits := s.hash("contact", value)
+	i := 0
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return r
+		}
+		i++
+		return rune('0' + digits[i%len(digits)]%10)
+	}, value)
+}
+
+// Street is a made up street line, empty stays empty
+func (s *Scrubber) Street(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return strconv.Itoa(s.pick("number", value, 200)+1) + " " + scrub_last_names[s.pick("street", value, len(scrub_last_names))] + " Street"
+}
+
+// DOB moves the date by up to half a year either way, which keeps the age distribution. Anonymized dates are removed
+func (s *Scrubber) DOB(value string) string {
+	if s.placeholders {
+		return ""
+	}
+
+	dob, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return value
+	}
+
+	return dob.AddDate(0, 0, s.pick("dob", value, 365)-182).Format("2006-01-02")
+}
+
+// field fakes one of the personal fields found in customer snapshots, false for any other field
+func (s *Scrubber) field(field string, value string) (string, bool) {
+	switch field {
+	case "name":
+		return s.Name(value), true
+	case "email", "blocked_by":
+		return s.Email(value), true
+	case "contact":
+		return s.Contact(value), true
+	case "dob":
+		return s.DOB(value), true
+	case "reason":
+		return "Blocked (reason scrubbed)", true
+	}
+
+	return value, false
+}
+
+// payload scrubs a customer snapshot, including the nested block. The fakes are stored plainly
+func (s *Scrubber) payload(payload string) (string, error) {
+	var fields map[string]any
+	err := json.Unmarshal([]byte(payload), &fields)
+	if err != nil {
+		return "", err
+	}
+
+	// fakes of the encrypted values would not match the ones made for the row
+	err = decrypt_snapshot_fields(fields)
+	if err != nil {
+		return "", err
+	}
+
+	s.scrub_fields(fields)
+	if block, ok := fields["block"].(map[string]any); ok {
+		s.scrub_fields(block)
+	}
+
+	scrubbed, err := json.Marshal(fields)
+	return string(scrubbed), err
+}
+
+// points fakes the values of an emails or phones list, false for any other field
+func (s *Scrubber) points(field string, value any) bool {
+	points, ok := value.([]any)
+	if !ok {
+		return false
+	}
+
+	for single, list := range contact_field_points {
+		if list != field {
+			continue
+		}
+
+		for _, point := range points {
+			point, ok := point.(map[string]any)
+			if !ok {
+				continue
+			}
+			if str, ok := point["value"].(string); ok {
+				point["value"], _ = s.field(single, str)
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+func (s *Scrubber) scrub_fields(fields map[string]any) {
+	for field, value := range fields {
+		if erased, ok := anonymized_fields[field]; ok && s.placeholders {
+			fields[field] = erased
+			continue
+		}
+
+		if s.points(field, value) {
+			continue
+		}
+
+		str, ok := value.(string)
+		if !ok || (field == "reason" && fields["blocked_by"] == nil) {
+			continue
+		}
+
+		fields[field], _ = s.field(field, str)
+	}
+}
+
+func (s *Scrubber) changes(changes string) (string, error) {
+	// as for payloads, the fakes are made from the real values
+	opened, err := open_pii_json([]byte(changes))
+	if err != nil {
+		return "", err
+	}
+
+	var list []FieldChange
+	err = json.Unmarshal(opened, &list)
+	if err != nil {
+		return "", err
+	}
+
+	for i, change := range list {
+		for _, value := range []*json.RawMessage{&list[i].Old, &list[i].New} {
+			if erased, ok := anonymized_fields[change.Field]; ok && s.placeholders {
+				*value, _ = json.Marshal(erased)
+				continue
+			}
+
+			var points any
+			if json.Unmarshal(*value, &points) == nil && s.points(change.Field, points) {
+				*value, _ = json.Marshal(points)
+				continue
+			}
+
+			var str string
+			if json.Unmarshal(*value, &str) != nil {
+				continue
+			}
+
+			scrubbed, ok := s.field(change.Field, str)
+			if ok {
+				*value, _ = json.Marshal(scrubbed)
+			}
+		}
+	}
+
+	scrubbed, err := json.Marshal(list)
+	return string(scrubbed), err
+}
+
+// run_scrub is the scrub subcommand, args are what follows it on the command line
+func run_scrub(args []string) error {
+	if len(args) != 2 {
+		return errors.New(scrub_usage)
+	}
+
+	source, target := args[0], args[1]
+	_, err := os.Stat(target)
+	if err == nil {
+		return errors.New(target + " already exists, scrub only writes new files")
+	}
+
+	scrubber, err := new_scrubber()
+	if err != nil {
+		return err
+	}
+
+	// encrypted customer fields are read with the server's key
+	pii_cipher, err = new_pii_cipher(env("PII_ENCRYPTION_KEY", ""), env("PII_ENCRYPTION_PREVIOUS_KEY", ""))
+	if err != nil {
+		return err
+	}
+
+	// an encrypted source is read with the server's passphrase, the copy is written in plain through the os vfs
+	driver, source_dsn, target_dsn := "sqlite", "file:"+source+"?mode=ro", target
+	passphrase := env("DATABASE_PASSPHRASE", "")
+	if passphrase != "" {
+		driver, source_dsn, target_dsn = "sqlite3", encrypted_dsn(source, passphrase)+"&mode=ro", "file:"+target+"?vfs=os"
+	}
+
+	source_db, err := sql.Open(driver, source_dsn)
+	if err != nil {
+		return err
+	}
+	defer source_db.Close()
+
+	// a consistent snapshot even while the source is being written to
+	_, err = source_db.Exec(`VACUUM INTO ?;`, target_dsn)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", target)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = migrate(db)
+	if err == nil {
+		err = scrub_database(db, scrubber)
+	}
+	if err != nil {
+		db.Close()
+		os.Remove(target)
+		return err
+	}
+
+	// rewrite the file so no page still holds the real values
+	_, err = db.Exec(`VACUUM;`)
+	return err
+}
+
+// #region Database
+
+func scrub_database(db *sql.DB, scrubber *Scrubber) error {
+	return with_tx(db, func(tx *sql.Tx) error {
+		// the fakes are not an edit, the versions clients hold stay valid and no history is recorded
+		return without_version_triggers(tx, func() error {
+			err := scrub_customers(tx, scrubber)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_events(tx, scrubber)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_versions(tx, scrubber)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT email FROM email_suppressions;`, `UPDATE email_suppressions SET email = ? WHERE email = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT resolved_by FROM review_flags WHERE resolved_by IS NOT NULL;`, `UPDATE review_flags SET resolved_by = ? WHERE resolved_by = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT actor FROM customer_status_transitions;`, `UPDATE customer_status_transitions SET actor = ? WHERE actor = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT source FROM customer_tags WHERE source NOT LIKE 'rule:%';`, `UPDATE customer_tags SET source = ? WHERE source = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT line1 FROM customer_addresses;`, `UPDATE customer_addresses SET line1 = ? WHERE line1 = ?;`, scrubber.Street)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`UPDATE customer_addresses SET line2 = '' WHERE line2 != '';`)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT postal_code FROM customer_addresses;`, `UPDATE customer_addresses SET postal_code = ? WHERE postal_code = ?;`, scrubber.Contact)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_contact_points(tx, "email", scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_contact_points(tx, "phone", scrubber.Contact)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT author FROM customer_notes;`, `UPDATE customer_notes SET author = ? WHERE author = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`UPDATE customer_notes SET body = 'Note scrubbed';`)
+			if err != nil {
+				return err
+			}
+
+			// file names such as passport-jane-doe.pdf identify the customer too
+			err = scrub_column(tx, `SELECT DISTINCT uploaded_by FROM customer_attachments;`, `UPDATE customer_attachments SET uploaded_by = ? WHERE uploaded_by = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`UPDATE customer_attachments SET filename = 'attachment-' || id;`)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT recorded_by FROM customer_consents;`, `UPDATE customer_consents SET recorded_by = ? WHERE recorded_by = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			err = scrub_column(tx, `SELECT DISTINCT requested_by FROM anonymization_requests;`, `UPDATE anonymization_requests SET requested_by = ? WHERE requested_by = ?;`, scrubber.Email)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`UPDATE customer_status_transitions SET reason = 'Reason scrubbed' WHERE reason != '';`)
+			if err != nil {
+				return err
+			}
+
+			// production credentials and receivers have no business in a copy
+			_, err = tx.Exec(`
+			DELETE FROM api_keys;
+			DELETE FROM webhooks;
+			DELETE FROM export_recipients;
+			DELETE FROM leader_leases;
+			DELETE FROM sink_offsets;
+			DELETE FROM audit_logs;
+			`)
+			return err
+		})
+	})
+}
+
+func scrub_customers(tx *sql.Tx, scrubber *Scrubber) error {
+	rows, err := tx.Query(`SELECT id, COALESCE(name, ''), COALESCE(dob, ''), COALESCE(email, ''), COALESCE(contact, ''), COALESCE(blocked_by, '') FROM customers;`)
+	if err != nil {
+		return err
+	}
+
+	type customer_pii struct {
+		id                                    int64
+		name, dob, email, contact, blocked_by string
+	}
+
+	var customers []customer_pii
+	for rows.Next() {
+		var c customer_pii
+		err = rows.Scan(&c.id, &c.name, &c.dob, &c.email, &c.contact, &c.blocked_by)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		customers = append(customers, c)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	// the copy is stored plainly so it can be used without the key, the blind indexes hold the fakes
+	update_record := `
+	UPDATE customers
+	SET name = ?, dob = ?, email = ?, contact = ?, email_index = ?, contact_index = ?,
+		blocked_by = NULLIF(?, ''), blocked_reason = CASE WHEN blocked_reason IS NOT NULL THEN 'Blocked (reason scrubbed)' END
+	WHERE id = ?;
+	`
+
+	for _, c := range customers {
+		for i, value := range []*string{&c.dob, &c.email, &c.contact} {
+			*value, err = decrypt_pii(pii_fields[i], *value)
+			if err != nil {
+				return err
+			}
+		}
+
+		email, contact := scrubber.Email(c.email), scrubber.Contact(c.contact)
+		_, err = tx.Exec(update_record, scrubber.Name(c.name), scrubber.DOB(c.dob), email, contact, email, contact, scrubber.Email(c.blocked_by), c.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scrub_events(tx *sql.Tx, scrubber *Scrubber) error {
+	rows, err := tx.Query(`SELECT id, payload, changes FROM customer_events;`)
+	if err != nil {
+		return err
+	}
+
+	type event_pii struct {
+		id      int64
+		payload string
+		changes *string
+	}
+
+	var events []event_pii
+	for rows.Next() {
+		var e event_pii
+		err = rows.Scan(&e.id, &e.payload, &e.changes)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, e := range events {
+		payload, err := scrubber.payload(e.payload)
+		if err != nil {
+			return errors.New("event " + strconv.FormatInt(e.id, 10) + ": " + err.Error())
+		}
+
+		var changes *string
+		if e.changes != nil {
+			scrubbed, err := scrubber.changes(*e.changes)
+			if err != nil {
+				return err
+			}
+			changes = &scrubbed
+		}
+
+		_, err = tx.Exec(`UPDATE customer_events SET payload = ?, changes = ? WHERE id = ?;`, payload, changes, e.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scrub_versions(tx *sql.Tx, scrubber *Scrubber) error {
+	rows, err := tx.Query(`SELECT id, snapshot FROM customer_versions;`)
+	if err != nil {
+		return err
+	}
+
+	type version_pii struct {
+		id       int64
+		snapshot string
+	}
+
+	var versions []version_pii
+	for rows.Next() {
+		var v version_pii
+		err = rows.Scan(&v.id, &v.snapshot)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, v := range versions {
+		snapshot, err := scrubber.payload(v.snapshot)
+		if err != nil {
+			return errors.New("customer version " + strconv.FormatInt(v.id, 10) + ": " + err.Error())
+		}
+
+		_, err = tx.Exec(`UPDATE customer_versions SET snapshot = ? WHERE id = ?;`, snapshot, v.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scrub_contact_points fakes the points of kind from their real values, stored plainly as the customers are
+func scrub_contact_points(tx *sql.Tx, kind string, fake func(string) string) error {
+	rows, err := tx.Query(`SELECT id, value FROM customer_contact_points WHERE kind = ?;`, kind)
+	if err != nil {
+		return err
+	}
+
+	type stored_point struct {
+		id    int64
+		value string
+	}
+
+	var points []stored_point
+	for rows.Next() {
+		var p stored_point
+		err = rows.Scan(&p.id, &p.value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		points = append(points, p)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, p := range points {
+		value, err := decrypt_pii(contact_point_kinds[kind], p.value)
+		if err != nil {
+			return err
+		}
+
+		faked := fake(value)
+		_, err = tx.Exec(`UPDATE customer_contact_points SET value = ?, value_index = ? WHERE id = ?;`, faked, faked, p.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scrub_column replaces every value select_values returns with its fake, update_record takes the fake then the real value
+func scrub_column(tx *sql.Tx, select_values string, update_record string, fake func(string) string) error {
+	rows, err := tx.Query(select_values)
+	if err != nil {
+		return err
+	}
+
+	var values []string
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		values = append(values, value)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, value := range values {
+		_, err = tx.Exec(update_record, fake(value), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// #endregion
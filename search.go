@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// default_search_threshold is the least score returned when ?threshold= is not given
+const default_search_threshold = 0.7
+
+// SearchResult is a customer with how well its name matched the query, 1 for a name containing it
+type SearchResult struct {
+	Customer
+	Score float64 `json:"score"`
+}
+
+type GetSearchResponse struct {
+	Records []SearchResult `json:"records"`
+	Pagination
+}
+
+// word_similarity scores one query word against one name word, spelled alike or sounding alike
+func word_similarity(a string, b string) float64 {
+	edit := 1 - float64(levenshtein(a, b))/float64(max(len([]rune(a)), len([]rune(b))))
+	if soundex(a) != "" && soundex(a) == soundex(b) {
+		return max(edit, 0.9)
+	}
+
+	return edit
+}
+
+// search_similarity scores a name for the query. A name containing the query scores 1, otherwise each
+// query word is matched to its closest word of the name, so "Jon Smyth" and "smyth" both find "John Smith"
+func search_similarity(query string, name string) float64 {
+	query_tokens, name_tokens := name_tokens(query), name_tokens(name)
+	if len(query_tokens) == 0 || len(name_tokens) == 0 {
+		return 0
+	}
+
+	if strings.Contains(strings.Join(name_tokens, " "), strings.Join(query_tokens, " ")) {
+		return 1
+	}
+
+	total := 0.0
+	for _, query_token := range query_tokens {
+		best := 0.0
+		for _, name_token := range name_tokens {
+			best = max(best, word_similarity(query_token, name_token))
+		}
+		total += best
+	}
+
+	return max(total/float64(len(query_tokens)), name_similarity(query, name))
+}
+
+func search_threshold(r *http.Request) (float64, error) {
+	threshold_str := r.URL.Query().Get("threshold")
+	if threshold_str == "" {
+		return default_search_threshold, nil
+	}
+
+	threshold, err := strconv.ParseFloat(threshold_str, 64)
+	if err != nil || threshold < 0 || threshold > 1 {
+		return 0, &ValidationError{Field: "threshold", Message: "must be a number from 0 to 1"}
+	}
+
+	return threshold, nil
+}
+
+func register_search_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// customers whose name is like ?q=, best match first. The listing defaults for archived, unverified and
+	// inactive customers apply
+	mux.HandleFunc("GET /api/customers/search", func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if len(name_tokens(query)) == 0 {
+			http.Error(w, (&ValidationError{Field: "q", Message: "must contain a letter"}).Error(), http.StatusBadRequest)
+			return
+		}
+
+		threshold, err := search_threshold(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, limit := page_params(config, r, 10)
+
+		matches, err := search_customers(db, listing_scope(config, r), query, threshold)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pagination := new_pagination(r, page, limit, len(matches))
+		matches = matches[min((page-1)*limit, len(matches)):min(page*limit, len(matches))]
+
+		results := []SearchResult{}
+		for _, match := range matches {
+			customer, err := get_customer(db, match.id)
+			if err != nil && err.Error() == "Customer not found" {
+				continue
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			present_customer(r, customer)
+			results = append(results, SearchResult{Customer: *customer, Score: match.score})
+		}
+
+		if wants_html(r) {
+			customers := make([]Customer, len(results))
+			for i, result := range results {
+				customers[i] = result.Customer
+			}
+			write_customer_list_html(w, r, config, query, customers, pagination)
+			return
+		}
+
+		response_str, err := json.Marshal(ApiResponse[GetSearchResponse]{
+			Data: GetSearchResponse{
+				Records:    results,
+				Pagination: pagination,
+			},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		set_link_header(w, pagination)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	})
+}
+
+// #region Database
+
+type search_match struct {
+	id    int64
+	score float64
+}
+
+// search_customers scores every name in scope, names are not indexed for similarity so this reads them all
+func search_customers(db *sql.DB, scope ListingScope, query string, threshold float64) ([]search_match, error) {
+	where, args := scope.where()
+	rows, err := db.Query(`SELECT id, name FROM customers `+where+`;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []search_match{}
+	for rows.Next() {
+		var id int64
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return nil, err
+		}
+
+		score := search_similarity(query, name)
+		if score >= threshold && score > 0 {
+			matches = append(matches, search_match{id, score})
+		}
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	return matches, nil
+}
+
+// #endregion
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Segment is a saved customer listing, the filter is the query string GET /api/customers takes
+type Segment struct {
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"`
+	Filter      string  `json:"filter"`       // e.g. status=active&tags=vip
+	Sort        string  `json:"sort"`         // one of listing_sorts, by id when empty
+	MemberCount *int    `json:"member_count"` // as of counted_at, null until first counted
+	CountedAt   *string `json:"counted_at"`
+	CreatedBy   string  `json:"created_by"`
+	CreatedAt   string  `json:"created_at"`
+	UpdatedAt   string  `json:"updated_at"`
+}
+
+type SegmentDetails struct {
+	Name   string `json:"name"`
+	Filter string `json:"filter"`
+	Sort   string `json:"sort"`
+}
+
+type SegmentListingResponse struct {
+	Records []Segment `json:"records"`
+	Pagination
+}
+
+// segment_filters are the GET /api/customers parameters a segment may save, besides metadata.<key>
+var segment_filters = map[string]bool{
+	"include_archived":   true,
+	"include_unverified": true,
+	"include_inactive":   true,
+	"dob_from":           true,
+	"dob_to":             true,
+	"min_age":            true,
+	"max_age":            true,
+	"status":             true,
+	"tags":               true,
+	"tag_match":          true,
+	"consent":            true,
+	"email":              true,
+	"contact":            true,
+	"filter":             true,
+}
+
+// segment_request is r asking for the segment's filter and sort in place of its own query
+func segment_request(r *http.Request, filter string, sort string) *http.Request {
+	query, _ := url.ParseQuery(filter)
+	if sort != "" {
+		query.Set("sort", sort)
+	}
+
+	segment_r := r.Clone(r.Context())
+	segment_r.URL.RawQuery = query.Encode()
+	return segment_r
+}
+
+// segment_scope is the listing scope the segment stands for
+func segment_scope(config Config, r *http.Request, segment *Segment) (ListingScope, error) {
+	return filtered_listing_scope(config, segment_request(r, segment.Filter, segment.Sort))
+}
+
+func validate_segment(config Config, r *http.Request, input *SegmentDetails) error {
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		return &ValidationError{Field: "name", Message: "is required"}
+	}
+
+	input.Filter = strings.TrimPrefix(strings.TrimSpace(input.Filter), "?")
+	query, err := url.ParseQuery(input.Filter)
+	if err != nil {
+		return &ValidationError{Field: "filter", Message: "must be a query string like status=active&tags=vip"}
+	}
+
+	for key := range query {
+		if !segment_filters[key] && !strings.HasPrefix(key, "metadata.") {
+			return &ValidationError{Field: "filter", Message: key + " is not a customer filter"}
+		}
+	}
+	input.Filter = query.Encode()
+
+	input.Sort = strings.TrimSpace(input.Sort)
+	if _, ok := listing_sorts[input.Sort]; input.Sort != "" && !ok {
+		return &ValidationError{Field: "sort", Message: "must be id, name, created_at or updated_at, with - for descending"}
+	}
+
+	// the filters are checked the way the listing checks them
+	_, err = filtered_listing_scope(config, segment_request(r, input.Filter, input.Sort))
+	if err != nil {
+		return &ValidationError{Field: "filter", Message: err.Error()}
+	}
+
+	return nil
+}
+
+// path_segment_id reads the {id} of /segments/{id}
+func path_segment_id(r *http.Request) (int64, error) {
+	return strconv.ParseInt(r.PathValue("id"), 10, 64)
+}
+
+func register_segment_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// segments by name
+	mux.HandleFunc("GET /api/segments", func(w http.ResponseWriter, r *http.Request) {
+		page, limit := page_params(config, r, 20)
+
+		records, total_records, err := get_segments(db, tenant_from(r), (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[SegmentListingResponse]{
+			Data: SegmentListingResponse{
+				Records:    records,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+
+	mux.HandleFunc("POST /api/segments", func(w http.ResponseWriter, r *http.Request) {
+		var req SegmentDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_segment(config, r, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		segment, err := create_segment(db, tenant_from(r), actor_from(r), req)
+		if err != nil && err.Error() == "Segment already exists" {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[Segment]{Data: *segment})
+	})
+
+	mux.HandleFunc("GET /api/segments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_segment_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		segment, err := get_segment(db, id)
+		if err != nil && err.Error() == "Segment not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Segment]{Data: *segment})
+	})
+
+	mux.HandleFunc("DELETE /api/segments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_segment_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_segment(db, id)
+		if err != nil && err.Error() == "Segment not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// the customers in the segment as they are now, in its order. Listing them also refreshes the count
+	mux.HandleFunc("GET /api/segments/{id}/customers", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_segment_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		segment, err := get_segment(db, id)
+		if err != nil && err.Error() == "Segment not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		page, limit := page_params(config, r, 10)
+
+		scope, err := segment_scope(config, r, segment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result, err := get_customers(db, scope, (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		total_records, err := get_total_customers(db, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = set_segment_count(db, id, total_records)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range result {
+			present_customer(r, &result[i])
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, ApiResponse[GetListingResponse]{
+			Data: GetListingResponse{
+				Records:    result,
+				Pagination: pagination,
+			},
+		})
+	})
+
+	// recount the segment's members now, counts are otherwise only as fresh as the last listing
+	mux.HandleFunc("POST /api/segments/{id}/count", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_segment_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		segment, err := get_segment(db, id)
+		if err != nil && err.Error() == "Segment not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		scope, err := segment_scope(config, r, segment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		count, err := get_total_customers(db, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		segment, err = set_segment_count(db, id, count)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Segment]{Data: *segment})
+	})
+}
+
+// #region Database
+const segment_columns = `id, name, filter, sort, member_count, strftime('%Y-%m-%dT%H:%M:%SZ', counted_at), created_by,
+	strftime('%Y-%m-%dT%H:%M:%SZ', created_at), strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)`
+
+func scan_segment(row row_scanner) (Segment, error) {
+	var segment Segment
+	err := row.Scan(&segment.ID, &segment.Name, &segment.Filter, &segment.Sort, &segment.MemberCount, &segment.CountedAt, &segment.CreatedBy, &segment.CreatedAt, &segment.UpdatedAt)
+	return segment, err
+}
+
+func get_segment(db db_handle, id int64) (*Segment, error) {
+	segment, err := scan_segment(db.QueryRow(`SELECT `+segment_columns+` FROM segments WHERE id = ?;`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Segment not found")
+		}
+		return nil, err
+	}
+
+	return &segment, nil
+}
+
+func get_segments(db *sql.DB, tenant_id string, offset int, limit int) ([]Segment, int, error) {
+	get_records := `
+	SELECT ` + segment_columns + `
+	FROM segments
+	WHERE tenant_id = ?
+	ORDER BY name, id
+	LIMIT ? OFFSET ?;
+	`
+
+	rows, err := db.Query(get_records, tenant_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	segments := []Segment{}
+	for rows.Next() {
+		segment, err := scan_segment(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		segments = append(segments, segment)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, rows.Err()
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM segments WHERE tenant_id = ?;`, tenant_id).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return segments, count, nil
+}
+
+func create_segment(db *sql.DB, tenant_id string, actor string, input SegmentDetails) (*Segment, error) {
+	create_record := `
+	INSERT INTO segments (tenant_id, name, filter, sort, created_by)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (tenant_id, name) DO NOTHING;
+	`
+
+	var segment *Segment
+	err := with_tx(db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(create_record, tenant_id, input.Name, input.Filter, input.Sort, actor)
+		if err != nil {
+			return err
+		}
+
+		created, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if created == 0 {
+			return errors.New("Segment already exists")
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		segment, err = get_segment(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return segment, nil
+}
+
+func set_segment_count(db *sql.DB, id int64, count int) (*Segment, error) {
+	var segment *Segment
+	err := with_tx(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE segments SET member_count = ?, counted_at = CURRENT_TIMESTAMP WHERE id = ?;`, count, id)
+		if err != nil {
+			return err
+		}
+
+		segment, err = get_segment(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return segment, nil
+}
+
+func delete_segment(db *sql.DB, id int64) error {
+	result, err := exec_with_retry(db, `DELETE FROM segments WHERE id = ?;`, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return errors.New("Segment not found")
+	}
+
+	return nil
+}
+
+// #endregion
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// customer_field_columns is the sql behind each plainly stored field, ?fields= only selects these columns.
+// block, age and localized are derived from other columns, asking for them reads the whole row
+var customer_field_columns = map[string]string{
+	"name":                    `name`,
+	"dob":                     `dob`,
+	"email":                   `email`,
+	"contact":                 `contact`,
+	"country":                 `COALESCE(country, '')`,
+	"external_id":             `COALESCE(external_id, '')`,
+	"created_at":              `created_at`,
+	"updated_at":              `updated_at`,
+	"referral_code":           `COALESCE(referral_code, '')`,
+	"referred_by_customer_id": `referred_by_customer_id`,
+	"company_id":              `company_id`,
+	"blocked":                 `blocked_at IS NOT NULL`,
+	"status":                  `status`,
+	"archived_at":             `strftime('%Y-%m-%dT%H:%M:%SZ', archived_at)`,
+	"email_verified_at":       `strftime('%Y-%m-%dT%H:%M:%SZ', email_verified_at)`,
+	"avatar_updated_at":       `strftime('%Y-%m-%dT%H:%M:%SZ', avatar_updated_at)`,
+	"verified":                `email_verified_at IS NOT NULL`,
+	"version":                 `version`,
+}
+
+// requested_fields parses ?fields=id,name,email, nil when the caller wants everything. id is always included
+func requested_fields(r *http.Request) (map[string]bool, error) {
+	param := r.URL.Query().Get("fields")
+	if param == "" {
+		return nil, nil
+	}
+
+	fields := map[string]bool{"id": true}
+	for _, field := range split_list(param) {
+		_, ok := customer_fields[field]
+		if !ok && field != "id" {
+			return nil, &ValidationError{Field: "fields", Message: "unknown field " + field}
+		}
+		fields[field] = true
+	}
+
+	return fields, nil
+}
+
+// sparse_customer keeps only the requested fields of a customer's json, and its links
+func sparse_customer(customer Customer, fields map[string]bool) (map[string]json.RawMessage, error) {
+	customer_str, err := json.Marshal(customer)
+	if err != nil {
+		return nil, err
+	}
+
+	var sparse map[string]json.RawMessage
+	err = json.Unmarshal(customer_str, &sparse)
+	if err != nil {
+		return nil, err
+	}
+
+	for field := range sparse {
+		if !fields[field] && field != "links" {
+			delete(sparse, field)
+		}
+	}
+
+	return sparse, nil
+}
+
+// SparseListingResponse is GetListingResponse for ?fields=, each record carries only the requested fields
+type SparseListingResponse struct {
+	Records []map[string]json.RawMessage `json:"records"`
+	Pagination
+}
+
+func sparse_listing_response(customers []Customer, fields map[string]bool, pagination Pagination) ([]byte, error) {
+	records := make([]map[string]json.RawMessage, len(customers))
+	for i, customer := range customers {
+		sparse, err := sparse_customer(customer, fields)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = sparse
+	}
+
+	return json.Marshal(ApiResponse[SparseListingResponse]{
+		Data: SparseListingResponse{
+			Records:    records,
+			Pagination: pagination,
+		},
+	})
+}
+
+// sparse_columns is the select list for fields, false when one of them needs the whole row
+func sparse_columns(fields map[string]bool) ([]string, bool) {
+	names := []string{"id"}
+	for field := range fields {
+		if field == "id" {
+			continue
+		}
+
+		_, ok := customer_field_columns[field]
+		if !ok {
+			return nil, false
+		}
+		names = append(names, field)
+	}
+
+	return names, true
+}
+
+// #region Database
+
+// get_sparse_customers reads only the columns behind fields, falling back to the whole row when needed
+func get_sparse_customers(db *sql.DB, scope ListingScope, fields map[string]bool, offset int, limit int) ([]Customer, error) {
+	names, ok := sparse_columns(fields)
+	if !ok {
+		return get_customers(db, scope, offset, limit)
+	}
+
+	columns := make([]string, len(names))
+	for i, name := range names {
+		columns[i] = "id"
+		if name != "id" {
+			columns[i] = customer_field_columns[name]
+		}
+	}
+
+	where, args := scope.where()
+	get_records := `
+	SELECT ` + strings.Join(columns, ", ") + `
+	FROM customers
+	` + where + `
+	ORDER BY ` + scope.order_by() + `
+	LIMIT ? OFFSET ?;
+	`
+
+	rows, err := query_rows(db, get_records, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	customers := []Customer{}
+	for rows.Next() {
+		var customer Customer
+		value := reflect.ValueOf(&customer).Elem()
+
+		dest := make([]any, len(names))
+		for i, name := range names {
+			if name == "id" {
+				dest[i] = &customer.ID
+				continue
+			}
+			dest[i] = value.Field(customer_fields[name]).Addr().Interface()
+		}
+
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+
+		err = decrypt_customer_pii(&customer)
+		if err != nil {
+			return nil, err
+		}
+
+		customers = append(customers, customer)
+	}
+
+	if rows.Err() != nil {
+		return nil, errors.New("reading customers: " + rows.Err().Error())
+	}
+
+	return customers, nil
+}
+
+// #endregion
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	wasm_sqlite "github.com/ncruces/go-sqlite3"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// tx_busy_retries is how many times a transaction or statement is retried after SQLITE_BUSY before giving up
+const tx_busy_retries = 3
+
+// busy_backoff is the wait before the first retry, it doubles for each one after
+const busy_backoff = 50 * time.Millisecond
+
+// sqlite_synchronous_modes are the values SQLITE_SYNCHRONOUS takes
+var sqlite_synchronous_modes = map[string]bool{"OFF": true, "NORMAL": true, "FULL": true, "EXTRA": true}
+
+// open_database opens sqlite in wal mode, transactions take the write lock up front so the
+// time spent in Begin is the lock wait. With DATABASE_PASSPHRASE the file is encrypted, a plaintext one is
+// converted first
+func open_database(path string, config Config) (*sql.DB, error) {
+	if !sqlite_synchronous_modes[config.SqliteSynchronous] {
+		return nil, errors.New("SQLITE_SYNCHRONOUS must be OFF, NORMAL, FULL or EXTRA")
+	}
+
+	err := prepare_database_file(path, config.DatabasePassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	// the pragmas are in the dsn so every connection of the pool gets them, not only the first
+	options := "_pragma=journal_mode(WAL)" +
+		"&_pragma=busy_timeout(" + strconv.FormatInt(config.SqliteBusyTimeout.Milliseconds(), 10) + ")" +
+		"&_pragma=synchronous(" + config.SqliteSynchronous + ")" +
+		"&_pragma=cache_size(" + strconv.Itoa(config.SqliteCacheSize) + ")" +
+		"&_txlock=immediate"
+	// the replicator checkpoints once it has shipped the frames, sqlite checkpointing on its own could lose some
+	if config.ReplicaStore != "" {
+		options += "&_pragma=wal_autocheckpoint(0)"
+	}
+	if config.DatabasePassphrase != "" {
+		db, err := sql.Open("sqlite3", encrypted_dsn(path, config.DatabasePassphrase)+"&"+options)
+		if err == nil {
+			configure_pool(db, config)
+			err = db.Ping()
+		}
+		if errors.Is(err, wasm_sqlite.NOTADB) {
+			err = errors.New(path + " does not open with DATABASE_PASSPHRASE")
+		}
+		return db, err
+	}
+
+	db, err := sql.Open("sqlite", path+"?"+options)
+	if err != nil {
+		return nil, err
+	}
+
+	configure_pool(db, config)
+	return db, nil
+}
+
+// configure_pool sizes the connection pool, zero leaves a setting at the database/sql default
+func configure_pool(db *sql.DB, config Config) {
+	if config.DatabaseMaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.DatabaseMaxOpenConns)
+	}
+	if config.DatabaseMaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.DatabaseMaxIdleConns)
+	}
+	if config.DatabaseConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(config.DatabaseConnMaxLifetime)
+	}
+}
+
+// is_transient is true for SQLITE_BUSY and SQLITE_LOCKED, the lock was held elsewhere and the same
+// statement or transaction can succeed when run again
+func is_transient(err error) bool {
+	var sqlite_error *sqlite.Error
+	if errors.As(err, &sqlite_error) {
+		code := sqlite_error.Code() & 0xff
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	}
+
+	// encrypted databases go through the wasm driver
+	return errors.Is(err, wasm_sqlite.BUSY) || errors.Is(err, wasm_sqlite.LOCKED)
+}
+
+// is_constraint tells a write a unique or check constraint refused from the database failing
+func is_constraint(err error) bool {
+	var sqlite_error *sqlite.Error
+	if errors.As(err, &sqlite_error) {
+		return sqlite_error.Code()&0xff == sqlite3.SQLITE_CONSTRAINT
+	}
+
+	return errors.Is(err, wasm_sqlite.CONSTRAINT)
+}
+
+// retry_busy runs fn again while it fails with SQLITE_BUSY or SQLITE_LOCKED, which outlasting busy_timeout
+// can still give when a checkpoint or another process holds the lock
+func retry_busy(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !is_transient(err) {
+			return err
+		}
+
+		if attempt == tx_busy_retries {
+			storage_metrics.busy_failures.Add(1)
+			return err
+		}
+
+		storage_metrics.busy_retries.Add(1)
+		time.Sleep(busy_backoff << attempt)
+	}
+}
+
+// exec_with_retry is db.Exec for single statement writes, more than one goes through with_tx. A statement that
+// failed with SQLITE_BUSY changed nothing, so running it again is safe
+func exec_with_retry(db *sql.DB, query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := retry_busy(func() error {
+		var err error
+		result, err = db.Exec(query, args...)
+		return err
+	})
+
+	return result, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkCustomerStatements runs the hot customer reads on a database of 1000 customers with and without the
+// statement cache, on the default driver and on an encrypted database:
+//
+//	go test -run '^$' -bench CustomerStatements
+func BenchmarkCustomerStatements(b *testing.B) {
+	for _, driver := range []string{"modernc", "passphrase"} {
+		for _, cached := range []bool{false, true} {
+			config := load_config()
+			if driver == "passphrase" {
+				config.DatabasePassphrase = "benchmark passphrase"
+			}
+			db := benchmark_database(b, config)
+			scope := ListingScope{TenantID: default_tenant}
+
+			name := driver + "/uncached"
+			statements = nil
+			if cached {
+				name = driver + "/cached"
+				statements = new_statement_cache(config)
+				err := statements.Warm(db)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.Run(name+"/get", func(b *testing.B) {
+				for i := range b.N {
+					_, err := get_customer(db, int64(i%1000+1))
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(name+"/list", func(b *testing.B) {
+				for i := range b.N {
+					_, err := get_customers(db, scope, i%50*20, 20)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(name+"/count", func(b *testing.B) {
+				for range b.N {
+					_, err := get_total_customers(db, scope)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			statements.Close(db)
+			statements = nil
+			db.Close()
+		}
+	}
+}
+
+func benchmark_database(b *testing.B, config Config) *sql.DB {
+	db, err := open_database(filepath.Join(b.TempDir(), "benchmark.db"), config)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = migrate(db)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = with_tx(db, func(tx *sql.Tx) error {
+		for i := range 1000 {
+			n := strconv.Itoa(i)
+			_, _, err := insert_customer(tx, db, default_tenant, CustomerDetails{Name: "Customer " + n, Email: "customer" + n + "@example.com", Status: "active"})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return db
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// the signup periods customer stats cover, ending with the current one
+const (
+	stats_signup_days   = 30
+	stats_signup_weeks  = 12
+	stats_signup_months = 12
+)
+
+// stats_top_domains caps the email domains listed
+const stats_top_domains = 20
+
+// StatsOverview is what the dashboard shows, read from customer_counts which triggers keep up to date
+// in the same transaction as every customer and tag write
+type StatsOverview struct {
+	Total     int            `json:"total"`
+	ByStatus  map[string]int `json:"by_status"`
+	ByTag     map[string]int `json:"by_tag"`
+	ByCountry map[string]int `json:"by_country"` // customers without a country are counted under "unknown"
+}
+
+// CustomerStats is aggregated over the customers the listing filters select, so ?status=active or
+// ?filter= narrow it like they narrow GET /api/customers
+type CustomerStats struct {
+	Total         int           `json:"total"`
+	Signups       SignupStats   `json:"signups"`
+	ByEmailDomain []StatsBucket `json:"by_email_domain"` // most common first, customers without an email are left out. Null while PII_ENCRYPTION_KEY is set
+	AgeBuckets    []StatsBucket `json:"age_buckets"`     // null while PII_ENCRYPTION_KEY is set, dates of birth only compare once decrypted
+}
+
+// SignupStats counts customers created per period, periods without signups are left out. Weeks start on monday
+type SignupStats struct {
+	Daily   []StatsBucket `json:"daily"`   // YYYY-MM-DD
+	Weekly  []StatsBucket `json:"weekly"`  // the monday, YYYY-MM-DD
+	Monthly []StatsBucket `json:"monthly"` // YYYY-MM
+}
+
+type StatsBucket struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+func customer_stats(db *sql.DB, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope, err := filtered_listing_scope(config, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stats, err := get_customer_stats(db, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response_str, err := json.Marshal(ApiResponse[CustomerStats]{Data: *stats})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	}
+}
+
+func stats_overview(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		overview, err := get_stats_overview(db, tenant_from(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response_str, err := json.Marshal(ApiResponse[StatsOverview]{Data: *overview})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	}
+}
+
+// #region Database
+func get_stats_overview(db *sql.DB, tenant_id string) (*StatsOverview, error) {
+	rows, err := db.Query(`SELECT dimension, value, count FROM customer_counts WHERE tenant_id = ? AND count > 0;`, tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	overview := StatsOverview{ByStatus: map[string]int{}, ByTag: map[string]int{}, ByCountry: map[string]int{}}
+	for rows.Next() {
+		var dimension, value string
+		var count int
+		err = rows.Scan(&dimension, &value, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		switch dimension {
+		case "total":
+			overview.Total = count
+		case "status":
+			overview.ByStatus[value] = count
+		case "tag":
+			overview.ByTag[value] = count
+		case "country":
+			if value == "" {
+				value = "unknown"
+			}
+			overview.ByCountry[value] = count
+		}
+	}
+
+	return &overview, rows.Err()
+}
+
+// customer_age_sql is the age in whole years of a customer with a YYYY-MM-DD dob
+const customer_age_sql = `(CAST(strftime('%Y', 'now') AS INTEGER) - CAST(strftime('%Y', dob) AS INTEGER) - (strftime('%m-%d', 'now') < strftime('%m-%d', dob)))`
+
+// get_customer_stats runs one grouped query per figure, none of them reads customers into memory
+func get_customer_stats(db *sql.DB, scope ListingScope) (*CustomerStats, error) {
+	where, args := scope.where()
+	scoped := `SELECT id FROM customers ` + where
+
+	stats := CustomerStats{}
+	err := db.QueryRow(`SELECT COUNT(*) FROM customers `+where+`;`, args...).Scan(&stats.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	signups := []struct {
+		buckets *[]StatsBucket
+		period  string
+		since   string
+	}{
+		{&stats.Signups.Daily, `date(created_at)`, `date('now', '-` + strconv.Itoa(stats_signup_days-1) + ` days')`},
+		{&stats.Signups.Weekly, `date(created_at, '-6 days', 'weekday 1')`, `date('now', '-6 days', 'weekday 1', '-` + strconv.Itoa(7*(stats_signup_weeks-1)) + ` days')`},
+		{&stats.Signups.Monthly, `strftime('%Y-%m', created_at)`, `strftime('%Y-%m', 'now', 'start of month', '-` + strconv.Itoa(stats_signup_months-1) + ` months')`},
+	}
+	for _, signup := range signups {
+		get_counts := `
+		SELECT ` + signup.period + ` AS period, COUNT(*)
+		FROM customers
+		WHERE id IN (` + scoped + `)
+		GROUP BY period
+		HAVING period >= ` + signup.since + `
+		ORDER BY period;
+		`
+
+		*signup.buckets, err = get_stats_buckets(db, get_counts, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// emails are sealed with a key like dates of birth, so neither is grouped in sql then
+	if pii_cipher == nil {
+		get_domains := `
+		SELECT lower(substr(email, instr(email, '@') + 1)) AS domain, COUNT(*) AS count
+		FROM customers
+		WHERE COALESCE(email, '') != '' AND id IN (` + scoped + `)
+		GROUP BY domain
+		ORDER BY count DESC, domain
+		LIMIT ?;
+		`
+
+		stats.ByEmailDomain, err = get_stats_buckets(db, get_domains, append(args, stats_top_domains)...)
+		if err != nil {
+			return nil, err
+		}
+
+		get_ages := `
+		SELECT CASE
+			WHEN COALESCE(dob, '') = '' THEN 'unknown'
+			WHEN ` + customer_age_sql + ` < 18 THEN 'under 18'
+			WHEN ` + customer_age_sql + ` < 25 THEN '18-24'
+			WHEN ` + customer_age_sql + ` < 35 THEN '25-34'
+			WHEN ` + customer_age_sql + ` < 45 THEN '35-44'
+			WHEN ` + customer_age_sql + ` < 55 THEN '45-54'
+			WHEN ` + customer_age_sql + ` < 65 THEN '55-64'
+			ELSE '65 and over' END AS bucket, COUNT(*)
+		FROM customers
+		` + where + `
+		GROUP BY bucket
+		ORDER BY MIN(COALESCE(NULLIF(dob, ''), '0000')) DESC;
+		`
+
+		stats.AgeBuckets, err = get_stats_buckets(db, get_ages, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &stats, nil
+}
+
+func get_stats_buckets(db *sql.DB, query string, args ...any) ([]StatsBucket, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	buckets := []StatsBucket{}
+	for rows.Next() {
+		var bucket StatsBucket
+		err = rows.Scan(&bucket.Key, &bucket.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// #endregion
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const EventCustomerStatusChanged = "customer.status_changed"
+
+// status_transitions is the customer lifecycle, the statuses each status may move to. Blocking is open
+// from any status, a blocked customer can only be reactivated
+var status_transitions = map[string]map[string]bool{
+	"active":   {"inactive": true, "blocked": true},
+	"inactive": {"active": true, "blocked": true},
+	"blocked":  {"active": true},
+}
+
+// StatusTransition is one recorded move through the lifecycle
+type StatusTransition struct {
+	ID         int64  `json:"id"`
+	CustomerID int64  `json:"customer_id"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Reason     string `json:"reason"`
+	Actor      string `json:"actor"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type StatusTransitionDetails struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"` // required for blocked
+}
+
+// TransitionError is a move the lifecycle doesn't allow from the customer's current status, answered with 409
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	if e.From == e.To {
+		return "Customer is already " + e.To
+	}
+
+	return "Cannot change status from " + e.From + " to " + e.To
+}
+
+// listing_statuses reads ?status=active,inactive, nil when the listing isn't narrowed by status
+func listing_statuses(r *http.Request) ([]string, error) {
+	statuses := split_list(r.URL.Query().Get("status"))
+	for _, status := range statuses {
+		if !customer_statuses[status] {
+			return nil, &ValidationError{Field: "status", Message: "unknown status " + status}
+		}
+	}
+
+	return statuses, nil
+}
+
+func register_status_routes(mux *http.ServeMux, db *sql.DB) {
+	// move the customer to another status, blocking needs a reason
+	mux.HandleFunc("POST /api/customers/{id}/status", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		var req StatusTransitionDetails
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req.Reason = strings.TrimSpace(req.Reason)
+		if !customer_statuses[req.Status] {
+			http.Error(w, "Status must be active, inactive or blocked", http.StatusBadRequest)
+			return
+		}
+
+		if req.Status == "blocked" && req.Reason == "" {
+			http.Error(w, "Reason is required", http.StatusBadRequest)
+			return
+		}
+
+		customer, err := transition_customer_status(db, id, req.Status, req.Reason, actor_from(r))
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		var transition_error *TransitionError
+		if errors.As(err, &transition_error) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		present_customer(r, customer)
+		response_str, err := json.Marshal(ApiResponse[Customer]{Data: *customer})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	})
+
+	// the customer's status history, oldest first
+	mux.HandleFunc("GET /api/customers/{id}/status/transitions", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		transitions, err := get_status_transitions(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response_str, err := json.Marshal(ApiResponse[[]StatusTransition]{Data: transitions})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response_str)
+	})
+}
+
+// #region Database
+
+// transition_customer_status moves the customer to status if the lifecycle allows it, blocking records
+// reason and actor as the block and leaving blocked clears it
+func transition_customer_status(db *sql.DB, id int64, status string, reason string, actor string) (*Customer, error) {
+	update_record := `
+	UPDATE customers
+	SET status = ?,
+		blocked_at = CASE WHEN ? = 'blocked' THEN CURRENT_TIMESTAMP END,
+		blocked_reason = CASE WHEN ? = 'blocked' THEN ? END,
+		blocked_by = CASE WHEN ? = 'blocked' THEN ? END,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?;
+	`
+
+	var customer *Customer
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		before, err := get_customer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !status_transitions[before.Status][status] {
+			return &TransitionError{From: before.Status, To: status}
+		}
+
+		_, err = tx.Exec(update_record, status, status, status, reason, status, actor, id)
+		if err != nil {
+			return err
+		}
+
+		err = record_status_transition(tx, id, before.Status, status, reason, actor)
+		if err != nil {
+			return err
+		}
+
+		customer, err = get_customer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		changes, err := customer_changes(before, customer)
+		if err != nil {
+			return err
+		}
+
+		event_type := EventCustomerStatusChanged
+		if status == "blocked" {
+			event_type = EventCustomerBlocked
+		} else if before.Status == "blocked" {
+			event_type = EventCustomerUnblocked
+		}
+
+		event, err = record_change_event(tx, event_type, id, customer, changes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	event_broker.Publish(*event)
+
+	return customer, nil
+}
+
+func record_status_transition(tx *sql.Tx, id int64, from string, to string, reason string, actor string) error {
+	create_record := `
+	INSERT INTO customer_status_transitions (customer_id, from_status, to_status, reason, actor)
+	VALUES (?, ?, ?, ?, ?);
+	`
+
+	_, err := tx.Exec(create_record, id, from, to, reason, actor)
+	return err
+}
+
+func get_status_transitions(db *sql.DB, id int64) ([]StatusTransition, error) {
+	get_records := `
+	SELECT id, customer_id, from_status, to_status, reason, actor, strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+	FROM customer_status_transitions
+	WHERE customer_id = ?
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	transitions := []StatusTransition{}
+	for rows.Next() {
+		var transition StatusTransition
+		err = rows.Scan(&transition.ID, &transition.CustomerID, &transition.From, &transition.To, &transition.Reason, &transition.Actor, &transition.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, transition)
+	}
+
+	return transitions, rows.Err()
+}
+
+// #endregion
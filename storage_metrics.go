@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lock_wait_bounds are the histogram bucket upper bounds in seconds
+var lock_wait_bounds = [...]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// CheckpointStats is the result of the last wal checkpoint
+type CheckpointStats struct {
+	Busy         bool  // a reader or writer prevented a full checkpoint
+	LogFrames    int64 // frames in the wal
+	Checkpointed int64 // frames moved back into the database
+}
+
+// StorageMetrics counts sqlite write contention, exposed at /metrics in the prometheus text format
+type StorageMetrics struct {
+	busy_retries  atomic.Int64
+	busy_failures atomic.Int64 // transactions that still hit SQLITE_BUSY after the last retry
+
+	lock_wait_buckets [len(lock_wait_bounds) + 1]atomic.Int64
+	lock_wait_count   atomic.Int64
+	lock_wait_nanos   atomic.Int64
+
+	checkpoints       atomic.Int64
+	checkpoint_errors atomic.Int64
+
+	pings           atomic.Int64
+	ping_failures   atomic.Int64
+	ping_up         atomic.Bool
+	ping_latency_ns atomic.Int64 // of the last ping
+
+	mu              sync.Mutex
+	last_checkpoint CheckpointStats
+}
+
+var storage_metrics = &StorageMetrics{}
+
+func (m *StorageMetrics) observe_lock_wait(wait time.Duration) {
+	bucket := len(lock_wait_bounds)
+	for i, bound := range lock_wait_bounds {
+		if wait.Seconds() <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	m.lock_wait_buckets[bucket].Add(1)
+	m.lock_wait_count.Add(1)
+	m.lock_wait_nanos.Add(int64(wait))
+}
+
+// checkpoint runs a passive wal checkpoint, which never blocks writers, and records its stats
+func (m *StorageMetrics) checkpoint(db *sql.DB) error {
+	var stats CheckpointStats
+	err := db.QueryRow(`PRAGMA wal_checkpoint(PASSIVE);`).Scan(&stats.Busy, &stats.LogFrames, &stats.Checkpointed)
+	if err != nil {
+		m.checkpoint_errors.Add(1)
+		return err
+	}
+
+	m.checkpoints.Add(1)
+	m.mu.Lock()
+	m.last_checkpoint = stats
+	m.mu.Unlock()
+
+	return nil
+}
+
+func run_checkpoints(ctx context.Context, db *sql.DB, config Config) {
+	ticker := time.NewTicker(config.SqliteCheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := storage_metrics.checkpoint(db)
+		if err != nil {
+			println("wal checkpoint failed:", err.Error())
+		}
+	}
+}
+
+// ping records whether the database answers and how quickly, a failure is also logged
+func (m *StorageMetrics) ping(ctx context.Context, db *sql.DB) {
+	ctx, cancel := context.WithTimeout(ctx, health_check_timeout)
+	defer cancel()
+
+	start := time.Now()
+	var one int
+	err := db.QueryRowContext(ctx, `SELECT 1;`).Scan(&one)
+
+	m.pings.Add(1)
+	m.ping_latency_ns.Store(int64(time.Since(start)))
+	m.ping_up.Store(err == nil)
+	if err != nil && ctx.Err() != context.Canceled {
+		m.ping_failures.Add(1)
+		println("database ping failed:", err.Error())
+	}
+}
+
+// run_database_pings checks the database every DATABASE_PING_INTERVAL, so /metrics shows it going away
+// between requests
+func run_database_pings(ctx context.Context, db *sql.DB, config Config) {
+	if config.DatabasePingInterval <= 0 {
+		return
+	}
+
+	storage_metrics.ping(ctx, db)
+
+	ticker := time.NewTicker(config.DatabasePingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		storage_metrics.ping(ctx, db)
+	}
+}
+
+func register_metrics_routes(mux *http.ServeMux, db *sql.DB) {
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		storage_metrics.write(w)
+		request_metrics.write(w)
+		write_pool_metrics(w, db.Stats())
+		customer_cache.write_metrics(w, "customer_cache", "customers by id")
+		count_cache.write_metrics(w, "count_cache", "listing totals")
+	})
+}
+
+// write_pool_metrics reports the connection pool of the main database, tenant databases have pools of their own
+func write_pool_metrics(w http.ResponseWriter, stats sql.DBStats) {
+	write_metric(w, "sql_max_open_connections", "gauge", "Most connections the pool opens, 0 for no limit.", int64(stats.MaxOpenConnections))
+	write_metric(w, "sql_open_connections", "gauge", "Connections open, in use or idle.", int64(stats.OpenConnections))
+	write_metric(w, "sql_in_use_connections", "gauge", "Connections running a query or transaction.", int64(stats.InUse))
+	write_metric(w, "sql_idle_connections", "gauge", "Connections waiting in the pool.", int64(stats.Idle))
+	write_metric(w, "sql_wait_count_total", "counter", "Queries that waited for a connection.", stats.WaitCount)
+	fmt.Fprintf(w, "# HELP sql_wait_seconds_total Time spent waiting for a connection.\n# TYPE sql_wait_seconds_total counter\nsql_wait_seconds_total %g\n", stats.WaitDuration.Seconds())
+	write_metric(w, "sql_max_idle_closed_total", "counter", "Connections closed because the pool had DATABASE_MAX_IDLE_CONNS idle.", stats.MaxIdleClosed)
+	write_metric(w, "sql_max_lifetime_closed_total", "counter", "Connections closed after DATABASE_CONN_MAX_LIFETIME.", stats.MaxLifetimeClosed)
+}
+
+func (m *StorageMetrics) write(w http.ResponseWriter) {
+	write_metric(w, "sqlite_busy_retries_total", "counter", "Transactions retried after SQLITE_BUSY.", m.busy_retries.Load())
+	write_metric(w, "sqlite_busy_failures_total", "counter", "Transactions that failed with SQLITE_BUSY after all retries.", m.busy_failures.Load())
+
+	fmt.Fprintf(w, "# HELP sqlite_lock_wait_seconds Time spent waiting for the write lock.\n# TYPE sqlite_lock_wait_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range lock_wait_bounds {
+		cumulative += m.lock_wait_buckets[i].Load()
+		fmt.Fprintf(w, "sqlite_lock_wait_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "sqlite_lock_wait_seconds_bucket{le=\"+Inf\"} %d\n", m.lock_wait_count.Load())
+	fmt.Fprintf(w, "sqlite_lock_wait_seconds_sum %g\n", time.Duration(m.lock_wait_nanos.Load()).Seconds())
+	fmt.Fprintf(w, "sqlite_lock_wait_seconds_count %d\n", m.lock_wait_count.Load())
+
+	m.mu.Lock()
+	last := m.last_checkpoint
+	m.mu.Unlock()
+
+	busy := int64(0)
+	if last.Busy {
+		busy = 1
+	}
+
+	write_metric(w, "sqlite_wal_checkpoints_total", "counter", "Passive wal checkpoints run.", m.checkpoints.Load())
+	write_metric(w, "sqlite_wal_checkpoint_errors_total", "counter", "Wal checkpoints that failed.", m.checkpoint_errors.Load())
+	write_metric(w, "sqlite_wal_checkpoint_busy", "gauge", "Whether the last checkpoint was blocked from completing.", busy)
+	write_metric(w, "sqlite_wal_frames", "gauge", "Frames in the wal at the last checkpoint.", last.LogFrames)
+	write_metric(w, "sqlite_wal_checkpointed_frames", "gauge", "Frames checkpointed by the last checkpoint.", last.Checkpointed)
+
+	up := int64(0)
+	if m.ping_up.Load() {
+		up = 1
+	}
+
+	write_metric(w, "sqlite_up", "gauge", "Whether the last database ping answered.", up)
+	write_metric(w, "sqlite_pings_total", "counter", "Database pings run.", m.pings.Load())
+	write_metric(w, "sqlite_ping_failures_total", "counter", "Database pings that failed or timed out.", m.ping_failures.Load())
+	fmt.Fprintf(w, "# HELP sqlite_ping_seconds How long the last database ping took.\n# TYPE sqlite_ping_seconds gauge\nsqlite_ping_seconds %g\n", time.Duration(m.ping_latency_ns.Load()).Seconds())
+}
+
+func write_metric(w http.ResponseWriter, name string, kind string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+)
+
+// suppression_reasons are why an address must not receive marketing or transactional email
+var suppression_reasons = map[string]bool{
+	"unsubscribe": true,
+	"hard_bounce": true,
+	"complaint":   true,
+	"manual":      true,
+}
+
+type EmailSuppression struct {
+	Email     string `json:"email"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"` // who reported it, e.g. the esp webhook or an agent
+	CreatedAt string `json:"created_at"`
+}
+
+type SuppressionDetails struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+	Source string `json:"source"`
+}
+
+type SuppressionListingResponse struct {
+	Records []EmailSuppression `json:"records"`
+	Pagination
+}
+
+func normalize_suppressed_email(email string) string {
+	return canonical_email(email)
+}
+
+// is_email_suppressed must be consulted by every path that sends email, each tenant keeps its own list
+func is_email_suppressed(db db_handle, tenant_id string, email string) (bool, error) {
+	var found int
+	err := db.QueryRow(`SELECT 1 FROM email_suppressions WHERE tenant_id = ? AND email = ?;`, tenant_id, normalize_suppressed_email(email)).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func register_suppression_routes(mux *http.ServeMux, db *sql.DB, config Config) {
+	// list suppressed addresses, optionally by ?reason=
+	mux.HandleFunc("GET /api/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		page, limit := page_params(config, r, 50)
+
+		records, total_records, err := get_suppressions(db, tenant_from(r), r.URL.Query().Get("reason"), (page-1)*limit, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pagination := new_pagination(r, page, limit, total_records)
+		response := ApiResponse[SuppressionListingResponse]{
+			Data: SuppressionListingResponse{
+				Records:    records,
+				Pagination: pagination,
+			},
+		}
+
+		set_link_header(w, pagination)
+		write_json_response(w, http.StatusOK, response)
+	})
+
+	// check a single address
+	mux.HandleFunc("GET /api/suppressions/{email}", func(w http.ResponseWriter, r *http.Request) {
+		suppression, err := get_suppression(db, tenant_from(r), r.PathValue("email"))
+		if err != nil && err.Error() == "Suppression not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[EmailSuppression]{Data: *suppression})
+	})
+
+	// suppress an address, repeating it updates the reason
+	mux.HandleFunc("POST /api/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		var req SuppressionDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// "Name <a@b.com>" is suppressed as a@b.com, which is what lookups compare
+		address, err := mail.ParseAddress(req.Email)
+		if err != nil {
+			http.Error(w, "Invalid email", http.StatusBadRequest)
+			return
+		}
+		req.Email = address.Address
+
+		if !suppression_reasons[req.Reason] {
+			http.Error(w, "Invalid reason", http.StatusBadRequest)
+			return
+		}
+
+		if req.Source == "" {
+			req.Source = actor_from(r)
+		}
+
+		suppression, err := upsert_suppression(db, tenant_from(r), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[EmailSuppression]{Data: *suppression})
+	})
+
+	// lift a suppression, e.g. after the customer re-subscribes
+	mux.HandleFunc("DELETE /api/suppressions/{email}", func(w http.ResponseWriter, r *http.Request) {
+		err := delete_suppression(db, tenant_from(r), r.PathValue("email"))
+		if err != nil && err.Error() == "Suppression not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// #region Database
+const suppression_columns = `email, reason, source, created_at`
+
+func scan_suppression(row row_scanner) (EmailSuppression, error) {
+	var suppression EmailSuppression
+	err := row.Scan(&suppression.Email, &suppression.Reason, &suppression.Source, &suppression.CreatedAt)
+	return suppression, err
+}
+
+func get_suppression(db *sql.DB, tenant_id string, email string) (*EmailSuppression, error) {
+	get_record := `
+	SELECT ` + suppression_columns + `
+	FROM email_suppressions
+	WHERE tenant_id = ? AND email = ?;
+	`
+
+	suppression, err := scan_suppression(db.QueryRow(get_record, tenant_id, normalize_suppressed_email(email)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Suppression not found")
+		}
+		return nil, err
+	}
+
+	return &suppression, nil
+}
+
+func get_suppressions(db *sql.DB, tenant_id string, reason string, offset int, limit int) ([]EmailSuppression, int, error) {
+	get_records := `
+	SELECT ` + suppression_columns + `
+	FROM email_suppressions
+	WHERE tenant_id = ? AND (? = '' OR reason = ?)
+	ORDER BY created_at DESC, email
+	LIMIT ? OFFSET ?;
+	`
+
+	rows, err := db.Query(get_records, tenant_id, reason, reason, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	var suppressions []EmailSuppression = []EmailSuppression{}
+	for rows.Next() {
+		suppression, err := scan_suppression(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		suppressions = append(suppressions, suppression)
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM email_suppressions WHERE tenant_id = ? AND (? = '' OR reason = ?);`, tenant_id, reason, reason).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return suppressions, count, nil
+}
+
+// get_suppressed_emails reads the tenant's whole list as a set
+func get_suppressed_emails(db *sql.DB, tenant_id string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT email FROM email_suppressions WHERE tenant_id = ?;`, tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	emails := map[string]bool{}
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			return nil, err
+		}
+
+		emails[email] = true
+	}
+
+	return emails, rows.Err()
+}
+
+func upsert_suppression(db *sql.DB, tenant_id string, input SuppressionDetails) (*EmailSuppression, error) {
+	upsert_record := `
+	INSERT INTO email_suppressions (tenant_id, email, reason, source)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT (tenant_id, email) DO UPDATE SET reason = excluded.reason, source = excluded.source
+	RETURNING ` + suppression_columns + `;
+	`
+
+	suppression, err := scan_suppression(db.QueryRow(upsert_record, tenant_id, normalize_suppressed_email(input.Email), input.Reason, input.Source))
+	if err != nil {
+		return nil, err
+	}
+
+	return &suppression, nil
+}
+
+func delete_suppression(db *sql.DB, tenant_id string, email string) error {
+	result, err := exec_with_retry(db, `DELETE FROM email_suppressions WHERE tenant_id = ? AND email = ?;`, tenant_id, normalize_suppressed_email(email))
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("Suppression not found")
+	}
+
+	return nil
+}
+
+// #endregion
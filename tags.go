@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// TagCount is a tag and how many customers carry it, tags stay listed at 0 once their last customer loses them
+type TagCount struct {
+	Tag       string `json:"tag"`
+	Count     int    `json:"count"`
+	CreatedAt string `json:"created_at"`
+}
+
+// normalize_tag trims the tag and checks it can be named in a ?tags= list
+func normalize_tag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" || utf8.RuneCountInString(tag) > 64 || strings.Contains(tag, ",") {
+		return "", &ValidationError{Field: "tag", Message: "must be 1 to 64 characters without commas"}
+	}
+
+	return tag, nil
+}
+
+// listing_tags reads ?tags=vip,newsletter and ?tag_match=all or any, customers must carry every tag by default
+func listing_tags(r *http.Request) ([]string, bool, error) {
+	query := r.URL.Query()
+	tags := split_list(query.Get("tags"))
+
+	switch query.Get("tag_match") {
+	case "", "all":
+		return tags, true, nil
+	case "any":
+		return tags, false, nil
+	default:
+		return nil, false, &ValidationError{Field: "tag_match", Message: "must be all or any"}
+	}
+}
+
+func register_tag_routes(mux *http.ServeMux, db *sql.DB) {
+	// every tag in use or once used, with how many customers carry it
+	mux.HandleFunc("GET /api/tags", func(w http.ResponseWriter, r *http.Request) {
+		tags, err := get_tag_counts(db, tenant_from(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]TagCount]{Data: tags})
+	})
+
+	// tags on a customer
+	mux.HandleFunc("GET /api/customers/{id}/tags", func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		tags, err := get_customer_tags(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]string]{Data: tags})
+	})
+
+	// tag a customer, tagging twice changes nothing
+	mux.HandleFunc("PUT /api/customers/{id}/tags/{tag}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		tag, err := normalize_tag(r.PathValue("tag"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = get_customer_status(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = add_customer_tag(db, id, tag, actor_from(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tags, err := get_customer_tags(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]string]{Data: tags})
+	}))
+
+	// remove a tag
+	mux.HandleFunc("DELETE /api/customers/{id}/tags/{tag}", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = exec_with_retry(db, `DELETE FROM customer_tags WHERE customer_id = ? AND tag = ?;`, id, r.PathValue("tag"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		invalidate_counts()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// #region Database
+
+// add_customer_tag skips customers deleted since the event, tagging twice changes nothing.
+// source is the rule or the caller that added it
+func add_customer_tag(db *sql.DB, customer_id int64, tag string, source string) error {
+	insert_record := `
+	INSERT OR IGNORE INTO customer_tags (customer_id, tag, source)
+	SELECT id, ?, ? FROM customers WHERE id = ?;
+	`
+
+	_, err := exec_with_retry(db, insert_record, tag, source, customer_id)
+	if err != nil {
+		return err
+	}
+
+	// tags publish no event, but ?tags= listings count them
+	invalidate_counts()
+	return nil
+}
+
+func get_customer_tags(db *sql.DB, customer_id int64) ([]string, error) {
+	rows, err := db.Query(`SELECT tag FROM customer_tags WHERE customer_id = ? ORDER BY tag;`, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var tags []string = []string{}
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// get_tag_counts reads the counts the customer_counts triggers keep, most used first
+func get_tag_counts(db *sql.DB, tenant_id string) ([]TagCount, error) {
+	get_records := `
+	SELECT tags.name, COALESCE(customer_counts.count, 0), strftime('%Y-%m-%dT%H:%M:%SZ', tags.created_at)
+	FROM tags
+	LEFT JOIN customer_counts ON customer_counts.tenant_id = tags.tenant_id AND customer_counts.dimension = 'tag' AND customer_counts.value = tags.name
+	WHERE tags.tenant_id = ?
+	ORDER BY 2 DESC, tags.name;
+	`
+
+	rows, err := db.Query(get_records, tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		err = rows.Scan(&tag.Tag, &tag.Count, &tag.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// #endregion
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// tenant_databases is set with TENANT_ISOLATION=database, nil when tenants share the one database by row
+var tenant_databases *TenantDatabases
+
+// control_paths stay on the main database in database mode, it is where tenants and their keys are kept
+var control_paths = []string{
+	"/api/admin/tenants",
+	"/api/admin/api-keys",
+	"/api/admin/integrations",
+	"/api/admin/backup",
+	"/api/admin/maintenance",
+}
+
+// TenantDatabases keeps a database file per tenant under TENANT_DATABASE_DIR, each opened, migrated and
+// given its own routes and workers at startup or on first use. The default tenant stays in the main database
+type TenantDatabases struct {
+	dir     string
+	config  Config
+	control *sql.DB // the main database, which says what tenants exist
+	ctx     context.Context
+	blobs   BlobStore
+	routes  func(db *sql.DB, blobs BlobStore) http.HandlerFunc
+	workers func(ctx context.Context, db *sql.DB, blobs BlobStore)
+
+	mu     sync.Mutex
+	opened map[string]*tenant_database
+}
+
+type tenant_database struct {
+	ready   chan struct{} // closed once db and handler are set, or err
+	db      *sql.DB
+	handler http.HandlerFunc
+	err     error
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+func new_tenant_databases(ctx context.Context, control *sql.DB, config Config, blobs BlobStore, routes func(db *sql.DB, blobs BlobStore) http.HandlerFunc, workers func(ctx context.Context, db *sql.DB, blobs BlobStore)) (*TenantDatabases, error) {
+	err := os.MkdirAll(config.TenantDatabaseDir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	// REPLICA_STORE replicates the main database only, tenant files checkpoint themselves
+	config.ReplicaStore = ""
+
+	return &TenantDatabases{
+		dir:     config.TenantDatabaseDir,
+		config:  config,
+		control: control,
+		ctx:     ctx,
+		blobs:   blobs,
+		routes:  routes,
+		workers: workers,
+		opened:  map[string]*tenant_database{},
+	}, nil
+}
+
+// OpenAll opens every tenant in the control database, so their jobs, webhooks and scheduled work go on after
+// a restart without waiting for a request. A tenant that fails to open is logged and tried again on its next request
+func (t *TenantDatabases) OpenAll() error {
+	tenants, err := get_tenants(t.control)
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		if tenant.ID == default_tenant {
+			continue
+		}
+
+		_, err = t.open(tenant.ID)
+		if err != nil {
+			println("opening the database of tenant "+tenant.ID+" failed:", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (t *TenantDatabases) path(tenant_id string) string {
+	return filepath.Join(t.dir, tenant_id+".db")
+}
+
+// open returns the tenant's database, opening it the first time. Callers for a tenant that is still
+// opening wait for it rather than opening the file twice
+func (t *TenantDatabases) open(tenant_id string) (*tenant_database, error) {
+	t.mu.Lock()
+	tenant_db, ok := t.opened[tenant_id]
+	if !ok {
+		tenant_db = &tenant_database{ready: make(chan struct{})}
+		t.opened[tenant_id] = tenant_db
+	}
+	t.mu.Unlock()
+
+	if ok {
+		<-tenant_db.ready
+		return tenant_db, tenant_db.err
+	}
+
+	tenant_db.err = t.start(tenant_id, tenant_db)
+	if tenant_db.err != nil {
+		t.mu.Lock()
+		delete(t.opened, tenant_id)
+		t.mu.Unlock()
+	}
+	close(tenant_db.ready)
+
+	return tenant_db, tenant_db.err
+}
+
+func (t *TenantDatabases) start(tenant_id string, tenant_db *tenant_database) error {
+	// a file is only created for a tenant that exists
+	_, err := get_tenant(t.control, tenant_id)
+	if err != nil {
+		return err
+	}
+
+	db, err := open_database(t.path(tenant_id), t.config)
+	if err != nil {
+		return err
+	}
+
+	err = migrate(db)
+	if err == nil {
+		err = statements.Warm(db)
+	}
+	if err != nil {
+		statements.Close(db)
+		db.Close()
+		return err
+	}
+
+	blobs := tenant_blobs(t.blobs, tenant_id)
+	ctx, cancel := context.WithCancel(t.ctx)
+	tenant_db.db = db
+	tenant_db.handler = t.routes(db, blobs)
+	tenant_db.cancel = cancel
+
+	tenant_db.workers.Add(2)
+	go func() {
+		defer tenant_db.workers.Done()
+		t.workers(ctx, db, blobs)
+	}()
+	go func() {
+		defer tenant_db.workers.Done()
+		maintenance_mode.while_writable(ctx, func(ctx context.Context) { run_checkpoints(ctx, db, t.config) })
+	}()
+
+	return nil
+}
+
+// DB is the tenant's database, the main one for the default tenant
+func (t *TenantDatabases) DB(tenant_id string) (*sql.DB, error) {
+	if tenant_id == default_tenant {
+		return t.control, nil
+	}
+
+	tenant_db, err := t.open(tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return tenant_db.db, nil
+}
+
+func (t *TenantDatabases) Handler(tenant_id string) (http.HandlerFunc, error) {
+	tenant_db, err := t.open(tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return tenant_db.handler, nil
+}
+
+// Remove stops the tenant's workers and deletes its database file
+func (t *TenantDatabases) Remove(tenant_id string) error {
+	t.mu.Lock()
+	tenant_db, ok := t.opened[tenant_id]
+	delete(t.opened, tenant_id)
+	t.mu.Unlock()
+
+	if ok {
+		<-tenant_db.ready
+		if tenant_db.err == nil {
+			tenant_db.close()
+		}
+	}
+
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Remove(t.path(tenant_id) + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close stops the workers of every open tenant and closes their databases
+func (t *TenantDatabases) Close() {
+	t.mu.Lock()
+	opened := t.opened
+	t.opened = map[string]*tenant_database{}
+	t.mu.Unlock()
+
+	for _, tenant_db := range opened {
+		<-tenant_db.ready
+		if tenant_db.err == nil {
+			tenant_db.close()
+		}
+	}
+}
+
+func (d *tenant_database) close() {
+	d.cancel()
+	d.workers.Wait()
+	statements.Close(d.db)
+	d.db.Close()
+}
+
+// route_tenant_database serves a non default tenant's api requests from its own database, everything else
+// from the main one
+func route_tenant_database(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant_id := tenant_from(r)
+		if tenant_databases == nil || tenant_id == default_tenant || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next(w, r)
+			return
+		}
+
+		for _, path := range control_paths {
+			if strings.HasPrefix(r.URL.Path, path) {
+				next(w, r)
+				return
+			}
+		}
+
+		handler, err := tenant_databases.Handler(tenant_id)
+		if err != nil && err.Error() == "Tenant not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// tenant_blobs is the part of the shared store a tenant with its own database keeps its blobs in
+func tenant_blobs(blobs BlobStore, tenant_id string) BlobStore {
+	return &PrefixedBlobStore{BlobStore: blobs, prefix: "tenants/" + tenant_id + "/"}
+}
+
+// PrefixedBlobStore keeps a tenant's blobs under a prefix of the shared store
+type PrefixedBlobStore struct {
+	BlobStore
+	prefix string
+}
+
+func (s *PrefixedBlobStore) Put(ctx context.Context, key string, data []byte, content_type string) error {
+	return s.BlobStore.Put(ctx, s.prefix+key, data, content_type)
+}
+
+func (s *PrefixedBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.BlobStore.Get(ctx, s.prefix+key)
+}
+
+func (s *PrefixedBlobStore) Delete(ctx context.Context, key string) error {
+	return s.BlobStore.Delete(ctx, s.prefix+key)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// default_tenant owns everything stored before tenants existed, and is where unbound callers land
+const default_tenant = "default"
+
+// Tenant is an isolated set of customers, companies, tags and suppressions sharing the one database
+type Tenant struct {
+	ID        string `json:"id"` // also what X-Tenant-ID names
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type TenantDetails struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ProvisionedTenant is a new tenant with the admin key bound to it, the plain key is only shown here
+type ProvisionedTenant struct {
+	Tenant
+	ApiKey CreatedApiKey `json:"api_key"`
+}
+
+var tenant_id_pattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// platform_paths manage what every tenant shares, tenant bound credentials can't reach them whatever their role
+var platform_paths = []string{
+	"/api/admin/tenants",
+	"/api/admin/webhooks",
+	"/api/admin/rules",
+	"/api/admin/metadata-schema",
+	"/api/admin/integrations",
+	"/api/admin/export-recipients",
+	"/api/admin/backup",
+	"/api/admin/maintenance",
+	"/admin/dashboard",
+	"/debug/",
+	"/api/admin/debug",
+	"/metrics",
+}
+
+type tenant_key struct{}
+
+// tenant_from is the tenant scope_tenant resolved for the request
+func tenant_from(r *http.Request) string {
+	return tenant_of(r.Context())
+}
+
+func tenant_of(ctx context.Context) string {
+	tenant_id, ok := ctx.Value(tenant_key{}).(string)
+	if !ok {
+		return default_tenant
+	}
+
+	return tenant_id
+}
+
+func validate_tenant(input *TenantDetails) error {
+	input.ID = strings.TrimSpace(input.ID)
+	if !tenant_id_pattern.MatchString(input.ID) {
+		return &ValidationError{Field: "id", Message: "must be lowercase letters, digits and dashes, at most 63"}
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		return &ValidationError{Field: "name", Message: "is required"}
+	}
+
+	return nil
+}
+
+// resolve_tenant picks the request's tenant. Credentials bound to a tenant always get theirs, platform admins
+// and servers without auth choose one with X-Tenant-ID, and other unbound credentials stay in the default tenant
+func resolve_tenant(r *http.Request) (string, error) {
+	requested := r.Header.Get("X-Tenant-ID")
+	principal := principal_from(r)
+
+	switch {
+	case principal != nil && principal.TenantID != "":
+		if requested != "" && requested != principal.TenantID {
+			return "", errors.New("Credentials belong to another tenant")
+		}
+		return principal.TenantID, nil
+	case principal == nil || principal.HasRole(RoleAdmin):
+		if requested == "" {
+			return default_tenant, nil
+		}
+		return requested, nil
+	default:
+		if requested != "" && requested != default_tenant {
+			return "", errors.New("Credentials belong to another tenant")
+		}
+		return default_tenant, nil
+	}
+}
+
+// path_resource_id reads the numeric id following prefix, as in /api/customers/{id}/notes
+func path_resource_id(path string, prefix string) (int64, bool) {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok {
+		return 0, false
+	}
+
+	segment, _, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(segment, 10, 64)
+	return id, err == nil
+}
+
+// scope_tenant resolves the tenant of every request and keeps it from reaching another tenant's customers
+// and companies by id, which answer as if they did not exist
+func scope_tenant(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if public_paths[r.URL.Path] {
+			next(w, r)
+			return
+		}
+
+		tenant_id, err := resolve_tenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		principal := principal_from(r)
+		if principal != nil && principal.TenantID != "" {
+			for _, prefix := range platform_paths {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					http.Error(w, "Tenant credentials can't manage the platform", http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		_, err = get_tenant(db, tenant_id)
+		if err != nil && err.Error() == "Tenant not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		owners := []struct {
+			prefix    string
+			table     string
+			not_found string
+		}{
+			{"/api/customers/", "customers", "Customer not found"},
+			{"/api/companies/", "companies", "Company not found"},
+			{"/api/segments/", "segments", "Segment not found"},
+			{"/api/jobs/", "jobs", "Job not found"},
+		}
+		for _, owner := range owners {
+			// tenants with their own database files can't reach another's rows
+			if tenant_databases != nil {
+				break
+			}
+
+			id, ok := path_resource_id(r.URL.Path, owner.prefix)
+			if !ok {
+				continue
+			}
+
+			// missing ids are left to the handler, which knows how to say so
+			owner_id, err := get_owning_tenant(db, owner.table, id)
+			if err != nil && err != sql.ErrNoRows {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if err == nil && owner_id != tenant_id {
+				http.Error(w, owner.not_found, http.StatusNotFound)
+				return
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), tenant_key{}, tenant_id)))
+	}
+}
+
+func register_tenant_routes(mux *http.ServeMux, db *sql.DB) {
+	mux.HandleFunc("GET /api/admin/tenants", func(w http.ResponseWriter, r *http.Request) {
+		tenants, err := get_tenants(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Tenant]{Data: tenants})
+	})
+
+	// provision a tenant along with an admin key for it
+	mux.HandleFunc("POST /api/admin/tenants", func(w http.ResponseWriter, r *http.Request) {
+		var req TenantDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validate_tenant(&req)
+		var validation_error *ValidationError
+		if errors.As(err, &validation_error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tenant, err := create_tenant(db, req)
+		if err != nil && err.Error() == "Tenant already exists" {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[ProvisionedTenant]{Data: *tenant})
+	})
+
+	mux.HandleFunc("GET /api/admin/tenants/{id}", func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := get_tenant(db, r.PathValue("id"))
+		if err != nil && err.Error() == "Tenant not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Tenant]{Data: *tenant})
+	})
+
+	// only empty tenants can go, and never the default one
+	mux.HandleFunc("DELETE /api/admin/tenants/{id}", func(w http.ResponseWriter, r *http.Request) {
+		err := delete_tenant(db, r.PathValue("id"))
+		if err != nil && err.Error() == "Tenant not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil && (err.Error() == "Tenant has customers" || err.Error() == "The default tenant can't be deleted") {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// #region Database
+const tenant_columns = `id, name, strftime('%Y-%m-%dT%H:%M:%SZ', created_at), strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)`
+
+func scan_tenant(row row_scanner) (Tenant, error) {
+	var tenant Tenant
+	err := row.Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt, &tenant.UpdatedAt)
+	return tenant, err
+}
+
+func get_tenant(db db_handle, id string) (*Tenant, error) {
+	tenant, err := scan_tenant(db.QueryRow(`SELECT `+tenant_columns+` FROM tenants WHERE id = ?;`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Tenant not found")
+		}
+		return nil, err
+	}
+
+	return &tenant, nil
+}
+
+func get_tenants(db *sql.DB) ([]Tenant, error) {
+	rows, err := db.Query(`SELECT ` + tenant_columns + ` FROM tenants ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		tenant, err := scan_tenant(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		tenants = append(tenants, tenant)
+	}
+
+	return tenants, rows.Err()
+}
+
+// get_owning_tenant reads the tenant of a customer or company, sql.ErrNoRows when there is no such row
+func get_owning_tenant(db *sql.DB, table string, id int64) (string, error) {
+	var tenant_id string
+	err := db.QueryRow(`SELECT tenant_id FROM `+table+` WHERE id = ?;`, id).Scan(&tenant_id)
+	return tenant_id, err
+}
+
+func create_tenant(db *sql.DB, input TenantDetails) (*ProvisionedTenant, error) {
+	key, err := generate_api_key()
+	if err != nil {
+		return nil, err
+	}
+
+	var provisioned ProvisionedTenant
+	err = with_tx(db, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM tenants WHERE id = ?);`, input.ID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return errors.New("Tenant already exists")
+		}
+
+		_, err = tx.Exec(`INSERT INTO tenants (id, name) VALUES (?, ?);`, input.ID, input.Name)
+		if err != nil {
+			return err
+		}
+
+		tenant, err := get_tenant(tx, input.ID)
+		if err != nil {
+			return err
+		}
+
+		api_key, err := insert_api_key(tx, ApiKeyDetails{Label: input.Name + " admin", Role: RoleAdmin}, input.ID, key)
+		if err != nil {
+			return err
+		}
+
+		provisioned = ProvisionedTenant{Tenant: *tenant, ApiKey: CreatedApiKey{ApiKey: *api_key, Key: key}}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &provisioned, nil
+}
+
+// delete_tenant removes an empty tenant and revokes the keys bound to it
+func delete_tenant(db *sql.DB, id string) error {
+	if id == default_tenant {
+		return errors.New("The default tenant can't be deleted")
+	}
+
+	if tenant_databases != nil {
+		return delete_tenant_database(db, id)
+	}
+
+	return with_tx(db, func(tx *sql.Tx) error {
+		var customers bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM customers WHERE tenant_id = ?);`, id).Scan(&customers)
+		if err != nil {
+			return err
+		}
+
+		if customers {
+			return errors.New("Tenant has customers")
+		}
+
+		result, err := tx.Exec(`DELETE FROM tenants WHERE id = ?;`, id)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if deleted == 0 {
+			return errors.New("Tenant not found")
+		}
+
+		for _, delete_records := range []string{
+			`DELETE FROM companies WHERE tenant_id = ?;`,
+			`DELETE FROM segments WHERE tenant_id = ?;`,
+			`DELETE FROM email_suppressions WHERE tenant_id = ?;`,
+			`DELETE FROM tags WHERE tenant_id = ?;`,
+			`DELETE FROM customer_counts WHERE tenant_id = ?;`,
+			`DELETE FROM jobs WHERE tenant_id = ?;`,
+			`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE tenant_id = ?;`,
+		} {
+			_, err = tx.Exec(delete_records, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// delete_tenant_database removes an empty tenant along with its database file
+func delete_tenant_database(db *sql.DB, id string) error {
+	tenant_db, err := tenant_databases.DB(id)
+	if err != nil {
+		return err
+	}
+
+	var customers bool
+	err = tenant_db.QueryRow(`SELECT EXISTS (SELECT 1 FROM customers);`).Scan(&customers)
+	if err != nil {
+		return err
+	}
+
+	if customers {
+		return errors.New("Tenant has customers")
+	}
+
+	err = with_tx(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM tenants WHERE id = ?;`, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE tenant_id = ?;`, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tenant_databases.Remove(id)
+}
+
+// #endregion
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimelineEntry is one line of a customer's history, built from their events, review flags and notes
+type TimelineEntry struct {
+	At      time.Time
+	Kind    string
+	Actor   string
+	Summary string
+	Details []string
+}
+
+// timeline_ignored_fields change on every write and say nothing on their own
+var timeline_ignored_fields = map[string]bool{
+	"updated_at": true,
+	"version":    true,
+}
+
+var timeline_html = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2rem; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; vertical-align: top; padding: .4rem .6rem; border-bottom: 1px solid #ddd; }
+th { background: #f4f4f4; }
+ul { margin: 0; padding-left: 1.2rem; }
+.meta { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">Generated {{.GeneratedAt}} by {{.GeneratedBy}}</p>
+<table>
+<tr><th>When (UTC)</th><th>What</th><th>By</th><th>Details</th></tr>
+{{range .Entries}}<tr>
+<td>{{.At.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Summary}}</td>
+<td>{{.Actor}}</td>
+<td>{{if .Details}}<ul>{{range .Details}}<li>{{.}}</li>{{end}}</ul>{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="4">No history recorded.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// export_customer_timeline renders the customer's history as html or pdf for people without api access
+func export_customer_timeline(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "html"
+		}
+
+		if format != "html" && format != "pdf" {
+			http.Error(w, "Invalid format", http.StatusBadRequest)
+			return
+		}
+
+		// deleted customers still have a history worth handing over
+		entries, err := get_customer_timeline(db, id, request_hidden_fields(r), request_masked_fields(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(entries) == 0 {
+			_, err = get_customer(db, id)
+			if err != nil && err.Error() == "Customer not found" {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		}
+
+		title := "Customer " + strconv.FormatInt(id, 10) + " timeline"
+		generated_at := time.Now().UTC().Format("2006-01-02 15:04:05") + " UTC"
+
+		var body bytes.Buffer
+		if format == "html" {
+			err = timeline_html.Execute(&body, map[string]any{
+				"Title":       title,
+				"GeneratedAt": generated_at,
+				"GeneratedBy": actor_from(r),
+				"Entries":     entries,
+			})
+		} else {
+			lines := []string{"Generated " + generated_at + " by " + actor_from(r), ""}
+			for _, entry := range entries {
+				line := entry.At.Format("2006-01-02 15:04:05") + "  " + entry.Summary
+				if entry.Actor != "" {
+					line += " (by " + entry.Actor + ")"
+				}
+				lines = append(lines, line)
+				for _, detail := range entry.Details {
+					lines = append(lines, "    - "+detail)
+				}
+			}
+			if len(entries) == 0 {
+				lines = append(lines, "No history recorded.")
+			}
+			err = write_text_pdf(&body, title, lines)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		filename := "customer-" + strconv.FormatInt(id, 10) + "-timeline." + format
+		if format == "html" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			// the report is a standalone document, the api's default-src 'none' would strip its styles
+			w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+		} else {
+			w.Header().Set("Content-Type", "application/pdf")
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.Write(body.Bytes())
+	}
+}
+
+// timeline_summary describes the event in words, unknown types fall back to the type itself
+func timeline_summary(event_type string) string {
+	switch event_type {
+	case EventCustomerCreated:
+		return "Customer created"
+	case EventCustomerUpdated:
+		return "Customer details changed"
+	case EventCustomerDeleted:
+		return "Customer deleted"
+	case EventCustomerBlocked:
+		return "Customer blocked"
+	case EventCustomerUnblocked:
+		return "Customer unblocked"
+	case EventCustomerArchived:
+		return "Customer archived"
+	case EventCustomerUnarchived:
+		return "Customer unarchived"
+	case EventCustomerStatusChanged:
+		return "Customer status changed"
+	case EventCustomerAnonymized:
+		return "Customer anonymized"
+	case EventCustomerMerged:
+		return "Customer merged"
+	case EventConsentGranted:
+		return "Consent granted"
+	case EventConsentRevoked:
+		return "Consent revoked"
+	}
+
+	return event_type
+}
+
+// diff_snapshots lists the fields that differ between two customer snapshots
+func diff_snapshots(before map[string]any, after map[string]any) []string {
+	var changes []string
+	for field, value := range after {
+		if timeline_ignored_fields[field] {
+			continue
+		}
+
+		old, ok := before[field]
+		old_str, _ := json.Marshal(old)
+		new_str, _ := json.Marshal(value)
+		if ok && string(old_str) == string(new_str) {
+			continue
+		}
+
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", field, old_str, new_str))
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+// #region Database
+func get_customer_timeline(db *sql.DB, customer_id int64, hidden map[string]bool, masked map[string]bool) ([]TimelineEntry, error) {
+	get_events := `
+	SELECT type, payload, created_at
+	FROM customer_events
+	WHERE customer_id = ?
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_events, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var entries []TimelineEntry
+	var snapshot map[string]any
+	for rows.Next() {
+		var event_type, payload, created_at string
+		err = rows.Scan(&event_type, &payload, &created_at)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := TimelineEntry{At: ParseTimestamp(created_at), Kind: "event", Summary: timeline_summary(event_type)}
+
+		opened, err := open_pii_json([]byte(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		var fields map[string]any
+		json.Unmarshal(mask_payload(masked, shape_payload(hidden, json.RawMessage(opened))), &fields)
+
+		switch event_type {
+		case EventCustomerCreated, EventCustomerUpdated, EventCustomerStatusChanged, EventCustomerMerged:
+			if snapshot != nil {
+				entry.Details = diff_snapshots(snapshot, fields)
+			}
+			snapshot = fields
+		case EventCustomerBlocked:
+			block, _ := fields["block"].(map[string]any)
+			entry.Actor, _ = block["blocked_by"].(string)
+			if reason, ok := block["reason"].(string); ok {
+				entry.Details = []string{"Reason: " + reason}
+			}
+		case EventConsentGranted, EventConsentRevoked:
+			entry.Actor, _ = fields["recorded_by"].(string)
+			purpose, _ := fields["purpose"].(string)
+			source, _ := fields["source"].(string)
+			entry.Details = []string{"Purpose: " + purpose, "Source: " + source}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	flags, err := db.Query(`SELECT reason, created_at, resolved_at, resolved_by FROM review_flags WHERE customer_id = ?;`, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer flags.Close()
+
+	for flags.Next() {
+		var reason, created_at string
+		var resolved_at, resolved_by *string
+		err = flags.Scan(&reason, &created_at, &resolved_at, &resolved_by)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, TimelineEntry{At: ParseTimestamp(created_at), Kind: "review", Summary: "Flagged for review: " + reason})
+		if resolved_at != nil {
+			entry := TimelineEntry{At: ParseTimestamp(*resolved_at), Kind: "review", Summary: "Review resolved: " + reason}
+			if resolved_by != nil {
+				entry.Actor = *resolved_by
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	err = flags.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	notes, err := db.Query(`SELECT author, body, created_at FROM customer_notes WHERE customer_id = ?;`, customer_id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer notes.Close()
+
+	for notes.Next() {
+		var author, body, created_at string
+		err = notes.Scan(&author, &body, &created_at)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, TimelineEntry{At: ParseTimestamp(created_at), Kind: "note", Actor: author, Summary: "Note", Details: strings.Split(body, "\n")})
+	}
+
+	err = notes.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].At.Before(entries[j].At)
+	})
+
+	return entries, nil
+}
+
+// #endregion
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tls_mode is how the server gets its certificate, empty serves plain http
+func tls_mode(config Config) string {
+	if len(split_list(config.AutocertHosts)) > 0 {
+		return "autocert"
+	}
+
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		return "files"
+	}
+
+	return ""
+}
+
+// configure_tls prepares the server for https and returns the secondary plain http server, which
+// redirects to https and in autocert mode also answers the acme http-01 challenges
+func configure_tls(config Config, server *http.Server) (*http.Server, error) {
+	mode := tls_mode(config)
+	if mode == "" {
+		return nil, nil
+	}
+
+	if mode == "files" && (config.TLSCertFile == "" || config.TLSKeyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	_, tls_port, err := net.SplitHostPort(server.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var redirect http.Handler = https_redirect(tls_port)
+	if mode == "autocert" {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(split_list(config.AutocertHosts)...),
+			Cache:      autocert.DirCache(config.AutocertCacheDir),
+			Email:      config.AutocertEmail,
+		}
+		if config.AutocertDirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: config.AutocertDirectoryURL}
+		}
+
+		server.TLSConfig = manager.TLSConfig()
+		redirect = manager.HTTPHandler(redirect)
+	}
+
+	if config.HTTPRedirectAddr == "" {
+		return nil, nil
+	}
+
+	return &http.Server{
+		Addr:              config.HTTPRedirectAddr,
+		Handler:           redirect,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}, nil
+}
+
+// https_redirect sends plain http requests to the same url on the https listener
+func https_redirect(tls_port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if tls_port != "443" {
+			host = net.JoinHostPort(host, tls_port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// listen serves http or https depending on the tls mode, autocert certificates come from TLSConfig
+func listen(config Config, server *http.Server) error {
+	switch tls_mode(config) {
+	case "files":
+		return server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	case "autocert":
+		return server.ListenAndServeTLS("", "")
+	default:
+		return server.ListenAndServe()
+	}
+}
+
+func split_list(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+)
+
+// ValidationError is returned for input the client has to fix, handlers answer it with 400
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+var referral_code_pattern = regexp.MustCompile(`^[A-Z0-9]{4,16}$`)
+
+var country_pattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// referral_cycle_record walks up the referrers from the new one, finding the customer being updated among them
+// would close a loop. UNION stops at a loop already in the data
+const referral_cycle_record = `
+WITH RECURSIVE chain(id) AS (
+	SELECT ?
+	UNION
+	SELECT customers.referred_by_customer_id FROM customers JOIN chain ON customers.id = chain.id
+	WHERE customers.referred_by_customer_id IS NOT NULL
+)
+SELECT EXISTS (SELECT 1 FROM chain WHERE id = ?);
+`
+
+// validate_customer normalizes and checks details before they are written, id is 0 for creates
+func validate_customer(ctx context.Context, db *sql.DB, input *CustomerDetails, id int64) error {
+	input.Email = strings.TrimSpace(input.Email)
+	if input.Email != "" {
+		email, err := normalize_email(ctx, input.Email)
+		if err != nil {
+			return err
+		}
+		input.Email = email
+	}
+
+	input.ReferralCode = strings.ToUpper(strings.TrimSpace(input.ReferralCode))
+	if input.ReferralCode != "" {
+		if !referral_code_pattern.MatchString(input.ReferralCode) {
+			return &ValidationError{Field: "referral_code", Message: "must be 4 to 16 letters or digits"}
+		}
+
+		var owner int64
+		err := db.QueryRow(`SELECT id FROM customers WHERE referral_code = ?;`, input.ReferralCode).Scan(&owner)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && owner != id {
+			return &ValidationError{Field: "referral_code", Message: "is already taken"}
+		}
+	}
+
+	if input.ReferredByCustomerID != nil {
+		if *input.ReferredByCustomerID == id {
+			return &ValidationError{Field: "referred_by_customer_id", Message: "cannot refer themselves"}
+		}
+
+		// customers of other tenants don't exist as far as this one can tell
+		tenant_id, err := get_owning_tenant(db, "customers", *input.ReferredByCustomerID)
+		if err == sql.ErrNoRows || (err == nil && tenant_id != tenant_of(ctx)) {
+			return &ValidationError{Field: "referred_by_customer_id", Message: "does not exist"}
+		}
+		if err != nil {
+			return err
+		}
+
+		// nor anyone this customer referred, directly or down the chain
+		if id != 0 {
+			var cycle bool
+			err = db.QueryRow(referral_cycle_record, *input.ReferredByCustomerID, id).Scan(&cycle)
+			if err != nil {
+				return err
+			}
+			if cycle {
+				return &ValidationError{Field: "referred_by_customer_id", Message: "was referred by this customer"}
+			}
+		}
+	}
+
+	if input.CompanyID != nil {
+		tenant_id, err := get_owning_tenant(db, "companies", *input.CompanyID)
+		if err == sql.ErrNoRows || (err == nil && tenant_id != tenant_of(ctx)) {
+			return &ValidationError{Field: "company_id", Message: "does not exist"}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	input.DOB = strings.TrimSpace(input.DOB)
+	if input.DOB != "" {
+		dob, err := normalize_dob(input.DOB)
+		if err != nil {
+			return err
+		}
+		input.DOB = dob
+	}
+
+	input.Country = strings.ToUpper(strings.TrimSpace(input.Country))
+	if input.Country != "" && !country_pattern.MatchString(input.Country) {
+		return &ValidationError{Field: "country", Message: "must be a two letter iso 3166-1 code"}
+	}
+
+	// after the country, which is the region for numbers without a country code
+	input.Contact = strings.TrimSpace(input.Contact)
+	if input.Contact != "" {
+		contact, err := normalize_phone(input.Contact, input.Country)
+		if err != nil {
+			return err
+		}
+		input.Contact = contact
+	}
+
+	// customers start active or inactive, after that the status only moves through POST /customers/{id}/status
+	if input.Status != "" && id == 0 && input.Status != "active" && input.Status != "inactive" {
+		return &ValidationError{Field: "status", Message: "must be active or inactive"}
+	}
+	if input.Status != "" && id != 0 {
+		var current string
+		err := db.QueryRow(`SELECT status FROM customers WHERE id = ?;`, id).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && input.Status != current {
+			return &ValidationError{Field: "status", Message: "is changed through POST /customers/{id}/status"}
+		}
+	}
+
+	err := validate_metadata(db, input)
+	if err != nil {
+		return err
+	}
+
+	return validate_contact_points(ctx, input)
+}
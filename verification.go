@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"math"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verification_purpose keeps other payloads signed with the session secret from passing as verification tokens
+const verification_purpose = "email_verification"
+
+// VerificationToken is the payload of the link in the verification email. It names the address by a
+// fingerprint so the link carries no personal data, and stops working once the email changes
+type VerificationToken struct {
+	Purpose    string `json:"purpose"`
+	CustomerID int64  `json:"cid"`
+	Email      string `json:"email"` // email_fingerprint of the address the link was sent to
+	Expires    int64  `json:"exp"`
+	TenantID   string `json:"tid,omitempty"` // picks the tenant's database with TENANT_ISOLATION=database
+}
+
+func email_fingerprint(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// verification_message is the plain text email with the link, lines end in crlf as smtp expects
+func verification_message(config Config, to string, link string) []byte {
+	lines := []string{
+		"From: " + config.SMTPFrom,
+		"To: " + to,
+		"Subject: Verify your email address",
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Open this link to confirm this is your email address:",
+		"",
+		link,
+		"",
+		"The link expires in " + config.VerificationTokenTTL.String() + ". If you did not expect this email you can ignore it.",
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// send_mail delivers through SMTP_ADDR, authenticating when SMTP_USERNAME is set. net/smtp upgrades to
+// starttls when the server offers it, and refuses plain auth over an unencrypted connection to another host
+func send_mail(config Config, to string, message []byte) error {
+	var auth smtp.Auth
+	if config.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(config.SMTPAddr)
+		auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, host)
+	}
+
+	return smtp.SendMail(config.SMTPAddr, auth, config.SMTPFrom, []string{to}, message)
+}
+
+func register_verification_routes(mux *http.ServeMux, db *sql.DB, config Config, sessions *SessionSigner) {
+	// email the customer a link that verifies their current address, at most once per VERIFICATION_RESEND_INTERVAL
+	mux.HandleFunc("POST /api/customers/{id}/send-verification", reject_blocked(db, func(w http.ResponseWriter, r *http.Request) {
+		id, err := path_customer_id(r)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		if config.SMTPAddr == "" {
+			http.Error(w, "Email delivery is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		customer, err := get_customer(db, id)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if customer.Email == "" {
+			http.Error(w, "Customer has no email", http.StatusConflict)
+			return
+		}
+
+		if customer.EmailVerifiedAt != nil {
+			http.Error(w, "Email is already verified", http.StatusConflict)
+			return
+		}
+
+		suppressed, err := is_email_suppressed(db, tenant_from(r), customer.Email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if suppressed {
+			http.Error(w, "Email is suppressed", http.StatusConflict)
+			return
+		}
+
+		retry_after, err := claim_verification_send(db, id, config.VerificationResendInterval)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if retry_after > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry_after.Seconds()))))
+			http.Error(w, "A verification email was sent recently", http.StatusTooManyRequests)
+			return
+		}
+
+		token, err := sessions.Encode(VerificationToken{
+			Purpose:    verification_purpose,
+			CustomerID: id,
+			Email:      email_fingerprint(customer.Email),
+			Expires:    time.Now().Add(config.VerificationTokenTTL).Unix(),
+			TenantID:   tenant_from(r),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		link := strings.TrimSuffix(config.PublicURL, "/") + "/verify?token=" + url.QueryEscape(token)
+		err = send_mail(config, customer.Email, verification_message(config, customer.Email, link))
+		if err != nil {
+			// a failed delivery doesn't count against the throttle
+			release_verification_send(db, id)
+			http.Error(w, "Sending the verification email failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	// the link from the email, public as the customer opens it without credentials
+	mux.HandleFunc("GET /verify", func(w http.ResponseWriter, r *http.Request) {
+		var token VerificationToken
+		err := sessions.Decode(r.URL.Query().Get("token"), verification_purpose, &token)
+		if err != nil {
+			http.Error(w, "Invalid verification link", http.StatusBadRequest)
+			return
+		}
+
+		if time.Now().Unix() > token.Expires {
+			http.Error(w, "Verification link has expired, request a new one", http.StatusGone)
+			return
+		}
+
+		// the link is public so the tenant comes from the token, not the request
+		db := db
+		if tenant_databases != nil && token.TenantID != "" {
+			db, err = tenant_databases.DB(token.TenantID)
+			if err != nil && err.Error() == "Tenant not found" {
+				http.Error(w, "Invalid verification link", http.StatusBadRequest)
+				return
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		customer, err := get_customer(db, token.CustomerID)
+		if err != nil && err.Error() == "Customer not found" {
+			http.Error(w, "Invalid verification link", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if customer.Email == "" || email_fingerprint(customer.Email) != token.Email {
+			http.Error(w, "Verification link is for a previous email address", http.StatusGone)
+			return
+		}
+
+		_, err = set_customer_email_verified(db, customer.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("Your email address is verified.\n"))
+	})
+}
+
+// #region Database
+
+// claim_verification_send records a send for the customer, or returns how long until the next one is allowed
+func claim_verification_send(db *sql.DB, id int64, interval time.Duration) (time.Duration, error) {
+	now := time.Now().Unix()
+	claim_record := `
+	INSERT INTO email_verifications (customer_id, sent_at)
+	VALUES (?, ?)
+	ON CONFLICT (customer_id) DO UPDATE SET sent_at = excluded.sent_at
+	WHERE email_verifications.sent_at <= ?;
+	`
+
+	result, err := exec_with_retry(db, claim_record, id, now, now-int64(interval.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return 0, err
+	}
+
+	var sent_at int64
+	err = db.QueryRow(`SELECT sent_at FROM email_verifications WHERE customer_id = ?;`, id).Scan(&sent_at)
+	if err != nil {
+		return 0, err
+	}
+
+	return max(time.Until(time.Unix(sent_at+int64(interval.Seconds()), 0)), time.Second), nil
+}
+
+func release_verification_send(db *sql.DB, id int64) error {
+	_, err := exec_with_retry(db, `DELETE FROM email_verifications WHERE customer_id = ?;`, id)
+	return err
+}
+
+// #endregion
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApiVersion is one generation of the api mounted under its prefix, e.g. /v1/customers. Its handler
+// sees the path with the prefix swapped back to /api, so the routes keep their /api patterns and
+// a /v2 with different response shapes can bring a mux and handlers of its own
+type ApiVersion struct {
+	Prefix  string
+	Handler http.Handler
+}
+
+type api_version_key struct{}
+
+// route_versions dispatches /v1/... and friends to their version, and keeps serving the unversioned /api
+// routes through legacy as deprecated aliases. Routes outside /api, such as health checks and login, are not versioned
+func route_versions(config Config, versions []ApiVersion, legacy http.Handler) (http.HandlerFunc, error) {
+	deprecated_at, err := time.Parse("2006-01-02", config.LegacyDeprecatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	var sunset time.Time
+	if config.LegacySunset != "" {
+		sunset, err = time.Parse("2006-01-02", config.LegacySunset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	current := versions[len(versions)-1].Prefix
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, version := range versions {
+			rest, ok := strings.CutPrefix(r.URL.Path, version.Prefix+"/")
+			if !ok {
+				continue
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), api_version_key{}, version.Prefix))
+			url := *r.URL
+			url.Path = "/api/" + rest
+			url.RawPath = ""
+			r.URL = &url
+
+			version.Handler.ServeHTTP(w, r)
+			return
+		}
+
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/api/"); ok {
+			header := w.Header()
+			header.Set("Deprecation", "@"+strconv.FormatInt(deprecated_at.Unix(), 10))
+			if !sunset.IsZero() {
+				header.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			}
+			header.Add("Link", "<"+current+"/"+rest+`>; rel="successor-version"`)
+		}
+
+		legacy.ServeHTTP(w, r)
+	}, nil
+}
+
+// public_path turns an /api route path into the one the caller used, so links stay within their version
+func public_path(r *http.Request, path string) string {
+	prefix, ok := r.Context().Value(api_version_key{}).(string)
+	if !ok {
+		return path
+	}
+
+	rest, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return path
+	}
+
+	return prefix + "/" + rest
+}
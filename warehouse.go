@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarehouseRow is the flattened shape of a customer event as loaded into the warehouse
+type WarehouseRow struct {
+	EventID    int64  `json:"event_id"`
+	Type       string `json:"type"`
+	CustomerID int64  `json:"customer_id"`
+	Payload    string `json:"payload"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// WarehouseSink loads batches of change events into an analytics warehouse
+type WarehouseSink interface {
+	Name() string
+	EnsureSchema(ctx context.Context) error
+	Load(ctx context.Context, rows []WarehouseRow) error
+}
+
+const EventCustomerSnapshot = "customer.snapshot"
+
+func new_warehouse_sink(config Config) (WarehouseSink, error) {
+	switch config.WarehouseSink {
+	case "":
+		return nil, nil
+	case "clickhouse":
+		return &ClickHouseSink{
+			URL:      config.ClickHouseURL,
+			User:     config.ClickHouseUser,
+			Password: config.ClickHousePassword,
+			Table:    config.ClickHouseTable,
+		}, nil
+	case "bigquery":
+		if config.BigQueryProject == "" || config.BigQueryDataset == "" {
+			return nil, errors.New("BIGQUERY_PROJECT and BIGQUERY_DATASET are required for the bigquery sink")
+		}
+		tokens, err := new_google_token_source(config.BigQueryCredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		return &BigQuerySink{
+			Project: config.BigQueryProject,
+			Dataset: config.BigQueryDataset,
+			Table:   config.BigQueryTable,
+			Tokens:  tokens,
+		}, nil
+	default:
+		return nil, errors.New("Unknown warehouse sink " + config.WarehouseSink)
+	}
+}
+
+// run_warehouse_sink periodically ships new events to the sink, advancing a stored cursor only after a successful load
+func run_warehouse_sink(ctx context.Context, db *sql.DB, sink WarehouseSink, config Config) {
+	health := integrations.Get("warehouse")
+
+	err := sink.EnsureSchema(ctx)
+	health.Record(err)
+	if err != nil {
+		println("warehouse schema setup failed:", err.Error())
+		return
+	}
+
+	_, found, err := get_sink_offset(db, sink.Name())
+	if err != nil {
+		println("warehouse offset lookup failed:", err.Error())
+		return
+	}
+
+	// a fresh sink starts with a snapshot of the current table, as does an explicit backfill
+	if !found || config.WarehouseBackfill {
+		err = backfill_warehouse(ctx, db, sink, config.WarehouseBatchSize)
+		health.Record(err)
+		if err != nil {
+			println("warehouse backfill failed:", err.Error())
+			return
+		}
+	}
+
+	ticker := time.NewTicker(config.WarehouseInterval)
+	defer ticker.Stop()
+
+	for {
+		err = flush_warehouse(ctx, db, sink, config.WarehouseBatchSize)
+		if err != nil {
+			println("warehouse load failed:", err.Error())
+		}
+		if ctx.Err() == nil {
+			health.Record(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func flush_warehouse(ctx context.Context, db *sql.DB, sink WarehouseSink, batch_size int) error {
+	for {
+		offset, _, err := get_sink_offset(db, sink.Name())
+		if err != nil {
+			return err
+		}
+
+		events, err := get_events_since(db, "", offset, batch_size)
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		rows := make([]WarehouseRow, 0, len(events))
+		for _, event := range events {
+			rows = append(rows, WarehouseRow{
+				EventID:    event.ID,
+				Type:       event.Type,
+				CustomerID: event.CustomerID,
+				Payload:    string(event.Payload),
+				CreatedAt:  event.CreatedAt,
+			})
+		}
+
+		err = sink.Load(ctx, rows)
+		if err != nil {
+			return err
+		}
+
+		err = set_sink_offset(db, sink.Name(), events[len(events)-1].ID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// backfill_warehouse loads every existing customer as a snapshot row, then moves the cursor to the latest event
+func backfill_warehouse(ctx context.Context, db *sql.DB, sink WarehouseSink, batch_size int) error {
+	var latest int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM customer_events;`).Scan(&latest)
+	if err != nil {
+		return err
+	}
+
+	snapshot_at := time.Now().UTC().Format(time.RFC3339)
+	rows := []WarehouseRow{}
+	err = each_customer(db, func(c Customer) error {
+		payload, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+
+		rows = append(rows, WarehouseRow{
+			Type:       EventCustomerSnapshot,
+			CustomerID: c.ID,
+			Payload:    string(payload),
+			CreatedAt:  snapshot_at,
+		})
+		if len(rows) < batch_size {
+			return nil
+		}
+
+		err = sink.Load(ctx, rows)
+		rows = rows[:0]
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(rows) > 0 {
+		err = sink.Load(ctx, rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	return set_sink_offset(db, sink.Name(), latest)
+}
+
+// #region ClickHouse
+type ClickHouseSink struct {
+	URL      string
+	User     string
+	Password string
+	Table    string
+}
+
+func (s *ClickHouseSink) Name() string {
+	return "clickhouse"
+}
+
+func (s *ClickHouseSink) EnsureSchema(ctx context.Context) error {
+	// ReplacingMergeTree collapses rows redelivered after a failed cursor update
+	query := `
+	CREATE TABLE IF NOT EXISTS ` + s.Table + ` (
+		event_id UInt64,
+		type LowCardinality(String),
+		customer_id Int64,
+		payload String,
+		created_at DateTime
+	)
+	ENGINE = ReplacingMergeTree
+	ORDER BY (customer_id, event_id, type);
+	`
+
+	return s.exec(ctx, query, nil)
+}
+
+func (s *ClickHouseSink) Load(ctx context.Context, rows []WarehouseRow) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, row := range rows {
+		row.CreatedAt = ParseTimestamp(row.CreatedAt).Format("2006-01-02 15:04:05")
+		err := encoder.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.exec(ctx, "INSERT INTO "+s.Table+" FORMAT JSONEachRow", &body)
+}
+
+func (s *ClickHouseSink) exec(ctx context.Context, query string, body io.Reader) error {
+	endpoint := s.URL + "/?query=" + url.QueryEscape(query)
+	if body == nil {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-ClickHouse-User", s.User)
+	req.Header.Set("X-ClickHouse-Key", s.Password)
+
+	return do_warehouse_request(req)
+}
+
+// #endregion
+
+// #region BigQuery
+type BigQuerySink struct {
+	Project string
+	Dataset string
+	Table   string
+	Tokens  *GoogleTokenSource
+}
+
+// bigquery_scope is what the service account's access tokens are asked for
+const bigquery_scope = "https://www.googleapis.com/auth/bigquery"
+
+// google_metadata_token_url hands out tokens for the service account attached to the instance, on gcp
+const google_metadata_token_url = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// ServiceAccountKey is the part of a service account's json key file the token exchange needs
+type ServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// GoogleTokenSource keeps an access token for bigquery, refreshed before it expires after its hour. With a key
+// file it signs its own assertion for the token, without one it asks the gcp metadata server
+type GoogleTokenSource struct {
+	key         *ServiceAccountKey
+	private_key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func new_google_token_source(path string) (*GoogleTokenSource, error) {
+	if path == "" {
+		return &GoogleTokenSource{}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key ServiceAccountKey
+	err = json.Unmarshal(content, &key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New(path + " has no private key")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private_key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New(path + " does not hold an rsa key")
+	}
+
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &GoogleTokenSource{key: &key, private_key: private_key}, nil
+}
+
+// Token returns the current access token, fetching a new one when it is about to expire
+func (s *GoogleTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expires) > time.Minute {
+		return s.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if s.key != nil {
+		req, err = s.assertion_request(ctx)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, google_metadata_token_url+"?scopes="+url.QueryEscape(bigquery_scope), nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("google token: %s: %s", res.Status, message)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// assertion_request exchanges a jwt signed with the service account's key for an access token
+func (s *GoogleTokenSource) assertion_request(ctx context.Context) (*http.Request, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := json.Marshal(map[string]any{
+		"iss":   s.key.ClientEmail,
+		"scope": bigquery_scope,
+		"aud":   s.key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.private_key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func (s *BigQuerySink) Name() string {
+	return "bigquery"
+}
+
+func (s *BigQuerySink) table_url() string {
+	return fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables", s.Project, s.Dataset)
+}
+
+func (s *BigQuerySink) EnsureSchema(ctx context.Context) error {
+	req, err := s.request(ctx, http.MethodGet, s.table_url()+"/"+s.Table, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// only a missing table is created, a token or permission problem is not one
+	if res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("GET %s: %s", req.URL.Path, res.Status)
+	}
+
+	table := map[string]any{
+		"tableReference": map[string]string{
+			"projectId": s.Project,
+			"datasetId": s.Dataset,
+			"tableId":   s.Table,
+		},
+		"schema": map[string]any{
+			"fields": []map[string]string{
+				{"name": "event_id", "type": "INT64"},
+				{"name": "type", "type": "STRING"},
+				{"name": "customer_id", "type": "INT64"},
+				{"name": "payload", "type": "JSON"},
+				{"name": "created_at", "type": "TIMESTAMP"},
+			},
+		},
+		"timePartitioning": map[string]string{
+			"type":  "DAY",
+			"field": "created_at",
+		},
+	}
+
+	req, err = s.request(ctx, http.MethodPost, s.table_url(), table)
+	if err != nil {
+		return err
+	}
+
+	return do_warehouse_request(req)
+}
+
+func (s *BigQuerySink) Load(ctx context.Context, rows []WarehouseRow) error {
+	insert_rows := make([]map[string]any, 0, len(rows))
+	for _, row := range rows {
+		// insertId lets bigquery drop rows redelivered after a failed cursor update
+		insert_id := strconv.FormatInt(row.EventID, 10)
+		if row.Type == EventCustomerSnapshot {
+			insert_id = "snapshot-" + strconv.FormatInt(row.CustomerID, 10) + "-" + row.CreatedAt
+		}
+
+		row.CreatedAt = ParseTimestamp(row.CreatedAt).Format(time.RFC3339)
+		insert_rows = append(insert_rows, map[string]any{
+			"insertId": insert_id,
+			"json":     row,
+		})
+	}
+
+	req, err := s.request(ctx, http.MethodPost, s.table_url()+"/"+s.Table+"/insertAll", map[string]any{"rows": insert_rows})
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, res.Status, message)
+	}
+
+	// rejected rows come back with a 200, the batch is failed so the cursor stays and it is sent again
+	var result struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+
+	if len(result.InsertErrors) > 0 {
+		first := result.InsertErrors[0]
+		message := "unknown error"
+		if len(first.Errors) > 0 {
+			message = first.Errors[0].Reason + ": " + first.Errors[0].Message
+		}
+		return fmt.Errorf("bigquery rejected %d of %d rows, event %d: %s", len(result.InsertErrors), len(rows), rows[first.Index].EventID, message)
+	}
+
+	return nil
+}
+
+func (s *BigQuerySink) request(ctx context.Context, method string, endpoint string, body any) (*http.Request, error) {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		body_str, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(body_str)
+	}
+
+	token, err := s.Tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// #endregion
+
+func do_warehouse_request(req *http.Request) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, res.Status, message)
+	}
+
+	return nil
+}
+
+// #region Database
+func get_sink_offset(db *sql.DB, name string) (int64, bool, error) {
+	get_record := `
+	SELECT last_event_id
+	FROM sink_offsets
+	WHERE name = ?;
+	`
+
+	var offset int64
+	err := db.QueryRow(get_record, name).Scan(&offset)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return offset, true, nil
+}
+
+func set_sink_offset(db *sql.DB, name string, offset int64) error {
+	upsert_record := `
+	INSERT INTO sink_offsets (name, last_event_id)
+	VALUES (?, ?)
+	ON CONFLICT (name) DO UPDATE SET last_event_id = excluded.last_event_id, updated_at = CURRENT_TIMESTAMP;
+	`
+
+	_, err := exec_with_retry(db, upsert_record, name, offset)
+	return err
+}
+
+// #endregion
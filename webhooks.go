@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EventWebhookDisabled = "webhook.disabled"
+
+// webhook_role is the field policy role applied to webhook payloads and bus messages, their receivers are
+// outside the api's users
+const webhook_role = "webhook"
+
+type Webhook struct {
+	ID                  int64    `json:"id"`
+	URL                 string   `json:"url"`
+	EventTypes          []string `json:"event_types"` // empty means every event
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	FailingSince        *string  `json:"failing_since"`
+	LastError           *string  `json:"last_error"`
+	DisabledAt          *string  `json:"disabled_at"`
+	CreatedAt           string   `json:"created_at"`
+}
+
+type CreatedWebhook struct {
+	Webhook
+	Secret string `json:"secret"` // only ever returned on creation, signs every delivery
+}
+
+type WebhookDetails struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// WebhookDisabled is the payload of the webhook.disabled event raised when a receiver is given up on
+type WebhookDisabled struct {
+	WebhookID    int64  `json:"webhook_id"`
+	URL          string `json:"url"`
+	FailingSince string `json:"failing_since"`
+	LastError    string `json:"last_error"`
+}
+
+func (h *Webhook) wants(event_type string) bool {
+	if len(h.EventTypes) == 0 {
+		return true
+	}
+
+	for _, t := range h.EventTypes {
+		if t == event_type {
+			return true
+		}
+	}
+
+	return false
+}
+
+func webhook_offset_name(id int64) string {
+	return "webhook:" + strconv.FormatInt(id, 10)
+}
+
+// run_webhooks keeps one delivery worker per enabled webhook, so a slow or dead receiver only ever
+// holds up its own cursor. Deliveries across workers are capped at WEBHOOK_CONCURRENCY
+func run_webhooks(ctx context.Context, db *sql.DB, config Config) {
+	type worker struct {
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+
+	workers := map[int64]*worker{}
+	slots := make(chan struct{}, max(config.WebhookConcurrency, 1))
+
+	ticker := time.NewTicker(config.WebhookInterval)
+	defer ticker.Stop()
+
+	for {
+		webhooks, err := get_webhooks(db, false)
+		if err != nil {
+			println("webhook lookup failed:", err.Error())
+		}
+
+		if err == nil {
+			enabled := map[int64]bool{}
+			for _, webhook := range webhooks {
+				enabled[webhook.ID] = true
+
+				// a worker stops by itself when it disables its webhook, re-enabling needs a new one
+				current := workers[webhook.ID]
+				if current != nil {
+					select {
+					case <-current.done:
+					default:
+						continue
+					}
+				}
+
+				worker_ctx, cancel := context.WithCancel(ctx)
+				started := &worker{cancel: cancel, done: make(chan struct{})}
+				workers[webhook.ID] = started
+				go func() {
+					defer close(started.done)
+					run_webhook_worker(worker_ctx, db, config, webhook.ID, slots)
+				}()
+			}
+
+			// deleted or disabled webhooks stop at their next delivery
+			for id, current := range workers {
+				if !enabled[id] {
+					current.cancel()
+					delete(workers, id)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, current := range workers {
+				<-current.done
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func run_webhook_worker(ctx context.Context, db *sql.DB, config Config, id int64, slots chan struct{}) {
+	wake := event_broker.Subscribe()
+	defer event_broker.Unsubscribe(wake)
+
+	client := &http.Client{Timeout: config.WebhookTimeout}
+	health := integrations.Get("webhook:" + strconv.FormatInt(id, 10))
+	var open_until time.Time
+
+	for {
+		// an open circuit skips deliveries until the backoff runs out, then the next attempt is the probe
+		if time.Now().After(open_until) {
+			webhook, err := get_webhook(db, id)
+			if err != nil || webhook.DisabledAt != nil {
+				return
+			}
+
+			err = flush_webhook(ctx, db, client, config, webhook, slots)
+			if ctx.Err() == nil {
+				health.Record(err)
+			}
+			if err != nil && ctx.Err() == nil {
+				open_until = time.Now().Add(webhook_backoff(config, webhook.ConsecutiveFailures+1))
+
+				disabled, record_err := record_webhook_failure(db, config, webhook, err)
+				if record_err != nil {
+					println("webhook failure record failed:", record_err.Error())
+				}
+				if disabled {
+					return
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.WebhookInterval):
+		case _, ok := <-wake:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// webhook_backoff doubles with every consecutive failure up to WEBHOOK_MAX_BACKOFF
+func webhook_backoff(config Config, failures int) time.Duration {
+	backoff := config.WebhookInterval
+	for i := 1; i < failures && backoff < config.WebhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, config.WebhookMaxBackoff)
+}
+
+// flush_webhook delivers pending events in order, the cursor moves past each event only once it is accepted
+func flush_webhook(ctx context.Context, db *sql.DB, client *http.Client, config Config, webhook *Webhook, slots chan struct{}) error {
+	name := webhook_offset_name(webhook.ID)
+	hidden, masked := hidden_fields([]string{webhook_role}), masked_fields([]string{webhook_role})
+
+	secret, err := get_webhook_secret(db, webhook.ID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		offset, _, err := get_sink_offset(db, name)
+		if err != nil {
+			return err
+		}
+
+		events, err := get_events_since(db, "", offset, config.WebhookBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		for _, event := range events {
+			if webhook.wants(event.Type) {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				err = deliver_webhook(ctx, client, webhook, secret, shape_event(hidden, masked, event))
+				<-slots
+				if err != nil {
+					return err
+				}
+
+				if webhook.ConsecutiveFailures > 0 {
+					err = reset_webhook_failures(db, webhook.ID)
+					if err != nil {
+						return err
+					}
+					webhook.ConsecutiveFailures = 0
+				}
+			}
+
+			err = set_sink_offset(db, name, event.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deliver_webhook posts an event the webhook_role policy was applied to
+func deliver_webhook(ctx context.Context, client *http.Client, webhook *Webhook, secret string, event CustomerEvent) error {
+	body, err := json.Marshal(EventMessage{
+		SchemaVersion: event_schema_version,
+		ID:            event.ID,
+		Type:          event.Type,
+		CustomerID:    event.CustomerID,
+		TenantID:      event.TenantID,
+		OccurredAt:    ParseTimestamp(event.CreatedAt).Format(time.RFC3339),
+		Data:          event.Payload,
+		Changes:       event.Changes,
+	})
+	if err != nil {
+		return err
+	}
+
+	// receivers check Webhook-Signature against hmac-sha256 of "<timestamp>.<body>" with their secret
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", strconv.FormatInt(event.ID, 10))
+	req.Header.Set("Webhook-Timestamp", timestamp)
+	req.Header.Set("Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("Webhook receiver answered " + res.Status)
+	}
+
+	return nil
+}
+
+func register_webhook_routes(mux *http.ServeMux, db *sql.DB) {
+	// subscribe a url to events, the signing secret is only shown in this response
+	mux.HandleFunc("POST /api/admin/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		var req WebhookDetails
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		parsed, err := url.Parse(req.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			http.Error(w, "Invalid url", http.StatusBadRequest)
+			return
+		}
+
+		webhook, err := create_webhook(db, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusCreated, ApiResponse[CreatedWebhook]{Data: *webhook})
+	})
+
+	// list webhooks with their delivery health
+	mux.HandleFunc("GET /api/admin/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		webhooks, err := get_webhooks(db, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[[]Webhook]{Data: webhooks})
+	})
+
+	// re-enable a webhook that was disabled, delivery resumes where it stopped
+	mux.HandleFunc("POST /api/admin/webhooks/{id}/enable", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		webhook, err := enable_webhook(db, id)
+		if err != nil && err.Error() == "Webhook not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		write_json_response(w, http.StatusOK, ApiResponse[Webhook]{Data: *webhook})
+	})
+
+	// remove a webhook
+	mux.HandleFunc("DELETE /api/admin/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		err = delete_webhook(db, id)
+		if err != nil && err.Error() == "Webhook not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// #region Database
+const webhook_columns = `id, url, event_types, consecutive_failures, failing_since, last_error, disabled_at, created_at`
+
+func scan_webhook(row row_scanner) (Webhook, error) {
+	var webhook Webhook
+	var event_types string
+	err := row.Scan(&webhook.ID, &webhook.URL, &event_types, &webhook.ConsecutiveFailures, &webhook.FailingSince, &webhook.LastError, &webhook.DisabledAt, &webhook.CreatedAt)
+	webhook.EventTypes = strings.FieldsFunc(event_types, func(r rune) bool { return r == ',' })
+	if webhook.EventTypes == nil {
+		webhook.EventTypes = []string{}
+	}
+	return webhook, err
+}
+
+func create_webhook(db *sql.DB, input WebhookDetails) (*CreatedWebhook, error) {
+	create_record := `
+	INSERT INTO webhooks (url, secret, event_types)
+	VALUES (?, ?, ?)
+	RETURNING ` + webhook_columns + `;
+	`
+
+	secret := "whsec_" + random_token(24)
+
+	var created *CreatedWebhook
+	err := with_tx(db, func(tx *sql.Tx) error {
+		webhook, err := scan_webhook(tx.QueryRow(create_record, input.URL, secret, strings.Join(input.EventTypes, ",")))
+		if err != nil {
+			return err
+		}
+
+		// new webhooks receive events from now on, not the whole history
+		_, err = tx.Exec(`
+		INSERT INTO sink_offsets (name, last_event_id)
+		VALUES (?, (SELECT COALESCE(MAX(id), 0) FROM customer_events))
+		ON CONFLICT (name) DO UPDATE SET last_event_id = excluded.last_event_id, updated_at = CURRENT_TIMESTAMP;
+		`, webhook_offset_name(webhook.ID))
+		if err != nil {
+			return err
+		}
+
+		created = &CreatedWebhook{Webhook: webhook, Secret: secret}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+func get_webhook(db *sql.DB, id int64) (*Webhook, error) {
+	webhook, err := scan_webhook(db.QueryRow(`SELECT `+webhook_columns+` FROM webhooks WHERE id = ?;`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Webhook not found")
+		}
+		return nil, err
+	}
+
+	return &webhook, nil
+}
+
+// get_webhooks lists the enabled webhooks, or every webhook when include_disabled is set
+func get_webhooks(db *sql.DB, include_disabled bool) ([]Webhook, error) {
+	get_records := `
+	SELECT ` + webhook_columns + `
+	FROM webhooks
+	WHERE ? OR disabled_at IS NULL
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(get_records, include_disabled)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var webhooks []Webhook = []Webhook{}
+	for rows.Next() {
+		webhook, err := scan_webhook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func get_webhook_secret(db *sql.DB, id int64) (string, error) {
+	var secret string
+	err := db.QueryRow(`SELECT secret FROM webhooks WHERE id = ?;`, id).Scan(&secret)
+	return secret, err
+}
+
+// record_webhook_failure counts the failure and disables the webhook once it has been failing longer
+// than WEBHOOK_DISABLE_AFTER_DAYS, raising a webhook.disabled event to tell someone
+func record_webhook_failure(db *sql.DB, config Config, webhook *Webhook, cause error) (bool, error) {
+	update_record := `
+	UPDATE webhooks
+	SET consecutive_failures = consecutive_failures + 1, failing_since = COALESCE(failing_since, CURRENT_TIMESTAMP), last_error = ?
+	WHERE id = ?
+	RETURNING ` + webhook_columns + `;
+	`
+
+	disable_record := `
+	UPDATE webhooks
+	SET disabled_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND disabled_at IS NULL AND failing_since <= datetime('now', ?);
+	`
+
+	var event *CustomerEvent
+	err := with_tx(db, func(tx *sql.Tx) error {
+		failed, err := scan_webhook(tx.QueryRow(update_record, cause.Error(), webhook.ID))
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(disable_record, webhook.ID, "-"+strconv.Itoa(config.WebhookDisableAfterDays)+" days")
+		if err != nil {
+			return err
+		}
+
+		disabled, err := result.RowsAffected()
+		if err != nil || disabled == 0 {
+			return err
+		}
+
+		event, err = record_event(tx, EventWebhookDisabled, 0, WebhookDisabled{
+			WebhookID:    failed.ID,
+			URL:          failed.URL,
+			FailingSince: *failed.FailingSince,
+			LastError:    cause.Error(),
+		})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if event != nil {
+		println("webhook", webhook.ID, "disabled:", cause.Error())
+		event_broker.Publish(*event)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func reset_webhook_failures(db *sql.DB, id int64) error {
+	_, err := exec_with_retry(db, `UPDATE webhooks SET consecutive_failures = 0, failing_since = NULL WHERE id = ?;`, id)
+	return err
+}
+
+func enable_webhook(db *sql.DB, id int64) (*Webhook, error) {
+	update_record := `
+	UPDATE webhooks
+	SET disabled_at = NULL, consecutive_failures = 0, failing_since = NULL
+	WHERE id = ?
+	RETURNING ` + webhook_columns + `;
+	`
+
+	webhook, err := scan_webhook(db.QueryRow(update_record, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Webhook not found")
+		}
+		return nil, err
+	}
+
+	return &webhook, nil
+}
+
+func delete_webhook(db *sql.DB, id int64) error {
+	result, err := exec_with_retry(db, `DELETE FROM webhooks WHERE id = ?;`, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("Webhook not found")
+	}
+
+	_, err = exec_with_retry(db, `DELETE FROM sink_offsets WHERE name = ?;`, webhook_offset_name(id))
+	return err
+}
+
+// #endregion
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// WebSocketMessage is sent by clients to narrow or widen the events they receive
+type WebSocketMessage struct {
+	Action     string `json:"action"` // subscribe or unsubscribe
+	CustomerID *int64 `json:"customer_id,omitempty"`
+}
+
+// WebSocketSubscription tracks which customers a single connection is interested in, always within its tenant
+type WebSocketSubscription struct {
+	mu        sync.Mutex
+	tenant_id string
+	all       bool
+	customers map[int64]struct{}
+}
+
+func (s *WebSocketSubscription) Apply(message WebSocketMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case message.Action == "subscribe" && message.CustomerID == nil:
+		s.all = true
+	case message.Action == "subscribe":
+		s.all = false
+		s.customers[*message.CustomerID] = struct{}{}
+	case message.Action == "unsubscribe" && message.CustomerID == nil:
+		s.all = false
+		s.customers = map[int64]struct{}{}
+	case message.Action == "unsubscribe":
+		delete(s.customers, *message.CustomerID)
+	}
+}
+
+func (s *WebSocketSubscription) Matches(event CustomerEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.TenantID != s.tenant_id {
+		return false
+	}
+
+	if s.all {
+		return true
+	}
+
+	_, ok := s.customers[event.CustomerID]
+	return ok
+}
+
+// websocket_connections lets shutdown wait for open sockets to finish their close handshake
+var websocket_connections sync.WaitGroup
+
+const websocket_ping_interval = 30 * time.Second
+
+// websocket_events broadcasts customer events to the client, everything by default or only ?customer_id= when given
+func websocket_events() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subscription := &WebSocketSubscription{tenant_id: tenant_from(r), all: true, customers: map[int64]struct{}{}}
+		hidden, masked := request_hidden_fields(r), request_masked_fields(r)
+		id_str := r.URL.Query().Get("customer_id")
+		if id_str != "" {
+			id, err := strconv.ParseInt(id_str, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid customer_id", http.StatusBadRequest)
+				return
+			}
+			subscription.Apply(WebSocketMessage{Action: "subscribe", CustomerID: &id})
+		}
+
+		// the connection outlives the request, so the server timeouts must not apply
+		clear_deadlines(w)
+
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: []string{"*"}})
+		if err != nil {
+			return
+		}
+
+		websocket_connections.Add(1)
+		defer websocket_connections.Done()
+		defer conn.CloseNow()
+
+		live := event_broker.Subscribe()
+		defer event_broker.Unsubscribe(live)
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		// read subscription changes until the client goes away
+		go func() {
+			defer cancel()
+			for {
+				_, data, err := conn.Read(ctx)
+				if err != nil {
+					return
+				}
+
+				var message WebSocketMessage
+				err = json.Unmarshal(data, &message)
+				if err != nil {
+					continue
+				}
+				subscription.Apply(message)
+			}
+		}()
+
+		ping := time.NewTicker(websocket_ping_interval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-live:
+				if !ok {
+					conn.Close(websocket.StatusGoingAway, "Server shutting down")
+					return
+				}
+
+				if !subscription.Matches(event) {
+					continue
+				}
+
+				data, err := json.Marshal(shape_event(hidden, masked, event))
+				if err != nil {
+					continue
+				}
+
+				write_ctx, write_cancel := context.WithTimeout(ctx, 10*time.Second)
+				err = conn.Write(write_ctx, websocket.MessageText, data)
+				write_cancel()
+				if err != nil {
+					return
+				}
+			case <-ping.C:
+				ping_ctx, ping_cancel := context.WithTimeout(ctx, 10*time.Second)
+				err := conn.Ping(ping_ctx)
+				ping_cancel()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+}